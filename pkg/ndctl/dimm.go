@@ -46,6 +46,12 @@ func (d *Dimm) Handle() int16 {
 	return int16(C.ndctl_dimm_get_handle(ndd))
 }
 
+//Serial returns the serial number of the dimm
+func (d *Dimm) Serial() uint32 {
+	ndd := (*C.struct_ndctl_dimm)(d)
+	return uint32(C.ndctl_dimm_get_serial(ndd))
+}
+
 //MarshalJSON returns the encoding of dimm
 func (d *Dimm) MarshalJSON() ([]byte, error) {
 	return json.Marshal(map[string]interface{}{
@@ -53,6 +59,7 @@ func (d *Dimm) MarshalJSON() ([]byte, error) {
 		"dev":     d.DeviceName(),
 		"handle":  d.Handle(),
 		"phys_id": d.PhysicalID(),
+		"serial":  d.Serial(),
 		"enabled": d.Enabled(),
 	})
 }
@@ -49,6 +49,29 @@ type NamespaceType string
 //NamespaceMode represents mode of the namespace
 type NamespaceMode string
 
+// ParseNamespaceMode converts a mode name as used by the ndctl command line tool
+// into a NamespaceMode. The legacy names "memory", "devdax" and "safe" are accepted
+// as aliases of fsdax, dax and sector.
+func ParseNamespaceMode(mode string) (NamespaceMode, error) {
+	switch mode {
+	case string(FsdaxMode), "memory":
+		return FsdaxMode, nil
+	case string(DaxMode), "devdax":
+		return DaxMode, nil
+	case string(SectorMode), "safe":
+		return SectorMode, nil
+	case string(RawMode):
+		return RawMode, nil
+	}
+	return UnknownMode, fmt.Errorf("Unsupported namespace mode %q", mode)
+}
+
+// BlockDevice reports whether namespaces in this mode provide a block device,
+// which is not the case for device dax
+func (mode NamespaceMode) BlockDevice() bool {
+	return mode == FsdaxMode || mode == SectorMode || mode == RawMode
+}
+
 func (mode NamespaceMode) toCMode() C.enum_ndctl_namespace_mode {
 	switch mode {
 	case DaxMode:
@@ -0,0 +1,86 @@
+package ndctl_test
+
+import (
+	"testing"
+
+	"github.com/intel/pmem-csi/pkg/ndctl"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestNdctl(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "ndctl Suite")
+}
+
+var _ = Describe("namespace mode", func() {
+	It("parses mode names", func() {
+		cases := map[string]ndctl.NamespaceMode{
+			"fsdax":  ndctl.FsdaxMode,
+			"memory": ndctl.FsdaxMode,
+			"dax":    ndctl.DaxMode,
+			"devdax": ndctl.DaxMode,
+			"sector": ndctl.SectorMode,
+			"safe":   ndctl.SectorMode,
+			"raw":    ndctl.RawMode,
+		}
+		for name, expected := range cases {
+			mode, err := ndctl.ParseNamespaceMode(name)
+			Expect(err).NotTo(HaveOccurred(), name)
+			Expect(mode).To(Equal(expected), name)
+		}
+	})
+
+	It("rejects unsupported modes", func() {
+		for _, name := range []string{"", "unknown", "FSDAX", "blk"} {
+			mode, err := ndctl.ParseNamespaceMode(name)
+			Expect(err).To(HaveOccurred(), name)
+			Expect(mode).To(Equal(ndctl.UnknownMode), name)
+		}
+	})
+
+	It("knows which modes have a block device", func() {
+		Expect(ndctl.FsdaxMode.BlockDevice()).To(BeTrue())
+		Expect(ndctl.SectorMode.BlockDevice()).To(BeTrue())
+		Expect(ndctl.RawMode.BlockDevice()).To(BeTrue())
+		Expect(ndctl.DaxMode.BlockDevice()).To(BeFalse())
+		Expect(ndctl.UnknownMode.BlockDevice()).To(BeFalse())
+	})
+})
+
+var _ = Describe("create namespace options", func() {
+	It("resolves mode aliases", func() {
+		cases := map[ndctl.NamespaceMode]ndctl.NamespaceMode{
+			"memory": ndctl.FsdaxMode,
+			"devdax": ndctl.DaxMode,
+			"safe":   ndctl.SectorMode,
+		}
+		for alias, expected := range cases {
+			opts, err := ndctl.CreateNamespaceOpts{Mode: alias}.WithDefaults()
+			Expect(err).NotTo(HaveOccurred(), string(alias))
+			Expect(opts.Mode).To(Equal(expected), string(alias))
+		}
+	})
+
+	It("sets the sector size for the safe alias", func() {
+		opts, err := ndctl.CreateNamespaceOpts{Mode: "safe"}.WithDefaults()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(opts.SectorSize).To(Equal(uint64(4096)))
+		opts, err = ndctl.CreateNamespaceOpts{Mode: "memory"}.WithDefaults()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(opts.SectorSize).To(BeZero())
+	})
+
+	It("defaults to fsdax", func() {
+		opts, err := ndctl.CreateNamespaceOpts{}.WithDefaults()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(opts.Type).To(Equal(ndctl.PmemNamespace))
+		Expect(opts.Mode).To(Equal(ndctl.FsdaxMode))
+		Expect(opts.Location).To(Equal(ndctl.DeviceMap))
+	})
+
+	It("rejects unsupported modes", func() {
+		_, err := ndctl.CreateNamespaceOpts{Mode: "blk"}.WithDefaults()
+		Expect(err).To(HaveOccurred())
+	})
+})
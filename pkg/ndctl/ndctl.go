@@ -33,6 +33,38 @@ type CreateNamespaceOpts struct {
 	Location   MapLocation
 }
 
+// WithDefaults returns the options as CreateNamespace uses them: unset type, mode and
+// location get their defaults, mode aliases like "memory" or "safe" get replaced by the
+// mode they stand for and sector mode gets a 4 KiB sector size unless one is set
+func (opts CreateNamespaceOpts) WithDefaults() (CreateNamespaceOpts, error) {
+	if opts.Type == "" {
+		opts.Type = PmemNamespace
+	}
+	if opts.Mode == "" {
+		if opts.Type == PmemNamespace {
+			opts.Mode = FsdaxMode // == MemoryMode
+		} else {
+			opts.Mode = SectorMode
+		}
+	}
+	mode, err := ParseNamespaceMode(string(opts.Mode))
+	if err != nil {
+		return opts, err
+	}
+	opts.Mode = mode
+	if opts.Location == "" {
+		opts.Location = DeviceMap
+	}
+
+	if opts.SectorSize == 0 {
+		if opts.Type == BlockNamespace || opts.Mode == SectorMode {
+			// default sector size for blk-type or safe-mode
+			opts.SectorSize = kib4
+		}
+	}
+	return opts, nil
+}
+
 // Context go wrapper for ndctl context
 type Context C.struct_ndctl_ctx
 
@@ -55,6 +55,12 @@ func (r *Region) MaxAvailableExtent() uint64 {
 	return uint64(C.ndctl_region_get_max_available_extent(ndr))
 }
 
+//NumaNode returns the NUMA node of the region, -1 if unknown
+func (r *Region) NumaNode() int {
+	ndr := (*C.struct_ndctl_region)(r)
+	return int(C.ndctl_region_get_numa_node(ndr))
+}
+
 func (r *Region) Type() RegionType {
 	ndr := (*C.struct_ndctl_region)(r)
 	switch C.ndctl_region_get_type(ndr) {
@@ -118,27 +124,9 @@ func (r *Region) SeedNamespace() *Namespace {
 func (r *Region) CreateNamespace(opts CreateNamespaceOpts) (*Namespace, error) {
 	ndr := (*C.struct_ndctl_region)(r)
 	defaultAlign := mib2
-	var err error
-	/* Set defaults */
-	if opts.Type == "" {
-		opts.Type = PmemNamespace
-	}
-	if opts.Mode == "" {
-		if opts.Type == PmemNamespace {
-			opts.Mode = FsdaxMode // == MemoryMode
-		} else {
-			opts.Mode = SectorMode
-		}
-	}
-	if opts.Location == "" {
-		opts.Location = DeviceMap
-	}
-
-	if opts.SectorSize == 0 {
-		if opts.Type == BlockNamespace || opts.Mode == SectorMode {
-			// default sector size for blk-type or safe-mode
-			opts.SectorSize = kib4
-		}
+	opts, err := opts.WithDefaults()
+	if err != nil {
+		return nil, err
 	}
 
 	/* Sanity checks */
@@ -304,6 +292,7 @@ func (r *Region) MarshalJSON() ([]byte, error) {
 		"size":                 r.Size(),
 		"available_size":       r.AvailableSize(),
 		"max_available_extent": r.MaxAvailableExtent(),
+		"numa_node":            r.NumaNode(),
 		"namespaces":           r.ActiveNamespaces(),
 		"mappings":             r.Mappings(),
 	})
@@ -7,6 +7,7 @@ SPDX-License-Identifier: Apache-2.0
 package pmemcsidriver
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
 	"sync"
@@ -85,7 +86,7 @@ func NewNodeControllerServer(nodeID string, dm pmdmanager.PmemDeviceManager, sm
 	// Restore provisioned volumes from state.
 	if sm != nil {
 		// Get actual devices at DeviceManager
-		devices, err := dm.ListDevices()
+		devices, err := dm.ListDevices(context.Background())
 		if err != nil {
 			glog.Warningf("Failed to get volumes: %s", err.Error())
 		}
@@ -209,8 +210,39 @@ func (cs *nodeControllerServer) CreateVolume(ctx context.Context, req *csi.Creat
 			}(volumeID)
 		}
 
-		if err := cs.dm.CreateDevice(volumeID, uint64(asked), nsmode); err != nil {
-			return nil, status.Errorf(codes.Internal, "CreateVolume: failed to create volume: %s", err.Error())
+		devCtx := pmdmanager.WithLogger(ctx, pmdmanager.GlogLogger().WithValues("volume", volumeID))
+		if err := cs.dm.CreateDevice(devCtx, volumeID, uint64(asked), nsmode); err != nil {
+			if errors.Is(err, pmdmanager.ErrNotEnoughSpace) || errors.Is(err, pmdmanager.ErrThinPoolFull) {
+				return nil, status.Errorf(codes.ResourceExhausted, "CreateVolume: failed to create volume: %s", err.Error())
+			} else if errors.Is(err, pmdmanager.ErrInvalidSize) {
+				return nil, status.Errorf(codes.OutOfRange, "CreateVolume: failed to create volume: %s", err.Error())
+			} else if errors.Is(err, pmdmanager.ErrInvalidName) {
+				return nil, status.Errorf(codes.InvalidArgument, "CreateVolume: failed to create volume: %s", err.Error())
+			} else if !errors.Is(err, pmdmanager.ErrDeviceExists) {
+				return nil, status.Errorf(codes.Internal, "CreateVolume: failed to create volume: %s", err.Error())
+			}
+			// repeated request for a volume id whose device got created already,
+			// it must be large enough and gets reported with the size it really has
+			dev, err := cs.dm.GetDevice(devCtx, volumeID)
+			if err != nil {
+				return nil, status.Errorf(codes.Internal, "CreateVolume: failed to get existing volume: %s", err.Error())
+			}
+			if dev.Size < uint64(asked) {
+				return nil, status.Errorf(codes.AlreadyExists, "CreateVolume: volume %s exists with size %d, smaller than %d", volumeID, dev.Size, asked)
+			}
+			glog.V(3).Infof("CreateVolume: device for volume %s exists already, size %d", volumeID, dev.Size)
+			if int64(dev.Size) != vol.Size {
+				vol.Size = int64(dev.Size)
+				if cs.sm != nil {
+					// replace the state persisted with the asked size
+					if err := cs.sm.Delete(volumeID); err != nil {
+						return nil, status.Error(codes.Internal, err.Error())
+					}
+					if err := cs.sm.Create(volumeID, vol); err != nil {
+						return nil, status.Error(codes.Internal, err.Error())
+					}
+				}
+			}
 		}
 
 		cs.mutex.Lock()
@@ -269,7 +301,8 @@ func (cs *nodeControllerServer) DeleteVolume(ctx context.Context, req *csi.Delet
 		return &csi.DeleteVolumeResponse{}, nil
 	}
 
-	if err := cs.dm.DeleteDevice(req.VolumeId, eraseafter); err != nil {
+	devCtx := pmdmanager.WithLogger(ctx, pmdmanager.GlogLogger().WithValues("volume", req.VolumeId))
+	if err := cs.dm.DeleteDevice(devCtx, req.VolumeId, eraseafter); err != nil {
 		return nil, status.Errorf(codes.Internal, "Failed to delete volume: %s", err.Error())
 	}
 	if cs.sm != nil {
@@ -345,7 +378,7 @@ func (cs *nodeControllerServer) ListVolumes(ctx context.Context, req *csi.ListVo
 func (cs *nodeControllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
 	var capacity int64
 
-	cap, err := cs.dm.GetCapacity()
+	cap, err := cs.dm.GetCapacity(ctx)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, err.Error())
 	}
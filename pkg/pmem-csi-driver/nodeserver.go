@@ -205,7 +205,7 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 	glog.V(4).Infof("NodeStageVolume: VolumeID:%v Staging target path:%v Requested fsType:%v",
 		req.GetVolumeId(), stagingtargetPath, requestedFsType)
 
-	device, err := ns.dm.GetDevice(req.VolumeId)
+	device, err := ns.dm.GetDevice(ctx, req.VolumeId)
 	if err != nil {
 		glog.Errorf("NodeStageVolume: did not find volume %s", req.VolumeId)
 		return nil, status.Error(codes.InvalidArgument, err.Error())
@@ -316,7 +316,7 @@ func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 	// by spec, we have to return OK if asked volume is not mounted on asked path,
 	// so we look up the current device by volumeID and see is that device
 	// mounted on staging target path
-	_, err := ns.dm.GetDevice(req.VolumeId)
+	_, err := ns.dm.GetDevice(ctx, req.VolumeId)
 	if err != nil {
 		glog.Errorf("NodeUnstageVolume: did not find volume %s", req.GetVolumeId())
 		return nil, err
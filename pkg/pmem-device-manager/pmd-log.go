@@ -0,0 +1,94 @@
+package pmdmanager
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"k8s.io/klog/glog"
+)
+
+// Logger structured logging as used by the device managers.
+// The methods mirror those of logr.Logger, which makes wrapping one straightforward.
+type Logger interface {
+	// Info logs a message with key/value pairs, if the verbosity of the logger is enabled
+	Info(msg string, keysAndValues ...interface{})
+	// Error logs an error with key/value pairs regardless of verbosity
+	Error(err error, msg string, keysAndValues ...interface{})
+	// V returns a logger for messages of the given verbosity
+	V(level int) Logger
+	// WithValues returns a logger which adds the key/value pairs to all messages
+	WithValues(keysAndValues ...interface{}) Logger
+}
+
+// GlogLogger returns a Logger writing to glog, this is the default of the device managers
+func GlogLogger() Logger {
+	return glogLogger{}
+}
+
+// DiscardLogger returns a Logger which drops all messages
+func DiscardLogger() Logger {
+	return discardLogger{}
+}
+
+type loggerKey struct{}
+
+// WithLogger returns a context carrying logger. Device manager methods called with
+// that context log through it, which allows adding request specific values like the volume ID.
+func WithLogger(ctx context.Context, logger Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// loggerFrom returns the logger stored in ctx, fallback if there is none
+func loggerFrom(ctx context.Context, fallback Logger) Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(Logger); ok {
+		return logger
+	}
+	return fallback
+}
+
+type glogLogger struct {
+	level  int
+	values []interface{}
+}
+
+func (l glogLogger) Info(msg string, keysAndValues ...interface{}) {
+	if glog.V(glog.Level(l.level)) {
+		glog.InfoDepth(1, l.format(msg, keysAndValues))
+	}
+}
+
+func (l glogLogger) Error(err error, msg string, keysAndValues ...interface{}) {
+	glog.ErrorDepth(1, l.format(msg, append(keysAndValues, "error", err)))
+}
+
+func (l glogLogger) V(level int) Logger {
+	return glogLogger{level: l.level + level, values: l.values}
+}
+
+func (l glogLogger) WithValues(keysAndValues ...interface{}) Logger {
+	values := append(append([]interface{}{}, l.values...), keysAndValues...)
+	return glogLogger{level: l.level, values: values}
+}
+
+// format appends key=value pairs to msg, values of the logger first
+func (l glogLogger) format(msg string, keysAndValues []interface{}) string {
+	var b strings.Builder
+	b.WriteString(msg)
+	all := append(append([]interface{}{}, l.values...), keysAndValues...)
+	for i := 0; i < len(all); i += 2 {
+		if i+1 < len(all) {
+			fmt.Fprintf(&b, " %v=%q", all[i], fmt.Sprint(all[i+1]))
+		} else {
+			fmt.Fprintf(&b, " %v=<missing>", all[i])
+		}
+	}
+	return b.String()
+}
+
+type discardLogger struct{}
+
+func (discardLogger) Info(msg string, keysAndValues ...interface{})             {}
+func (discardLogger) Error(err error, msg string, keysAndValues ...interface{}) {}
+func (l discardLogger) V(level int) Logger                                      { return l }
+func (l discardLogger) WithValues(keysAndValues ...interface{}) Logger          { return l }
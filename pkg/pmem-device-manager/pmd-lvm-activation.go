@@ -0,0 +1,63 @@
+package pmdmanager
+
+import (
+	"context"
+	"fmt"
+)
+
+// CreateOptions select how CreateDeviceWithOptions creates a device
+type CreateOptions struct {
+	// Inactive creates the device without activating it, so it has no device node
+	// until ActivateDevice gets called
+	Inactive bool
+	// ReadOnly creates the device with read-only permission
+	ReadOnly bool
+}
+
+// lvcreateArgs returns the lvcreate arguments for the options
+func (opts CreateOptions) lvcreateArgs() []string {
+	args := []string{}
+	if opts.Inactive {
+		args = append(args, "-a", "n")
+	}
+	if opts.ReadOnly {
+		args = append(args, "--permission", "r")
+	}
+	return args
+}
+
+// CreateDeviceWithOptions creates a device like CreateDevice with the given activation
+// state and permission. The start of inactive or read-only devices does not get cleared
+// like that of other devices, because it cannot be written.
+func (lvm *pmemLvm) CreateDeviceWithOptions(ctx context.Context, name string, size uint64, nsmode string, opts CreateOptions) (err error) {
+	defer func() { lvm.metrics.operationDone("create", err) }()
+	if nsmode, err = lvmNamespaceMode(nsmode); err != nil {
+		return err
+	}
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+	if err := lvm.checkNewDevice(ctx, name); err != nil {
+		return err
+	}
+	_, err = lvm.createDeviceRemaining(ctx, lvm.volumeGroups, name, size, nsmode, noNumaNode, nil, opts)
+	return err
+}
+
+// ActivateDevice activates a device which was created inactive and waits for its device
+// node. Activating an active device does nothing.
+func (lvm *pmemLvm) ActivateDevice(ctx context.Context, name string) error {
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+
+	device, err := lvm.getDevice(name)
+	if err != nil {
+		return err
+	}
+	if output, err := lvm.runCommand(ctx, "lvchange", "-ay", device.Path); err != nil {
+		return fmt.Errorf("ActivateDevice: Failed: lvchange of '%s': %w(output: %s)", name, err, output)
+	}
+	if lvm.dryRun {
+		return nil
+	}
+	return waitDevicePath(ctx, device, lvm.deviceWaitTimeout)
+}
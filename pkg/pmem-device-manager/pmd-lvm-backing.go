@@ -0,0 +1,109 @@
+package pmdmanager
+
+import (
+	"context"
+
+	"github.com/intel/pmem-csi/pkg/ndctl"
+)
+
+// VolumeGroupBacking describes a managed volume group together with the namespaces
+// its physical volumes are on
+type VolumeGroupBacking struct {
+	VolumeGroupInfo
+	// Bus and Region device names of the region the group belongs to by its name
+	Bus    string
+	Region string
+	// Namespaces maps the block device paths of the physical volumes to the mode of their namespace
+	Namespaces map[string]string
+	// NamespaceMode mode shared by all namespaces of the group, empty when none were
+	// found or their modes differ
+	NamespaceMode string
+	// DAX is set when all namespaces are in fsdax mode, so filesystems on volumes in
+	// the group can be mounted with -o dax
+	DAX bool
+}
+
+// GetVolumeGroupBacking returns for each managed volume group which namespaces hold it
+// and their mode as reported by ndctl. Mode in VolumeGroupInfo is only the tag of the
+// group, which was set when it got created.
+func (lvm *pmemLvm) GetVolumeGroupBacking(ctx context.Context) ([]VolumeGroupBacking, error) {
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+
+	result := []VolumeGroupBacking{}
+	if len(lvm.volumeGroups) == 0 {
+		return result, nil
+	}
+	vgs, err := lvm.getVolumeGroups(ctx, lvm.volumeGroups, "")
+	if err != nil {
+		return nil, err
+	}
+	pvs, err := lvm.getPhysicalVolumes(ctx, vgNames(vgs))
+	if err != nil {
+		return nil, err
+	}
+	for _, vg := range vgs {
+		result = append(result, VolumeGroupBacking{VolumeGroupInfo: vg.info(), Namespaces: map[string]string{}})
+	}
+	err = lvm.regions.withRegions(func(regions []initRegion) error {
+		for i := range result {
+			backing := &result[i]
+			r := regionOfVolumeGroup(regions, backing.Name)
+			if r == nil {
+				lvm.logger(ctx).V(3).Info("No region for volume group", "vg", backing.Name)
+				continue
+			}
+			backing.Bus = r.busName()
+			backing.Region = r.DeviceName()
+			modes := map[string]string{}
+			for _, ns := range r.namespaces() {
+				modes["/dev/"+ns.BlockDeviceName()] = string(ns.Mode())
+			}
+			for _, pv := range pvs {
+				if pv.vg != backing.Name {
+					continue
+				}
+				if mode, ok := modes[pv.name]; ok {
+					backing.Namespaces[pv.name] = mode
+				} else {
+					lvm.logger(ctx).V(3).Info("Physical volume is no namespace of the region", "vg", backing.Name, "pv", pv.name, "region", backing.Region)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range result {
+		result[i].NamespaceMode = sharedNamespaceMode(result[i].Namespaces)
+		result[i].DAX = result[i].NamespaceMode == string(ndctl.FsdaxMode)
+	}
+	return result, nil
+}
+
+// regionOfVolumeGroup returns the region whose volume group for some namespace mode has
+// the given name, see vgName
+func regionOfVolumeGroup(regions []initRegion, vg string) initRegion {
+	for _, r := range regions {
+		for _, nsmode := range lvmNamespaceModes {
+			if r.vgName(nsmode) == vg {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+// sharedNamespaceMode returns the mode of all namespaces, empty if there are none or
+// their modes differ
+func sharedNamespaceMode(namespaces map[string]string) string {
+	shared := ""
+	for _, mode := range namespaces {
+		if shared != "" && shared != mode {
+			return ""
+		}
+		shared = mode
+	}
+	return shared
+}
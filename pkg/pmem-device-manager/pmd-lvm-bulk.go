@@ -0,0 +1,91 @@
+package pmdmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// DeleteDevices deletes the devices with given names like DeleteDevice and returns the
+// names of those which were deleted, in the given order, and the failures of the others.
+// A failure does not stop the remaining deletions. Up to LVMConfig.DeleteConcurrency
+// devices get erased at the same time, without holding devicemutex, so other calls can
+// proceed meanwhile. Busy devices are refused with ErrDeviceBusy, devices which do not
+// exist count as deleted.
+func (lvm *pmemLvm) DeleteDevices(ctx context.Context, names []string, flush bool) ([]string, map[string]error) {
+	errs := map[string]error{}
+	unique := []string{}
+	for _, name := range names {
+		if _, ok := errs[name]; !ok {
+			errs[name] = nil
+			unique = append(unique, name)
+		}
+	}
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	slots := make(chan struct{}, lvm.deleteConcurrency)
+	for _, name := range unique {
+		name := name
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			err := lvm.deleteDeviceOfMany(ctx, name, flush)
+			lvm.metrics.operationDone("delete", err)
+			mutex.Lock()
+			errs[name] = err
+			mutex.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	deleted := []string{}
+	for _, name := range unique {
+		if errs[name] == nil {
+			deleted = append(deleted, name)
+			delete(errs, name)
+		}
+	}
+	return deleted, errs
+}
+
+// deleteDeviceOfMany deletes one device for DeleteDevices, it takes devicemutex only
+// while closing and removing the device. While it gets erased, the device is marked as
+// deleting like by DeleteDeviceAsync, so other operations on it fail.
+func (lvm *pmemLvm) deleteDeviceOfMany(ctx context.Context, name string, flush bool) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("deleting device %s: %w", name, err)
+	}
+	devicemutex.Lock()
+	device, err := lvm.lookupDevice(ctx, name)
+	if errors.Is(err, ErrDeviceNotFound) {
+		devicemutex.Unlock()
+		lvm.logger(ctx).V(3).Info("Device already deleted", "device", name)
+		return nil
+	}
+	if err == nil {
+		device, err = lvm.closeEncryptedDevice(ctx, device)
+	}
+	if err == nil {
+		err = lvm.checkUnused(device)
+	}
+	if err == nil {
+		lvm.eraseJobs.start(name)
+	}
+	devicemutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	flushDuration, err := lvm.clearForDelete(ctx, device, flush)
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+	lvm.eraseJobs.forget(name)
+	if err != nil {
+		return err
+	}
+	return lvm.removeDevice(ctx, device, flush, flushDuration)
+}
@@ -0,0 +1,110 @@
+package pmdmanager
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultVGCacheTTL how long vgs output remains valid when volume groups do not get modified
+const defaultVGCacheTTL = 2 * time.Second
+
+// vgCache remembers the volume groups reported by vgs, indexed by the list of requested groups.
+// It is safe for concurrent use.
+type vgCache struct {
+	mutex   sync.Mutex
+	ttl     time.Duration
+	entries map[string]vgCacheEntry
+}
+
+type vgCacheEntry struct {
+	vgs     []vgInfo
+	expires time.Time
+}
+
+func newVGCache(ttl time.Duration) *vgCache {
+	return &vgCache{ttl: ttl, entries: map[string]vgCacheEntry{}}
+}
+
+func vgCacheKey(groups []string) string {
+	return strings.Join(groups, ",")
+}
+
+// get returns the cached volume groups, ok is false when nothing valid was cached
+func (c *vgCache) get(groups []string) (vgs []vgInfo, ok bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, ok := c.entries[vgCacheKey(groups)]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return append([]vgInfo{}, entry.vgs...), true
+}
+
+func (c *vgCache) put(groups []string, vgs []vgInfo) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries[vgCacheKey(groups)] = vgCacheEntry{vgs: append([]vgInfo{}, vgs...), expires: time.Now().Add(c.ttl)}
+}
+
+// invalidate drops all entries, must be called whenever logical volumes get created, removed or resized
+func (c *vgCache) invalidate() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries = map[string]vgCacheEntry{}
+}
+
+type vgSnapshotKey struct{}
+
+// WithVGSnapshot returns a context in which the LVM device manager runs vgs at most once
+// for the same volume groups, until it creates, removes or resizes a logical volume.
+// Use it for calls which belong to the same request, like GetCapacity followed by CreateDevice.
+func WithVGSnapshot(ctx context.Context) context.Context {
+	return context.WithValue(ctx, vgSnapshotKey{}, &vgSnapshot{entries: map[string][]vgInfo{}})
+}
+
+// vgSnapshot remembers the volume groups seen during one request, indexed like vgCache.
+// It is safe for concurrent use, a nil snapshot remembers nothing.
+type vgSnapshot struct {
+	mutex   sync.Mutex
+	entries map[string][]vgInfo
+}
+
+// vgSnapshotFrom returns the snapshot of the context, nil if it has none
+func vgSnapshotFrom(ctx context.Context) *vgSnapshot {
+	snapshot, _ := ctx.Value(vgSnapshotKey{}).(*vgSnapshot)
+	return snapshot
+}
+
+func (s *vgSnapshot) get(groups []string) (vgs []vgInfo, ok bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	vgs, ok = s.entries[vgCacheKey(groups)]
+	return append([]vgInfo{}, vgs...), ok
+}
+
+func (s *vgSnapshot) put(groups []string, vgs []vgInfo) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.entries[vgCacheKey(groups)] = append([]vgInfo{}, vgs...)
+}
+
+// invalidate drops all entries, like vgCache.invalidate
+func (s *vgSnapshot) invalidate() {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.entries = map[string][]vgInfo{}
+}
@@ -0,0 +1,92 @@
+package pmdmanager
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// lvmTools are the LVM commands which get LVMConfig.LVMConfigOverrides
+var lvmTools = map[string]bool{
+	"lvm": true, "lvs": true, "vgs": true, "pvs": true, "vgdisplay": true,
+	"lvcreate": true, "lvremove": true, "lvextend": true, "lvreduce": true,
+	"lvrename": true, "lvchange": true, "lvconvert": true,
+	"vgcreate": true, "vgextend": true, "vgchange": true,
+}
+
+// lvmConfigKey is the section/key path of an LVM configuration setting, like global/locking_type
+var lvmConfigKey = regexp.MustCompile(`^[a-z_][a-z0-9_]*(/[a-z_][a-z0-9_]*)+$`)
+
+// lvmConfigRunner passes --config with the overrides to LVM commands, other commands are
+// run unchanged
+type lvmConfigRunner struct {
+	runner    commandRunner
+	overrides string
+}
+
+func (r lvmConfigRunner) Run(ctx context.Context, cmd string, args ...string) (string, error) {
+	if lvmTools[cmd] {
+		args = append([]string{"--config", r.overrides}, args...)
+	}
+	return r.runner.Run(ctx, cmd, args...)
+}
+
+// validateLVMConfigOverrides checks that overrides consists of space separated key=value pairs
+// like `global/locking_type=1 devices/filter=["a|/dev/pmem.*|", "r|.*|"]`. Values may contain
+// spaces inside quotes and brackets.
+func validateLVMConfigOverrides(overrides string) error {
+	settings, err := splitLVMConfig(overrides)
+	if err != nil {
+		return fmt.Errorf("Invalid LVM config overrides %q: %w", overrides, err)
+	}
+	for _, setting := range settings {
+		parts := strings.SplitN(setting, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return fmt.Errorf("Invalid LVM config overrides %q: %q is no key=value pair", overrides, setting)
+		}
+		if !lvmConfigKey.MatchString(parts[0]) {
+			return fmt.Errorf("Invalid LVM config overrides %q: key %q is no section/name path", overrides, parts[0])
+		}
+	}
+	return nil
+}
+
+// splitLVMConfig splits LVM config settings at spaces outside of quotes and brackets
+func splitLVMConfig(config string) ([]string, error) {
+	settings := []string{}
+	var current strings.Builder
+	quoted := false
+	depth := 0
+	for _, c := range config {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+			if depth < 0 {
+				return nil, fmt.Errorf("unbalanced ]")
+			}
+		case depth == 0 && (c == ' ' || c == '\t' || c == '\n'):
+			if current.Len() > 0 {
+				settings = append(settings, current.String())
+				current.Reset()
+			}
+			continue
+		}
+		current.WriteRune(c)
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if depth > 0 {
+		return nil, fmt.Errorf("unbalanced [")
+	}
+	if current.Len() > 0 {
+		settings = append(settings, current.String())
+	}
+	return settings, nil
+}
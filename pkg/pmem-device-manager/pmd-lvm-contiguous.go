@@ -0,0 +1,95 @@
+package pmdmanager
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/intel/pmem-csi/pkg/ndctl"
+)
+
+// pvSegmentArgs lists the segments of physical volumes, pvseg_size is a number of extents
+var pvSegmentArgs = []string{"--noheadings", "--nosuffix", "--separator", lvsSeparator, "--segments",
+	"-o", "vg_name,pv_name,pvseg_size,segtype,vg_extent_size,vg_tags", "--units", "B"}
+
+// freeSegmentType is the segtype pvs reports for unallocated space
+const freeSegmentType = "free"
+
+// GetMaxContiguous returns per namespace mode the size of the largest free area on a
+// single physical volume. vgs reports the free space of a group in total, which may be
+// split up over several namespaces or between devices, so a linear device of that size
+// can be created only when lvcreate gets -C y or it fits into such an area. For thin
+// pools the free space in the pools is returned, like GetCapacity does.
+func (lvm *pmemLvm) GetMaxContiguous(ctx context.Context) (map[string]uint64, error) {
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+
+	if lvm.thinPool {
+		return lvm.getCapacity(ctx)
+	}
+	contiguous := map[string]uint64{}
+	for _, nsmod := range []ndctl.NamespaceMode{ndctl.FsdaxMode, ndctl.SectorMode} {
+		contiguous[string(nsmod)] = 0
+	}
+	if len(lvm.volumeGroups) == 0 {
+		return contiguous, nil
+	}
+	// pvs takes names of physical volumes, not of volume groups
+	output, err := lvm.runCommand(ctx, "pvs", lvm.pvsSelectArgs(pvSegmentArgs, lvm.volumeGroups)...)
+	if err != nil {
+		return nil, fmt.Errorf("list physical volume segments failed : %w(pvs output: %s)", err, output)
+	}
+	free, err := parseFreeSegments(output)
+	if err != nil {
+		return nil, err
+	}
+	for _, seg := range free {
+		if !lvm.managesVolumeGroup(seg.vg) {
+			continue
+		}
+		if seg.size > contiguous[seg.tag] {
+			contiguous[seg.tag] = seg.size
+		}
+	}
+	return contiguous, nil
+}
+
+// freeSegment is one unallocated area of a physical volume
+type freeSegment struct {
+	vg   string
+	pv   string
+	size uint64
+	// tag of the volume group, i.e. its namespace mode
+	tag string
+}
+
+// parseFreeSegments returns the free segments in the output of pvs for pvSegmentArgs
+func parseFreeSegments(output string) ([]freeSegment, error) {
+	segments := []freeSegment{}
+	for _, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Split(line, lvsSeparator)
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("Failed to parse pvs output line: %q", line)
+		}
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		if fields[3] != freeSegmentType {
+			continue
+		}
+		extents, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse segment size in pvs output line %q: %w", line, err)
+		}
+		extentSize, err := parseBytes(fields[4])
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse extent size in pvs output line %q: %w", line, err)
+		}
+		segments = append(segments, freeSegment{vg: fields[0], pv: fields[1], size: extents * extentSize, tag: fields[5]})
+	}
+	return segments, nil
+}
@@ -0,0 +1,133 @@
+package pmdmanager
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// KeyProvider supplies the key material of encrypted devices.
+// Keys never get logged or passed on the command line.
+type KeyProvider interface {
+	// Key returns the key for the device with given name
+	Key(ctx context.Context, name string) ([]byte, error)
+}
+
+// cryptMapperDir is where device mapper creates the opened encrypted devices
+const cryptMapperDir = "/dev/mapper/"
+
+// cryptName returns the device mapper name of the opened encrypted device
+func cryptName(name string) string {
+	return name + "-crypt"
+}
+
+// CreateEncryptedDevice creates a device like CreateDevice and sets it up as a LUKS device
+// with the key from keys. The Path of the resulting PmemDeviceInfo is the opened
+// /dev/mapper device, DeleteDevice closes it before removing the logical volume.
+func (lvm *pmemLvm) CreateEncryptedDevice(ctx context.Context, name string, size uint64, nsmode string, keys KeyProvider) (err error) {
+	defer func() { lvm.metrics.operationDone("create", err) }()
+	if nsmode, err = lvmNamespaceMode(nsmode); err != nil {
+		return err
+	}
+	if keys == nil {
+		return fmt.Errorf("No key provider for encrypted device %s", name)
+	}
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+	if err := lvm.checkNewDevice(ctx, name); err != nil {
+		return err
+	}
+	if err := lvm.createDevice(ctx, name, size, nsmode, noNumaNode); err != nil {
+		return err
+	}
+	if lvm.dryRun {
+		// there is no logical volume to encrypt
+		return nil
+	}
+
+	device := lvm.devices[name]
+	if err := lvm.encryptDevice(ctx, device, keys); err != nil {
+		// do not leave an unencrypted device behind
+		if _, rmErr := lvm.runCommand(ctx, "lvremove", "-fy", device.Path); rmErr != nil {
+			lvm.logger(ctx).Error(rmErr, "Failed to remove device after encryption failure", "device", name)
+		} else {
+			delete(lvm.devices, name)
+		}
+		return err
+	}
+	lvm.cryptDevices[name] = device.Path
+	device.Path = cryptMapperDir + cryptName(name)
+	lvm.devices[name] = device
+
+	return nil
+}
+
+// encryptDevice formats the logical volume as LUKS device and opens it
+func (lvm *pmemLvm) encryptDevice(ctx context.Context, device PmemDeviceInfo, keys KeyProvider) error {
+	key, err := keys.Key(ctx, device.Name)
+	if err != nil {
+		return fmt.Errorf("key for device %s: %w", device.Name, err)
+	}
+	keyFile, err := writeKeyFile(key)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(keyFile)
+
+	lvm.logger(ctx).V(3).Info("Encrypting device", "device", device.Name, "path", device.Path)
+	if output, err := lvm.runCommand(ctx, "cryptsetup", "luksFormat", "--batch-mode", "--key-file", keyFile, device.Path); err != nil {
+		return fmt.Errorf("cryptsetup luksFormat %s failed: %w(output: %s)", device.Path, err, output)
+	}
+	if output, err := lvm.runCommand(ctx, "cryptsetup", "luksOpen", "--key-file", keyFile, device.Path, cryptName(device.Name)); err != nil {
+		return fmt.Errorf("cryptsetup luksOpen %s failed: %w(output: %s)", device.Path, err, output)
+	}
+	return nil
+}
+
+// writeKeyFile stores key in a file only readable by the owner and returns its name
+func writeKeyFile(key []byte) (string, error) {
+	file, err := ioutil.TempFile("", "pmem-csi-key-")
+	if err != nil {
+		return "", fmt.Errorf("creating key file failed: %w", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(key); err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("writing key file failed: %w", err)
+	}
+	return file.Name(), nil
+}
+
+// closeEncryptedDevice closes the device mapper device of an encrypted device and
+// returns the device info for the logical volume itself. Other devices are returned unchanged.
+func (lvm *pmemLvm) closeEncryptedDevice(ctx context.Context, device PmemDeviceInfo) (PmemDeviceInfo, error) {
+	lvPath, ok := lvm.cryptDevices[device.Name]
+	if !ok {
+		return device, nil
+	}
+	if output, err := lvm.runCommand(ctx, "cryptsetup", "luksClose", cryptName(device.Name)); err != nil {
+		return device, fmt.Errorf("cryptsetup luksClose %s failed: %w(output: %s)", cryptName(device.Name), err, output)
+	}
+	device.Path = lvPath
+	return device, nil
+}
+
+// findEncryptedDevices replaces the path of devices which are open as encrypted devices
+// with that of their device mapper device
+func (lvm *pmemLvm) findEncryptedDevices(devices map[string]PmemDeviceInfo) {
+	for name, dev := range devices {
+		devices[name] = lvm.findEncryptedDevice(dev)
+	}
+}
+
+// findEncryptedDevice is findEncryptedDevices for a single device
+func (lvm *pmemLvm) findEncryptedDevice(dev PmemDeviceInfo) PmemDeviceInfo {
+	cryptPath := cryptMapperDir + cryptName(dev.Name)
+	if _, err := os.Stat(cryptPath); err != nil {
+		return dev
+	}
+	lvm.cryptDevices[dev.Name] = dev.Path
+	dev.Path = cryptPath
+	return dev
+}
@@ -0,0 +1,41 @@
+package pmdmanager
+
+import (
+	"strings"
+
+	"github.com/intel/pmem-csi/pkg/ndctl"
+)
+
+// findDAXDevices sets DAXCapable for devices which support direct access
+func (lvm *pmemLvm) findDAXDevices(devices map[string]PmemDeviceInfo) {
+	for name, dev := range devices {
+		devices[name] = lvm.findDAXDevice(dev)
+	}
+}
+
+// findDAXDevice is findDAXDevices for a single device. Only volumes in volume groups on
+// fsdax namespaces can support DAX, and only if the kernel reports it for their device,
+// which is not the case for an encrypted device on top of the volume.
+func (lvm *pmemLvm) findDAXDevice(dev PmemDeviceInfo) PmemDeviceInfo {
+	dev.DAXCapable = false
+	if vgNamespaceMode(deviceVolumeGroup(dev)) != string(ndctl.FsdaxMode) {
+		return dev
+	}
+	if lvm.daxSupported != nil {
+		dev.DAXCapable = lvm.daxSupported(dev.Path)
+	} else {
+		dev.DAXCapable = sysfsDAXSupported(dev.Path)
+	}
+	return dev
+}
+
+// vgNamespaceMode returns the namespace mode of a managed volume group by its name, see
+// vgName, empty for other volume groups
+func vgNamespaceMode(vg string) string {
+	for _, nsmode := range lvmNamespaceModes {
+		if strings.HasSuffix(vg, string(nsmode)) {
+			return string(nsmode)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,179 @@
+package pmdmanager
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// defaultEraseJobRetention how long the result of a finished background deletion is kept
+// when EraseStatus does not get called for it
+const defaultEraseJobRetention = 10 * time.Minute
+
+// EraseState is the state of a background deletion started by DeleteDeviceAsync
+type EraseState string
+
+const (
+	// EraseRunning the device is still getting erased or removed
+	EraseRunning EraseState = "running"
+	// EraseDone the device was erased and removed
+	EraseDone EraseState = "done"
+	// EraseFailed erasing or removing failed, the device still exists
+	EraseFailed EraseState = "failed"
+)
+
+// eraseJob one background deletion
+type eraseJob struct {
+	state EraseState
+	err   error
+	// finished when the job ended, zero while it is running
+	finished time.Time
+}
+
+// eraseJobs the registry of background deletions, indexed by device name.
+// Finished jobs stay until their final state was reported once or the retention
+// period is over.
+type eraseJobs struct {
+	mutex     sync.Mutex
+	jobs      map[string]*eraseJob
+	retention time.Duration
+	// now replaces time.Now in tests
+	now func() time.Time
+}
+
+func newEraseJobs() *eraseJobs {
+	return &eraseJobs{jobs: map[string]*eraseJob{}, retention: defaultEraseJobRetention, now: time.Now}
+}
+
+// prune drops finished jobs which are older than the retention period, the mutex must be held
+func (j *eraseJobs) prune() {
+	now := j.now()
+	for name, job := range j.jobs {
+		if job.state != EraseRunning && now.Sub(job.finished) >= j.retention {
+			delete(j.jobs, name)
+		}
+	}
+}
+
+// start registers a running job for the device, unless one is running already
+func (j *eraseJobs) start(name string) bool {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.prune()
+	if job, ok := j.jobs[name]; ok && job.state == EraseRunning {
+		return false
+	}
+	j.jobs[name] = &eraseJob{state: EraseRunning}
+	return true
+}
+
+// deleting checks whether a job for the device is running
+func (j *eraseJobs) deleting(name string) bool {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	job, ok := j.jobs[name]
+	return ok && job.state == EraseRunning
+}
+
+// finish records the result of the job for the device
+func (j *eraseJobs) finish(name string, err error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	job := j.jobs[name]
+	if err != nil {
+		job.state, job.err = EraseFailed, err
+	} else {
+		job.state = EraseDone
+	}
+	job.finished = j.now()
+	j.prune()
+}
+
+// forget removes the job for the device without recording its result, for deletions
+// whose caller gets the result directly
+func (j *eraseJobs) forget(name string) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	delete(j.jobs, name)
+}
+
+// status returns the state of the job for the device and removes finished jobs
+func (j *eraseJobs) status(name string) (eraseJob, bool) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.prune()
+	job, ok := j.jobs[name]
+	if !ok {
+		return eraseJob{}, false
+	}
+	if job.state != EraseRunning {
+		delete(j.jobs, name)
+	}
+	return *job, true
+}
+
+// DeleteDeviceAsync deletes a device like DeleteDevice with flush enabled, but erases and
+// removes it in the background, so the call returns as soon as the device was closed.
+// EraseStatus reports the progress. The device remains known until it was removed, but
+// all other operations on it fail with ErrDeviceDeleting meanwhile. Calling it again while
+// a deletion of the device is running does nothing.
+func (lvm *pmemLvm) DeleteDeviceAsync(ctx context.Context, name string) error {
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+
+	if lvm.eraseJobs.deleting(name) {
+		lvm.logger(ctx).V(4).Info("Device is getting deleted already", "device", name)
+		return nil
+	}
+	device, err := lvm.getDevice(name)
+	if err != nil {
+		return err
+	}
+	// marks the device as deleting while devicemutex is held
+	lvm.eraseJobs.start(name)
+	device, err = lvm.closeEncryptedDevice(ctx, device)
+	if err == nil {
+		err = lvm.checkUnused(device)
+	}
+	if err != nil {
+		lvm.metrics.operationDone("delete", err)
+		lvm.eraseJobs.finish(name, err)
+		return err
+	}
+	// the job outlives the request, only its logger gets used
+	jobCtx := WithLogger(context.Background(), lvm.logger(ctx))
+	go lvm.runEraseJob(jobCtx, device)
+
+	return nil
+}
+
+// runEraseJob erases the device without holding devicemutex, then removes it
+func (lvm *pmemLvm) runEraseJob(ctx context.Context, device PmemDeviceInfo) {
+	flushDuration, err := lvm.clearForDelete(ctx, device, true)
+	if err == nil {
+		devicemutex.Lock()
+		err = lvm.removeDevice(ctx, device, true, flushDuration)
+		devicemutex.Unlock()
+	}
+	if err != nil {
+		lvm.logger(ctx).Error(err, "Background deletion failed", "device", device.Name)
+	}
+	lvm.metrics.operationDone("delete", err)
+	lvm.eraseJobs.finish(device.Name, err)
+}
+
+// EraseStatus returns the state of the background deletion of the device with given name.
+// For failed deletions the error is that of the job. Once a finished deletion was reported,
+// or after ten minutes without being asked for, it is forgotten and EraseStatus fails with
+// ErrDeviceNotFound, like for unknown names.
+func (lvm *pmemLvm) EraseStatus(ctx context.Context, name string) (EraseState, error) {
+	job, ok := lvm.eraseJobs.status(name)
+	if !ok {
+		return "", fmt.Errorf("no background deletion of device %s: %w", name, ErrDeviceNotFound)
+	}
+	if job.state == EraseFailed {
+		return job.state, fmt.Errorf("background deletion of device %s failed: %w", name, job.err)
+	}
+	return job.state, nil
+}
@@ -0,0 +1,207 @@
+package pmdmanager
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// VolumeGroupState tells whether devices can be created in a volume group
+type VolumeGroupState string
+
+const (
+	// VolumeGroupHealthy all physical volumes of the group are present
+	VolumeGroupHealthy VolumeGroupState = "healthy"
+	// VolumeGroupPartial some physical volumes, i.e. namespaces, of the group are missing
+	VolumeGroupPartial VolumeGroupState = "partial"
+	// VolumeGroupMissing the group does not exist anymore
+	VolumeGroupMissing VolumeGroupState = "missing"
+	// VolumeGroupThinMetadataFull the metadata of the thin pool in the group is full, see
+	// ResizeThinMetadata
+	VolumeGroupThinMetadataFull VolumeGroupState = "thin-metadata-full"
+)
+
+// VolumeGroupHealth is the state of one volume group managed by the LVM device manager
+type VolumeGroupHealth struct {
+	Name  string
+	State VolumeGroupState
+	// MissingPVs number of physical volumes of the group which were not found
+	MissingPVs int
+	// ThinMetadataPercent used part of the thin pool metadata with LVMConfig.ThinPool
+	ThinMetadataPercent float64
+}
+
+// vgAttrPartial is the position of the partial flag in vg_attr
+const vgAttrPartial = 3
+
+// vgHealthArgs lists the health of volume groups, naming a group which does not exist
+// makes vgs fail after reporting the others
+var vgHealthArgs = []string{"--noheadings", "-o", "vg_name,vg_attr,vg_missing_pv_count"}
+
+// HealthCheck reports the state of all managed volume groups. Creating devices in
+// groups which are not healthy fails, so those should not be used for new volumes.
+// With LVMConfig.ThinPool it also reports the metadata usage of the thin pools.
+func (lvm *pmemLvm) HealthCheck(ctx context.Context) ([]VolumeGroupHealth, error) {
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+
+	health := []VolumeGroupHealth{}
+	if len(lvm.volumeGroups) == 0 {
+		return health, nil
+	}
+	args := append(append([]string{}, vgHealthArgs...), lvm.volumeGroups...)
+	output, err := lvm.runCommand(ctx, "vgs", args...)
+	reported := output
+	if err != nil {
+		// the error messages about missing groups are not part of the report
+		reported = namedRows(output, lvm.volumeGroups)
+	}
+	found, parseErr := parseVGHealth(reported)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	if err != nil && len(found) == 0 {
+		return nil, fmt.Errorf("vgs failure: %w(output: %s)", err, output)
+	}
+	for _, vg := range lvm.volumeGroups {
+		if h, ok := found[vg]; ok {
+			health = append(health, h)
+		} else {
+			health = append(health, VolumeGroupHealth{Name: vg, State: VolumeGroupMissing})
+		}
+	}
+	if lvm.thinPool {
+		if err := lvm.checkThinMetadata(ctx, health); err != nil {
+			return nil, err
+		}
+	}
+	return health, nil
+}
+
+// checkThinMetadata adds the metadata usage of the thin pools to the health of existing
+// groups. Healthy groups whose pool metadata is full cannot take new volumes either.
+func (lvm *pmemLvm) checkThinMetadata(ctx context.Context, health []VolumeGroupHealth) error {
+	names := []string{}
+	for _, h := range health {
+		if h.State != VolumeGroupMissing {
+			names = append(names, h.Name)
+		}
+	}
+	pools, err := lvm.getThinPools(ctx, names)
+	if err != nil {
+		return err
+	}
+	for i := range health {
+		pool, ok := pools[health[i].Name]
+		if !ok {
+			continue
+		}
+		lvm.warnThinMetadata(ctx, pool)
+		health[i].ThinMetadataPercent = pool.metadataPercent
+		if pool.metadataFull() && health[i].State == VolumeGroupHealthy {
+			health[i].State = VolumeGroupThinMetadataFull
+		}
+	}
+	return nil
+}
+
+// parseVGHealth parses the output of vgs for vgHealthArgs, indexed by volume group name
+func parseVGHealth(output string) (map[string]VolumeGroupHealth, error) {
+	health := map[string]VolumeGroupHealth{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 || len(fields[1]) <= vgAttrPartial {
+			return nil, fmt.Errorf("Failed to parse vgs output line: %q", line)
+		}
+		missing, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse missing physical volumes in vgs output line %q: %w", line, err)
+		}
+		h := VolumeGroupHealth{Name: fields[0], State: VolumeGroupHealthy, MissingPVs: missing}
+		if fields[1][vgAttrPartial] == 'p' || missing > 0 {
+			h.State = VolumeGroupPartial
+		}
+		health[h.Name] = h
+	}
+	return health, nil
+}
+
+// segmentArgs lists all segments of all volumes, including hidden ones like thin pool
+// metadata, with the space they take in their volume group
+var segmentArgs = []string{"--noheadings", "--nosuffix", "--separator", lvsSeparator, "-a", "-o", "vg_name,seg_size,segtype", "--units", "B"}
+
+// virtualSegmentTypes take no space of their own in the volume group: thin volumes are
+// allocated from their pool, whose space is that of its hidden data and metadata volumes
+var virtualSegmentTypes = map[string]bool{"thin": true, "thin-pool": true}
+
+// VerifyAccounting cross-checks the size of each managed volume group against its free
+// space plus the size of all volumes in it, hidden ones included. Differences of more
+// than one extent get reported in the error. This is a diagnostic aid: when it fails,
+// free space reported by GetCapacity may not be usable.
+func (lvm *pmemLvm) VerifyAccounting(ctx context.Context) error {
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+
+	if len(lvm.volumeGroups) == 0 {
+		return nil
+	}
+	vgs, err := lvm.listVolumeGroups(ctx, lvm.volumeGroups)
+	if err != nil {
+		return err
+	}
+	args := append(append([]string{}, segmentArgs...), vgNames(vgs)...)
+	output, err := lvm.runCommand(ctx, "lvs", args...)
+	if err != nil {
+		return fmt.Errorf("list volume segments failed : %w(lvs output: %s)", err, output)
+	}
+	allocated, err := parseSegmentSizes(output)
+	if err != nil {
+		return err
+	}
+	problems := []string{}
+	for _, vg := range vgs {
+		accounted := vg.free + allocated[vg.name]
+		diff := int64(vg.size) - int64(accounted)
+		if diff < 0 {
+			diff = -diff
+		}
+		if uint64(diff) <= vg.extentSize {
+			continue
+		}
+		lvm.logger(ctx).V(2).Info("Volume group space does not add up", "vg", vg.name,
+			"size", vg.size, "free", vg.free, "allocated", allocated[vg.name])
+		problems = append(problems, fmt.Sprintf("%s: size %d, free %d, allocated %d", vg.name, vg.size, vg.free, allocated[vg.name]))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("volume group space does not add up: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// parseSegmentSizes parses the output of lvs for segmentArgs and returns the
+// allocated bytes per volume group
+func parseSegmentSizes(output string) (map[string]uint64, error) {
+	allocated := map[string]uint64{}
+	for _, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Split(line, lvsSeparator)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("Failed to parse segment line: %q", line)
+		}
+		size, err := parseBytes(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse segment size in line %q: %w", line, err)
+		}
+		if virtualSegmentTypes[strings.TrimSpace(fields[2])] {
+			continue
+		}
+		allocated[strings.TrimSpace(fields[0])] += size
+	}
+	return allocated, nil
+}
@@ -0,0 +1,102 @@
+package pmdmanager
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// incompleteTag marks logical volumes whose creation has not finished yet, see
+// LVMConfig.MarkIncomplete. It is no key/value pair, so it does not show up in
+// PmemDeviceInfo.Tags.
+const incompleteTag = "pmem-csi.incomplete"
+
+// incompleteTagArgs adds the lvcreate arguments for incompleteTag to tagArgs
+// when marking is enabled
+func (lvm *pmemLvm) incompleteTagArgs(tagArgs []string) []string {
+	if !lvm.markIncomplete {
+		return tagArgs
+	}
+	return append(append([]string{}, tagArgs...), "--addtag", incompleteTag)
+}
+
+// markComplete removes incompleteTag from a device after it was set up
+func (lvm *pmemLvm) markComplete(ctx context.Context, device PmemDeviceInfo) error {
+	if !lvm.markIncomplete {
+		return nil
+	}
+	if output, err := lvm.runCommand(ctx, "lvchange", "--deltag", incompleteTag, device.Path); err != nil {
+		return fmt.Errorf("marking device %s complete failed: %w(lvchange output: %s)", device.Name, err, output)
+	}
+	return nil
+}
+
+// ListIncomplete returns the devices which still carry the tag of LVMConfig.MarkIncomplete,
+// i.e. whose creation failed or got interrupted after lvcreate. Callers may delete them,
+// unless a create of that device is still running.
+func (lvm *pmemLvm) ListIncomplete(ctx context.Context) ([]PmemDeviceInfo, error) {
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+
+	return lvm.listIncomplete(ctx)
+}
+
+// listIncomplete is ListIncomplete without locking
+func (lvm *pmemLvm) listIncomplete(ctx context.Context) ([]PmemDeviceInfo, error) {
+	devices := []PmemDeviceInfo{}
+	if len(lvm.volumeGroups) == 0 {
+		return devices, nil
+	}
+	// The tag is not part of PmemDeviceInfo.Tags, so without selection the names
+	// of the tagged volumes have to be looked up first.
+	var match func(dev PmemDeviceInfo) bool
+	if lvm.noSelection {
+		names, err := lvm.incompleteNames(ctx)
+		if err != nil {
+			return nil, err
+		}
+		match = func(dev PmemDeviceInfo) bool {
+			return names[dev.Name]
+		}
+	}
+	// {} matches volumes having the tag among others
+	found, err := lvm.listSelectedDevices(ctx, "lv_tags={"+incompleteTag+"}", match, lvm.volumeGroups...)
+	if err != nil {
+		return nil, err
+	}
+	for name, dev := range found {
+		lvm.devices[name] = dev
+		devices = append(devices, dev)
+	}
+
+	return devices, nil
+}
+
+// incompleteNamesArgs lists all volumes with their tags
+var incompleteNamesArgs = []string{"--noheadings", "--separator", lvsSeparator, "-o", "lv_name,lv_tags"}
+
+// incompleteNames returns the names of the volumes carrying incompleteTag, for LVM
+// versions without selection
+func (lvm *pmemLvm) incompleteNames(ctx context.Context) (map[string]bool, error) {
+	args := append(append([]string{}, incompleteNamesArgs...), lvm.volumeGroups...)
+	output, err := lvm.runCommand(ctx, "lvs", args...)
+	if err != nil {
+		return nil, fmt.Errorf("list volume tags failed : %w(lvs output: %s)", err, output)
+	}
+	names := map[string]bool{}
+	for _, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Split(line, lvsSeparator)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("Failed to parse volume tags line: %q", line)
+		}
+		for _, tag := range strings.Split(fields[1], ",") {
+			if strings.TrimSpace(tag) == incompleteTag {
+				names[strings.TrimSpace(fields[0])] = true
+			}
+		}
+	}
+	return names, nil
+}
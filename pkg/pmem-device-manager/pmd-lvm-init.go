@@ -0,0 +1,306 @@
+package pmdmanager
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/intel/pmem-csi/pkg/ndctl"
+)
+
+const (
+	// initNamespaceName name of the namespaces created for and used by pmem-csi
+	initNamespaceName = "pmem-csi"
+	// initMinNamespaceSize smaller namespaces are not attempted, their creation would fail
+	initMinNamespaceSize = 2 * 1024 * 1024 * 1024
+	// initNamespaceAlign alignment of created namespaces
+	initNamespaceAlign = 1024 * 1024 * 1024
+)
+
+// RegionInit configures how EnsureVolumeGroups prepares regions.
+// LVM needs block devices, so only fsdax and sector namespaces are supported.
+type RegionInit struct {
+	// UseForFsdax percentage of each region to use for fsdax namespaces
+	UseForFsdax int
+	// UseForSector percentage of each region to use for sector namespaces
+	UseForSector int
+}
+
+func (cfg RegionInit) validate() error {
+	if cfg.UseForFsdax < 0 || cfg.UseForFsdax > 100 {
+		return fmt.Errorf("UseForFsdax value must be 0..100")
+	}
+	if cfg.UseForSector < 0 || cfg.UseForSector > 100 {
+		return fmt.Errorf("UseForSector value must be 0..100")
+	}
+	if cfg.UseForFsdax+cfg.UseForSector > 100 {
+		return fmt.Errorf("UseForFsdax and UseForSector combined must not exceed 100")
+	}
+	return nil
+}
+
+// initRegion the parts of a region needed for preparing it, implemented by ndctlRegion
+type initRegion interface {
+	DeviceName() string
+	// busName returns the device name of the bus the region is on
+	busName() string
+	Size() uint64
+	AvailableSize() uint64
+	MaxAvailableExtent() uint64
+	NumaNode() int
+	// dimmSerials returns the serial numbers of the DIMMs the region is interleaved across
+	dimmSerials() []string
+	// accepted returns the result of filter for the region
+	accepted(filter RegionFilter) bool
+	// vgName returns the name of the volume group for namespaces of the region in given mode
+	vgName(nsmode ndctl.NamespaceMode) string
+	namespaces() []initNamespace
+	createNamespace(opts ndctl.CreateNamespaceOpts) error
+}
+
+// initNamespace the parts of a namespace needed for preparing a region, implemented by *ndctl.Namespace
+type initNamespace interface {
+	Name() string
+	Mode() ndctl.NamespaceMode
+	Size() uint64
+	BlockDeviceName() string
+}
+
+type ndctlRegion struct {
+	*ndctl.Region
+	bus *ndctl.Bus
+}
+
+func (r ndctlRegion) busName() string {
+	return r.bus.DeviceName()
+}
+
+func (r ndctlRegion) vgName(nsmode ndctl.NamespaceMode) string {
+	return vgName(r.bus, r.Region, nsmode)
+}
+
+func (r ndctlRegion) dimmSerials() []string {
+	serials := []string{}
+	for _, m := range r.Mappings() {
+		serials = append(serials, formatDimmSerial(m.Dimm().Serial()))
+	}
+	return serials
+}
+
+// formatDimmSerial formats a serial number like ndctl list does
+func formatDimmSerial(serial uint32) string {
+	return fmt.Sprintf("0x%08x", serial)
+}
+
+func (r ndctlRegion) accepted(filter RegionFilter) bool {
+	return filter(r.bus, r.Region)
+}
+
+func (r ndctlRegion) namespaces() []initNamespace {
+	namespaces := []initNamespace{}
+	for _, ns := range r.ActiveNamespaces() {
+		namespaces = append(namespaces, ns)
+	}
+	return namespaces
+}
+
+func (r ndctlRegion) createNamespace(opts ndctl.CreateNamespaceOpts) error {
+	_, err := r.CreateNamespace(opts)
+	return err
+}
+
+// regionSource provides the active regions of the system
+type regionSource interface {
+	// withRegions calls fn with all active regions, they are only valid during that call
+	withRegions(fn func(regions []initRegion) error) error
+}
+
+// ndctlRegions the regionSource for the regions found by libndctl
+type ndctlRegions struct{}
+
+func (ndctlRegions) withRegions(fn func(regions []initRegion) error) error {
+	ndctx, err := ndctl.NewContext()
+	if err != nil {
+		return fmt.Errorf("Failed to initialize pmem context: %w", err)
+	}
+	defer ndctx.Free()
+
+	regions := []initRegion{}
+	for _, bus := range ndctx.GetBuses() {
+		for _, r := range bus.ActiveRegions() {
+			regions = append(regions, ndctlRegion{Region: r, bus: bus})
+		}
+	}
+	return fn(regions)
+}
+
+// RegionInfo describes an active region as found by EnumerateRegions
+type RegionInfo struct {
+	// Bus device name of the bus, for example ndbus0
+	Bus string
+	// Region device name of the region, for example region0
+	Region string
+	// VolumeGroups names of the volume groups for the namespaces of the region, indexed by
+	// namespace mode. They only exist when the region was prepared, see EnsureVolumeGroups.
+	VolumeGroups map[string]string
+	// Size total size in bytes
+	Size uint64
+	// AvailableSize bytes not used by any namespace yet
+	AvailableSize uint64
+	// NumaNode NUMA node the region is attached to, -1 if unknown
+	NumaNode int
+	// DimmSerials serial numbers of the DIMMs backing the region, for example 0x00000001.
+	// Unlike the device names they do not change when regions get enumerated in another order.
+	DimmSerials []string
+}
+
+// lvmNamespaceModes the namespace modes which can hold volume groups
+var lvmNamespaceModes = []ndctl.NamespaceMode{ndctl.FsdaxMode, ndctl.SectorMode}
+
+// EnumerateRegions returns all active regions on all buses, like NewPmemDeviceManagerLVM
+// finds them, without checking which of them have volume groups
+func EnumerateRegions() ([]RegionInfo, error) {
+	return enumerateRegions(ndctlRegions{})
+}
+
+// enumerateRegions returns the regions of source
+func enumerateRegions(source regionSource) ([]RegionInfo, error) {
+	infos := []RegionInfo{}
+	err := source.withRegions(func(regions []initRegion) error {
+		for _, r := range regions {
+			infos = append(infos, regionInfo(r))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// regionInfo copies the relevant data of r, which is only valid inside withRegions
+func regionInfo(r initRegion) RegionInfo {
+	info := RegionInfo{
+		Bus:           r.busName(),
+		Region:        r.DeviceName(),
+		VolumeGroups:  map[string]string{},
+		Size:          r.Size(),
+		AvailableSize: r.AvailableSize(),
+		NumaNode:      r.NumaNode(),
+		DimmSerials:   append([]string{}, r.dimmSerials()...),
+	}
+	for _, nsmode := range lvmNamespaceModes {
+		info.VolumeGroups[string(nsmode)] = r.vgName(nsmode)
+	}
+	return info
+}
+
+// EnsureVolumeGroups prepares all active regions for NewPmemDeviceManagerLVM: it creates
+// pmem-csi namespaces with the configured share of each region, unless they exist already,
+// and groups them into one volume group per region and namespace mode.
+// This is what the pmem-ns-init and pmem-vgm tools do, so it can run in the driver itself.
+func EnsureVolumeGroups(ctx context.Context, cfg RegionInit) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	return ndctlRegions{}.withRegions(func(regions []initRegion) error {
+		devicemutex.Lock()
+		defer devicemutex.Unlock()
+		return ensureVolumeGroups(ctx, regions, cfg, execRunner{}, loggerFrom(ctx, GlogLogger()))
+	})
+}
+
+func ensureVolumeGroups(ctx context.Context, regions []initRegion, cfg RegionInit, runner commandRunner, log Logger) error {
+	uses := []struct {
+		nsmode   ndctl.NamespaceMode
+		uselimit int
+	}{
+		{ndctl.FsdaxMode, cfg.UseForFsdax},
+		{ndctl.SectorMode, cfg.UseForSector},
+	}
+	for _, r := range regions {
+		for _, use := range uses {
+			createNamespace(r, use.uselimit, use.nsmode, log)
+		}
+		for _, use := range uses {
+			if err := ensureVolumeGroup(ctx, r, use.nsmode, runner, log); err != nil {
+				return fmt.Errorf("volume group for region %s: %w", r.DeviceName(), err)
+			}
+		}
+	}
+	return nil
+}
+
+// createNamespace creates a namespace with up to uselimit percent of the region,
+// minus what existing pmem-csi namespaces in that mode already use.
+// Failures get logged only, the region may still have usable namespaces.
+func createNamespace(r initRegion, uselimit int, nsmode ndctl.NamespaceMode, log Logger) {
+	canUse := uint64(uselimit) * r.Size() / 100
+	for _, ns := range r.namespaces() {
+		if ns.Mode() == nsmode && ns.Name() == initNamespaceName {
+			if ns.Size() >= canUse {
+				canUse = 0
+			} else {
+				canUse -= ns.Size()
+			}
+		}
+	}
+	// Because of overhead by alignement and extra space for page mapping, calculated available may show more than actual
+	if r.AvailableSize() < canUse {
+		canUse = r.AvailableSize()
+	}
+	// fragmented space could lead to r.MaxAvailableExtent() being less than r.AvailableSize()
+	if r.MaxAvailableExtent() < canUse {
+		canUse = r.MaxAvailableExtent()
+	}
+	log.V(4).Info("Namespace space", "region", r.DeviceName(), "mode", nsmode, "percent", uselimit, "size", canUse)
+	if canUse < initMinNamespaceSize {
+		return
+	}
+	log.V(3).Info("Creating namespace", "region", r.DeviceName(), "mode", nsmode, "size", canUse)
+	err := r.createNamespace(ndctl.CreateNamespaceOpts{
+		Name:  initNamespaceName,
+		Mode:  nsmode,
+		Size:  canUse,
+		Align: initNamespaceAlign,
+	})
+	if err != nil {
+		log.Error(err, "Failed to create namespace", "region", r.DeviceName(), "mode", nsmode, "size", canUse)
+	}
+}
+
+// ensureVolumeGroup adds all pmem-csi namespaces of the region in nsmode which are
+// not physical volumes yet to the volume group of the region, creating it if needed
+func ensureVolumeGroup(ctx context.Context, r initRegion, nsmode ndctl.NamespaceMode, runner commandRunner, log Logger) error {
+	vgname := r.vgName(nsmode)
+	devices := []string{}
+	for _, ns := range r.namespaces() {
+		// consider only namespaces in asked namespacemode,
+		// and having name given by this driver, to exclude foreign ones
+		if ns.Mode() != nsmode || ns.Name() != initNamespaceName {
+			continue
+		}
+		devName := "/dev/" + ns.BlockDeviceName()
+		output, err := runCommand(ctx, runner, defaultCommandTimeout, "pvs", "--noheadings", "-o", "vg_name", devName)
+		if err != nil || len(strings.TrimSpace(output)) == 0 {
+			devices = append(devices, devName)
+		}
+	}
+	if len(devices) == 0 {
+		log.V(5).Info("No new namespaces for volume group", "vg", vgname)
+		return nil
+	}
+	cmd := "vgextend"
+	if _, err := runCommand(ctx, runner, defaultCommandTimeout, "vgdisplay", vgname); err != nil {
+		cmd = "vgcreate"
+	}
+	log.V(3).Info("Adding namespaces to volume group", "vg", vgname, "command", cmd, "devices", strings.Join(devices, " "))
+	if output, err := runCommand(ctx, runner, defaultCommandTimeout, cmd, append([]string{"--force", vgname}, devices...)...); err != nil {
+		return fmt.Errorf("%s %s failed: %w(output: %s)", cmd, vgname, err, output)
+	}
+	// Tag add works without error if repeated, so it is safe to run without checking for existing
+	if _, err := runCommand(ctx, runner, defaultCommandTimeout, "vgchange", "--addtag", string(nsmode), vgname); err != nil {
+		return fmt.Errorf("tagging %s failed: %w", vgname, err)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package pmdmanager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// lvsJSONArgs and vgsJSONArgs request the columns of lvsArgs and vgsArgs as JSON,
+// see LVMConfig.JSONReports
+var lvsJSONArgs = []string{"--reportformat", "json", "--nosuffix", "-o", strings.Join(lvsColumns, ","), "--units", "B"}
+var vgsJSONArgs = []string{"--reportformat", "json", "--nosuffix", "-o", strings.Join(vgsColumns, ","), "--units", "B"}
+
+// lvmJSONReport is the output of an LVM reporting command with --reportformat json, for
+// example {"report": [{"lv": [{"lv_name": "vol1", "lv_size": "4194304", ...}]}]}.
+// All values are strings, also the sizes.
+type lvmJSONReport struct {
+	Report []map[string][]map[string]string `json:"report"`
+}
+
+// parseJSONReport returns the values of columns, in that order, for each row of the given
+// kind ("lv" or "vg") in the JSON output of an LVM reporting command
+func parseJSONReport(output, kind string, columns []string) ([][]string, error) {
+	var report lvmJSONReport
+	if err := json.Unmarshal([]byte(output), &report); err != nil {
+		return nil, fmt.Errorf("Failed to parse JSON report: %w", err)
+	}
+	rows := [][]string{}
+	for _, part := range report.Report {
+		for _, row := range part[kind] {
+			fields := make([]string, len(columns))
+			for i, column := range columns {
+				value, ok := row[column]
+				if !ok {
+					return nil, fmt.Errorf("Failed to parse JSON report: %s without %s", kind, column)
+				}
+				fields[i] = strings.TrimSpace(value)
+			}
+			rows = append(rows, fields)
+		}
+	}
+	return rows, nil
+}
+
+// lvsArgs returns the arguments of lvs for listing devices, without volume groups
+func (lvm *pmemLvm) lvsArgs() []string {
+	args := lvsArgs
+	if lvm.jsonReports {
+		args = lvsJSONArgs
+	}
+	if lvm.includeHidden {
+		return append([]string{"-a"}, args...)
+	}
+	return append([]string{}, args...)
+}
+
+// vgsArgs returns the arguments of vgs for listing volume groups, without their names
+func (lvm *pmemLvm) vgsArgs() []string {
+	if lvm.jsonReports {
+		return append([]string{}, vgsJSONArgs...)
+	}
+	return append([]string{}, vgsArgs...)
+}
+
+// parseLVS parses the output of lvs for lvsArgs, like parseLVSOuput
+func (lvm *pmemLvm) parseLVS(ctx context.Context, output string) (map[string]PmemDeviceInfo, error) {
+	devices := map[string]PmemDeviceInfo{}
+	err := lvm.forEachLVSDevice(ctx, output, func(dev PmemDeviceInfo) error {
+		devices[dev.Name] = dev
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+// forEachLVSDevice parses the output of lvs for lvsArgs and calls fn for each device,
+// like forEachLVSLine
+func (lvm *pmemLvm) forEachLVSDevice(ctx context.Context, output string, fn func(dev PmemDeviceInfo) error) error {
+	if !lvm.jsonReports {
+		return forEachLVSLine(lvm.logger(ctx), output, lvm.includeHidden, fn)
+	}
+	rows, err := parseJSONReport(output, "lv", lvsColumns)
+	if err != nil {
+		return err
+	}
+	for _, fields := range rows {
+		if !lvm.includeHidden && internalLV(fields) {
+			continue
+		}
+		dev, err := parseLVSFields(fields, strings.Join(fields, lvsSeparator))
+		if err != nil {
+			return err
+		}
+		if err := fn(dev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseVGS parses the output of vgs for vgsArgs, like parseVGSOutput
+func (lvm *pmemLvm) parseVGS(output string) (map[string]vgInfo, error) {
+	if !lvm.jsonReports {
+		return parseVGSOutput(output)
+	}
+	rows, err := parseJSONReport(output, "vg", vgsColumns)
+	if err != nil {
+		return nil, err
+	}
+	vgs := map[string]vgInfo{}
+	for _, fields := range rows {
+		vg, err := parseVGSFields(fields, strings.Join(fields, " "))
+		if err != nil {
+			return nil, err
+		}
+		vgs[vg.name] = vg
+	}
+	return vgs, nil
+}
@@ -0,0 +1,99 @@
+package pmdmanager
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "pmem_csi_lvm"
+
+// lvmMetrics collectors of the LVM device manager.
+// They always get updated, RegisterMetrics makes them visible.
+type lvmMetrics struct {
+	operations      *prometheus.CounterVec
+	failures        *prometheus.CounterVec
+	commandDuration *prometheus.HistogramVec
+	eraseDuration   prometheus.Histogram
+	deleteDuration  *prometheus.HistogramVec
+	capacity        *prometheus.GaugeVec
+}
+
+func newLVMMetrics() *lvmMetrics {
+	return &lvmMetrics{
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "operations_total",
+			Help:      "Number of device operations.",
+		}, []string{"operation"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "operation_failures_total",
+			Help:      "Number of failed device operations.",
+		}, []string{"operation"}),
+		commandDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "command_duration_seconds",
+			Help:      "Run time of LVM and erase commands.",
+		}, []string{"command"}),
+		eraseDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "erase_duration_seconds",
+			Help:      "Run time of erasing an entire device.",
+			// from 0.1s up to about 7 hours, shredding large devices is slow
+			Buckets: prometheus.ExponentialBuckets(0.1, 4, 9),
+		}),
+		deleteDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "delete_phase_duration_seconds",
+			Help:      "Run time of the phases of deleting a device, erasing it (flush) and removing the logical volume (lvremove).",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 4, 9),
+		}, []string{"phase"}),
+		capacity: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "capacity_bytes",
+			Help:      "Size of all managed volume groups, as seen by the last GetCapacity.",
+		}, []string{"state"}),
+	}
+}
+
+func (m *lvmMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.operations, m.failures, m.commandDuration, m.eraseDuration, m.deleteDuration, m.capacity}
+}
+
+// operationDone counts an operation and whether it failed
+func (m *lvmMetrics) operationDone(operation string, err error) {
+	m.operations.WithLabelValues(operation).Inc()
+	if err != nil {
+		m.failures.WithLabelValues(operation).Inc()
+	}
+}
+
+// RegisterMetrics makes the metrics of the manager available through reg
+func (lvm *pmemLvm) RegisterMetrics(reg prometheus.Registerer) error {
+	for _, c := range lvm.metrics.collectors() {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// instrumentedRunner measures the run time of the commands of another runner
+type instrumentedRunner struct {
+	runner  commandRunner
+	metrics *lvmMetrics
+}
+
+func (r instrumentedRunner) Run(ctx context.Context, cmd string, args ...string) (string, error) {
+	start := time.Now()
+	output, err := r.runner.Run(ctx, cmd, args...)
+	duration := time.Since(start).Seconds()
+	r.metrics.commandDuration.WithLabelValues(cmd).Observe(duration)
+	switch cmd {
+	case "shred", "blkdiscard":
+		r.metrics.eraseDuration.Observe(duration)
+	}
+	return output, err
+}
@@ -0,0 +1,145 @@
+package pmdmanager
+
+import (
+	"context"
+	"fmt"
+)
+
+// migrateSuffix is appended to the name of a device while its copy in the target
+// volume group gets written
+const migrateSuffix = "-migrate"
+
+// MigrateDevice moves a device into another managed volume group with the same
+// namespace mode, keeping its name, size and tags, for example to free space in a
+// full group. The groups of different regions never share physical volumes, so
+// pvmove cannot move the device: it gets copied into a new logical volume in the
+// target group, then the old one gets erased and removed. Copying needs as much free
+// space in the target group as the device is large and must be enabled with
+// LVMConfig.AllowCopyMigration. Devices which are in use get refused with ErrDeviceBusy.
+func (lvm *pmemLvm) MigrateDevice(ctx context.Context, name, targetVG string) (err error) {
+	defer func() { lvm.metrics.operationDone("migrate", err) }()
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+
+	device, err := lvm.getDevice(name)
+	if err != nil {
+		return err
+	}
+	sourceVG := deviceVolumeGroup(device)
+	if sourceVG == targetVG {
+		return nil
+	}
+	if !lvm.managesVolumeGroup(targetVG) {
+		return fmt.Errorf("MigrateDevice: Failed: volume group %s is not managed", targetVG)
+	}
+	if !lvm.allowCopyMigration {
+		return fmt.Errorf("MigrateDevice: Failed: moving device '%s' to another volume group needs a copy, which is disabled", name)
+	}
+	if _, ok := lvm.cryptDevices[name]; ok {
+		return fmt.Errorf("MigrateDevice: Failed: migrating encrypted device '%s' is not supported", name)
+	}
+	if lvm.thinPool {
+		return fmt.Errorf("MigrateDevice: Failed: migrating thin volume '%s' is not supported", name)
+	}
+	if err := canFlush(device, lvm.flushConfig()); err != nil {
+		return err
+	}
+	tmpName := name + migrateSuffix
+	if err := lvm.checkNewDevice(ctx, tmpName); err != nil {
+		return err
+	}
+	tagArgs, err := lvTagArgs(device.Tags)
+	if err != nil {
+		return err
+	}
+
+	vgs, err := lvm.getVolumeGroups(ctx, []string{sourceVG, targetVG}, "")
+	if err != nil {
+		return err
+	}
+	var source, target vgInfo
+	for _, vg := range vgs {
+		switch vg.name {
+		case sourceVG:
+			source = vg
+		case targetVG:
+			target = vg
+		}
+	}
+	if source.tag != target.tag {
+		return fmt.Errorf("MigrateDevice: Failed: volume group %s is for %s namespaces, device '%s' is in a %s group",
+			targetVG, target.tag, name, source.tag)
+	}
+	aligned := roundToExtent(device.Size, target.extentSize)
+	if target.free < aligned {
+		return fmt.Errorf("MigrateDevice: Failed: volume group %s has %v free, device '%s' needs %v: %w",
+			targetVG, target.free, name, aligned, ErrNotEnoughSpace)
+	}
+
+	sizeArgs, err := lvm.lvcreateSizeArgs(aligned, target.extentSize)
+	if err != nil {
+		return err
+	}
+	args := append(append(append([]string{"-Zn"}, sizeArgs...), tagArgs...), lvm.deviceLVCreateArgs()...)
+	args = append(args, "-n", tmpName, targetVG)
+	if output, err := lvm.runCommand(ctx, "lvcreate", args...); err != nil {
+		return fmt.Errorf("MigrateDevice: Failed: lvcreate in volume group %s: %w(output: %s)", targetVG, err, output)
+	}
+	if lvm.dryRun {
+		return nil
+	}
+	copied, err := lvm.copyDevice(ctx, device, tmpName, targetVG)
+	if err != nil {
+		lvm.removeMigrationCopy(ctx, copied, tmpName, targetVG)
+		return err
+	}
+	// the data must not linger in the old group
+	if err := lvm.deleteDevice(ctx, device, true, false); err != nil {
+		lvm.removeMigrationCopy(ctx, copied, tmpName, targetVG)
+		return fmt.Errorf("MigrateDevice: Failed: deleting '%s' in volume group %s after copying it: %w", name, sourceVG, err)
+	}
+	if _, err := lvm.runCommand(ctx, "lvrename", targetVG, tmpName, name); err != nil {
+		// the data is safe in the copy, which can be renamed manually
+		return fmt.Errorf("MigrateDevice: Failed: renaming copy '%s' of '%s': %w", tmpName, name, err)
+	}
+	migrated, err := lvm.getUncachedDevice(ctx, name, targetVG)
+	if err != nil {
+		return err
+	}
+	lvm.devices[name] = migrated
+	lvm.logger(ctx).V(3).Info("Migrated device", "device", name, "from", sourceVG, "to", targetVG)
+
+	return nil
+}
+
+// copyDevice copies the data of device into the logical volume tmpName in targetVG
+// and returns that volume, also when copying failed
+func (lvm *pmemLvm) copyDevice(ctx context.Context, device PmemDeviceInfo, tmpName, targetVG string) (PmemDeviceInfo, error) {
+	copied, err := lvm.getUncachedDevice(ctx, tmpName, targetVG)
+	if err != nil {
+		return PmemDeviceInfo{}, err
+	}
+	if err := WaitDeviceAppears(ctx, copied); err != nil {
+		return copied, err
+	}
+	lvm.logger(ctx).V(4).Info("Copying device", "device", device.Name, "from", device.Path, "to", copied.Path, "size", device.Size)
+	// copying takes as long as erasing an entire device
+	if output, err := runCommand(ctx, lvm.wrappedRunner(), lvm.timeouts.shred, "dd", "if="+device.Path, "of="+copied.Path, "bs=1M", "conv=fsync"); err != nil {
+		return copied, fmt.Errorf("MigrateDevice: Failed: copying '%s': %w(dd output: %s)", device.Name, err, output)
+	}
+	return copied, nil
+}
+
+// removeMigrationCopy erases and removes the copy of a failed migration. When it
+// was not found after lvcreate, it only gets removed.
+func (lvm *pmemLvm) removeMigrationCopy(ctx context.Context, copied PmemDeviceInfo, tmpName, targetVG string) {
+	var err error
+	if copied.Path != "" {
+		err = lvm.deleteDevice(ctx, copied, true, false)
+	} else {
+		_, err = lvm.runCommand(ctx, "lvremove", "-fy", targetVG+"/"+tmpName)
+	}
+	if err != nil {
+		lvm.logger(ctx).Error(err, "Failed to remove copy after failed migration", "device", tmpName, "vg", targetVG)
+	}
+}
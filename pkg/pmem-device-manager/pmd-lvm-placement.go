@@ -0,0 +1,93 @@
+package pmdmanager
+
+import (
+	"context"
+	"fmt"
+)
+
+// CreateDeviceOnPVs creates a device like CreateDevice, but only allocates it on the given
+// physical volumes, for example /dev/pmem0.1, to isolate it from devices on the other
+// namespaces of the region. All of them must be in the same managed volume group for
+// namespaces in nsmode and together have enough free space. Thin volumes are not supported,
+// their data is in the thin pool.
+func (lvm *pmemLvm) CreateDeviceOnPVs(ctx context.Context, name string, size uint64, nsmode string, pvNames []string) (err error) {
+	defer func() { lvm.metrics.operationDone("create", err) }()
+	if nsmode, err = lvmNamespaceMode(nsmode); err != nil {
+		return err
+	}
+	if len(pvNames) == 0 {
+		return fmt.Errorf("CreateDevice: Failed: no physical volumes given for '%s'", name)
+	}
+	if lvm.thinPool {
+		return fmt.Errorf("CreateDevice: Failed: placing thin volume '%s' on physical volumes is not supported", name)
+	}
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+	if err := lvm.checkNewDevice(ctx, name); err != nil {
+		return err
+	}
+
+	vgs, err := lvm.getVolumeGroups(ctx, lvm.volumeGroups, nsmode)
+	if err != nil {
+		return err
+	}
+	pvs, err := lvm.getPhysicalVolumes(ctx, vgNames(vgs))
+	if err != nil {
+		return err
+	}
+	vgname, free, err := placementGroup(pvs, pvNames, nsmode)
+	if err != nil {
+		return err
+	}
+	var vg vgInfo
+	for _, v := range vgs {
+		if v.name == vgname {
+			vg = v
+		}
+	}
+	if err := validateSize([]vgInfo{vg}, name, size, true); err != nil {
+		return err
+	}
+	aligned := roundToExtent(size, vg.extentSize)
+	if free < aligned {
+		return fmt.Errorf("CreateDevice: Failed: physical volumes %v have %v free, '%s' needs %v: %w",
+			pvNames, free, name, aligned, ErrNotEnoughSpace)
+	}
+
+	sizeArgs, err := lvm.lvcreateSizeArgs(aligned, vg.extentSize)
+	if err != nil {
+		return err
+	}
+	// see createDeviceRemaining for -Zn
+	args := append(append(append([]string{"-Zn"}, sizeArgs...), lvm.incompleteTagArgs(nil)...), lvm.deviceLVCreateArgs()...)
+	args = append(append(args, "-n", name, vg.name), pvNames...)
+	if output, err := lvm.runCommand(ctx, "lvcreate", args...); err != nil {
+		return fmt.Errorf("CreateDevice: Failed: lvcreate on physical volumes %v: %w(output: %s)", pvNames, err, output)
+	}
+	return lvm.setupNewDevice(ctx, name, size, vg.name, CreateOptions{})
+}
+
+// placementGroup returns the volume group holding all of the physical volumes pvNames
+// and their free space in total
+func placementGroup(pvs []pvInfo, pvNames []string, nsmode string) (string, uint64, error) {
+	vgname := ""
+	var free uint64
+	for _, pvName := range pvNames {
+		found := false
+		for _, pv := range pvs {
+			if pv.name != pvName {
+				continue
+			}
+			if vgname != "" && vgname != pv.vg {
+				return "", 0, fmt.Errorf("physical volumes %v are in volume groups %s and %s", pvNames, vgname, pv.vg)
+			}
+			vgname = pv.vg
+			free += pv.free
+			found = true
+		}
+		if !found {
+			return "", 0, fmt.Errorf("physical volume %s is not in a managed volume group for %s namespaces", pvName, nsmode)
+		}
+	}
+	return vgname, free, nil
+}
@@ -0,0 +1,181 @@
+package pmdmanager
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// validatePools rejects unnamed pools and volume groups which belong to more than one pool
+func validatePools(pools map[string][]string) error {
+	owners := map[string]string{}
+	for pool, groups := range pools {
+		if pool == "" {
+			return fmt.Errorf("pool without name")
+		}
+		for _, vg := range groups {
+			if owner, ok := owners[vg]; ok && owner != pool {
+				return fmt.Errorf("volume group %s is in pools %s and %s", vg, owner, pool)
+			}
+			owners[vg] = pool
+		}
+	}
+	return nil
+}
+
+// validatePoolSerials rejects unnamed pools and serials which belong to more than one pool
+func validatePoolSerials(poolSerials map[string][]string) error {
+	owners := map[string]string{}
+	for pool, serials := range poolSerials {
+		if pool == "" {
+			return fmt.Errorf("pool without name")
+		}
+		for _, serial := range serials {
+			serial = strings.ToLower(serial)
+			if owner, ok := owners[serial]; ok && owner != pool {
+				return fmt.Errorf("DIMM serial %s is in pools %s and %s", serial, owner, pool)
+			}
+			owners[serial] = pool
+		}
+	}
+	return nil
+}
+
+// poolErasePoliciesWithDefaults validates LVMConfig.PoolErasePolicies, which may only name
+// pools of Pools or PoolSerials, and fills in their unset fields
+func poolErasePoliciesWithDefaults(cfg LVMConfig) (map[string]ErasePolicy, error) {
+	policies := map[string]ErasePolicy{}
+	for pool, policy := range cfg.PoolErasePolicies {
+		_, inPools := cfg.Pools[pool]
+		_, inSerials := cfg.PoolSerials[pool]
+		if !inPools && !inSerials {
+			return nil, fmt.Errorf("erase policy for unknown pool %s", pool)
+		}
+		policy, err := policy.withDefaults()
+		if err != nil {
+			return nil, fmt.Errorf("erase policy of pool %s: %w", pool, err)
+		}
+		policies[pool] = policy
+	}
+	return policies, nil
+}
+
+func copyPools(pools map[string][]string) map[string][]string {
+	result := map[string][]string{}
+	for pool, groups := range pools {
+		result[pool] = append([]string{}, groups...)
+	}
+	return result
+}
+
+// addSerialPools adds the volume groups of the regions on the DIMMs of LVMConfig.PoolSerials
+// to their pools. A region interleaved across DIMMs of different pools, or a group which then
+// is in two pools, gets rejected.
+func (lvm *pmemLvm) addSerialPools(regions []RegionInfo) error {
+	if len(lvm.poolSerials) == 0 {
+		return nil
+	}
+	serialPools := map[string]string{}
+	for pool, serials := range lvm.poolSerials {
+		for _, serial := range serials {
+			serialPools[strings.ToLower(serial)] = pool
+		}
+	}
+	pools := copyPools(lvm.pools)
+	for pool := range lvm.poolSerials {
+		// known even when none of its DIMMs are on this node
+		if _, ok := pools[pool]; !ok {
+			pools[pool] = []string{}
+		}
+	}
+	for _, r := range regions {
+		pool := ""
+		for _, serial := range r.DimmSerials {
+			p, ok := serialPools[strings.ToLower(serial)]
+			if !ok {
+				continue
+			}
+			if pool != "" && pool != p {
+				return fmt.Errorf("region %s is on DIMMs of pools %s and %s", r.Region, pool, p)
+			}
+			pool = p
+		}
+		if pool == "" {
+			continue
+		}
+		for _, nsmode := range lvmNamespaceModes {
+			pools[pool] = append(pools[pool], r.VolumeGroups[string(nsmode)])
+		}
+		lvm.log.V(4).Info("Region assigned to pool by DIMM serial", "region", r.Region, "pool", pool)
+	}
+	if err := validatePools(pools); err != nil {
+		return err
+	}
+	lvm.pools = pools
+	return nil
+}
+
+// poolOf returns the pool the volume group belongs to, empty when it is in none
+func (lvm *pmemLvm) poolOf(vg string) string {
+	for pool, groups := range lvm.pools {
+		for _, group := range groups {
+			if group == vg {
+				return pool
+			}
+		}
+	}
+	return ""
+}
+
+// poolGroups returns the managed volume groups of the pool
+func (lvm *pmemLvm) poolGroups(pool string) ([]string, error) {
+	members, ok := lvm.pools[pool]
+	if !ok {
+		return nil, fmt.Errorf("unknown pool %s", pool)
+	}
+	inPool := map[string]bool{}
+	for _, vg := range members {
+		inPool[vg] = true
+	}
+	groups := []string{}
+	for _, vg := range lvm.volumeGroups {
+		if inPool[vg] {
+			groups = append(groups, vg)
+		}
+	}
+	return groups, nil
+}
+
+// CreateDeviceInPool creates a device like CreateDevice, but only in the volume groups of the pool
+func (lvm *pmemLvm) CreateDeviceInPool(ctx context.Context, pool string, name string, size uint64, nsmode string) (err error) {
+	defer func() { lvm.metrics.operationDone("create", err) }()
+	if nsmode, err = lvmNamespaceMode(nsmode); err != nil {
+		return err
+	}
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+	groups, err := lvm.poolGroups(pool)
+	if err != nil {
+		return err
+	}
+	if err := lvm.checkNewDevice(ctx, name); err != nil {
+		return err
+	}
+	_, err = lvm.createDeviceRemaining(ctx, groups, name, size, nsmode, noNumaNode, nil, CreateOptions{})
+	return err
+}
+
+// GetPoolCapacity is GetCapacity limited to the volume groups of the pool
+func (lvm *pmemLvm) GetPoolCapacity(ctx context.Context, pool string) (map[string]uint64, error) {
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+	groups, err := lvm.poolGroups(pool)
+	if err != nil {
+		return nil, err
+	}
+	if len(groups) == 0 {
+		// none of the groups exist on this node
+		return map[string]uint64{}, nil
+	}
+	return lvm.getCapacityOf(ctx, groups)
+}
@@ -0,0 +1,64 @@
+package pmdmanager
+
+import (
+	"context"
+	"fmt"
+)
+
+// CreateDeviceRange creates a device of at least minSize and at most maxSize bytes, like
+// the required and limit bytes of a CSI capacity range, and returns it with the size that
+// got allocated. It grows the device toward maxSize as far as the free space of a single
+// volume group allows. maxSize 0 means minSize. Thin volumes always get minSize because
+// they only allocate what gets written.
+func (lvm *pmemLvm) CreateDeviceRange(ctx context.Context, name string, minSize, maxSize uint64, nsmode string) (dev PmemDeviceInfo, err error) {
+	defer func() { lvm.metrics.operationDone("create", err) }()
+	if maxSize == 0 {
+		maxSize = minSize
+	}
+	if maxSize < minSize {
+		return PmemDeviceInfo{}, fmt.Errorf("CreateDevice: Failed: maximum size(%v) of '%s' is smaller than minimum size(%v)", maxSize, name, minSize)
+	}
+	if nsmode, err = lvmNamespaceMode(nsmode); err != nil {
+		return PmemDeviceInfo{}, err
+	}
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+	if err := lvm.checkNewDevice(ctx, name); err != nil {
+		return PmemDeviceInfo{}, err
+	}
+	size := minSize
+	if !lvm.thinPool && maxSize > minSize {
+		vgs, err := lvm.getVolumeGroups(ctx, lvm.volumeGroups, nsmode)
+		if err != nil {
+			return PmemDeviceInfo{}, err
+		}
+		size = rangeSize(vgs, minSize, maxSize)
+	}
+	if _, err := lvm.createDeviceRemaining(ctx, lvm.volumeGroups, name, size, nsmode, noNumaNode, nil, CreateOptions{}); err != nil {
+		return PmemDeviceInfo{}, err
+	}
+	if lvm.dryRun {
+		return PmemDeviceInfo{Name: name, Size: size}, nil
+	}
+	// setupNewDevice recorded the result of lvs
+	return lvm.getDevice(name)
+}
+
+// rangeSize returns the largest size of at most maxSize which fits into one of vgs without
+// rounding it up beyond maxSize, or minSize when none has space for more
+func rangeSize(vgs []vgInfo, minSize, maxSize uint64) uint64 {
+	size := minSize
+	for _, vg := range vgs {
+		fits := maxSize
+		if vg.free < fits {
+			fits = vg.free
+		}
+		if vg.extentSize != 0 {
+			fits -= fits % vg.extentSize
+		}
+		if fits > size {
+			size = fits
+		}
+	}
+	return size
+}
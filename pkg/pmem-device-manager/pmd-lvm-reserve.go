@@ -0,0 +1,143 @@
+package pmdmanager
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// defaultReservationTTL how long a reservation lasts when it does not get released
+const defaultReservationTTL = 5 * time.Minute
+
+// ReservationToken identifies a reservation made with Reserve
+type ReservationToken string
+
+// reservations is the in-memory ledger of Reserve, protected by devicemutex
+type reservations struct {
+	ttl     time.Duration
+	next    uint64
+	entries map[ReservationToken]reservation
+	// now replaces time.Now in tests
+	now func() time.Time
+}
+
+type reservation struct {
+	size    uint64
+	expires time.Time
+}
+
+func newReservations(ttl time.Duration) *reservations {
+	return &reservations{ttl: ttl, entries: map[ReservationToken]reservation{}, now: time.Now}
+}
+
+// reserved returns the size of all reservations which have not expired yet and drops the others
+func (r *reservations) reserved() uint64 {
+	now := r.now()
+	var total uint64
+	for token, entry := range r.entries {
+		if !now.Before(entry.expires) {
+			delete(r.entries, token)
+			continue
+		}
+		total += entry.size
+	}
+	return total
+}
+
+// add records a new reservation of size
+func (r *reservations) add(size uint64) ReservationToken {
+	r.next++
+	token := ReservationToken(fmt.Sprintf("reservation-%d", r.next))
+	r.entries[token] = reservation{size: size, expires: r.now().Add(r.ttl)}
+	return token
+}
+
+// deduct reduces each capacity returned by getCapacity by the reserved space
+func (r *reservations) deduct(capacity map[string]uint64) {
+	reserved := r.reserved()
+	for nsmode, free := range capacity {
+		if free > reserved {
+			capacity[nsmode] = free - reserved
+		} else {
+			capacity[nsmode] = 0
+		}
+	}
+}
+
+// Reserve sets aside size bytes for a device which is going to be created later, so that
+// GetCapacity stops reporting that space to others which plan their devices based on it.
+// It fails with ErrNotEnoughSpace when GetCapacity, which already deducts the existing
+// reservations, reports less than size for all namespace modes. The reservation gets released with Release, typically after
+// creating the device, or expires after LVMConfig.ReservationTTL. Reservations are only
+// kept in memory and do not limit CreateDevice.
+func (lvm *pmemLvm) Reserve(ctx context.Context, size uint64) (ReservationToken, error) {
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+
+	if size == 0 {
+		return "", fmt.Errorf("Reserve: Failed: size is zero: %w", ErrInvalidSize)
+	}
+	capacity, err := lvm.getCapacity(ctx)
+	if err != nil {
+		return "", err
+	}
+	lvm.reservations.deduct(capacity)
+	var free uint64
+	for _, c := range capacity {
+		if c > free {
+			free = c
+		}
+	}
+	if free < size {
+		return "", fmt.Errorf("Reserve: Failed: %v unreserved, required(%v): %w", free, size, ErrNotEnoughSpace)
+	}
+	token := lvm.reservations.add(size)
+	lvm.logger(ctx).V(4).Info("Reserved capacity", "token", token, "size", size)
+	return token, nil
+}
+
+// Release gives back the space of a reservation. Releasing an unknown or expired
+// reservation does nothing.
+func (lvm *pmemLvm) Release(token ReservationToken) {
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+
+	delete(lvm.reservations.entries, token)
+}
+
+// GetDeployableCapacity returns a conservative size of the largest device which can still be
+// deployed: the largest capacity of GetCapacity, which already deducts the reservations of
+// Reserve, minus the sizes of devices whose creation has not finished according to
+// LVMConfig.MarkIncomplete. Those are either still being set up or orphans of aborted
+// creates, which may get deleted and created again. As linear ones already hold their
+// space, their size may be deducted twice, so the result errs on the low side.
+func (lvm *pmemLvm) GetDeployableCapacity(ctx context.Context) (uint64, error) {
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+
+	capacity, err := lvm.getCapacity(ctx)
+	if err != nil {
+		return 0, err
+	}
+	lvm.reservations.deduct(capacity)
+	var free uint64
+	for _, c := range capacity {
+		if c > free {
+			free = c
+		}
+	}
+	if !lvm.markIncomplete {
+		return free, nil
+	}
+	incomplete, err := lvm.listIncomplete(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, dev := range incomplete {
+		if dev.Size >= free {
+			return 0, nil
+		}
+		free -= dev.Size
+	}
+	return free, nil
+}
@@ -0,0 +1,98 @@
+package pmdmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// selfTestDevice is the name of the logical volume created by SelfTest
+const selfTestDevice = "pmem-csi-selftest"
+
+// SelfTest creates a device of one extent in LVMConfig.SelfTestVolumeGroup, checks that lvs
+// lists it with that size, erases it like FlushDeviceData and deletes it again. It runs the
+// real LVM tools for all of that and thus validates them, for example when the driver
+// starts. A device left behind by an interrupted self test gets deleted first. SelfTest
+// must be enabled with LVMConfig.EnableSelfTest and is not supported in dry run mode.
+func (lvm *pmemLvm) SelfTest(ctx context.Context) error {
+	if !lvm.selfTest {
+		return errors.New("SelfTest: not enabled")
+	}
+	if lvm.dryRun {
+		return errors.New("SelfTest: not supported in dry run mode")
+	}
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+
+	vg := lvm.selfTestVolumeGroup
+	log := lvm.logger(ctx).WithValues("vg", vg, "device", selfTestDevice)
+	if err := lvm.removeSelfTestDevice(ctx, vg); err != nil {
+		return fmt.Errorf("SelfTest: removing old device: %w", err)
+	}
+	vgs, err := lvm.getVolumeGroups(ctx, []string{vg}, "")
+	if err != nil {
+		return fmt.Errorf("SelfTest: %w", err)
+	}
+	if len(vgs) == 0 {
+		return fmt.Errorf("SelfTest: volume group %s: %w", vg, ErrNoVolumeGroups)
+	}
+	size := vgs[0].extentSize
+	if size == 0 {
+		size = 4 << 20
+	}
+	log.V(3).Info("Self test: creating device", "size", size)
+	if _, err := lvm.createDeviceRemaining(ctx, []string{vg}, selfTestDevice, size, "", noNumaNode, nil, CreateOptions{}); err != nil {
+		return fmt.Errorf("SelfTest: create: %w", err)
+	}
+	if err := lvm.checkSelfTestDevice(ctx, vg, size); err != nil {
+		if cleanupErr := lvm.removeSelfTestDevice(ctx, vg); cleanupErr != nil {
+			log.Error(cleanupErr, "Self test: removing device failed")
+		}
+		return err
+	}
+	log.V(3).Info("Self test: deleting device")
+	if err := lvm.removeSelfTestDevice(ctx, vg); err != nil {
+		return fmt.Errorf("SelfTest: delete: %w", err)
+	}
+	devices, err := lvm.listDevices(ctx, vg)
+	if err != nil {
+		return fmt.Errorf("SelfTest: list after delete: %w", err)
+	}
+	if _, ok := devices[selfTestDevice]; ok {
+		return errors.New("SelfTest: device still listed after delete")
+	}
+	log.V(2).Info("Self test passed")
+	return nil
+}
+
+// checkSelfTestDevice verifies that lvs lists the device of SelfTest with given size
+// and that it can be erased
+func (lvm *pmemLvm) checkSelfTestDevice(ctx context.Context, vg string, size uint64) error {
+	devices, err := lvm.listDevices(ctx, vg)
+	if err != nil {
+		return fmt.Errorf("SelfTest: list: %w", err)
+	}
+	dev, ok := devices[selfTestDevice]
+	if !ok {
+		return fmt.Errorf("SelfTest: created device not listed: %w", ErrDeviceNotFound)
+	}
+	if dev.Size != size {
+		return fmt.Errorf("SelfTest: created device has size %v instead of %v", dev.Size, size)
+	}
+	if err := clearDevice(ctx, dev, true, lvm.flushConfig()); err != nil {
+		return fmt.Errorf("SelfTest: flush: %w", err)
+	}
+	return nil
+}
+
+// removeSelfTestDevice deletes the device of SelfTest if it exists, without erasing it
+func (lvm *pmemLvm) removeSelfTestDevice(ctx context.Context, vg string) error {
+	dev, err := lvm.getUncachedDevice(ctx, selfTestDevice, vg)
+	if errors.Is(err, ErrDeviceNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return lvm.deleteDevice(ctx, dev, false, true)
+}
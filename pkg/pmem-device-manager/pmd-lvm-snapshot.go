@@ -0,0 +1,100 @@
+package pmdmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// CreateSnapshot creates a copy-on-write snapshot snapName of the device sourceName in
+// its volume group. size is the space reserved for changes of the origin or the
+// snapshot, 0 reserves the size of the origin, so that the snapshot cannot overflow.
+// Snapshots of thin volumes share the thin pool with their origin, size is ignored for them.
+func (lvm *pmemLvm) CreateSnapshot(ctx context.Context, sourceName, snapName string, size uint64) (err error) {
+	defer func() { lvm.metrics.operationDone("snapshot", err) }()
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+
+	origin, err := lvm.getDevice(sourceName)
+	if err != nil {
+		return fmt.Errorf("CreateSnapshot: Failed: origin: %w", err)
+	}
+	if origin.IsSnapshot() {
+		return fmt.Errorf("CreateSnapshot: Failed: '%s' is a snapshot itself", sourceName)
+	}
+	if err := lvm.checkNewDevice(ctx, snapName); err != nil {
+		return err
+	}
+	vgName := deviceVolumeGroup(origin)
+	thin, err := lvm.isThinVolume(ctx, origin)
+	if err != nil {
+		return fmt.Errorf("CreateSnapshot: Failed: origin: %w", err)
+	}
+	args := []string{"-s"}
+	var aligned uint64
+	if !thin {
+		// the space for changes comes out of the free space of the volume group
+		if size == 0 {
+			size = origin.Size
+		}
+		vgs, err := lvm.getVolumeGroups(ctx, []string{vgName}, "")
+		if err != nil {
+			return err
+		}
+		if len(vgs) == 0 {
+			return fmt.Errorf("CreateSnapshot: Failed: volume group %s of '%s' not found", vgName, sourceName)
+		}
+		vg := vgs[0]
+		aligned = roundToExtent(size, vg.extentSize)
+		if vg.free < aligned {
+			return fmt.Errorf("CreateSnapshot: Failed: volume group %s has %v free, snapshot '%s' needs %v: %w",
+				vgName, vg.free, snapName, aligned, ErrNotEnoughSpace)
+		}
+		sizeArgs, err := lvm.lvcreateSizeArgs(aligned, vg.extentSize)
+		if err != nil {
+			return err
+		}
+		args = append(args, sizeArgs...)
+	}
+	args = append(args, "-n", snapName, vgName+"/"+sourceName)
+	if output, err := lvm.runCommand(ctx, "lvcreate", args...); err != nil {
+		return fmt.Errorf("CreateSnapshot: Failed: lvcreate of '%s': %w(output: %s)", snapName, err, output)
+	}
+	if lvm.dryRun {
+		return nil
+	}
+	snapshot, err := lvm.getUncachedDevice(ctx, snapName, vgName)
+	if err != nil {
+		return err
+	}
+	lvm.devices[snapName] = snapshot
+	lvm.logger(ctx).V(3).Info("Created snapshot", "snapshot", snapName, "origin", sourceName, "size", aligned, "thin", thin)
+
+	return nil
+}
+
+// DeleteSnapshot removes a snapshot created by CreateSnapshot. The snapshot only holds
+// the changes of its origin, so it does not get erased. Devices which are no snapshot
+// are refused, they have to be deleted with DeleteDevice. Like DeleteDevice, it refuses
+// snapshots in use and counts missing ones as deleted.
+func (lvm *pmemLvm) DeleteSnapshot(ctx context.Context, name string) (err error) {
+	defer func() { lvm.metrics.operationDone("delete", err) }()
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+
+	snapshot, err := lvm.lookupDevice(ctx, name)
+	if errors.Is(err, ErrDeviceNotFound) {
+		lvm.logger(ctx).V(3).Info("Snapshot already deleted", "snapshot", name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !snapshot.IsSnapshot() {
+		return fmt.Errorf("DeleteSnapshot: Failed: '%s' is no snapshot", name)
+	}
+	if err := lvm.checkUnused(snapshot); err != nil {
+		return err
+	}
+	return lvm.removeDevice(ctx, snapshot, false, 0)
+}
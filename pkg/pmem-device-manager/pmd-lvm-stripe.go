@@ -0,0 +1,156 @@
+package pmdmanager
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// stripeSize is the amount of data in KiB written to one physical volume before moving to the next one
+const stripeSize = 64
+
+var pvsArgs = []string{"--noheadings", "--nosuffix", "--separator", lvsSeparator, "-o", "vg_name,pv_name,pv_free", "--units", "B"}
+
+// pvInfo describes one physical volume, i.e. one namespace, of a volume group
+type pvInfo struct {
+	vg   string
+	name string
+	free uint64
+}
+
+// CreateStripedDevice creates a device striped over stripes physical volumes.
+// Each volume group corresponds to one region and its physical volumes are the
+// namespaces in that region, so striping spreads the device over those namespaces.
+// When no volume group has enough physical volumes with enough free space,
+// a linear device gets created as with CreateDevice.
+func (lvm *pmemLvm) CreateStripedDevice(ctx context.Context, name string, size uint64, nsmode string, stripes int) (err error) {
+	defer func() { lvm.metrics.operationDone("create", err) }()
+	if nsmode, err = lvmNamespaceMode(nsmode); err != nil {
+		return err
+	}
+	if stripes < 1 {
+		return fmt.Errorf("Invalid number of stripes(%d)", stripes)
+	}
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+	if err := lvm.checkNewDevice(ctx, name); err != nil {
+		return err
+	}
+	if stripes == 1 || lvm.thinPool {
+		return lvm.createDevice(ctx, name, size, nsmode, noNumaNode)
+	}
+
+	vgs, err := lvm.getVolumeGroups(ctx, lvm.volumeGroups, nsmode)
+	if err != nil {
+		return err
+	}
+	if err := validateSize(vgs, name, size, true); err != nil {
+		return err
+	}
+	pvs, err := lvm.getPhysicalVolumes(ctx, vgNames(vgs))
+	if err != nil {
+		return err
+	}
+	for _, vg := range stripeCandidates(candidateVolumeGroups(vgs, size, lvm.allocStrategy), pvs, size, stripes) {
+		// each stripe consists of full extents
+		sizeArgs, err := lvm.lvcreateSizeArgs(roundToExtent(size, vg.extentSize*uint64(stripes)), vg.extentSize)
+		if err != nil {
+			return err
+		}
+		if _, err := lvm.runCommand(ctx, "lvcreate", stripedArgs(name, sizeArgs, vg.name, stripes, append(lvm.incompleteTagArgs(nil), lvm.deviceLVCreateArgs()...))...); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			lvm.logger(ctx).V(3).Info("striped lvcreate failed, trying next free region",
+				"device", name, "size", size, "stripes", stripes, "vg", vg.name, "error", err)
+		} else {
+			return lvm.setupNewDevice(ctx, name, size, vg.name, CreateOptions{})
+		}
+	}
+	lvm.logger(ctx).V(3).Info("No region can stripe device, creating linear device", "device", name, "size", size, "stripes", stripes)
+	return lvm.createDevice(ctx, name, size, nsmode, noNumaNode)
+}
+
+// stripedArgs returns the lvcreate arguments for a striped device
+func stripedArgs(name string, sizeArgs []string, vg string, stripes int, extraArgs []string) []string {
+	// see CreateDevice for -Zn
+	args := append(append([]string{"-Zn", "-i", strconv.Itoa(stripes), "-I", strconv.Itoa(stripeSize)}, sizeArgs...), extraArgs...)
+	return append(args, "-n", name, vg)
+}
+
+// stripeCandidates filters volume groups which have at least stripes physical volumes
+// with enough free space for their part of the device
+func stripeCandidates(vgs []vgInfo, pvs []pvInfo, size uint64, stripes int) []vgInfo {
+	// round up, lvcreate does the same with the extents of each stripe
+	stripeBytes := (size + uint64(stripes) - 1) / uint64(stripes)
+	usable := map[string]int{}
+	for _, pv := range pvs {
+		if pv.free >= stripeBytes {
+			usable[pv.vg]++
+		}
+	}
+	result := []vgInfo{}
+	for _, vg := range vgs {
+		if usable[vg.name] >= stripes {
+			result = append(result, vg)
+		}
+	}
+	return result
+}
+
+// vgSelection selects the physical volumes of given volume groups for pvs, whose
+// positional arguments can only be physical volumes
+func vgSelection(volumeGroups []string) string {
+	selection := make([]string, len(volumeGroups))
+	for i, vg := range volumeGroups {
+		selection[i] = "vg_name=" + vg
+	}
+	return strings.Join(selection, "||")
+}
+
+// pvsSelectArgs adds the selection of the volume groups to pvs arguments. LVM versions
+// without selection list all physical volumes, the caller has to filter them.
+func (lvm *pmemLvm) pvsSelectArgs(args []string, volumeGroups []string) []string {
+	args = append([]string{}, args...)
+	if lvm.noSelection {
+		return args
+	}
+	return append(args, "-S", vgSelection(volumeGroups))
+}
+
+// getPhysicalVolumes lists the physical volumes of given volume groups
+func (lvm *pmemLvm) getPhysicalVolumes(ctx context.Context, volumeGroups []string) ([]pvInfo, error) {
+	pvs := []pvInfo{}
+	if len(volumeGroups) == 0 {
+		return pvs, nil
+	}
+	wanted := map[string]bool{}
+	for _, vg := range volumeGroups {
+		wanted[vg] = true
+	}
+	output, err := lvm.runCommand(ctx, "pvs", lvm.pvsSelectArgs(pvsArgs, volumeGroups)...)
+	if err != nil {
+		return nil, fmt.Errorf("list physical volumes failed : %w(pvs output: %s)", err, output)
+	}
+	for _, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Split(line, lvsSeparator)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("Failed to parse pvs output line: %q", line)
+		}
+		free, err := parseBytes(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse free space in pvs output line %q: %w", line, err)
+		}
+		pv := pvInfo{vg: strings.TrimSpace(fields[0]), name: strings.TrimSpace(fields[1]), free: free}
+		if !wanted[pv.vg] {
+			// without selection, or a physical volume without group
+			continue
+		}
+		pvs = append(pvs, pv)
+	}
+	return pvs, nil
+}
@@ -0,0 +1,85 @@
+package pmdmanager
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// maxLVTagLength is the maximum length of an LVM tag
+const maxLVTagLength = 1024
+
+// lvTagSeparator separates key and value in the tags of pmem-csi, see lvTagArgs
+const lvTagSeparator = "="
+
+// EphemeralTag marks the devices of short-lived volumes, like CSI ephemeral inline volumes,
+// when CreateDeviceWithTags gets it with value "true". Deleting such a device neither
+// erases nor clears it, whatever the erase policy, so their data may show up in later
+// devices unless LVMConfig.ZeroOnCreate is set.
+const EphemeralTag = "pmem-csi.ephemeral"
+
+// isEphemeral checks whether the device carries EphemeralTag
+func isEphemeral(device PmemDeviceInfo) bool {
+	return device.Tags[EphemeralTag] == "true"
+}
+
+// lvTagArgs turns key/value pairs into lvcreate arguments adding one "key=value" tag each.
+// LVM allows only A-Z a-z 0-9 _ + . - / = ! : & # in tags, = not being allowed in keys,
+// and tags must not start with a hyphen.
+func lvTagArgs(tags map[string]string) ([]string, error) {
+	keys := []string{}
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	// stable command lines
+	sort.Strings(keys)
+	args := []string{}
+	for _, key := range keys {
+		value := tags[key]
+		if key == "" || strings.HasPrefix(key, "-") {
+			return nil, fmt.Errorf("invalid tag key %q", key)
+		}
+		if c, ok := invalidLVTagChar(key, false); ok {
+			return nil, fmt.Errorf("tag key %q contains %q", key, c)
+		}
+		if c, ok := invalidLVTagChar(value, true); ok {
+			return nil, fmt.Errorf("value of tag %q contains %q", key, c)
+		}
+		tag := key + lvTagSeparator + value
+		if len(tag) > maxLVTagLength {
+			return nil, fmt.Errorf("tag %q longer than %d characters", key, maxLVTagLength)
+		}
+		args = append(args, "--addtag", tag)
+	}
+	return args, nil
+}
+
+// invalidLVTagChar returns the first character of s which is not allowed in LVM tags
+func invalidLVTagChar(s string, allowSeparator bool) (rune, bool) {
+	for _, c := range s {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("_+.-/!:&#", c) {
+			continue
+		}
+		if allowSeparator && string(c) == lvTagSeparator {
+			continue
+		}
+		return c, true
+	}
+	return 0, false
+}
+
+// parseLVTags parses the lv_tags field of lvs. Tags which are not key/value pairs are ignored.
+func parseLVTags(field string) map[string]string {
+	var tags map[string]string
+	for _, tag := range strings.Split(field, ",") {
+		parts := strings.SplitN(tag, lvTagSeparator, 2)
+		if len(parts) != 2 || parts[0] == "" {
+			continue
+		}
+		if tags == nil {
+			tags = map[string]string{}
+		}
+		tags[parts[0]] = parts[1]
+	}
+	return tags
+}
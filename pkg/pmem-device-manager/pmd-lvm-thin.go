@@ -0,0 +1,359 @@
+package pmdmanager
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// thinPoolName is the name of the thin pool logical volume in each volume group
+const thinPoolName = "thinpool"
+
+// thinPoolInfo describes the thin pool of one volume group
+type thinPoolInfo struct {
+	vg string
+	// size of the pool data volume in bytes
+	size uint64
+	// dataPercent is the used part of the pool data volume
+	dataPercent float64
+	// metadataPercent is the used part of the pool metadata volume
+	metadataPercent float64
+}
+
+// thinMetadataFullPercent is the metadata usage at which a pool cannot take new volumes,
+// LVM switches it to read-only then
+const thinMetadataFullPercent = 100
+
+// thinMetadataWarnPercent is the metadata usage from which on GetCapacity and
+// HealthCheck warn about the pool
+const thinMetadataWarnPercent = 80
+
+// metadataFull checks whether the pool ran out of metadata space
+func (p thinPoolInfo) metadataFull() bool {
+	return p.metadataPercent >= thinMetadataFullPercent
+}
+
+// free returns the unused pool data space in bytes, none when the metadata is full
+func (p thinPoolInfo) free() uint64 {
+	if p.dataPercent >= 100 || p.metadataFull() {
+		return 0
+	}
+	return uint64(float64(p.size) * (100 - p.dataPercent) / 100)
+}
+
+// thinPoolArgs lists the thin pools, see lvsSelectArgs for the selection
+var thinPoolArgs = []string{"--noheadings", "--nosuffix", "--separator", lvsSeparator, "-o", "vg_name,lv_size,data_percent,metadata_percent,lv_name", "--units", "B"}
+
+// lvsSelectArgs adds a selection to lvs arguments, except for LVM versions without
+// selection. Those list all volumes and the caller has to filter them.
+func (lvm *pmemLvm) lvsSelectArgs(args []string, selection string) []string {
+	args = append([]string{}, args...)
+	if lvm.noSelection {
+		return args
+	}
+	return append(args, "-S", selection)
+}
+
+// ensureThinPools creates the thin pool in all volume groups which do not have one yet,
+// using all of the free space of the group
+func (lvm *pmemLvm) ensureThinPools(ctx context.Context) error {
+	pools, err := lvm.getThinPools(ctx, lvm.volumeGroups)
+	if err != nil {
+		return err
+	}
+	for _, vg := range lvm.volumeGroups {
+		if _, ok := pools[vg]; ok {
+			continue
+		}
+		lvm.logger(ctx).V(3).Info("Creating thin pool", "vg", vg, "pool", thinPoolName)
+		if output, err := lvm.runCommand(ctx, "lvcreate", "--type", "thin-pool", "-l", "100%FREE", "-n", thinPoolName, vg); err != nil {
+			return fmt.Errorf("creating thin pool in volume group %s failed: %w(lvcreate output: %s)", vg, err, output)
+		}
+	}
+	return nil
+}
+
+// getThinPools returns the thin pools of given volume groups, indexed by volume group name
+func (lvm *pmemLvm) getThinPools(ctx context.Context, volumeGroups []string) (map[string]thinPoolInfo, error) {
+	pools := map[string]thinPoolInfo{}
+	if len(volumeGroups) == 0 {
+		return pools, nil
+	}
+	args := append(lvm.lvsSelectArgs(thinPoolArgs, "lv_name="+thinPoolName), volumeGroups...)
+	output, err := lvm.runCommand(ctx, "lvs", args...)
+	if err != nil {
+		return nil, fmt.Errorf("list thin pools failed : %w(lvs output: %s)", err, output)
+	}
+	return parseThinPoolOutput(output)
+}
+
+// parseThinPoolOutput parses the output of lvs for thinPoolArgs
+func parseThinPoolOutput(output string) (map[string]thinPoolInfo, error) {
+	pools := map[string]thinPoolInfo{}
+	for _, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Split(line, lvsSeparator)
+		if len(fields) < 5 {
+			return nil, fmt.Errorf("Failed to parse thin pool line: %q", line)
+		}
+		if strings.TrimSpace(fields[4]) != thinPoolName {
+			continue
+		}
+		pool := thinPoolInfo{vg: strings.TrimSpace(fields[0])}
+		var err error
+		if pool.size, err = parseBytes(fields[1]); err != nil {
+			return nil, fmt.Errorf("Failed to parse thin pool size in line %q: %w", line, err)
+		}
+		// data_percent and metadata_percent are empty on inactive pools
+		if percent := strings.TrimSpace(fields[2]); percent != "" {
+			if pool.dataPercent, err = strconv.ParseFloat(percent, 64); err != nil {
+				return nil, fmt.Errorf("Failed to parse thin pool usage in line %q: %w", line, err)
+			}
+		}
+		if percent := strings.TrimSpace(fields[3]); percent != "" {
+			if pool.metadataPercent, err = strconv.ParseFloat(percent, 64); err != nil {
+				return nil, fmt.Errorf("Failed to parse thin pool metadata usage in line %q: %w", line, err)
+			}
+		}
+		pools[pool.vg] = pool
+	}
+	return pools, nil
+}
+
+// thinPoolsAsVolumeGroups replaces size and free space of volume groups with those of their thin pool.
+// Groups without thin pool have no space available for thin volumes.
+func (lvm *pmemLvm) thinPoolsAsVolumeGroups(ctx context.Context, vgs []vgInfo) ([]vgInfo, error) {
+	pools, err := lvm.getThinPools(ctx, vgNames(vgs))
+	if err != nil {
+		return nil, err
+	}
+	return lvm.poolsAsVolumeGroups(ctx, vgs, pools), nil
+}
+
+// poolsAsVolumeGroups is thinPoolsAsVolumeGroups for pools listed already
+func (lvm *pmemLvm) poolsAsVolumeGroups(ctx context.Context, vgs []vgInfo, pools map[string]thinPoolInfo) []vgInfo {
+	result := []vgInfo{}
+	for _, vg := range vgs {
+		pool := pools[vg.name]
+		lvm.warnThinMetadata(ctx, pool)
+		result = append(result, vgInfo{name: vg.name, size: pool.size, free: pool.free(), tag: vg.tag})
+	}
+	lvm.watermark.check(result)
+	return result
+}
+
+// warnThinMetadata logs pools whose metadata is full or about to be
+func (lvm *pmemLvm) warnThinMetadata(ctx context.Context, pool thinPoolInfo) {
+	if pool.metadataFull() {
+		lvm.logger(ctx).Info("Thin pool metadata full, no volumes can be created", "vg", pool.vg,
+			"metadataPercent", pool.metadataPercent)
+	} else if pool.metadataPercent >= thinMetadataWarnPercent {
+		lvm.logger(ctx).Info("Thin pool metadata almost full", "vg", pool.vg, "metadataPercent", pool.metadataPercent)
+	}
+}
+
+// createThinDevice creates a thin volume in one of the thin pools of given volume groups.
+// The returned free space is that of the pool before creating the volume, thin volumes
+// only take pool space when data gets written.
+func (lvm *pmemLvm) createThinDevice(ctx context.Context, name string, size uint64, vgs []vgInfo, numaNode int, tagArgs []string, opts CreateOptions) (uint64, error) {
+	infos, err := lvm.getThinPools(ctx, vgNames(vgs))
+	if err != nil {
+		return 0, err
+	}
+	pools := lvm.poolsAsVolumeGroups(ctx, vgs, infos)
+	candidates := candidateVolumeGroups(pools, 1, lvm.allocStrategy)
+	if lvm.maxOverprovision > 0 && len(candidates) > 0 {
+		if candidates, err = lvm.withinOverprovisionLimit(ctx, candidates, size); err != nil {
+			return 0, err
+		}
+	}
+	strSz := lvSize(size)
+	// lastErr is the last failure of lvcreate for another reason than pool space, see createDevice
+	var lastErr error
+	// thin volumes may be larger than the free pool space, every pool which is not full will do
+	for _, pool := range lvm.preferNumaNode(candidates, numaNode) {
+		args := append(append([]string{"-V", strSz, "--thinpool", thinPoolName}, tagArgs...), lvm.deviceLVCreateArgs()...)
+		args = append(args, "-n", name, pool.name)
+		output, err := lvm.runCommand(ctx, "lvcreate", args...)
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, err
+			}
+			lvm.logger(ctx).V(3).Info("lvcreate of thin volume failed, trying next pool",
+				"device", name, "size", size, "vg", pool.name, "error", err, "output", output)
+			if !isThinNoSpaceOutput(output) {
+				lastErr = fmt.Errorf("lvcreate of thin volume in volume group %s failed: %w(output: %s)", pool.name, err, output)
+			}
+			continue
+		}
+		if err := lvm.setupNewDevice(ctx, name, size, pool.name, opts); err != nil {
+			return 0, err
+		}
+		return pool.free, nil
+	}
+	if lastErr != nil {
+		return 0, lastErr
+	}
+	for _, info := range infos {
+		if info.metadataFull() && info.dataPercent < 100 {
+			return 0, fmt.Errorf("No thin pool is having metadata space for %v, metadata of %s is %v%% full: %w",
+				size, info.vg, info.metadataPercent, ErrThinMetadataFull)
+		}
+	}
+	return 0, fmt.Errorf("No thin pool is having space for %v: %w", size, ErrThinPoolFull)
+}
+
+// lvcreateThinPoolFull is part of the lowercased lvcreate output when a thin pool has
+// reached its autoextend threshold, as in "Cannot create new thin volume, free space in
+// thin pool vg/thinpool reached threshold."
+const lvcreateThinPoolFull = "reached threshold"
+
+// isThinNoSpaceOutput checks whether lvcreate of a thin volume failed for lack of space
+func isThinNoSpaceOutput(output string) bool {
+	output = strings.ToLower(output)
+	return strings.Contains(output, lvcreateNoSpace) || strings.Contains(output, lvcreateThinPoolFull)
+}
+
+// ResizeThinMetadata grows the metadata volume of the thin pool in the managed volume group
+// vg to newSize bytes, rounded up to MiB. The space gets taken from the volume group, which
+// must have enough free space outside of the pool. This is the recovery from a pool with
+// full metadata, see ErrThinMetadataFull.
+func (lvm *pmemLvm) ResizeThinMetadata(ctx context.Context, vg string, newSize uint64) error {
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+
+	if !lvm.thinPool {
+		return fmt.Errorf("ResizeThinMetadata: Failed: thin pools are not enabled")
+	}
+	if !lvm.managesVolumeGroup(vg) {
+		return fmt.Errorf("ResizeThinMetadata: Failed: volume group %s is not managed", vg)
+	}
+	if newSize == 0 {
+		return fmt.Errorf("ResizeThinMetadata: Failed: size of metadata in %s is zero: %w", vg, ErrInvalidSize)
+	}
+	lvm.logger(ctx).V(3).Info("Resizing thin pool metadata", "vg", vg, "pool", thinPoolName, "size", newSize)
+	if output, err := lvm.runCommand(ctx, "lvextend", "--poolmetadatasize", lvSize(newSize), vg+"/"+thinPoolName); err != nil {
+		return fmt.Errorf("ResizeThinMetadata: Failed: lvextend of thin pool in %s: %w(output: %s)", vg, err, output)
+	}
+	return nil
+}
+
+// isThinVolume checks whether device is a thin volume in the thin pool of its volume group
+func (lvm *pmemLvm) isThinVolume(ctx context.Context, device PmemDeviceInfo) (bool, error) {
+	if !lvm.thinPool {
+		return false, nil
+	}
+	output, err := lvm.runCommand(ctx, "lvs", "--noheadings", "-o", "pool_lv", device.Path)
+	if err != nil {
+		return false, fmt.Errorf("get thin pool of %s failed : %w(lvs output: %s)", device.Name, err, output)
+	}
+	return strings.TrimSpace(output) == thinPoolName, nil
+}
+
+// thinVolumeArgs lists the volumes with their pool, the size of thin volumes is the virtual size
+var thinVolumeArgs = []string{"--noheadings", "--nosuffix", "--separator", lvsSeparator, "-o", "vg_name,lv_size,pool_lv", "--units", "B"}
+
+// getVirtualSizes returns the summed size of all thin volumes per volume group
+func (lvm *pmemLvm) getVirtualSizes(ctx context.Context, volumeGroups []string) (map[string]uint64, error) {
+	virtual := map[string]uint64{}
+	if len(volumeGroups) == 0 {
+		return virtual, nil
+	}
+	args := append(lvm.lvsSelectArgs(thinVolumeArgs, "pool_lv="+thinPoolName), volumeGroups...)
+	output, err := lvm.runCommand(ctx, "lvs", args...)
+	if err != nil {
+		return nil, fmt.Errorf("list thin volumes failed : %w(lvs output: %s)", err, output)
+	}
+	for _, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Split(line, lvsSeparator)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("Failed to parse thin volume line: %q", line)
+		}
+		if strings.TrimSpace(fields[2]) != thinPoolName {
+			continue
+		}
+		size, err := parseBytes(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse thin volume size in line %q: %w", line, err)
+		}
+		virtual[strings.TrimSpace(fields[0])] += size
+	}
+	return virtual, nil
+}
+
+// withinOverprovisionLimit filters the pools in which a new thin volume of given size keeps
+// the summed size of all thin volumes within LVMConfig.MaxOverprovisionRatio of the pool size
+func (lvm *pmemLvm) withinOverprovisionLimit(ctx context.Context, pools []vgInfo, size uint64) ([]vgInfo, error) {
+	virtual, err := lvm.getVirtualSizes(ctx, vgNames(pools))
+	if err != nil {
+		return nil, err
+	}
+	result := []vgInfo{}
+	for _, pool := range pools {
+		limit := float64(pool.size) * lvm.maxOverprovision
+		if float64(virtual[pool.name]+size) <= limit {
+			result = append(result, pool)
+		} else {
+			lvm.logger(ctx).V(3).Info("Thin pool would exceed over-provisioning limit", "vg", pool.name,
+				"poolSize", pool.size, "virtualSize", virtual[pool.name], "size", size, "ratio", lvm.maxOverprovision)
+		}
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("No thin pool can provide %v within %v times its size: %w", size, lvm.maxOverprovision, ErrOverprovisionLimit)
+	}
+	return result, nil
+}
+
+// ThinPoolUsage describes the thin pool of one volume group
+type ThinPoolUsage struct {
+	VolumeGroup string
+	// Size of the pool data volume in bytes
+	Size uint64
+	// DataPercent used part of the pool data volume
+	DataPercent float64
+	// MetadataPercent used part of the pool metadata volume, the pool fails when it is full
+	MetadataPercent float64
+	// VirtualSize summed size of all thin volumes in the pool, which may exceed Size
+	VirtualSize uint64
+}
+
+// GetThinPoolUsage reports data and metadata usage of the thin pools in all managed
+// volume groups, in addition to the free space reported by GetCapacity.
+// Without LVMConfig.ThinPool there are no pools and the result is empty.
+func (lvm *pmemLvm) GetThinPoolUsage(ctx context.Context) ([]ThinPoolUsage, error) {
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+
+	usage := []ThinPoolUsage{}
+	if !lvm.thinPool {
+		return usage, nil
+	}
+	pools, err := lvm.getThinPools(ctx, lvm.volumeGroups)
+	if err != nil {
+		return nil, err
+	}
+	virtual, err := lvm.getVirtualSizes(ctx, lvm.volumeGroups)
+	if err != nil {
+		return nil, err
+	}
+	for _, vg := range lvm.volumeGroups {
+		pool, ok := pools[vg]
+		if !ok {
+			continue
+		}
+		usage = append(usage, ThinPoolUsage{
+			VolumeGroup:     vg,
+			Size:            pool.size,
+			DataPercent:     pool.dataPercent,
+			MetadataPercent: pool.metadataPercent,
+			VirtualSize:     virtual[vg],
+		})
+	}
+	return usage, nil
+}
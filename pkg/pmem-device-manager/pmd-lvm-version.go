@@ -0,0 +1,81 @@
+package pmdmanager
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// lvmVersion is the version of the LVM tools, for example 2.03.11
+type lvmVersion struct {
+	major, minor, patch int
+}
+
+func (v lvmVersion) String() string {
+	return fmt.Sprintf("%d.%02d.%02d", v.major, v.minor, v.patch)
+}
+
+// atLeast checks whether v is the same as or newer than other
+func (v lvmVersion) atLeast(other lvmVersion) bool {
+	if v.major != other.major {
+		return v.major > other.major
+	}
+	if v.minor != other.minor {
+		return v.minor > other.minor
+	}
+	return v.patch >= other.patch
+}
+
+// lvmSelectionVersion is the first version supporting -S/--select, older ones
+// have to list all volumes and filter them here
+var lvmSelectionVersion = lvmVersion{2, 2, 107}
+
+// lvmJSONVersion is the first version supporting --reportformat json
+var lvmJSONVersion = lvmVersion{2, 2, 158}
+
+// lvmVersionPrefix starts the line with the tools version in the output of "lvm version",
+// for example "  LVM version:     2.03.11(2) (2021-01-08)"
+const lvmVersionPrefix = "LVM version:"
+
+// parseLVMVersion finds the tools version in the output of "lvm version"
+func parseLVMVersion(output string) (lvmVersion, error) {
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, lvmVersionPrefix) {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, lvmVersionPrefix))
+		if len(fields) == 0 {
+			break
+		}
+		var v lvmVersion
+		// the library version in brackets follows without space
+		if _, err := fmt.Sscanf(fields[0], "%d.%d.%d", &v.major, &v.minor, &v.patch); err != nil {
+			return lvmVersion{}, fmt.Errorf("Failed to parse LVM version %q: %w", fields[0], err)
+		}
+		return v, nil
+	}
+	return lvmVersion{}, fmt.Errorf("no LVM version in output: %q", output)
+}
+
+// detectVersion checks which LVM version is installed and disables features it lacks.
+// When the version cannot be determined, a current version is assumed.
+func (lvm *pmemLvm) detectVersion(ctx context.Context) error {
+	output, err := lvm.runCommand(ctx, "lvm", "version")
+	if err != nil {
+		lvm.log.V(3).Info("Failed to get LVM version, assuming a current one", "error", err, "output", output)
+		return nil
+	}
+	version, err := parseLVMVersion(output)
+	if err != nil {
+		lvm.log.V(3).Info("Unknown LVM version, assuming a current one", "error", err)
+		return nil
+	}
+	lvm.log.V(4).Info("Detected LVM version", "version", version)
+	lvm.noSelection = !version.atLeast(lvmSelectionVersion)
+	if lvm.jsonReports && !version.atLeast(lvmJSONVersion) {
+		lvm.log.V(3).Info("LVM version lacks JSON reports, parsing text", "version", version, "needed", lvmJSONVersion)
+		lvm.jsonReports = false
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package pmdmanager
+
+// capacityWatermark calls cb when the free space of a volume group drops below fraction of its size
+type capacityWatermark struct {
+	fraction float64
+	cb       func(vg VolumeGroupInfo)
+	// below remembers the groups which were below the watermark when last checked
+	below map[string]bool
+}
+
+// SetCapacityWatermark registers cb to be called when the free space of a managed volume
+// group falls below fraction of its size, for example 0.1 for less than 10% free.
+// It gets called once per crossing, the group has to rise above the watermark again before
+// the next call. Volume groups get checked whenever vgs runs, for example in GetCapacity.
+// With LVMConfig.ThinPool the free data space of the thin pools gets checked instead.
+// cb runs while the manager is locked and must not call it. A fraction <= 0 or a nil cb
+// removes the watermark.
+func (lvm *pmemLvm) SetCapacityWatermark(fraction float64, cb func(vg VolumeGroupInfo)) {
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+
+	if fraction <= 0 || cb == nil {
+		lvm.watermark = nil
+		return
+	}
+	lvm.watermark = &capacityWatermark{fraction: fraction, cb: cb, below: map[string]bool{}}
+}
+
+// check calls the callback for all groups which dropped below the watermark since the last check
+func (w *capacityWatermark) check(vgs []vgInfo) {
+	if w == nil {
+		return
+	}
+	for _, vg := range vgs {
+		below := vg.size > 0 && float64(vg.free) < w.fraction*float64(vg.size)
+		if below && !w.below[vg.name] {
+			w.cb(vg.info())
+		}
+		w.below[vg.name] = below
+	}
+}
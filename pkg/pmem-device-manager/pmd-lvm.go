@@ -1,197 +1,1573 @@
 package pmdmanager
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/intel/pmem-csi/pkg/ndctl"
-	pmemexec "github.com/intel/pmem-csi/pkg/pmem-exec"
-	"k8s.io/klog/glog"
 )
 
+// AllocStrategy defines how CreateDevice picks a volume group
+// among those having enough free space for the new device.
+type AllocStrategy string
+
+const (
+	// FirstFit picks the first volume group with enough available space:
+	// simplest, groups get filled in order.
+	FirstFit AllocStrategy = "first-fit"
+	// BestFit picks the group with smallest available space which satisfies the request:
+	// ordered initially, but later leaves bigger free space available.
+	BestFit AllocStrategy = "best-fit"
+	// WorstFit picks the group with largest available space:
+	// groups get used round-robin, i.e. load-balanced, but does not leave large unused.
+	WorstFit AllocStrategy = "worst-fit"
+)
+
+// LVMConfig configuration of the LVM based pmem device manager.
+// Zero values select the defaults.
+type LVMConfig struct {
+	// AllocStrategy strategy for choosing the volume group of a new device, defaults to FirstFit
+	AllocStrategy AllocStrategy
+	// CommandTimeout limits the run time of lvcreate, lvremove, lvs, vgs and dd, defaults to 30 seconds
+	CommandTimeout time.Duration
+	// ShredTimeout limits the run time of erasing an entire device, defaults to 30 minutes.
+	// Raise it on large or slow pmem devices.
+	ShredTimeout time.Duration
+	// ErasePolicy how DeleteDevice and FlushDeviceData erase data, defaults to DefaultErasePolicy.
+	// PoolErasePolicies may override it per pool.
+	ErasePolicy ErasePolicy
+	// ThinPool creates devices as thin volumes in a thin pool per volume group instead of
+	// allocating their whole size up front, which allows overcommitting capacity.
+	ThinPool bool
+	// MaxOverprovisionRatio limits the summed size of the thin volumes in a pool to this
+	// multiple of the pool size, for example 2.0. Zero means no limit.
+	MaxOverprovisionRatio float64
+	// Logger receives the messages of the manager unless the context of a call carries
+	// one, see WithLogger. Defaults to GlogLogger.
+	Logger Logger
+	// DryRun logs commands which would modify volumes or their data instead of running them
+	// and reports success. Commands which only query state still run.
+	DryRun bool
+	// AllowShrink permits ResizeDevice to reduce the size of a device, which destroys data at its end
+	AllowShrink bool
+	// VGCacheTTL how long volume group sizes reported by vgs get reused, defaults to 2 seconds.
+	// Negative values disable caching.
+	VGCacheTTL time.Duration
+	// RegionFilter selects the regions whose volume groups get managed, defaults to all active regions
+	RegionFilter RegionFilter
+	// RegionInfoFilter selects regions by their RegionInfo, for example by NUMA node or DIMM
+	// serials. Regions have to be accepted by it and by RegionFilter.
+	RegionInfoFilter RegionInfoFilter
+	// LVCreateExtraArgs get added to lvcreate when creating a device, for example
+	// "--type", "linear". Options for name, size, thin pool, striping, activation, permission
+	// or signature wiping are managed by the device manager and get rejected.
+	LVCreateExtraArgs []string
+	// Pools names disjoint subsets of the volume groups, for example to dedicate some regions
+	// to a separate storage class. CreateDeviceInPool and GetPoolCapacity only consider the
+	// groups of the given pool, the other methods all managed groups.
+	Pools map[string][]string
+	// PoolSerials maps pool names to DIMM serial numbers as listed in RegionInfo.DimmSerials.
+	// The volume groups of accepted regions on any of these DIMMs join the pool, in addition
+	// to those named in Pools, so storage classes can follow the hardware.
+	PoolSerials map[string][]string
+	// PoolErasePolicies overrides ErasePolicy for the devices in the volume groups of the
+	// named pools of Pools or PoolSerials, for example EraseShred for a pool holding
+	// sensitive data and EraseNone for a scratch pool
+	PoolErasePolicies map[string]ErasePolicy
+	// AllocateByExtents passes the size of new devices to lvcreate as number of extents
+	// instead of MBytes, so the allocated size is exactly the requested size rounded up
+	// to the extent size of the volume group, also for extents smaller than 1 MByte.
+	// Thin volumes are not affected.
+	AllocateByExtents bool
+	// LockRetries how often lvcreate, lvremove and other commands modifying volumes get
+	// repeated when they fail because another process holds an LVM lock, defaults to 3.
+	// Negative values disable repeating.
+	LockRetries int
+	// LockRetryDelay wait time before the first repetition after lock contention, it doubles
+	// for each further one. Defaults to 100 milliseconds.
+	LockRetryDelay time.Duration
+	// RemoveBusyRetries how often deleting a device repeats lvremove when it fails because the
+	// volume is still in use, for example right after unmounting it, defaults to 3. Other
+	// failures are not repeated. Negative values disable repeating.
+	RemoveBusyRetries int
+	// RemoveBusyRetryDelay wait time before the first repetition of lvremove, it doubles for
+	// each further one. Defaults to 200 milliseconds.
+	RemoveBusyRetryDelay time.Duration
+	// AllowCopyMigration permits MigrateDevice to copy devices into another volume group
+	AllowCopyMigration bool
+	// ZeroOnCreate zeroes all of a new device with blkdiscard -z before handing it out, instead
+	// of only its start. This keeps data of earlier devices from leaking even when they were
+	// not erased, but takes time proportional to the device size.
+	ZeroOnCreate bool
+	// MarkIncomplete tags new devices in lvcreate and removes the tag once the device was
+	// set up, so devices whose creation failed half-way can be found with ListIncomplete
+	MarkIncomplete bool
+	// DeviceWaitTimeout how long creating a device waits for udev to create its device node,
+	// defaults to 1 second. Raise it on busy nodes where lvcreate returns well before that.
+	DeviceWaitTimeout time.Duration
+	// DeleteConcurrency how many devices DeleteDevices erases at the same time, defaults to 1.
+	// Erasing is limited by the bandwidth of the pmem, so more than a few rarely help.
+	DeleteConcurrency int
+	// ToolPaths maps commands like "lvcreate", "lvs" or "shred" to the binaries which get
+	// run for them, for example wrappers in minimal containers. Other commands get looked
+	// up in PATH. All given paths must exist.
+	ToolPaths map[string]string
+	// JSONReports requests the output of lvs and vgs as JSON instead of text columns. It gets
+	// ignored for LVM versions before 2.02.158, which only report text.
+	JSONReports bool
+	// LVMConfigOverrides get passed with --config to every LVM command, so that settings of
+	// the host lvm.conf like device filters or locking do not interfere. They are space
+	// separated section/key=value pairs, for example global/locking_type=1
+	// devices/filter=["a|/dev/pmem.*|","r|.*|"]. Empty passes no --config.
+	LVMConfigOverrides string
+	// ReservationTTL how long a reservation made with Reserve lasts when it does not get
+	// released, defaults to 5 minutes
+	ReservationTTL time.Duration
+	// IncludeHiddenVolumes lists hidden and internal logical volumes, like the metadata of
+	// thin pools or mirror images, as devices. By default only volumes usable as devices get listed.
+	IncludeHiddenVolumes bool
+	// EnableSelfTest permits SelfTest, which creates and deletes a device in
+	// SelfTestVolumeGroup. That group must be set then.
+	EnableSelfTest bool
+	// SelfTestVolumeGroup the volume group SelfTest uses, usually one set aside for testing
+	SelfTestVolumeGroup string
+	// KeepSignatures disables wiping of filesystem, RAID or partition table signatures
+	// when lvcreate allocates a device. By default they get wiped, so that a new device
+	// never shows the stale filesystem of a deleted one on the same extents.
+	KeepSignatures bool
+}
+
+// pmemLvm all exported methods hold devicemutex while they run, so the free space
+// checked in a volume group and the lvcreate, lvextend or lvremove acting on it
+// cannot interleave with another mutation. Unexported helpers expect the caller to hold it.
 type pmemLvm struct {
-	volumeGroups []string
-	devices      map[string]PmemDeviceInfo
+	volumeGroups  []string
+	devices       map[string]PmemDeviceInfo
+	allocStrategy AllocStrategy
+	allowShrink   bool
+	thinPool      bool
+	dryRun        bool
+	timeouts      commandTimeouts
+	erasePolicy   ErasePolicy
+	runner        commandRunner
+	regions       regionSource
+	regionFilter  RegionFilter
+	vgCache       *vgCache
+	metrics       *lvmMetrics
+	log           Logger
+	// regionInfoFilter is applied to the regions accepted by regionFilter, if set
+	regionInfoFilter RegionInfoFilter
+	// numaNodes maps volume group names to the NUMA node of their region
+	numaNodes map[string]int
+	// vgRegions maps volume group names to the device name of their region
+	vgRegions map[string]string
+	// cryptDevices maps names of encrypted devices to the path of their logical volume
+	cryptDevices map[string]string
+	// lvcreateExtraArgs are passed to each lvcreate of a device
+	lvcreateExtraArgs []string
+	// deviceBusy replaces sysfsDeviceBusy in tests
+	deviceBusy func(path string) (bool, error)
+	// watermark is set by SetCapacityWatermark
+	watermark *capacityWatermark
+	// allocateByExtents passes -l instead of -L to lvcreate
+	allocateByExtents bool
+	// pools maps pool names to their volume groups
+	pools map[string][]string
+	// poolErasePolicies replace erasePolicy for devices in the pools
+	poolErasePolicies map[string]ErasePolicy
+	// markIncomplete tags devices with incompleteTag while they get created
+	markIncomplete bool
+	// lockRetries and lockRetryDelay configure the lockRetryRunner
+	lockRetries    int
+	lockRetryDelay time.Duration
+	// eraseJobs tracks the deletions of DeleteDeviceAsync
+	eraseJobs *eraseJobs
+	// zeroOnCreate zeroes new devices entirely
+	zeroOnCreate bool
+	// noSelection is set for LVM versions without lvs -S
+	noSelection bool
+	// allowCopyMigration enables MigrateDevice
+	allowCopyMigration bool
+	// toolPaths binaries to run instead of looking up commands in PATH
+	toolPaths map[string]string
+	// maxOverprovision limit of thin volume sizes relative to the pool size, 0 for none
+	maxOverprovision float64
+	// deviceWaitTimeout how long new devices may take until their device node appears
+	deviceWaitTimeout time.Duration
+	// deleteConcurrency how many devices DeleteDevices erases in parallel
+	deleteConcurrency int
+	// poolSerials maps pool names to DIMM serials, init adds the matching groups to pools
+	poolSerials map[string][]string
+	// removeBusyRetries and removeBusyRetryDelay configure repeating lvremove of volumes in use
+	removeBusyRetries    int
+	removeBusyRetryDelay time.Duration
+	// jsonReports selects JSON output of lvs and vgs
+	jsonReports bool
+	// daxSupported replaces sysfsDAXSupported in tests
+	daxSupported func(path string) bool
+	// lvmConfigOverrides are passed with --config to LVM commands, see lvmConfigRunner
+	lvmConfigOverrides string
+	// reservations is the ledger of Reserve, deducted by GetCapacity
+	reservations *reservations
+	// includeHidden lists hidden and internal volumes with lvs -a
+	includeHidden bool
+	// selfTest enables SelfTest in selfTestVolumeGroup
+	selfTest            bool
+	selfTestVolumeGroup string
+	// wipeSignatures passes wipeSignatureArgs to lvcreate of a device
+	wipeSignatures bool
 }
 
+// noNumaNode selects volume groups regardless of their NUMA node
+const noNumaNode = -1
+
 var _ PmemDeviceManager = &pmemLvm{}
-var lvsArgs = []string{"--noheadings", "--nosuffix", "-o", "lv_name,lv_path,lv_size", "--units", "B"}
-var vgsArgs = []string{"--noheadings", "--nosuffix", "-o", "vg_name,vg_size,vg_free,vg_tags", "--units", "B"}
+var _ Snapshotter = &pmemLvm{}
+var _ Resizer = &pmemLvm{}
+var _ StripedCreator = &pmemLvm{}
+var _ EncryptedCreator = &pmemLvm{}
+
+// lvsColumns fields requested from lvs, parseLVSOuput relies on this order
+var lvsColumns = []string{"lv_name", "lv_path", "lv_size", "lv_uuid", "vg_name", "lv_tags", "lv_dm_path", "origin", "lv_attr"}
+
+// lvsSeparator separates lvs output fields, it is not allowed in LVM names and tags
+const lvsSeparator = "|"
+
+var lvsArgs = []string{"--noheadings", "--nosuffix", "--separator", lvsSeparator, "-o", strings.Join(lvsColumns, ","), "--units", "B"}
+
+// vgsColumns fields requested from vgs, parseVGSOutput relies on this order
+var vgsColumns = []string{"vg_name", "vg_size", "vg_free", "vg_extent_size", "vg_tags"}
+
+var vgsArgs = []string{"--noheadings", "--nosuffix", "-o", strings.Join(vgsColumns, ","), "--units", "B"}
+
+// NewPmemDeviceManagerLVM Instantiates a new LVM based pmem device manager
+// The pre-requisite for this manager is that all the pmem regions which should be managed by
+// this LMV manager are devided into namespaces and grouped as volume groups.
+func NewPmemDeviceManagerLVM() (PmemDeviceManager, error) {
+	return NewPmemDeviceManagerLVMFiltered(acceptAllRegions)
+}
+
+// RegionFilter returns true for regions which are dedicated to pmem-csi
+type RegionFilter func(bus *ndctl.Bus, region *ndctl.Region) bool
+
+func acceptAllRegions(bus *ndctl.Bus, region *ndctl.Region) bool {
+	return true
+}
+
+// RegionInfoFilter returns true for regions which are dedicated to pmem-csi, like
+// RegionFilter, but decides based on the region as listed by EnumerateRegions
+type RegionInfoFilter func(info RegionInfo) bool
+
+// NewPmemDeviceManagerLVMFiltered Instantiates a new LVM based pmem device manager
+// which only manages the volume groups of regions accepted by filter.
+func NewPmemDeviceManagerLVMFiltered(filter RegionFilter) (PmemDeviceManager, error) {
+	return NewPmemDeviceManagerLVMWithConfig(LVMConfig{RegionFilter: filter})
+}
+
+// NewPmemDeviceManagerLVMFilteredByInfo Instantiates a new LVM based pmem device manager
+// which only manages the volume groups of regions whose RegionInfo filter accepts.
+func NewPmemDeviceManagerLVMFilteredByInfo(filter RegionInfoFilter) (PmemDeviceManager, error) {
+	return NewPmemDeviceManagerLVMWithConfig(LVMConfig{RegionInfoFilter: filter})
+}
+
+// NewPmemDeviceManagerLVMWithStrategy Instantiates a new LVM based pmem device manager
+// which uses the given strategy for choosing the volume group of a new device.
+func NewPmemDeviceManagerLVMWithStrategy(strategy AllocStrategy) (PmemDeviceManager, error) {
+	return NewPmemDeviceManagerLVMWithConfig(LVMConfig{AllocStrategy: strategy})
+}
+
+// NewPmemDeviceManagerLVMThin Instantiates a new LVM based pmem device manager
+// which creates thin volumes in a thin pool per volume group.
+func NewPmemDeviceManagerLVMThin() (PmemDeviceManager, error) {
+	return NewPmemDeviceManagerLVMWithConfig(LVMConfig{ThinPool: true})
+}
+
+// NewPmemDeviceManagerLVMWithConfig Instantiates a new LVM based pmem device manager
+// with the given configuration.
+func NewPmemDeviceManagerLVMWithConfig(cfg LVMConfig) (PmemDeviceManager, error) {
+	lvm, err := newPmemLvm(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+
+	if err := lvm.init(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return lvm, nil
+}
+
+// init finds the existing volume groups of the regions accepted by the region filter
+// and the devices in them. It fails with ErrNoVolumeGroups when there are none.
+func (lvm *pmemLvm) init(ctx context.Context) error {
+	if err := lvm.detectVersion(ctx); err != nil {
+		return err
+	}
+	numRegions := 0
+	accepted := []RegionInfo{}
+	err := lvm.regions.withRegions(func(regions []initRegion) error {
+		numRegions = len(regions)
+		for _, r := range regions {
+			if lvm.regionFilter != nil && !r.accepted(lvm.regionFilter) {
+				lvm.log.V(4).Info("Region not accepted by filter, skipping", "region", r.DeviceName())
+				continue
+			}
+			info := regionInfo(r)
+			if lvm.regionInfoFilter != nil && !lvm.regionInfoFilter(info) {
+				lvm.log.V(4).Info("Region not accepted by info filter, skipping", "region", info.Region, "bus", info.Bus)
+				continue
+			}
+			accepted = append(accepted, info)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	volumeGroups := []string{}
+	for _, r := range accepted {
+		for _, nsmode := range lvmNamespaceModes {
+			vgname := r.VolumeGroups[string(nsmode)]
+			if _, err := lvm.runCommand(ctx, "vgs", vgname); err != nil {
+				lvm.log.V(5).Info("Volume group does not exist, skipping", "vg", vgname)
+			} else {
+				volumeGroups = append(volumeGroups, vgname)
+				lvm.numaNodes[vgname] = r.NumaNode
+				lvm.vgRegions[vgname] = r.Region
+			}
+		}
+	}
+	if len(volumeGroups) == 0 {
+		return fmt.Errorf("%d active regions, %d of them accepted by the region filter: %w",
+			numRegions, len(accepted), ErrNoVolumeGroups)
+	}
+
+	lvm.volumeGroups = volumeGroups
+	if err := lvm.addSerialPools(accepted); err != nil {
+		return err
+	}
+	if lvm.thinPool {
+		if err := lvm.ensureThinPools(ctx); err != nil {
+			return err
+		}
+	}
+	lvm.devices, err = lvm.listDevices(ctx, volumeGroups...)
+	return err
+}
+
+// managedLVCreateOptions are set by the device manager itself, short and long form
+var managedLVCreateOptions = [][]string{
+	{"-n", "--name"},
+	{"-L", "--size"},
+	{"-l", "--extents"},
+	{"-V", "--virtualsize"},
+	{"-T", "--thin"},
+	{"", "--thinpool"},
+	{"-i", "--stripes"},
+	{"-I", "--stripesize"},
+	{"-a", "--activate"},
+	{"-p", "--permission"},
+	{"-W", "--wipesignatures"},
+}
+
+// wipeSignatureArgs make lvcreate wipe signatures found on a new device without asking,
+// see LVMConfig.KeepSignatures
+var wipeSignatureArgs = []string{"-Wy", "--yes"}
+
+// deviceLVCreateArgs returns the arguments which get added to each lvcreate of a device
+// after the managed ones, i.e. signature wiping and LVMConfig.LVCreateExtraArgs
+func (lvm *pmemLvm) deviceLVCreateArgs() []string {
+	if !lvm.wipeSignatures {
+		return lvm.lvcreateExtraArgs
+	}
+	return append(append([]string{}, wipeSignatureArgs...), lvm.lvcreateExtraArgs...)
+}
+
+// validateLVCreateArgs rejects extra lvcreate arguments which would override managed ones,
+// also in the "-nvalue" and "--name=value" forms
+func validateLVCreateArgs(args []string) error {
+	for _, arg := range args {
+		for _, option := range managedLVCreateOptions {
+			short, long := option[0], option[1]
+			if (short != "" && strings.HasPrefix(arg, short)) ||
+				arg == long || strings.HasPrefix(arg, long+"=") {
+				return fmt.Errorf("lvcreate argument %q conflicts with %s, which is set by the device manager", arg, long)
+			}
+		}
+	}
+	return nil
+}
+
+// newPmemLvm validates the configuration and returns a manager without any volume groups
+func newPmemLvm(cfg LVMConfig) (*pmemLvm, error) {
+	if cfg.AllocStrategy == "" {
+		cfg.AllocStrategy = FirstFit
+	}
+	switch cfg.AllocStrategy {
+	case FirstFit, BestFit, WorstFit:
+	default:
+		return nil, fmt.Errorf("Unknown allocation strategy(%v)", cfg.AllocStrategy)
+	}
+	if cfg.CommandTimeout == 0 {
+		cfg.CommandTimeout = defaultCommandTimeout
+	}
+	if cfg.ShredTimeout == 0 {
+		cfg.ShredTimeout = defaultShredTimeout
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = GlogLogger()
+	}
+	if cfg.VGCacheTTL == 0 {
+		cfg.VGCacheTTL = defaultVGCacheTTL
+	}
+	if cfg.LockRetries == 0 {
+		cfg.LockRetries = defaultLockRetries
+	}
+	if cfg.LockRetryDelay == 0 {
+		cfg.LockRetryDelay = defaultLockRetryDelay
+	}
+	if cfg.RemoveBusyRetries == 0 {
+		cfg.RemoveBusyRetries = defaultRemoveBusyRetries
+	}
+	if cfg.RemoveBusyRetryDelay == 0 {
+		cfg.RemoveBusyRetryDelay = defaultRemoveBusyRetryDelay
+	}
+	if cfg.ReservationTTL < 0 {
+		return nil, fmt.Errorf("Invalid reservation TTL(%v)", cfg.ReservationTTL)
+	}
+	if cfg.ReservationTTL == 0 {
+		cfg.ReservationTTL = defaultReservationTTL
+	}
+	if cfg.DeviceWaitTimeout == 0 {
+		cfg.DeviceWaitTimeout = defaultDeviceWaitTimeout
+	}
+	if cfg.DeleteConcurrency < 0 {
+		return nil, fmt.Errorf("Invalid delete concurrency(%d)", cfg.DeleteConcurrency)
+	}
+	if cfg.DeleteConcurrency == 0 {
+		cfg.DeleteConcurrency = 1
+	}
+	erasePolicy, err := cfg.ErasePolicy.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MaxOverprovisionRatio < 0 {
+		return nil, fmt.Errorf("Invalid over-provisioning ratio(%v)", cfg.MaxOverprovisionRatio)
+	}
+	if err := checkToolPaths(cfg.ToolPaths); err != nil {
+		return nil, err
+	}
+	toolPaths := map[string]string{}
+	for cmd, path := range cfg.ToolPaths {
+		toolPaths[cmd] = path
+	}
+	if cfg.EnableSelfTest && cfg.SelfTestVolumeGroup == "" {
+		return nil, errors.New("Self test enabled without volume group")
+	}
+	if err := validateLVMConfigOverrides(cfg.LVMConfigOverrides); err != nil {
+		return nil, err
+	}
+	if err := validateLVCreateArgs(cfg.LVCreateExtraArgs); err != nil {
+		return nil, err
+	}
+	if err := validatePools(cfg.Pools); err != nil {
+		return nil, err
+	}
+	if err := validatePoolSerials(cfg.PoolSerials); err != nil {
+		return nil, err
+	}
+	poolErasePolicies, err := poolErasePoliciesWithDefaults(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pmemLvm{
+		devices:       map[string]PmemDeviceInfo{},
+		numaNodes:     map[string]int{},
+		vgRegions:     map[string]string{},
+		cryptDevices:  map[string]string{},
+		allocStrategy: cfg.AllocStrategy,
+		allowShrink:   cfg.AllowShrink,
+		thinPool:      cfg.ThinPool,
+		dryRun:        cfg.DryRun,
+		timeouts: commandTimeouts{
+			command: cfg.CommandTimeout,
+			shred:   cfg.ShredTimeout,
+		},
+		erasePolicy:          erasePolicy,
+		runner:               execRunner{},
+		regions:              ndctlRegions{},
+		regionFilter:         cfg.RegionFilter,
+		regionInfoFilter:     cfg.RegionInfoFilter,
+		lvcreateExtraArgs:    append([]string{}, cfg.LVCreateExtraArgs...),
+		allocateByExtents:    cfg.AllocateByExtents,
+		pools:                copyPools(cfg.Pools),
+		poolSerials:          copyPools(cfg.PoolSerials),
+		poolErasePolicies:    poolErasePolicies,
+		markIncomplete:       cfg.MarkIncomplete,
+		lockRetries:          cfg.LockRetries,
+		lockRetryDelay:       cfg.LockRetryDelay,
+		eraseJobs:            newEraseJobs(),
+		zeroOnCreate:         cfg.ZeroOnCreate,
+		allowCopyMigration:   cfg.AllowCopyMigration,
+		toolPaths:            toolPaths,
+		maxOverprovision:     cfg.MaxOverprovisionRatio,
+		deviceWaitTimeout:    cfg.DeviceWaitTimeout,
+		deleteConcurrency:    cfg.DeleteConcurrency,
+		removeBusyRetries:    cfg.RemoveBusyRetries,
+		removeBusyRetryDelay: cfg.RemoveBusyRetryDelay,
+		jsonReports:          cfg.JSONReports,
+		lvmConfigOverrides:   cfg.LVMConfigOverrides,
+		reservations:         newReservations(cfg.ReservationTTL),
+		includeHidden:        cfg.IncludeHiddenVolumes,
+		selfTest:             cfg.EnableSelfTest,
+		selfTestVolumeGroup:  cfg.SelfTestVolumeGroup,
+		wipeSignatures:       !cfg.KeepSignatures,
+		vgCache:              newVGCache(cfg.VGCacheTTL),
+		metrics:              newLVMMetrics(),
+		log:                  cfg.Logger,
+	}, nil
+}
+
+type vgInfo struct {
+	name string
+	size uint64
+	free uint64
+	// extentSize allocation unit of the group, sizes of volumes are multiples of it
+	extentSize uint64
+	tag        string
+}
+
+// VolumeGroupInfo describes a volume group as seen by the LVM device manager
+type VolumeGroupInfo struct {
+	Name string
+	// Size total size in bytes
+	Size uint64
+	// Free unallocated bytes
+	Free uint64
+	// ExtentSize allocation unit in bytes, device sizes get rounded up to it
+	ExtentSize uint64
+	// Mode namespace mode of the region the group is in, i.e. its tag
+	Mode string
+}
+
+// ListVolumeGroups returns all managed volume groups
+func (lvm *pmemLvm) ListVolumeGroups(ctx context.Context) ([]VolumeGroupInfo, error) {
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+
+	result := []VolumeGroupInfo{}
+	if len(lvm.volumeGroups) == 0 {
+		// vgs without names would list all groups
+		return result, nil
+	}
+	vgs, err := lvm.getVolumeGroups(ctx, lvm.volumeGroups, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, vg := range vgs {
+		result = append(result, vg.info())
+	}
+	return result, nil
+}
+
+func (vg vgInfo) info() VolumeGroupInfo {
+	return VolumeGroupInfo{Name: vg.name, Size: vg.size, Free: vg.free, ExtentSize: vg.extentSize, Mode: vg.tag}
+}
+
+// vgNames returns the names of given volume groups
+func vgNames(vgs []vgInfo) []string {
+	names := []string{}
+	for _, vg := range vgs {
+		names = append(names, vg.name)
+	}
+	return names
+}
+
+func (lvm *pmemLvm) GetCapacity(ctx context.Context) (map[string]uint64, error) {
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+	capacity, err := lvm.getCapacity(ctx)
+	if err != nil {
+		return nil, err
+	}
+	vgs, err := lvm.getVolumeGroups(ctx, lvm.volumeGroups, "")
+	if err != nil {
+		return nil, err
+	}
+	total, free, _ := sumCapacity(vgs)
+	lvm.metrics.capacity.WithLabelValues("total").Set(float64(total))
+	lvm.metrics.capacity.WithLabelValues("free").Set(float64(free))
+	// space set aside by Reserve is not available to others
+	lvm.reservations.deduct(capacity)
+
+	return capacity, nil
+}
+
+// GetCapacityForVolumeGroup returns the size of the largest device which can be created
+// in the managed volume group vg
+func (lvm *pmemLvm) GetCapacityForVolumeGroup(ctx context.Context, vg string) (uint64, error) {
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+
+	if !lvm.managesVolumeGroup(vg) {
+		return 0, fmt.Errorf("volume group %s is not managed", vg)
+	}
+	capacity, err := lvm.getCapacityOf(ctx, []string{vg})
+	if err != nil {
+		return 0, err
+	}
+	var free uint64
+	for _, c := range capacity {
+		// a group has only one mode
+		if c > free {
+			free = c
+		}
+	}
+	return free, nil
+}
+
+// managesVolumeGroup checks whether vg is one of the managed volume groups
+func (lvm *pmemLvm) managesVolumeGroup(vg string) bool {
+	for _, name := range lvm.volumeGroups {
+		if name == vg {
+			return true
+		}
+	}
+	return false
+}
+
+// GetCapacityForRegion is GetCapacity limited to the volume groups of the region
+// with given device name, for example region0
+func (lvm *pmemLvm) GetCapacityForRegion(ctx context.Context, region string) (map[string]uint64, error) {
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+
+	groups := []string{}
+	for _, vg := range lvm.volumeGroups {
+		if lvm.vgRegions[vg] == region {
+			groups = append(groups, vg)
+		}
+	}
+	if len(groups) == 0 {
+		return nil, fmt.Errorf("region %s has no managed volume groups", region)
+	}
+	return lvm.getCapacityOf(ctx, groups)
+}
+
+// GetCapacityDetails returns the total, free and used space summed up over
+// all managed volume groups. In contrast to GetCapacity, the free space is not
+// necessarily available for a single device.
+func (lvm *pmemLvm) GetCapacityDetails(ctx context.Context) (total, free, used uint64, err error) {
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+
+	vgs := []vgInfo{}
+	for _, nsmod := range []ndctl.NamespaceMode{ndctl.FsdaxMode, ndctl.SectorMode} {
+		modeVgs, err := lvm.getVolumeGroups(ctx, lvm.volumeGroups, string(nsmod))
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		vgs = append(vgs, modeVgs...)
+	}
+	total, free, used = sumCapacity(vgs)
+	return total, free, used, nil
+}
+
+// GetRegionAvailableSize returns the space of all active regions which is not used by
+// any namespace yet. That space is not part of any volume group and thus not included
+// in GetCapacity, but EnsureVolumeGroups can turn it into new volume groups.
+func (lvm *pmemLvm) GetRegionAvailableSize(ctx context.Context) (uint64, error) {
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+	var available uint64
+	err := lvm.regions.withRegions(func(regions []initRegion) error {
+		for _, r := range regions {
+			available += r.AvailableSize()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return available, nil
+}
+
+// Capabilities depends on the configuration: thin volumes cannot be striped, shrinking
+// must be enabled with LVMConfig.AllowShrink. Snapshots work in both modes, those of
+// thin volumes are thin themselves.
+func (lvm *pmemLvm) Capabilities() DeviceManagerCapabilities {
+	return DeviceManagerCapabilities{
+		Snapshots:        true,
+		Resize:           true,
+		Shrink:           lvm.allowShrink,
+		Striping:         !lvm.thinPool,
+		ThinProvisioning: lvm.thinPool,
+		Encryption:       true,
+	}
+}
+
+// nsmode is expected to be either "fsdax" or "sector", empty means "fsdax"
+func (lvm *pmemLvm) CreateDevice(ctx context.Context, name string, size uint64, nsmode string) (err error) {
+	defer func() { lvm.metrics.operationDone("create", err) }()
+	if nsmode, err = lvmNamespaceMode(nsmode); err != nil {
+		return err
+	}
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+	if err := lvm.checkNewDevice(ctx, name); err != nil {
+		return err
+	}
+	return lvm.createDevice(ctx, name, size, nsmode, noNumaNode)
+}
+
+// CreateDeviceInfo creates a device like CreateDevice and returns it as listed by lvs
+// right after creation, so Size is the size after rounding by LVM.
+func (lvm *pmemLvm) CreateDeviceInfo(ctx context.Context, name string, size uint64, nsmode string) (dev PmemDeviceInfo, err error) {
+	defer func() { lvm.metrics.operationDone("create", err) }()
+	if nsmode, err = lvmNamespaceMode(nsmode); err != nil {
+		return PmemDeviceInfo{}, err
+	}
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+	if err := lvm.checkNewDevice(ctx, name); err != nil {
+		return PmemDeviceInfo{}, err
+	}
+	if err := lvm.createDevice(ctx, name, size, nsmode, noNumaNode); err != nil {
+		return PmemDeviceInfo{}, err
+	}
+	if lvm.dryRun {
+		return PmemDeviceInfo{Name: name, Size: size}, nil
+	}
+	// setupNewDevice recorded the result of lvs
+	return lvm.getDevice(name)
+}
+
+// CreateDeviceWithTags creates a device like CreateDevice which carries the given
+// key/value pairs as LVM tags. They are part of the PmemDeviceInfo of the device.
+func (lvm *pmemLvm) CreateDeviceWithTags(ctx context.Context, name string, size uint64, nsmode string, tags map[string]string) (err error) {
+	defer func() { lvm.metrics.operationDone("create", err) }()
+	if nsmode, err = lvmNamespaceMode(nsmode); err != nil {
+		return err
+	}
+	tagArgs, err := lvTagArgs(tags)
+	if err != nil {
+		return err
+	}
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+	if err := lvm.checkNewDevice(ctx, name); err != nil {
+		return err
+	}
+	_, err = lvm.createDeviceRemaining(ctx, lvm.volumeGroups, name, size, nsmode, noNumaNode, tagArgs, CreateOptions{})
+	return err
+}
+
+// CreateDeviceOnNode creates a device like CreateDevice, but prefers volume groups
+// whose region is attached to the given NUMA node. Other volume groups get used
+// only when none on that node has enough space.
+func (lvm *pmemLvm) CreateDeviceOnNode(ctx context.Context, name string, size uint64, nsmode string, numaNode int) (err error) {
+	defer func() { lvm.metrics.operationDone("create", err) }()
+	if nsmode, err = lvmNamespaceMode(nsmode); err != nil {
+		return err
+	}
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+	if err := lvm.checkNewDevice(ctx, name); err != nil {
+		return err
+	}
+	return lvm.createDevice(ctx, name, size, nsmode, numaNode)
+}
+
+// CreateDeviceRemaining creates a device like CreateDevice and returns how much free
+// space is left in the volume group it was created in, which saves callers that track
+// capacity a GetCapacity call. With thin pools it is the free space of the pool.
+func (lvm *pmemLvm) CreateDeviceRemaining(ctx context.Context, name string, size uint64, nsmode string) (remaining uint64, err error) {
+	defer func() { lvm.metrics.operationDone("create", err) }()
+	if nsmode, err = lvmNamespaceMode(nsmode); err != nil {
+		return 0, err
+	}
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+	if err := lvm.checkNewDevice(ctx, name); err != nil {
+		return 0, err
+	}
+	return lvm.createDeviceRemaining(ctx, lvm.volumeGroups, name, size, nsmode, noNumaNode, nil, CreateOptions{})
+}
+
+// checkNewDevice fails with ErrDeviceExists when a device with given name exists already
+func (lvm *pmemLvm) checkNewDevice(ctx context.Context, name string) error {
+	if err := validateLVName(name); err != nil {
+		return err
+	}
+	// Check that such name does not exist. In certain error states, for example when
+	// namespace creation works but device zeroing fails (missing /dev/pmemX.Y in container),
+	// this function is asked to create new devices repeatedly, forcing running out of space.
+	// Avoid device filling with garbage entries by returning error.
+	// Overall, no point having more than one namespace with same name.
+	if lvm.eraseJobs.deleting(name) {
+		return fmt.Errorf("CreateDevice: Failed: volume with that name '%s': %w", name, ErrDeviceDeleting)
+	}
+	exists, err := lvm.deviceExists(ctx, name)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("CreateDevice: Failed: volume with that name '%s': %w", name, ErrDeviceExists)
+	}
+	return nil
+}
+
+// createDevice creates a linear or thin volume, preferably on numaNode (noNumaNode for any).
+// devicemutex must be held by the caller.
+func (lvm *pmemLvm) createDevice(ctx context.Context, name string, size uint64, nsmode string, numaNode int) error {
+	_, err := lvm.createDeviceRemaining(ctx, lvm.volumeGroups, name, size, nsmode, numaNode, nil, CreateOptions{})
+	return err
+}
+
+// createDeviceRemaining creates the device in one of groups with the given lvcreate tag
+// arguments and options and returns the free space left in the chosen volume group
+func (lvm *pmemLvm) createDeviceRemaining(ctx context.Context, groups []string, name string, size uint64, nsmode string, numaNode int, tagArgs []string, opts CreateOptions) (uint64, error) {
+	if len(groups) == 0 {
+		return 0, fmt.Errorf("CreateDevice: Failed: no volume group for '%s': %w", name, ErrNoVolumeGroups)
+	}
+	// pick a region according to configured allocation strategy, see AllocStrategy.
+	// NOTE: We walk buses and regions in ndctl context, but avail.size we check in LV context
+	vgs, err := lvm.getVolumeGroups(ctx, groups, nsmode)
+	if err != nil {
+		return 0, err
+	}
+	if err := validateSize(vgs, name, size, !lvm.thinPool); err != nil {
+		return 0, err
+	}
+	tagArgs = append(lvm.incompleteTagArgs(tagArgs), opts.lvcreateArgs()...)
+	if lvm.thinPool {
+		return lvm.createThinDevice(ctx, name, size, vgs, numaNode, tagArgs, opts)
+	}
+
+	// lastErr is the last failure of lvcreate for another reason than space,
+	// which vgs did not predict
+	var lastErr error
+	for _, vg := range lvm.preferNumaNode(candidateVolumeGroups(vgs, size, lvm.allocStrategy), numaNode) {
+		// In some container environments clearing device fails with race condition.
+		// So, we ask lvm not to clear(-Zn) the newly created device, instead we do ourself in later stage.
+		aligned := roundToExtent(size, vg.extentSize)
+		sizeArgs, err := lvm.lvcreateSizeArgs(aligned, vg.extentSize)
+		if err != nil {
+			return 0, err
+		}
+		args := append(append(append([]string{"-Zn"}, sizeArgs...), tagArgs...), lvm.deviceLVCreateArgs()...)
+		args = append(args, "-n", name, vg.name)
+		if output, err := lvm.runCommand(ctx, "lvcreate", args...); err != nil {
+			if ctx.Err() != nil {
+				// no point trying other regions for an aborted request
+				return 0, err
+			}
+			lvm.logger(ctx).V(3).Info("lvcreate failed, trying next free region", "device", name, "size", size, "vg", vg.name, "error", err, "output", output)
+			if !strings.Contains(strings.ToLower(output), lvcreateNoSpace) {
+				lastErr = fmt.Errorf("lvcreate in volume group %s failed: %w(output: %s)", vg.name, err, output)
+			}
+		} else {
+			if err := lvm.setupNewDevice(ctx, name, size, vg.name, opts); err != nil {
+				return 0, err
+			}
+			// candidateVolumeGroups ensures that the aligned size fits
+			return vg.free - aligned, nil
+		}
+	}
+	if lastErr != nil {
+		return 0, lastErr
+	}
+	return 0, noSpaceError(vgs, size)
+}
+
+// lvcreateNoSpace is part of the lowercased lvcreate output when the volume group is too full,
+// as in "Insufficient free space: ..." or "Volume group ... has insufficient free space"
+const lvcreateNoSpace = "insufficient free space"
+
+// noSpaceError explains why none of vgs can hold a device of given size:
+// the free space may be too small in total, or only split up over several volume groups
+func noSpaceError(vgs []vgInfo, size uint64) error {
+	if _, free, _ := sumCapacity(vgs); free >= size {
+		return fmt.Errorf("No region is having enough space required(%v), %v free in total: %w", size, free, ErrFragmented)
+	}
+	return fmt.Errorf("No region is having enough space required(%v): %w", size, ErrNotEnoughSpace)
+}
+
+// validateSize fails with ErrInvalidSize when size is zero, smaller than the extent size of
+// all of vgs or, with checkMax, larger than even the biggest of them could ever hold. Thin
+// volumes may be larger than their volume group when over-provisioning.
+func validateSize(vgs []vgInfo, name string, size uint64, checkMax bool) error {
+	if size == 0 {
+		return fmt.Errorf("CreateDevice: Failed: size of '%s' is zero: %w", name, ErrInvalidSize)
+	}
+	var minExtent, maxSize uint64
+	for _, vg := range vgs {
+		if minExtent == 0 || vg.extentSize < minExtent {
+			minExtent = vg.extentSize
+		}
+		if vg.size > maxSize {
+			maxSize = vg.size
+		}
+	}
+	if size < minExtent {
+		return fmt.Errorf("CreateDevice: Failed: size(%v) of '%s' is smaller than extent size(%v): %w", size, name, minExtent, ErrInvalidSize)
+	}
+	if checkMax && len(vgs) > 0 && size > maxSize {
+		return fmt.Errorf("CreateDevice: Failed: size(%v) of '%s' is larger than any volume group(%v): %w", size, name, maxSize, ErrInvalidSize)
+	}
+	return nil
+}
+
+// setupNewDevice makes a just created logical volume ready for use and records it.
+// size is the requested size, which lvcreate may have rounded up. opts are those the
+// volume was created with.
+func (lvm *pmemLvm) setupNewDevice(ctx context.Context, name string, size uint64, vgname string, opts CreateOptions) error {
+	if lvm.dryRun {
+		// lvcreate did not run, there is no device to set up
+		return nil
+	}
+	// clear start of device to avoid old data being recognized as file system
+	device, err := lvm.getUncachedDevice(ctx, name, vgname)
+	if err != nil {
+		return err
+	}
+	if device.Size != size {
+		// the difference counts against the capacity of the volume group
+		lvm.logger(ctx).V(2).Info("Allocated size differs from requested size", "device", name,
+			"requested", size, "actual", device.Size, "delta", int64(device.Size)-int64(size))
+	}
+	if opts.Inactive || opts.ReadOnly {
+		// no device node to write to, or writing is not permitted
+		lvm.logger(ctx).V(3).Info("Not clearing inactive or read-only device", "device", name,
+			"inactive", opts.Inactive, "readOnly", opts.ReadOnly)
+		return lvm.recordNewDevice(ctx, device)
+	}
+	err = waitDevicePath(ctx, device, lvm.deviceWaitTimeout)
+	if err != nil {
+		return err
+	}
+	if lvm.zeroOnCreate {
+		err = lvm.zeroNewDevice(ctx, device)
+	} else {
+		err = clearDevice(ctx, device, false, lvm.flushConfig())
+	}
+	if err != nil {
+		return err
+	}
+	return lvm.recordNewDevice(ctx, device)
+}
+
+// recordNewDevice marks a device complete after setupNewDevice and records it
+func (lvm *pmemLvm) recordNewDevice(ctx context.Context, device PmemDeviceInfo) error {
+	if err := lvm.markComplete(ctx, device); err != nil {
+		return err
+	}
+
+	lvm.devices[device.Name] = device
+
+	return nil
+}
+
+// zeroNewDevice zeroes all of a new device with blkdiscard, see LVMConfig.ZeroOnCreate
+func (lvm *pmemLvm) zeroNewDevice(ctx context.Context, device PmemDeviceInfo) error {
+	cfg := lvm.flushConfig()
+	cfg.policy = ErasePolicy{Method: EraseZero, Iterations: 1, Verify: lvm.erasePolicy.Verify}
+	start := time.Now()
+	if err := flushDevice(ctx, device, 0, cfg); err != nil {
+		return fmt.Errorf("zeroing new device %s: %w", device.Name, err)
+	}
+	lvm.logger(ctx).V(4).Info("Zeroed new device", "device", device.Name, "size", device.Size, "duration", time.Since(start))
+	return nil
+}
+
+// ResizeDevice changes the size of an existing device to newSize, rounded like in CreateDevice.
+// Shrinking is refused unless enabled with LVMConfig.AllowShrink.
+func (lvm *pmemLvm) ResizeDevice(ctx context.Context, name string, newSize uint64) error {
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+
+	device, err := lvm.getDevice(name)
+	if err != nil {
+		return err
+	}
+	if _, ok := lvm.cryptDevices[name]; ok {
+		return fmt.Errorf("ResizeDevice: Failed: resizing encrypted device '%s' is not supported", name)
+	}
+	if newSize < device.Size && !lvm.allowShrink {
+		return fmt.Errorf("ResizeDevice: Failed: requested size(%v) of '%s' is smaller than current size(%v) and shrinking is disabled",
+			newSize, name, device.Size)
+	}
+	if newSize == device.Size {
+		return nil
+	}
+
+	vgname := deviceVolumeGroup(device)
+	if newSize > device.Size {
+		vgs, err := lvm.getVolumeGroups(ctx, []string{vgname}, "")
+		if err != nil {
+			return err
+		}
+		if len(vgs) == 0 {
+			return fmt.Errorf("ResizeDevice: Failed: volume group '%s' of '%s' not found: %w", vgname, name, ErrNotEnoughSpace)
+		}
+		newSize = roundToExtent(newSize, vgs[0].extentSize)
+		if vgs[0].free < newSize-device.Size {
+			return fmt.Errorf("ResizeDevice: Failed: volume group '%s' can not grow '%s' to size(%v): %w",
+				vgname, name, newSize, ErrNotEnoughSpace)
+		}
+		_, err = lvm.runCommand(ctx, "lvextend", "-L", lvSize(newSize), device.Path)
+		if err != nil {
+			return err
+		}
+	} else {
+		lvm.logger(ctx).V(3).Info("Shrinking device", "device", name, "size", device.Size, "newSize", newSize)
+		if _, err := lvm.runCommand(ctx, "lvreduce", "-f", "-L", lvSize(newSize), device.Path); err != nil {
+			return err
+		}
+	}
+
+	if lvm.dryRun {
+		return nil
+	}
+	resized, err := lvm.getUncachedDevice(ctx, name, vgname)
+	if err != nil {
+		return err
+	}
+	lvm.devices[name] = resized
+
+	return nil
+}
+
+// DeleteDevice refuses devices which are mounted or open with ErrDeviceBusy,
+// see ForceDeleteDevice. Devices which do not exist count as deleted.
+func (lvm *pmemLvm) DeleteDevice(ctx context.Context, name string, flush bool) (err error) {
+	defer func() { lvm.metrics.operationDone("delete", err) }()
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+
+	device, err := lvm.lookupDevice(ctx, name)
+	if errors.Is(err, ErrDeviceNotFound) {
+		lvm.logger(ctx).V(3).Info("Device already deleted", "device", name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return lvm.deleteDevice(ctx, device, flush, false)
+}
+
+// ForceDeleteDevice deletes a device like DeleteDevice, even when it is in use.
+// Users of the device may see I/O errors or lose data.
+func (lvm *pmemLvm) ForceDeleteDevice(ctx context.Context, name string, flush bool) (err error) {
+	defer func() { lvm.metrics.operationDone("delete", err) }()
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+
+	device, err := lvm.lookupDevice(ctx, name)
+	if errors.Is(err, ErrDeviceNotFound) {
+		lvm.logger(ctx).V(3).Info("Device already deleted", "device", name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	lvm.logger(ctx).V(3).Info("Deleting device regardless of its use", "device", name)
+	return lvm.deleteDevice(ctx, device, flush, true)
+}
+
+// deleteDevice erases and removes the device, with force also when it is in use
+func (lvm *pmemLvm) deleteDevice(ctx context.Context, device PmemDeviceInfo, flush, force bool) error {
+	// erasing the logical volume of an encrypted device also destroys its LUKS header
+	device, err := lvm.closeEncryptedDevice(ctx, device)
+	if err != nil {
+		return err
+	}
+	if !force {
+		if err := lvm.checkUnused(device); err != nil {
+			return err
+		}
+	}
+	flushDuration, err := lvm.clearForDelete(ctx, device, flush)
+	if err != nil {
+		return err
+	}
+	return lvm.removeDevice(ctx, device, flush, flushDuration)
+}
+
+// checkUnused refuses to delete devices which are mounted or held open: removing them
+// would corrupt their data or hang the unmount. Missing devices are left to lvremove.
+func (lvm *pmemLvm) checkUnused(device PmemDeviceInfo) error {
+	err := canFlush(device, lvm.flushConfig())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// clearForDelete is the first phase of deleteDevice, it erases the closed device and
+// returns how long that took. It does not need devicemutex.
+func (lvm *pmemLvm) clearForDelete(ctx context.Context, device PmemDeviceInfo, flush bool) (time.Duration, error) {
+	if isEphemeral(device) {
+		lvm.logger(ctx).V(4).Info("Not clearing ephemeral device", "device", device.Name, "flush", flush)
+		return 0, nil
+	}
+	// time both phases separately, either erasing or LVM may be the slow one
+	start := time.Now()
+	err := clearDevice(ctx, device, flush, lvm.deviceFlushConfig(device))
+	flushDuration := time.Since(start)
+	lvm.metrics.deleteDuration.WithLabelValues("flush").Observe(flushDuration.Seconds())
+	return flushDuration, err
+}
+
+// removeDevice is the second phase of deleteDevice, it removes the logical volume
+// and forgets the device
+func (lvm *pmemLvm) removeDevice(ctx context.Context, device PmemDeviceInfo, flush bool, flushDuration time.Duration) error {
+	start := time.Now()
+	err := lvm.lvremove(ctx, device)
+	removeDuration := time.Since(start)
+	lvm.metrics.deleteDuration.WithLabelValues("lvremove").Observe(removeDuration.Seconds())
+	if err != nil {
+		return err
+	}
+	lvm.logger(ctx).V(4).Info("Deleted device", "device", device.Name, "flush", flush,
+		"flushDuration", flushDuration, "lvremoveDuration", removeDuration)
+	if !lvm.dryRun {
+		delete(lvm.devices, device.Name)
+		delete(lvm.cryptDevices, device.Name)
+	}
+
+	return nil
+}
+
+// lvremove removes the logical volume of device. While it is still in use, lvremove gets
+// repeated up to removeBusyRetries times, waiting removeBusyRetryDelay before the first
+// repetition and twice as long before each further one.
+func (lvm *pmemLvm) lvremove(ctx context.Context, device PmemDeviceInfo) error {
+	delay := lvm.removeBusyRetryDelay
+	for attempt := 0; ; attempt++ {
+		output, err := lvm.runCommand(ctx, "lvremove", "-fy", device.Path)
+		if err == nil || attempt >= lvm.removeBusyRetries || ctx.Err() != nil || !isLVInUseError(output) {
+			return err
+		}
+		lvm.logger(ctx).V(3).Info("Logical volume still in use, retrying lvremove",
+			"device", device.Name, "attempt", attempt+1, "delay", delay, "output", output)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// WipeVolumeGroup deletes all devices in the managed volume group vg like DeleteDevice,
+// for example before decommissioning its region. Unlike DeleteOrphans it continues
+// after failures and returns an error listing all devices which could not be deleted,
+// wrapping the first failure. Running it again retries those devices.
+func (lvm *pmemLvm) WipeVolumeGroup(ctx context.Context, vg string, flush bool) error {
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+
+	if !lvm.managesVolumeGroup(vg) {
+		return fmt.Errorf("volume group %s is not managed", vg)
+	}
+	devices, err := lvm.listDevices(ctx, vg)
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for name := range devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var firstErr error
+	failures := []string{}
+	for _, name := range names {
+		lvm.logger(ctx).V(3).Info("Wiping device", "device", name, "vg", vg)
+		err := lvm.deleteDevice(ctx, devices[name], flush, false)
+		lvm.metrics.operationDone("delete", err)
+		if err != nil {
+			if ctx.Err() != nil {
+				// the remaining devices would fail the same way
+				return fmt.Errorf("wiping volume group %s: deleting device %s: %w", vg, name, err)
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			failures = append(failures, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	if firstErr != nil {
+		return fmt.Errorf("wiping volume group %s: deleting %d of %d devices failed (%s): %w",
+			vg, len(failures), len(names), strings.Join(failures, "; "), firstErr)
+	}
+
+	return nil
+}
+
+// DeleteOrphans deletes all devices in the managed volume groups whose name is not
+// in known, like DeleteDevice does, and returns the names of the deleted devices.
+// It stops at the first device which cannot be deleted. This never happens
+// automatically, callers must be sure that known is complete.
+func (lvm *pmemLvm) DeleteOrphans(ctx context.Context, known map[string]bool, flush bool) ([]string, error) {
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+
+	deleted := []string{}
+	if len(lvm.volumeGroups) == 0 {
+		return deleted, nil
+	}
+	devices, err := lvm.listDevices(ctx, lvm.volumeGroups...)
+	if err != nil {
+		return deleted, err
+	}
+	names := []string{}
+	for name := range devices {
+		if !known[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		lvm.logger(ctx).V(3).Info("Deleting orphaned device", "device", name)
+		err := lvm.deleteDevice(ctx, devices[name], flush, false)
+		lvm.metrics.operationDone("delete", err)
+		if err != nil {
+			return deleted, fmt.Errorf("deleting orphaned device %s: %w", name, err)
+		}
+		deleted = append(deleted, name)
+	}
+
+	return deleted, nil
+}
+
+// RenameDevice gives a device a new name without touching its data
+func (lvm *pmemLvm) RenameDevice(ctx context.Context, oldName, newName string) error {
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+
+	device, err := lvm.getDevice(oldName)
+	if err != nil {
+		return err
+	}
+	if _, ok := lvm.cryptDevices[oldName]; ok {
+		return fmt.Errorf("RenameDevice: Failed: renaming encrypted device '%s' is not supported", oldName)
+	}
+	if err := lvm.checkNewDevice(ctx, newName); err != nil {
+		return err
+	}
+	vgname := deviceVolumeGroup(device)
+	if _, err := lvm.runCommand(ctx, "lvrename", vgname, oldName, newName); err != nil {
+		return err
+	}
+	if lvm.dryRun {
+		return nil
+	}
+	delete(lvm.devices, oldName)
+	renamed, err := lvm.getUncachedDevice(ctx, newName, vgname)
+	if err != nil {
+		return err
+	}
+	lvm.devices[newName] = renamed
+
+	return nil
+}
+
+func (lvm *pmemLvm) FlushDeviceData(ctx context.Context, name string) error {
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+
+	device, err := lvm.getDevice(name)
+	if err != nil {
+		return err
+	}
+	cfg := lvm.deviceFlushConfig(device)
+	if err := canFlush(device, cfg); err != nil {
+		return err
+	}
+
+	return clearDevice(ctx, device, true, cfg)
+}
+
+func (lvm *pmemLvm) CanFlush(ctx context.Context, name string) error {
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+
+	device, err := lvm.getDevice(name)
+	if err != nil {
+		return err
+	}
+
+	return canFlush(device, lvm.flushConfig())
+}
+
+func (lvm *pmemLvm) FormatDevice(ctx context.Context, name string, fsType string, opts []string) error {
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+
+	device, err := lvm.getDevice(name)
+	if err != nil {
+		return err
+	}
+
+	return formatDevice(ctx, device, fsType, opts, lvm.flushConfig())
+}
+
+func (lvm *pmemLvm) ListDevices(ctx context.Context) ([]PmemDeviceInfo, error) {
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+
+	devices := []PmemDeviceInfo{}
+	for _, dev := range lvm.devices {
+		devices = append(devices, dev)
+	}
+
+	return devices, nil
+}
 
-// NewPmemDeviceManagerLVM Instantiates a new LVM based pmem device manager
-// The pre-requisite for this manager is that all the pmem regions which should be managed by
-// this LMV manager are devided into namespaces and grouped as volume groups.
-func NewPmemDeviceManagerLVM() (PmemDeviceManager, error) {
+// ForEachDevice calls fn for each logical volume in the managed volume groups while
+// parsing the output of lvs, without collecting all of them first. When fn returns
+// ErrStopIteration, ForEachDevice stops and returns nil, other errors get returned as is.
+// fn runs while devicemutex is held and thus must not call other methods of the manager.
+func (lvm *pmemLvm) ForEachDevice(ctx context.Context, fn func(dev PmemDeviceInfo) error) error {
 	devicemutex.Lock()
 	defer devicemutex.Unlock()
 
-	ctx, err := ndctl.NewContext()
+	if len(lvm.volumeGroups) == 0 {
+		return nil
+	}
+	args := append(lvm.lvsArgs(), lvm.volumeGroups...)
+	output, err := lvm.runCommand(ctx, "lvs", args...)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to initialize pmem context: %s", err.Error())
+		return fmt.Errorf("list volumes failed : %w(lvs output: %s)", err, output)
 	}
-	volumeGroups := []string{}
-	for _, bus := range ctx.GetBuses() {
-		for _, r := range bus.ActiveRegions() {
-			nsmodes := []ndctl.NamespaceMode{ndctl.FsdaxMode, ndctl.SectorMode}
-			for _, nsmod := range nsmodes {
-				vgname := vgName(bus, r, nsmod)
-				if _, err := pmemexec.RunCommand("vgs", vgname); err != nil {
-					glog.V(5).Infof("NewPmemDeviceManagerLVM: VG %v non-existent, skip", vgname)
-				} else {
-					volumeGroups = append(volumeGroups, vgname)
-				}
-			}
+	err = lvm.forEachLVSDevice(ctx, output, func(dev PmemDeviceInfo) error {
+		if lvm.thinPool && dev.Name == thinPoolName {
+			return nil
 		}
+		return fn(lvm.findDAXDevice(lvm.findEncryptedDevice(dev)))
+	})
+	if errors.Is(err, ErrStopIteration) {
+		return nil
 	}
-	ctx.Free()
+	return err
+}
 
-	devices, err := listDevices(volumeGroups...)
-	if err != nil {
-		return nil, err
-	}
+// Reconcile rebuilds the known devices from the logical volumes which exist in the
+// managed volume groups, with a single lvs call, and returns them indexed by name.
+// Callers can compare the result with the volumes they know about and remove orphans.
+func (lvm *pmemLvm) Reconcile(ctx context.Context) (map[string]PmemDeviceInfo, error) {
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
 
-	return &pmemLvm{
-		volumeGroups: volumeGroups,
-		devices:      devices,
-	}, nil
-}
+	devices := map[string]PmemDeviceInfo{}
+	if len(lvm.volumeGroups) > 0 {
+		var err error
+		if devices, err = lvm.listDevices(ctx, lvm.volumeGroups...); err != nil {
+			return nil, err
+		}
+	}
+	lvm.devices = devices
+	result := map[string]PmemDeviceInfo{}
+	for name, dev := range devices {
+		result[name] = dev
+	}
 
-type vgInfo struct {
-	name string
-	size uint64
-	free uint64
-	tag  string
+	return result, nil
 }
 
-func (lvm *pmemLvm) GetCapacity() (map[string]uint64, error) {
+// ListDevicesWithPrefix returns the devices whose name starts with prefix.
+// Only those get listed by lvs, which is cheaper than ListDevices when there are many devices.
+func (lvm *pmemLvm) ListDevicesWithPrefix(ctx context.Context, prefix string) ([]PmemDeviceInfo, error) {
 	devicemutex.Lock()
 	defer devicemutex.Unlock()
-	return lvm.getCapacity()
-}
 
-// nsmode is expected to be either "fsdax" or "sector"
-func (lvm *pmemLvm) CreateDevice(name string, size uint64, nsmode string) error {
-	if nsmode != string(ndctl.FsdaxMode) && nsmode != string(ndctl.SectorMode) {
-		return fmt.Errorf("Unknown nsmode(%v)", nsmode)
+	if c, ok := invalidLVNameChar(prefix); ok {
+		return nil, fmt.Errorf("device name prefix %q contains %q: %w", prefix, c, ErrInvalidName)
 	}
-	devicemutex.Lock()
-	defer devicemutex.Unlock()
-	// Check that such name does not exist. In certain error states, for example when
-	// namespace creation works but device zeroing fails (missing /dev/pmemX.Y in container),
-	// this function is asked to create new devices repeatedly, forcing running out of space.
-	// Avoid device filling with garbage entries by returning error.
-	// Overall, no point having more than one namespace with same name.
-	_, err := lvm.getDevice(name)
-	if err == nil {
-		return fmt.Errorf("CreateDevice: Failed: namespace with that name '%s' exists", name)
-	}
-	// pick a region, few possible strategies:
-	// 1. pick first with enough available space: simplest, regions get filled in order;
-	// 2. pick first with largest available space: regions get used round-robin, i.e. load-balanced, but does not leave large unused;
-	// 3. pick first with smallest available which satisfies the request: ordered initially, but later leaves bigger free available;
-	// Let's implement strategy 1 for now, simplest to code as no need to compare sizes in all regions
-	// NOTE: We walk buses and regions in ndctl context, but avail.size we check in LV context
-	vgs, err := getVolumeGroups(lvm.volumeGroups, nsmode)
+	devices := []PmemDeviceInfo{}
+	if len(lvm.volumeGroups) == 0 {
+		return devices, nil
+	}
+	selection := ""
+	if prefix != "" {
+		selection = "lv_name=~^" + regexp.QuoteMeta(prefix)
+	}
+	found, err := lvm.listSelectedDevices(ctx, selection, func(dev PmemDeviceInfo) bool {
+		return strings.HasPrefix(dev.Name, prefix)
+	}, lvm.volumeGroups...)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	// lvcreate takes size in MBytes if no unit.
-	// We use MBytes here to avoid problems with byte-granularity, as lvcreate
-	// may refuse to create some arbitrary sizes.
-	// Division by 1M should not result in smaller-than-asked here
-	// as lvcreate will round up to next 4MB boundary.
-	sizeM := int(size / (1024 * 1024))
-	strSz := strconv.Itoa(sizeM)
-
-	for _, vg := range vgs {
-		if vg.free >= size {
-			// In some container environments clearing device fails with race condition.
-			// So, we ask lvm not to clear(-Zn) the newly created device, instead we do ourself in later stage.
-			// lvcreate takes size in MBytes if no unit
-			if _, err := pmemexec.RunCommand("lvcreate", "-Zn", "-L", strSz, "-n", name, vg.name); err != nil {
-				glog.V(3).Infof("lvcreate failed with error: %v, trying for next free region", err)
-			} else {
-				// clear start of device to avoid old data being recognized as file system
-				device, err := getUncachedDevice(name, vg.name)
-				if err != nil {
-					return err
-				}
-				err = WaitDeviceAppears(device)
-				if err != nil {
-					return err
-				}
-				err = ClearDevice(device, false)
-				if err != nil {
-					return err
-				}
-
-				lvm.devices[device.Name] = device
-
-				return nil
-			}
-		}
+	for name, dev := range found {
+		lvm.devices[name] = dev
+		devices = append(devices, dev)
 	}
-	return fmt.Errorf("No region is having enough space required(%v)", size)
+
+	return devices, nil
 }
 
-func (lvm *pmemLvm) DeleteDevice(name string, flush bool) error {
+// DeviceExists checks whether a logical volume with given name exists in the managed volume groups
+func (lvm *pmemLvm) DeviceExists(ctx context.Context, name string) (bool, error) {
 	devicemutex.Lock()
 	defer devicemutex.Unlock()
 
-	device, err := lvm.getDevice(name)
-	if err != nil {
-		return err
+	return lvm.deviceExists(ctx, name)
+}
+
+func (lvm *pmemLvm) deviceExists(ctx context.Context, name string) (bool, error) {
+	if _, ok := lvm.devices[name]; ok {
+		return true, nil
 	}
-	if err := ClearDevice(device, flush); err != nil {
-		return err
+	if len(lvm.volumeGroups) == 0 || validateLVName(name) != nil {
+		return false, nil
+	}
+	// not known to us, but another lvcreate could have won the race
+	dev, err := lvm.getUncachedDevice(ctx, name, lvm.volumeGroups...)
+	if errors.Is(err, ErrDeviceNotFound) {
+		return false, nil
 	}
+	if err != nil {
+		return false, err
+	}
+	lvm.devices[name] = dev
 
-	_, err = pmemexec.RunCommand("lvremove", "-fy", device.Path)
-	return err
+	return true, nil
 }
 
-func (lvm *pmemLvm) FlushDeviceData(name string) error {
+// GetDevice returns the known device with that name. Unknown names get looked up with
+// an lvs query for just that device, which finds devices created by others.
+func (lvm *pmemLvm) GetDevice(ctx context.Context, id string) (PmemDeviceInfo, error) {
 	devicemutex.Lock()
 	defer devicemutex.Unlock()
 
-	device, err := lvm.getDevice(name)
+	return lvm.lookupDevice(ctx, id)
+}
+
+// lookupDevice is GetDevice without locking: devices missing from lvm.devices get
+// looked up with lvs before they count as not found
+func (lvm *pmemLvm) lookupDevice(ctx context.Context, id string) (PmemDeviceInfo, error) {
+	if dev, err := lvm.getDevice(id); err == nil || errors.Is(err, ErrDeviceDeleting) || len(lvm.volumeGroups) == 0 || validateLVName(id) != nil {
+		return dev, err
+	}
+	// created behind our back, only look for that one device
+	dev, err := lvm.getUncachedDevice(ctx, id, lvm.volumeGroups...)
 	if err != nil {
-		return err
+		return PmemDeviceInfo{}, err
 	}
-
-	return ClearDevice(device, true)
+	lvm.devices[id] = dev
+	return dev, nil
 }
 
-func (lvm *pmemLvm) ListDevices() ([]PmemDeviceInfo, error) {
+// GetDeviceUncached returns the device like GetDevice, but always asks lvs instead of
+// answering from the devices known to the manager, for reads which must not miss changes
+// made behind its back. The result replaces the known device, a device which no longer
+// exists gets forgotten.
+func (lvm *pmemLvm) GetDeviceUncached(ctx context.Context, id string) (PmemDeviceInfo, error) {
 	devicemutex.Lock()
 	defer devicemutex.Unlock()
 
-	devices := []PmemDeviceInfo{}
-	for _, dev := range lvm.devices {
-		devices = append(devices, dev)
+	if len(lvm.volumeGroups) == 0 {
+		return PmemDeviceInfo{}, fmt.Errorf("Device with name %s: %w", id, ErrDeviceNotFound)
+	}
+	if err := validateLVName(id); err != nil {
+		return PmemDeviceInfo{}, err
+	}
+	dev, err := lvm.getUncachedDevice(ctx, id, lvm.volumeGroups...)
+	if errors.Is(err, ErrDeviceNotFound) {
+		delete(lvm.devices, id)
 	}
+	if err != nil {
+		return PmemDeviceInfo{}, err
+	}
+	lvm.devices[id] = dev
+	return dev, nil
+}
 
-	return devices, nil
+// WaitForDevice waits until the device with given name exists and has a device node,
+// for example when it was created by another process and udev lags behind. It polls
+// for at most timeout and fails early when ctx is done or looking up the device fails
+// for another reason than ErrDeviceNotFound.
+func (lvm *pmemLvm) WaitForDevice(ctx context.Context, name string, timeout time.Duration) (PmemDeviceInfo, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		dev, err := lvm.GetDevice(ctx, name)
+		if err == nil {
+			if _, err = os.Stat(dev.Path); err == nil {
+				return dev, nil
+			}
+		} else if !errors.Is(err, ErrDeviceNotFound) {
+			return PmemDeviceInfo{}, err
+		}
+		if !time.Now().Before(deadline) {
+			return PmemDeviceInfo{}, fmt.Errorf("device %s did not appear within %v: %w", name, timeout, err)
+		}
+		lvm.logger(ctx).V(5).Info("Device not ready yet, retrying", "device", name, "error", err, "delay", retryStatTimeout)
+		select {
+		case <-ctx.Done():
+			return PmemDeviceInfo{}, fmt.Errorf("waiting for device %s aborted: %w", name, ctx.Err())
+		case <-time.After(retryStatTimeout):
+		}
+	}
 }
 
-func (lvm *pmemLvm) GetDevice(id string) (PmemDeviceInfo, error) {
+// GetDeviceByUUID returns the device with the given LVM UUID
+func (lvm *pmemLvm) GetDeviceByUUID(ctx context.Context, uuid string) (PmemDeviceInfo, error) {
 	devicemutex.Lock()
 	defer devicemutex.Unlock()
 
-	return lvm.getDevice(id)
+	for _, dev := range lvm.devices {
+		if dev.UUID == uuid {
+			return dev, nil
+		}
+	}
+	if len(lvm.volumeGroups) > 0 {
+		// renamed or created behind our back
+		devices, err := lvm.listDevices(ctx, lvm.volumeGroups...)
+		if err != nil {
+			return PmemDeviceInfo{}, err
+		}
+		lvm.devices = devices
+		for _, dev := range devices {
+			if dev.UUID == uuid {
+				return dev, nil
+			}
+		}
+	}
+
+	return PmemDeviceInfo{}, fmt.Errorf("Device with UUID %s: %w", uuid, ErrDeviceNotFound)
 }
 
 func (lvm *pmemLvm) getDevice(id string) (PmemDeviceInfo, error) {
+	if lvm.eraseJobs.deleting(id) {
+		return PmemDeviceInfo{}, fmt.Errorf("Device with name %s: %w", id, ErrDeviceDeleting)
+	}
 	if dev, ok := lvm.devices[id]; ok {
 		return dev, nil
 	}
 
-	return PmemDeviceInfo{}, fmt.Errorf("Device not found with name %s", id)
+	return PmemDeviceInfo{}, fmt.Errorf("Device with name %s: %w", id, ErrDeviceNotFound)
 }
 
-func getUncachedDevice(id string, volumeGroup string) (PmemDeviceInfo, error) {
-	devices, err := listDevices(volumeGroup)
+// getUncachedDevice asks lvs for the device with the given name in the given volume groups,
+// without listing all other devices in them
+func (lvm *pmemLvm) getUncachedDevice(ctx context.Context, id string, volumeGroups ...string) (PmemDeviceInfo, error) {
+	devices, err := lvm.listSelectedDevices(ctx, "lv_name="+id, func(dev PmemDeviceInfo) bool {
+		return dev.Name == id
+	}, volumeGroups...)
 	if err != nil {
 		return PmemDeviceInfo{}, err
 	}
@@ -199,52 +1575,361 @@ func getUncachedDevice(id string, volumeGroup string) (PmemDeviceInfo, error) {
 	if dev, ok := devices[id]; ok {
 		return dev, nil
 	}
-	return PmemDeviceInfo{}, fmt.Errorf("Device not found with name %s", id)
+	return PmemDeviceInfo{}, fmt.Errorf("Device with name %s: %w", id, ErrDeviceNotFound)
 }
 
 // listDevices Lists available logical devices in given volume groups
-func listDevices(volumeGroups ...string) (map[string]PmemDeviceInfo, error) {
-	args := append(lvsArgs, volumeGroups...)
-	output, err := pmemexec.RunCommand("lvs", args...)
+func (lvm *pmemLvm) listDevices(ctx context.Context, volumeGroups ...string) (map[string]PmemDeviceInfo, error) {
+	return lvm.listSelectedDevices(ctx, "", nil, volumeGroups...)
+}
+
+// listSelectedDevices lists the logical devices in given volume groups which match
+// the lvs selection criteria, all of them if selection is empty. LVM versions without
+// selection support list all devices and match decides which of them get returned.
+func (lvm *pmemLvm) listSelectedDevices(ctx context.Context, selection string, match func(dev PmemDeviceInfo) bool, volumeGroups ...string) (map[string]PmemDeviceInfo, error) {
+	if len(volumeGroups) == 0 {
+		// lvs without names would list the volumes of all groups
+		return map[string]PmemDeviceInfo{}, nil
+	}
+	args := lvm.lvsArgs()
+	if selection != "" && lvm.noSelection {
+		if match == nil {
+			return nil, fmt.Errorf("lvs selection %q needs LVM %s or newer", selection, lvmSelectionVersion)
+		}
+	} else if selection != "" {
+		args = append(args, "-S", selection)
+		match = nil
+	}
+	args = append(args, volumeGroups...)
+	output, err := lvm.runCommand(ctx, "lvs", args...)
+	if err != nil {
+		return nil, fmt.Errorf("list volumes failed : %w(lvs output: %s)", err, output)
+	}
+	devices, err := lvm.parseLVS(ctx, output)
+	if err != nil {
+		return nil, err
+	}
+	if lvm.thinPool {
+		delete(devices, thinPoolName)
+	}
+	if match != nil {
+		for name, dev := range devices {
+			if !match(dev) {
+				delete(devices, name)
+			}
+		}
+	}
+	lvm.findEncryptedDevices(devices)
+	lvm.findDAXDevices(devices)
+	return devices, nil
+}
+
+func (lvm *pmemLvm) flushConfig() flushConfig {
+	return flushConfig{
+		policy:     lvm.erasePolicy,
+		timeouts:   lvm.timeouts,
+		runner:     lvm.wrappedRunner(),
+		log:        lvm.log,
+		deviceBusy: lvm.deviceBusy,
+		dryRun:     lvm.dryRun,
+	}
+}
+
+// deviceFlushConfig is flushConfig with the erase policy of the pool of the device,
+// see LVMConfig.PoolErasePolicies
+func (lvm *pmemLvm) deviceFlushConfig(device PmemDeviceInfo) flushConfig {
+	cfg := lvm.flushConfig()
+	if policy, ok := lvm.poolErasePolicies[lvm.poolOf(device.VolumeGroup)]; ok {
+		cfg.policy = policy
+	}
+	return cfg
+}
+
+func (lvm *pmemLvm) runCommand(ctx context.Context, cmd string, args ...string) (string, error) {
+	output, err := runCommand(ctx, lvm.wrappedRunner(), lvm.timeouts.command, cmd, args...)
+	switch cmd {
+	case "lvcreate", "lvremove", "lvextend", "lvreduce":
+		// even failed commands may have changed something
+		lvm.invalidateCache()
+		vgSnapshotFrom(ctx).invalidate()
+	}
+	return output, err
+}
+
+// logger returns the logger for an operation with the given context
+func (lvm *pmemLvm) logger(ctx context.Context) Logger {
+	return loggerFrom(ctx, lvm.log)
+}
+
+// wrappedRunner returns the runner for all commands of the manager,
+// which measures them and in dry run mode skips those modifying state
+func (lvm *pmemLvm) wrappedRunner() commandRunner {
+	runner := lvm.runner
+	if len(lvm.toolPaths) > 0 {
+		// innermost, so that metrics and dry run see the command names
+		runner = toolPathRunner{runner: runner, paths: lvm.toolPaths}
+	}
+	if lvm.lvmConfigOverrides != "" {
+		runner = lvmConfigRunner{runner: runner, overrides: lvm.lvmConfigOverrides}
+	}
+	runner = instrumentedRunner{runner: runner, metrics: lvm.metrics}
+	if lvm.lockRetries > 0 {
+		runner = lockRetryRunner{runner: runner, retries: lvm.lockRetries, delay: lvm.lockRetryDelay, log: lvm.log}
+	}
+	if lvm.dryRun {
+		runner = dryRunRunner{runner: runner, log: lvm.log}
+	}
+	return runner
+}
+
+// invalidateCache forgets cached vgs results
+func (lvm *pmemLvm) invalidateCache() {
+	lvm.vgCache.invalidate()
+}
+
+// maxLVNameLength LVM limit for the length of logical volume names
+const maxLVNameLength = 127
+
+// lvReservedSubstrings may not appear in logical volume names, LVM uses them for internal volumes
+var lvReservedSubstrings = []string{"_cdata", "_cmeta", "_corig", "_mlog", "_mimage", "_pmspare", "_rimage", "_rmeta", "_tdata", "_tmeta", "_vorigin", "_vdata"}
+
+// validateLVName checks name against the LVM naming rules, so that it gets rejected
+// before being passed to lvcreate, where a leading hyphen would be taken as an option.
+func validateLVName(name string) error {
+	if name == "" || name == "." || name == ".." {
+		return fmt.Errorf("device name %q: %w", name, ErrInvalidName)
+	}
+	if len(name) > maxLVNameLength {
+		return fmt.Errorf("device name %q longer than %d characters: %w", name, maxLVNameLength, ErrInvalidName)
+	}
+	if name[0] == '-' {
+		return fmt.Errorf("device name %q starts with hyphen: %w", name, ErrInvalidName)
+	}
+	if c, ok := invalidLVNameChar(name); ok {
+		return fmt.Errorf("device name %q contains %q, only a-z A-Z 0-9 + _ . - are allowed: %w", name, c, ErrInvalidName)
+	}
+	if strings.HasPrefix(name, "snapshot") || strings.HasPrefix(name, "pvmove") {
+		return fmt.Errorf("device name %q uses reserved prefix: %w", name, ErrInvalidName)
+	}
+	for _, reserved := range lvReservedSubstrings {
+		if strings.Contains(name, reserved) {
+			return fmt.Errorf("device name %q contains reserved %q: %w", name, reserved, ErrInvalidName)
+		}
+	}
+	return nil
+}
+
+// invalidLVNameChar returns the first character of name which LVM does not allow in names
+func invalidLVNameChar(name string) (rune, bool) {
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("+_.-", c)) {
+			return c, true
+		}
+	}
+	return 0, false
+}
+
+// parseBytes parses a size printed by the LVM tools with "--units B". Some versions
+// append the unit despite "--nosuffix", so a trailing B gets ignored.
+func parseBytes(field string) (uint64, error) {
+	return strconv.ParseUint(strings.TrimSuffix(strings.TrimSpace(field), "B"), 10, 64)
+}
+
+// lvSize converts size in bytes to lvcreate/lvextend size argument.
+// lvcreate takes size in MBytes if no unit.
+// We use MBytes here to avoid problems with byte-granularity, as lvcreate
+// may refuse to create some arbitrary sizes.
+// Sizes get rounded up to full MBytes, callers align them to the extent size
+// of the volume group beforehand, see roundToExtent.
+func lvSize(size uint64) string {
+	const mb = 1024 * 1024
+	return strconv.FormatUint(roundToExtent(size, mb)/mb, 10)
+}
+
+// lvExtents returns the number of extents of given size which hold size bytes, for lvcreate -l
+func lvExtents(size, extentSize uint64) (string, error) {
+	if extentSize == 0 {
+		return "", fmt.Errorf("extent size unknown, cannot convert size(%v) to extents", size)
+	}
+	if size == 0 {
+		return "", fmt.Errorf("size 0 cannot be allocated in extents")
+	}
+	if size > math.MaxUint64-extentSize+1 {
+		return "", fmt.Errorf("size(%v) too large for extents of size(%v)", size, extentSize)
+	}
+	return strconv.FormatUint(roundToExtent(size, extentSize)/extentSize, 10), nil
+}
+
+// lvcreateSizeArgs returns the lvcreate arguments for the size of a new device
+// in a volume group with given extent size
+func (lvm *pmemLvm) lvcreateSizeArgs(size, extentSize uint64) ([]string, error) {
+	if !lvm.allocateByExtents {
+		// lvcreate takes size in MBytes if no unit
+		return []string{"-L", lvSize(size)}, nil
+	}
+	extents, err := lvExtents(size, extentSize)
+	if err != nil {
+		return nil, err
+	}
+	return []string{"-l", extents}, nil
+}
+
+// roundToExtent rounds size up to a multiple of extentSize, zero extentSize leaves it unchanged.
+// lvcreate would do the same, but then the caller would not know the real size. Create, resize
+// and capacity checks all round through it, so they agree on the size of a device.
+func roundToExtent(size, extentSize uint64) uint64 {
+	if extentSize == 0 {
+		return size
+	}
+	return (size + extentSize - 1) / extentSize * extentSize
+}
+
+// deviceVolumeGroup returns the volume group of a device as reported by lvs,
+// falling back to the path /dev/<vg>/<lv>
+func deviceVolumeGroup(device PmemDeviceInfo) string {
+	if device.VolumeGroup != "" {
+		return device.VolumeGroup
+	}
+	return filepath.Base(filepath.Dir(device.Path))
+}
+
+// lvmNamespaceMode checks that volume groups exist for nsmode, i.e. that namespaces
+// in that mode are block devices which pmem-csi initializes. An empty nsmode means fsdax.
+func lvmNamespaceMode(nsmode string) (string, error) {
+	if nsmode == "" {
+		return string(ndctl.FsdaxMode), nil
+	}
+	mode, err := ndctl.ParseNamespaceMode(nsmode)
 	if err != nil {
-		return nil, fmt.Errorf("list volumes failed : %s(lvs output: %s)", err.Error(), output)
+		return "", err
+	}
+	if mode != ndctl.FsdaxMode && mode != ndctl.SectorMode {
+		return "", fmt.Errorf("Unsupported nsmode(%v) for LVM, a block device is needed", nsmode)
 	}
-	return parseLVSOuput(output)
+	return string(mode), nil
 }
 
 func vgName(bus *ndctl.Bus, region *ndctl.Region, nsmode ndctl.NamespaceMode) string {
 	return bus.DeviceName() + region.DeviceName() + string(nsmode)
 }
 
-//lvs options "lv_name,lv_path,lv_size,lv_free"
-func parseLVSOuput(output string) (map[string]PmemDeviceInfo, error) {
+// parseLVSOuput parses lvs output with lvsColumns fields separated by lvsSeparator.
+// Additional trailing fields are ignored, lines with missing fields are an error.
+// Internal volumes are skipped unless includeHidden is set, see internalLV.
+func parseLVSOuput(log Logger, output string, includeHidden bool) (map[string]PmemDeviceInfo, error) {
 	devices := map[string]PmemDeviceInfo{}
-	lines := strings.Split(string(output), "\n")
-	for _, line := range lines {
-		fields := strings.Fields(strings.TrimSpace(line))
-		if len(fields) != 3 {
+	err := forEachLVSLine(log, output, includeHidden, func(dev PmemDeviceInfo) error {
+		devices[dev.Name] = dev
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return devices, nil
+}
+
+// forEachLVSLine parses lvs output like parseLVSOuput, one line at a time, and calls fn
+// for each device. It stops at the first error of fn and returns it.
+func forEachLVSLine(log Logger, output string, includeHidden bool, fn func(dev PmemDeviceInfo) error) error {
+	for len(output) > 0 {
+		line := output
+		if i := strings.IndexByte(output, '\n'); i >= 0 {
+			line, output = output[:i], output[i+1:]
+		} else {
+			output = ""
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields, err := splitLVSLine(log, line)
+		if err != nil {
+			return err
+		}
+		if !includeHidden && internalLV(fields) {
 			continue
 		}
+		dev, err := parseLVSFields(fields, line)
+		if err != nil {
+			return err
+		}
+		if err := fn(dev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		dev := PmemDeviceInfo{}
-		dev.Name = fields[0]
-		dev.Path = fields[1]
-		dev.Size, _ = strconv.ParseUint(fields[2], 10, 64)
+// splitLVSLine returns the fields of one non-empty line of lvs output
+func splitLVSLine(log Logger, line string) ([]string, error) {
+	fields := strings.Split(line, lvsSeparator)
+	if len(fields) < len(lvsColumns) {
+		return nil, fmt.Errorf("Failed to parse lvs output line: %q", line)
+	}
+	if len(fields) > len(lvsColumns) {
+		log.Info("Ignoring extra fields in lvs output", "line", line)
+	}
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	return fields, nil
+}
 
-		devices[dev.Name] = dev
+// internalLVTypes are the volume types, the first lv_attr character, of logical volumes
+// which are part of other volumes or pools: mirror and raid (i)mages, mirror (l)ogs, pool
+// m(e)tadata, (T)hin pool data, v(D)o pool data, (p)vmove and the (t)hin and v(d)o pools
+// themselves
+const internalLVTypes = "iIleTDptd"
+
+// internalLV checks the lvsColumns fields of a volume for being hidden, shown by lvs -a
+// in brackets, or internal, so that it cannot be used as a device
+func internalLV(fields []string) bool {
+	name, attr := fields[0], fields[8]
+	if strings.HasPrefix(name, "[") {
+		return true
 	}
+	return attr != "" && strings.ContainsRune(internalLVTypes, rune(attr[0]))
+}
 
-	return devices, nil
+// parseLVSFields converts the values of lvsColumns, in that order, found in the lvs output
+// part source
+func parseLVSFields(fields []string, source string) (PmemDeviceInfo, error) {
+	dev := PmemDeviceInfo{}
+	dev.Name = fields[0]
+	dev.Path = fields[1]
+	size, err := parseBytes(fields[2])
+	if err != nil {
+		return PmemDeviceInfo{}, fmt.Errorf("Failed to parse size in lvs output line %q: %w", source, err)
+	}
+	dev.Size = size
+	dev.UUID = fields[3]
+	dev.VolumeGroup = fields[4]
+	dev.Tags = parseLVTags(fields[5])
+	dev.DMPath = fields[6]
+	dev.Origin = fields[7]
+
+	return dev, nil
+}
+
+func (lvm *pmemLvm) getCapacity(ctx context.Context) (map[string]uint64, error) {
+	return lvm.getCapacityOf(ctx, lvm.volumeGroups)
 }
 
-func (lvm *pmemLvm) getCapacity() (map[string]uint64, error) {
+// getCapacityOf returns the largest free space per namespace mode in given volume groups
+func (lvm *pmemLvm) getCapacityOf(ctx context.Context, groups []string) (map[string]uint64, error) {
 	capacity := map[string]uint64{}
 	nsmodes := []ndctl.NamespaceMode{ndctl.FsdaxMode, ndctl.SectorMode}
 	for _, nsmod := range nsmodes {
-		vgs, err := getVolumeGroups(lvm.volumeGroups, string(nsmod))
+		vgs, err := lvm.getVolumeGroups(ctx, groups, string(nsmod))
 		if err != nil {
 			return nil, err
 		}
+		if lvm.thinPool {
+			// thin volumes get carved from the pools, not from volume group free space
+			if vgs, err = lvm.thinPoolsAsVolumeGroups(ctx, vgs); err != nil {
+				return nil, err
+			}
+		}
 
 		for _, vg := range vgs {
 			if vg.free > capacity[string(nsmod)] {
@@ -256,28 +1941,181 @@ func (lvm *pmemLvm) getCapacity() (map[string]uint64, error) {
 	return capacity, nil
 }
 
-func getVolumeGroups(groups []string, wantedTag string) ([]vgInfo, error) {
+// sumCapacity sums up size, free and used space of given volume groups
+func sumCapacity(vgs []vgInfo) (total, free, used uint64) {
+	for _, vg := range vgs {
+		total += vg.size
+		free += vg.free
+	}
+	return total, free, total - free
+}
+
+// candidateVolumeGroups returns the volume groups having at least size bytes free,
+// ordered by preference of the given allocation strategy.
+func candidateVolumeGroups(vgs []vgInfo, size uint64, strategy AllocStrategy) []vgInfo {
+	candidates := []vgInfo{}
+	for _, vg := range vgs {
+		if vg.free >= roundToExtent(size, vg.extentSize) {
+			candidates = append(candidates, vg)
+		}
+	}
+	switch strategy {
+	case BestFit:
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].free < candidates[j].free
+		})
+	case WorstFit:
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].free > candidates[j].free
+		})
+	}
+
+	return candidates
+}
+
+// preferNumaNode moves the volume groups on numaNode to the front, keeping the order otherwise
+func (lvm *pmemLvm) preferNumaNode(vgs []vgInfo, numaNode int) []vgInfo {
+	if numaNode == noNumaNode {
+		return vgs
+	}
+	onNode := func(vg vgInfo) bool {
+		node, ok := lvm.numaNodes[vg.name]
+		return ok && node == numaNode
+	}
+	sorted := append([]vgInfo{}, vgs...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return onNode(sorted[i]) && !onNode(sorted[j])
+	})
+	return sorted
+}
+
+// getVolumeGroups returns those of the given volume groups which are tagged with wantedTag,
+// or all of them if wantedTag is empty
+func (lvm *pmemLvm) getVolumeGroups(ctx context.Context, groups []string, wantedTag string) ([]vgInfo, error) {
+	snapshot := vgSnapshotFrom(ctx)
+	all, ok := snapshot.get(groups)
+	if !ok {
+		all, ok = lvm.vgCache.get(groups)
+	}
+	if !ok {
+		var err error
+		if all, err = lvm.listVolumeGroups(ctx, groups); err != nil {
+			return []vgInfo{}, err
+		}
+		lvm.vgCache.put(groups, all)
+		// cached results were checked already, thin pools get checked instead of their groups
+		if !lvm.thinPool {
+			lvm.watermark.check(all)
+		}
+	}
+	// the time based cache may expire during the request, the snapshot does not
+	snapshot.put(groups, all)
+	vgs := []vgInfo{}
+	for _, vg := range all {
+		if wantedTag == "" || vg.tag == wantedTag {
+			vgs = append(vgs, vg)
+		}
+	}
+
+	return vgs, nil
+}
+
+// listVolumeGroups runs vgs for given groups, bypassing the cache.
+// Groups which do not exist, for example on a partially initialized node, get
+// logged and skipped. It only fails when none of the groups exist.
+func (lvm *pmemLvm) listVolumeGroups(ctx context.Context, groups []string) ([]vgInfo, error) {
 	vgs := []vgInfo{}
-	args := append(vgsArgs, groups...)
-	output, err := pmemexec.RunCommand("vgs", args...)
-	if err != nil {
-		return vgs, fmt.Errorf("vgs failure: %s", err.Error())
-	}
-	for _, line := range strings.SplitN(output, "\n", len(groups)) {
-		fields := strings.Fields(strings.TrimSpace(line))
-		if len(fields) != 4 {
-			return vgs, fmt.Errorf("Failed to parse vgs output line: %s", line)
-		}
-		tag := fields[3]
-		if tag == wantedTag {
-			vg := vgInfo{}
-			vg.name = fields[0]
-			vg.size, _ = strconv.ParseUint(fields[1], 10, 64)
-			vg.free, _ = strconv.ParseUint(fields[2], 10, 64)
-			vg.tag = tag
+	if len(groups) == 0 {
+		// vgs without names would list all groups
+		return vgs, nil
+	}
+	args := append(lvm.vgsArgs(), groups...)
+	output, err := lvm.runCommand(ctx, "vgs", args...)
+	if err != nil {
+		// vgs fails when any of the named groups is missing, but still reports the others
+		output = lvm.reportedGroups(output, groups)
+	}
+	found, parseErr := lvm.parseVGS(output)
+	if parseErr != nil {
+		return vgs, parseErr
+	}
+	// lines are matched by name, vgs sorts its output and may leave out groups
+	for _, name := range groups {
+		if vg, ok := found[name]; ok {
 			vgs = append(vgs, vg)
+		} else {
+			lvm.logger(ctx).V(2).Info("Volume group not found", "vg", name)
+		}
+	}
+	if len(vgs) == 0 && len(groups) > 0 {
+		if err != nil {
+			return vgs, fmt.Errorf("vgs failure: none of the volume groups %s exist: %w", strings.Join(groups, ", "), err)
+		}
+		return vgs, fmt.Errorf("vgs failure: none of the volume groups %s exist", strings.Join(groups, ", "))
+	}
+
+	return vgs, nil
+}
+
+// reportedGroups returns the part of the output of a failed vgs run with the rows of
+// given groups, without the error messages mixed into it
+func (lvm *pmemLvm) reportedGroups(output string, groups []string) string {
+	if lvm.jsonReports {
+		start, end := strings.Index(output, "{"), strings.LastIndex(output, "}")
+		if start < 0 || end < start {
+			return "{}"
+		}
+		return output[start : end+1]
+	}
+	return namedRows(output, groups)
+}
+
+// namedRows keeps the lines of vgs output which start with one of the names
+func namedRows(output string, names []string) string {
+	wanted := map[string]bool{}
+	for _, name := range names {
+		wanted[name] = true
+	}
+	rows := []string{}
+	for _, line := range strings.Split(output, "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 && wanted[fields[0]] {
+			rows = append(rows, line)
 		}
 	}
+	return strings.Join(rows, "\n")
+}
 
+// parseVGSOutput parses the output of vgs for vgsArgs, indexed by volume group name
+func parseVGSOutput(output string) (map[string]vgInfo, error) {
+	vgs := map[string]vgInfo{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("Failed to parse vgs output line: %s", line)
+		}
+		vg, err := parseVGSFields(fields, line)
+		if err != nil {
+			return nil, err
+		}
+		vgs[vg.name] = vg
+	}
 	return vgs, nil
 }
+
+// parseVGSFields converts the values of vgsColumns, in that order, found in the vgs output
+// part source
+func parseVGSFields(fields []string, source string) (vgInfo, error) {
+	vg := vgInfo{}
+	vg.name = fields[0]
+	for i, value := range []*uint64{&vg.size, &vg.free, &vg.extentSize} {
+		var err error
+		if *value, err = parseBytes(fields[i+1]); err != nil {
+			return vgInfo{}, fmt.Errorf("Failed to parse %s in vgs output line %q: %w", vgsColumns[i+1], source, err)
+		}
+	}
+	vg.tag = fields[4]
+	return vg, nil
+}
@@ -0,0 +1,4985 @@
+package pmdmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/intel/pmem-csi/pkg/ndctl"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestPmemDeviceManager(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "PMEM Device Manager Suite")
+}
+
+// fakeRunner records commands instead of running them.
+// Output and result of each command come from handler, no handler means success with empty output.
+// ctxHandler replaces handler for commands which need the context.
+type fakeRunner struct {
+	mutex      sync.Mutex
+	calls      []string
+	handler    func(cmd string, args ...string) (string, error)
+	ctxHandler func(ctx context.Context, cmd string, args ...string) (string, error)
+}
+
+func (r *fakeRunner) Run(ctx context.Context, cmd string, args ...string) (string, error) {
+	r.mutex.Lock()
+	r.calls = append(r.calls, strings.Join(append([]string{cmd}, args...), " "))
+	handler, ctxHandler := r.handler, r.ctxHandler
+	r.mutex.Unlock()
+	if ctxHandler != nil {
+		return ctxHandler(ctx, cmd, args...)
+	}
+	if handler == nil {
+		return "", nil
+	}
+	return handler(cmd, args...)
+}
+
+// commands returns the recorded calls of the given command
+func (r *fakeRunner) commands(cmd string) []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	calls := []string{}
+	for _, call := range r.calls {
+		if strings.HasPrefix(call, cmd+" ") || call == cmd {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// newFakeLvm returns a manager for given volume groups whose commands go to runner
+func newFakeLvm(runner *fakeRunner, volumeGroups ...string) *pmemLvm {
+	lvm, err := newPmemLvm(LVMConfig{})
+	Expect(err).NotTo(HaveOccurred())
+	lvm.runner = runner
+	lvm.volumeGroups = volumeGroups
+	return lvm
+}
+
+// BenchmarkLookupDevice compares looking up one device with lvs against listing all of them,
+// collected in a map or streamed
+func BenchmarkLookupDevice(b *testing.B) {
+	var all strings.Builder
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&all, "  vol%d|/dev/null|4194304|uuid-vol%d|ndbus0region0fsdax||||\n", i, i)
+	}
+	runner := &fakeRunner{
+		handler: func(cmd string, args ...string) (string, error) {
+			for _, arg := range args {
+				if arg == "lv_name=vol4999" {
+					return "  vol4999|/dev/null|4194304|uuid-vol4999|ndbus0region0fsdax||||\n", nil
+				}
+			}
+			return all.String(), nil
+		},
+	}
+	lvm, err := newPmemLvm(LVMConfig{Logger: DiscardLogger()})
+	if err != nil {
+		b.Fatal(err)
+	}
+	lvm.runner = runner
+	lvm.volumeGroups = []string{"ndbus0region0fsdax"}
+
+	b.Run("single", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			runner.calls = nil
+			if _, err := lvm.getUncachedDevice(context.Background(), "vol4999", lvm.volumeGroups...); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("all", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			runner.calls = nil
+			devices, err := lvm.listDevices(context.Background(), lvm.volumeGroups...)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, ok := devices["vol4999"]; !ok {
+				b.Fatal("vol4999 not found")
+			}
+		}
+	})
+	b.Run("stream", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			runner.calls = nil
+			found := false
+			err := lvm.ForEachDevice(context.Background(), func(dev PmemDeviceInfo) error {
+				if dev.Name == "vol4999" {
+					found = true
+					return ErrStopIteration
+				}
+				return nil
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			if !found {
+				b.Fatal("vol4999 not found")
+			}
+		}
+	})
+}
+
+// fakeNamespace is a namespace of a fakeRegion
+type fakeNamespace struct {
+	name, blockDevice string
+	mode              ndctl.NamespaceMode
+	size              uint64
+}
+
+func (ns fakeNamespace) Name() string              { return ns.name }
+func (ns fakeNamespace) Mode() ndctl.NamespaceMode { return ns.mode }
+func (ns fakeNamespace) Size() uint64              { return ns.size }
+func (ns fakeNamespace) BlockDeviceName() string   { return ns.blockDevice }
+
+// fakeRegion replaces a region of the ndctl context
+type fakeRegion struct {
+	name      string
+	size      uint64
+	available uint64
+	numaNode  int
+	serials   []string
+	nsList    []initNamespace
+	created   []ndctl.CreateNamespaceOpts
+}
+
+func (r *fakeRegion) DeviceName() string         { return r.name }
+func (r *fakeRegion) busName() string            { return "ndbus0" }
+func (r *fakeRegion) Size() uint64               { return r.size }
+func (r *fakeRegion) AvailableSize() uint64      { return r.available }
+func (r *fakeRegion) MaxAvailableExtent() uint64 { return r.available }
+func (r *fakeRegion) NumaNode() int              { return r.numaNode }
+func (r *fakeRegion) dimmSerials() []string      { return r.serials }
+
+// accepted fails the test, there are no ndctl objects behind a fakeRegion which a RegionFilter
+// could check. Tests filter with RegionInfoFilter instead.
+func (r *fakeRegion) accepted(filter RegionFilter) bool {
+	Fail("RegionFilter called for fake region " + r.name)
+	return false
+}
+func (r *fakeRegion) vgName(nsmode ndctl.NamespaceMode) string {
+	return "ndbus0" + r.name + string(nsmode)
+}
+func (r *fakeRegion) namespaces() []initNamespace { return r.nsList }
+func (r *fakeRegion) createNamespace(opts ndctl.CreateNamespaceOpts) error {
+	r.created = append(r.created, opts)
+	r.nsList = append(r.nsList, fakeNamespace{
+		name:        opts.Name,
+		mode:        opts.Mode,
+		size:        opts.Size,
+		blockDevice: fmt.Sprintf("pmem%d", len(r.nsList)),
+	})
+	r.available -= opts.Size
+	return nil
+}
+
+// fakeRegions is a regionSource with fixed regions
+type fakeRegions []initRegion
+
+func (r fakeRegions) withRegions(fn func(regions []initRegion) error) error {
+	return fn(r)
+}
+
+// deviceNames returns the names of the devices
+func deviceNames(devices []PmemDeviceInfo) []string {
+	names := []string{}
+	for _, dev := range devices {
+		names = append(names, dev.Name)
+	}
+	return names
+}
+
+// recordingLogger records messages with their "progress" value
+type recordingLogger struct {
+	messages *[]string
+}
+
+func (l recordingLogger) Info(msg string, keysAndValues ...interface{}) {
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		switch keysAndValues[i] {
+		case "progress", "delta":
+			msg += fmt.Sprintf(" %v=%v", keysAndValues[i], keysAndValues[i+1])
+		}
+	}
+	*l.messages = append(*l.messages, msg)
+}
+func (l recordingLogger) Error(err error, msg string, keysAndValues ...interface{}) {}
+func (l recordingLogger) V(level int) Logger                                        { return l }
+func (l recordingLogger) WithValues(keysAndValues ...interface{}) Logger            { return l }
+
+// fakeKeys is a KeyProvider returning the same key for all devices
+type fakeKeys string
+
+func (k fakeKeys) Key(ctx context.Context, name string) ([]byte, error) {
+	return []byte(k), nil
+}
+
+var _ = Describe("pmem-lvm", func() {
+	Context("Allocation strategy", func() {
+		vgs := []vgInfo{
+			{name: "vg-medium", free: 8 << 30},
+			{name: "vg-small", free: 1 << 30},
+			{name: "vg-large", free: 16 << 30},
+			{name: "vg-tight", free: 4 << 30},
+		}
+		var size uint64 = 4 << 30
+
+		type cases struct {
+			strategy AllocStrategy
+			expected []string
+		}
+		for _, c := range []cases{
+			{FirstFit, []string{"vg-medium", "vg-large", "vg-tight"}},
+			{BestFit, []string{"vg-tight", "vg-medium", "vg-large"}},
+			{WorstFit, []string{"vg-large", "vg-medium", "vg-tight"}},
+		} {
+			c := c
+			It(string(c.strategy), func() {
+				Expect(vgNames(candidateVolumeGroups(vgs, size, c.strategy))).To(Equal(c.expected))
+			})
+		}
+
+		It("no group fits", func() {
+			Expect(candidateVolumeGroups(vgs, 32<<30, BestFit)).To(BeEmpty())
+		})
+
+		It("unknown strategy", func() {
+			_, err := NewPmemDeviceManagerLVMWithStrategy("no-such-strategy")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("NUMA", func() {
+		var runner *fakeRunner
+		var lvm *pmemLvm
+		var lvs string
+
+		BeforeEach(func() {
+			lvs = ""
+			runner = &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					switch cmd {
+					case "vgs":
+						return "  ndbus0region0fsdax 17179869184 8589934592 4194304 fsdax\n" +
+							"  ndbus0region1fsdax 17179869184 4294967296 4194304 fsdax\n" +
+							"  ndbus0region2fsdax 17179869184 8589934592 4194304 fsdax\n", nil
+					case "lvs":
+						return lvs, nil
+					case "lvcreate":
+						lvs = "  vol1|/dev/null|4194304|uuid-vol1|" + args[len(args)-1] + "||||\n"
+					}
+					return "", nil
+				},
+			}
+			lvm = newFakeLvm(runner, "ndbus0region0fsdax", "ndbus0region1fsdax", "ndbus0region2fsdax")
+			lvm.numaNodes = map[string]int{
+				"ndbus0region0fsdax": 0,
+				"ndbus0region1fsdax": 1,
+				"ndbus0region2fsdax": 1,
+			}
+		})
+
+		It("prefers groups on node", func() {
+			vgs := []vgInfo{{name: "ndbus0region0fsdax"}, {name: "ndbus0region1fsdax"}, {name: "ndbus0region2fsdax"}}
+			Expect(vgNames(lvm.preferNumaNode(vgs, 1))).To(Equal([]string{"ndbus0region1fsdax", "ndbus0region2fsdax", "ndbus0region0fsdax"}))
+			Expect(vgNames(lvm.preferNumaNode(vgs, noNumaNode))).To(Equal([]string{"ndbus0region0fsdax", "ndbus0region1fsdax", "ndbus0region2fsdax"}))
+		})
+
+		It("creates on node", func() {
+			err := lvm.CreateDeviceOnNode(context.Background(), "vol1", 4<<20, "fsdax", 1)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner.commands("lvcreate")).To(Equal([]string{"lvcreate -Zn -L 4 -Wy --yes -n vol1 ndbus0region1fsdax"}))
+		})
+
+		It("falls back to other nodes", func() {
+			err := lvm.CreateDeviceOnNode(context.Background(), "vol1", 6<<30, "fsdax", 1)
+			Expect(err).NotTo(HaveOccurred())
+			// region1 is too small, region2 on the same node comes before region0
+			Expect(runner.commands("lvcreate")).To(Equal([]string{"lvcreate -Zn -L 6144 -Wy --yes -n vol1 ndbus0region2fsdax"}))
+		})
+
+		It("unknown node", func() {
+			err := lvm.CreateDeviceOnNode(context.Background(), "vol1", 4<<20, "fsdax", 7)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner.commands("lvcreate")).To(Equal([]string{"lvcreate -Zn -L 4 -Wy --yes -n vol1 ndbus0region0fsdax"}))
+		})
+	})
+
+	Context("Extent size", func() {
+		It("aligns sizes", func() {
+			Expect(roundToExtent(40<<20, 32<<20)).To(Equal(uint64(64 << 20)))
+			Expect(roundToExtent(64<<20, 32<<20)).To(Equal(uint64(64 << 20)))
+			Expect(roundToExtent(5<<20+1, 1<<20)).To(Equal(uint64(6 << 20)))
+			Expect(roundToExtent(5<<20+1, 0)).To(Equal(uint64(5<<20 + 1)))
+			Expect(lvSize(5<<20 + 1)).To(Equal("6"))
+		})
+
+		It("rounds at extent boundaries", func() {
+			const extent = 4 << 20
+			Expect(roundToExtent(0, extent)).To(Equal(uint64(0)))
+			Expect(roundToExtent(1, extent)).To(Equal(uint64(extent)))
+			Expect(roundToExtent(extent, extent)).To(Equal(uint64(extent)))
+			Expect(roundToExtent(extent+1, extent)).To(Equal(uint64(2 * extent)))
+			Expect(roundToExtent(2*extent-1, extent)).To(Equal(uint64(2 * extent)))
+			Expect(lvSize(0)).To(Equal("0"))
+			Expect(lvSize(1 << 20)).To(Equal("1"))
+			Expect(lvSize(1<<20 + 1)).To(Equal("2"))
+			extents, err := lvExtents(extent+1, extent)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(extents).To(Equal("2"))
+		})
+
+		It("skips groups too small after alignment", func() {
+			vgs := []vgInfo{
+				{name: "vg-large-extents", free: 48 << 20, extentSize: 32 << 20},
+				{name: "vg-small-extents", free: 48 << 20, extentSize: 4 << 20},
+			}
+			Expect(vgNames(candidateVolumeGroups(vgs, 40<<20, FirstFit))).To(Equal([]string{"vg-small-extents"}))
+		})
+
+		It("creates aligned device", func() {
+			lvs := ""
+			runner := &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					switch cmd {
+					case "vgs":
+						return "  ndbus0region0fsdax 17179869184 8589934592 33554432 fsdax\n", nil
+					case "lvs":
+						return lvs, nil
+					case "lvcreate":
+						lvs = "  vol1|/dev/null|67108864|uuid-vol1|ndbus0region0fsdax||||\n"
+					}
+					return "", nil
+				},
+			}
+			lvm := newFakeLvm(runner, "ndbus0region0fsdax")
+			dev, err := lvm.CreateDeviceInfo(context.Background(), "vol1", 40<<20, "fsdax")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner.commands("lvcreate")).To(Equal([]string{"lvcreate -Zn -L 64 -Wy --yes -n vol1 ndbus0region0fsdax"}))
+			Expect(dev.Size).To(Equal(uint64(64 << 20)))
+		})
+	})
+
+	Context("Initialization", func() {
+		It("bare region", func() {
+			region := &fakeRegion{name: "region0", size: 64 << 30, available: 64 << 30}
+			runner := &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					if cmd == "vgdisplay" {
+						return "", fmt.Errorf("exit status 5")
+					}
+					return "", nil
+				},
+			}
+			err := ensureVolumeGroups(context.Background(), []initRegion{region}, RegionInit{UseForFsdax: 50, UseForSector: 25}, runner, DiscardLogger())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(region.created).To(Equal([]ndctl.CreateNamespaceOpts{
+				{Name: "pmem-csi", Mode: ndctl.FsdaxMode, Size: 32 << 30, Align: 1 << 30},
+				{Name: "pmem-csi", Mode: ndctl.SectorMode, Size: 16 << 30, Align: 1 << 30},
+			}))
+			Expect(runner.commands("vgcreate")).To(Equal([]string{
+				"vgcreate --force ndbus0region0fsdax /dev/pmem0",
+				"vgcreate --force ndbus0region0sector /dev/pmem1",
+			}))
+			Expect(runner.commands("vgchange")).To(Equal([]string{
+				"vgchange --addtag fsdax ndbus0region0fsdax",
+				"vgchange --addtag sector ndbus0region0sector",
+			}))
+		})
+
+		It("prepared region", func() {
+			region := &fakeRegion{name: "region0", size: 64 << 30, available: 32 << 30,
+				nsList: []initNamespace{
+					fakeNamespace{name: "pmem-csi", mode: ndctl.FsdaxMode, size: 32 << 30, blockDevice: "pmem0"},
+					fakeNamespace{name: "other", mode: ndctl.FsdaxMode, size: 16 << 30, blockDevice: "pmem0.1"},
+				},
+			}
+			runner := &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					if cmd == "pvs" {
+						return "  ndbus0region0fsdax\n", nil
+					}
+					return "", nil
+				},
+			}
+			err := ensureVolumeGroups(context.Background(), []initRegion{region}, RegionInit{UseForFsdax: 50}, runner, DiscardLogger())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(region.created).To(BeEmpty())
+			Expect(runner.commands("pvs")).To(Equal([]string{"pvs --noheadings -o vg_name /dev/pmem0"}))
+			Expect(runner.commands("vgcreate")).To(BeEmpty())
+			Expect(runner.commands("vgextend")).To(BeEmpty())
+		})
+
+		It("too small for a namespace", func() {
+			region := &fakeRegion{name: "region0", size: 64 << 30, available: 1 << 30}
+			runner := &fakeRunner{}
+			err := ensureVolumeGroups(context.Background(), []initRegion{region}, RegionInit{UseForFsdax: 100}, runner, DiscardLogger())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(region.created).To(BeEmpty())
+			Expect(runner.calls).To(BeEmpty())
+		})
+
+		It("invalid percentages", func() {
+			Expect(RegionInit{UseForFsdax: 60, UseForSector: 60}.validate()).NotTo(Succeed())
+			Expect(RegionInit{UseForFsdax: -1}.validate()).NotTo(Succeed())
+		})
+	})
+
+	Context("Enumeration", func() {
+		It("describes regions", func() {
+			regions := fakeRegions{
+				&fakeRegion{name: "region0", size: 64 << 30, available: 16 << 30, numaNode: 0, serials: []string{"0x00000001", "0x00000002"}},
+				&fakeRegion{name: "region1", size: 32 << 30, available: 0, numaNode: 1},
+			}
+			infos, err := enumerateRegions(regions)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(infos).To(Equal([]RegionInfo{
+				{
+					Bus:           "ndbus0",
+					Region:        "region0",
+					VolumeGroups:  map[string]string{"fsdax": "ndbus0region0fsdax", "sector": "ndbus0region0sector"},
+					Size:          64 << 30,
+					AvailableSize: 16 << 30,
+					NumaNode:      0,
+					DimmSerials:   []string{"0x00000001", "0x00000002"},
+				},
+				{
+					Bus:           "ndbus0",
+					Region:        "region1",
+					VolumeGroups:  map[string]string{"fsdax": "ndbus0region1fsdax", "sector": "ndbus0region1sector"},
+					Size:          32 << 30,
+					AvailableSize: 0,
+					NumaNode:      1,
+					DimmSerials:   []string{},
+				},
+			}))
+		})
+
+		It("no regions", func() {
+			infos, err := enumerateRegions(fakeRegions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(infos).To(BeEmpty())
+		})
+	})
+
+	Context("LVM version", func() {
+		oldVersion := "  LVM version:     2.02.98(2) (2012-10-15)\n" +
+			"  Library version: 1.02.77 (2012-10-15)\n" +
+			"  Driver version:  4.23.0\n"
+		newVersion := "  LVM version:     2.03.11(2) (2021-01-08)\n" +
+			"  Library version: 1.02.175 (2021-01-08)\n" +
+			"  Driver version:  4.43.0\n" +
+			"  Configuration:   ./configure --build=x86_64-linux-gnu\n"
+		var runner *fakeRunner
+		var lvm *pmemLvm
+		var version string
+
+		BeforeEach(func() {
+			runner = &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					switch cmd {
+					case "lvm":
+						return version, nil
+					case "lvs":
+						if strings.Contains(strings.Join(args, " "), "lv_name,lv_tags") {
+							return "  vol1|pmem-csi.incomplete,pmem-csi.owner=node1\n  vol2|pmem-csi.owner=node1\n", nil
+						}
+						// sizes with unit suffix, as printed by versions which ignore --nosuffix
+						return "  vol1|/dev/ndbus0region0fsdax/vol1|4194304B|uuid-vol1|ndbus0region0fsdax||||\n" +
+							"  vol2|/dev/ndbus0region0fsdax/vol2|8388608B|uuid-vol2|ndbus0region0fsdax||||\n", nil
+					}
+					return "", nil
+				},
+			}
+			lvm = newFakeLvm(runner)
+			lvm.regions = fakeRegions{&fakeRegion{name: "region0"}}
+		})
+
+		It("parses versions", func() {
+			v, err := parseLVMVersion(oldVersion)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(v).To(Equal(lvmVersion{2, 2, 98}))
+			Expect(v.atLeast(lvmSelectionVersion)).To(BeFalse())
+			v, err = parseLVMVersion(newVersion)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(v).To(Equal(lvmVersion{2, 3, 11}))
+			Expect(v.atLeast(lvmSelectionVersion)).To(BeTrue())
+			Expect(v.String()).To(Equal("2.03.11"))
+
+			_, err = parseLVMVersion("  LVM version:     unknown\n")
+			Expect(err).To(HaveOccurred())
+			_, err = parseLVMVersion("")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("current version selects in lvs", func() {
+			version = newVersion
+			Expect(lvm.init(context.Background())).To(Succeed())
+			Expect(lvm.noSelection).To(BeFalse())
+			dev, err := lvm.getUncachedDevice(context.Background(), "vol2", "ndbus0region0fsdax")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dev.Size).To(Equal(uint64(8 << 20)))
+			Expect(runner.commands("lvs")).To(ContainElement(
+				"lvs --noheadings --nosuffix --separator | -o lv_name,lv_path,lv_size,lv_uuid,vg_name,lv_tags,lv_dm_path,origin,lv_attr --units B -S lv_name=vol2 ndbus0region0fsdax"))
+		})
+
+		It("old version filters devices", func() {
+			version = oldVersion
+			Expect(lvm.init(context.Background())).To(Succeed())
+			Expect(lvm.noSelection).To(BeTrue())
+			Expect(lvm.devices).To(HaveLen(2))
+
+			runner.calls = nil
+			dev, err := lvm.getUncachedDevice(context.Background(), "vol2", "ndbus0region0fsdax")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dev.Size).To(Equal(uint64(8 << 20)))
+			devices, err := lvm.ListDevicesWithPrefix(context.Background(), "vol1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(deviceNames(devices)).To(ConsistOf("vol1"))
+			for _, call := range runner.commands("lvs") {
+				Expect(call).NotTo(ContainSubstring("-S"))
+			}
+
+			runner.calls = nil
+			incomplete, err := lvm.ListIncomplete(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(deviceNames(incomplete)).To(ConsistOf("vol1"))
+			Expect(runner.commands("lvs")).To(ContainElement("lvs --noheadings --separator | -o lv_name,lv_tags ndbus0region0fsdax ndbus0region0sector"))
+			for _, call := range runner.commands("lvs") {
+				Expect(call).NotTo(ContainSubstring("-S"))
+			}
+		})
+
+		It("old version with thin pools", func() {
+			version = oldVersion
+			lvm.thinPool = true
+			Expect(lvm.init(context.Background())).To(Succeed())
+			Expect(lvm.noSelection).To(BeTrue())
+		})
+
+		It("unknown version", func() {
+			version = "garbage"
+			Expect(lvm.init(context.Background())).To(Succeed())
+			Expect(lvm.noSelection).To(BeFalse())
+		})
+	})
+
+	Context("Discovery", func() {
+		var runner *fakeRunner
+		var lvm *pmemLvm
+
+		BeforeEach(func() {
+			runner = &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					// only fsdax volume groups exist
+					if cmd == "vgs" && !strings.HasSuffix(args[len(args)-1], "fsdax") {
+						return "", exitError(5)
+					}
+					return "", nil
+				},
+			}
+			lvm = newFakeLvm(runner)
+			lvm.regions = fakeRegions{
+				&fakeRegion{name: "region0", numaNode: 0},
+				&fakeRegion{name: "region1", numaNode: 1},
+				&fakeRegion{name: "region2", numaNode: 1},
+			}
+		})
+
+		It("all regions", func() {
+			Expect(lvm.init(context.Background())).To(Succeed())
+			Expect(lvm.volumeGroups).To(Equal([]string{"ndbus0region0fsdax", "ndbus0region1fsdax", "ndbus0region2fsdax"}))
+			Expect(lvm.numaNodes).To(Equal(map[string]int{"ndbus0region0fsdax": 0, "ndbus0region1fsdax": 1, "ndbus0region2fsdax": 1}))
+		})
+
+		It("filtered regions", func() {
+			filtered := []RegionInfo{}
+			lvm.regionInfoFilter = func(info RegionInfo) bool {
+				filtered = append(filtered, info)
+				return info.Region == "region1"
+			}
+			Expect(lvm.init(context.Background())).To(Succeed())
+			Expect(filtered).To(HaveLen(3))
+			Expect(filtered[1].Bus).To(Equal("ndbus0"))
+			Expect(filtered[1].NumaNode).To(Equal(1))
+			Expect(filtered[1].VolumeGroups).To(HaveKeyWithValue("fsdax", "ndbus0region1fsdax"))
+			Expect(lvm.volumeGroups).To(Equal([]string{"ndbus0region1fsdax"}))
+			Expect(runner.commands("vgs")).To(Equal([]string{"vgs ndbus0region1fsdax", "vgs ndbus0region1sector"}))
+			Expect(runner.commands("lvs")).To(Equal([]string{
+				"lvs --noheadings --nosuffix --separator | -o lv_name,lv_path,lv_size,lv_uuid,vg_name,lv_tags,lv_dm_path,origin,lv_attr --units B ndbus0region1fsdax",
+			}))
+		})
+
+		It("filtered by NUMA node and DIMM serials", func() {
+			lvm.regions = fakeRegions{
+				&fakeRegion{name: "region0", numaNode: 0, serials: []string{"0x00000001"}},
+				&fakeRegion{name: "region1", numaNode: 1, serials: []string{"0x00000002"}},
+				&fakeRegion{name: "region2", numaNode: 1, serials: []string{"0x00000003"}},
+			}
+			lvm.regionInfoFilter = func(info RegionInfo) bool {
+				return info.NumaNode == 1 && len(info.DimmSerials) == 1 && info.DimmSerials[0] != "0x00000002"
+			}
+			Expect(lvm.init(context.Background())).To(Succeed())
+			Expect(lvm.volumeGroups).To(Equal([]string{"ndbus0region2fsdax"}))
+		})
+
+		It("configures filter", func() {
+			filter := func(info RegionInfo) bool { return true }
+			lvm, err := newPmemLvm(LVMConfig{RegionInfoFilter: filter})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(lvm.regionInfoFilter).NotTo(BeNil())
+			Expect(lvm.regionFilter).To(BeNil())
+		})
+
+		It("pools by DIMM serial", func() {
+			lvm.regions = fakeRegions{
+				&fakeRegion{name: "region0", serials: []string{"0x00000001", "0x00000002"}},
+				&fakeRegion{name: "region1", serials: []string{"0x0000000A"}},
+				&fakeRegion{name: "region2", serials: []string{"0x00000003"}},
+			}
+			lvm.pools = map[string][]string{"bulk": {"ndbus0region2fsdax"}}
+			lvm.poolSerials = map[string][]string{
+				"fast":   {"0x0000000a"},
+				"bulk":   {"0x00000002"},
+				"absent": {"0x00000042"},
+			}
+			Expect(lvm.init(context.Background())).To(Succeed())
+			fast, err := lvm.poolGroups("fast")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fast).To(Equal([]string{"ndbus0region1fsdax"}))
+			bulk, err := lvm.poolGroups("bulk")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(bulk).To(Equal([]string{"ndbus0region0fsdax", "ndbus0region2fsdax"}))
+			absent, err := lvm.poolGroups("absent")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(absent).To(BeEmpty())
+		})
+
+		It("region on DIMMs of two pools", func() {
+			lvm.regions = fakeRegions{&fakeRegion{name: "region0", serials: []string{"0x00000001", "0x00000002"}}}
+			lvm.poolSerials = map[string][]string{"fast": {"0x00000001"}, "bulk": {"0x00000002"}}
+			Expect(lvm.init(context.Background())).NotTo(Succeed())
+		})
+
+		It("DIMM serial in two pools", func() {
+			_, err := newPmemLvm(LVMConfig{PoolSerials: map[string][]string{"fast": {"0x00000001"}, "bulk": {"0X00000001"}}})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("no buses", func() {
+			lvm.regions = fakeRegions{}
+			err := lvm.init(context.Background())
+			Expect(errors.Is(err, ErrNoVolumeGroups)).To(BeTrue())
+			Expect(err.Error()).To(ContainSubstring("0 active regions"))
+			Expect(runner.calls).To(Equal([]string{"lvm version"}))
+		})
+
+		It("no volume groups", func() {
+			runner.handler = func(cmd string, args ...string) (string, error) {
+				return "", exitError(5)
+			}
+			err := lvm.init(context.Background())
+			Expect(errors.Is(err, ErrNoVolumeGroups)).To(BeTrue())
+			Expect(err.Error()).To(ContainSubstring("3 active regions, 3 of them accepted"))
+			Expect(runner.commands("lvs")).To(BeEmpty())
+		})
+	})
+
+	Context("Capacity", func() {
+		It("region available size", func() {
+			lvm := newFakeLvm(&fakeRunner{})
+			lvm.regions = fakeRegions{
+				&fakeRegion{name: "region0", size: 64 << 30, available: 16 << 30},
+				&fakeRegion{name: "region1", size: 64 << 30, available: 0},
+				&fakeRegion{name: "region2", size: 32 << 30, available: 4 << 30},
+			}
+			available, err := lvm.GetRegionAvailableSize(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(available).To(Equal(uint64(20 << 30)))
+		})
+
+		It("no regions", func() {
+			lvm := newFakeLvm(&fakeRunner{})
+			lvm.regions = fakeRegions{}
+			available, err := lvm.GetRegionAvailableSize(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(available).To(BeZero())
+		})
+
+		It("sums up all volume groups", func() {
+			vgs := []vgInfo{
+				{name: "vg1", size: 16 << 30, free: 8 << 30},
+				{name: "vg2", size: 32 << 30, free: 32 << 30},
+				{name: "vg3", size: 4 << 30, free: 0},
+			}
+			total, free, used := sumCapacity(vgs)
+			Expect(total).To(Equal(uint64(52 << 30)))
+			Expect(free).To(Equal(uint64(40 << 30)))
+			Expect(used).To(Equal(uint64(12 << 30)))
+		})
+
+		It("no volume groups", func() {
+			total, free, used := sumCapacity(nil)
+			Expect(total).To(BeZero())
+			Expect(free).To(BeZero())
+			Expect(used).To(BeZero())
+		})
+
+		Context("scoped", func() {
+			var runner *fakeRunner
+			var lvm *pmemLvm
+
+			BeforeEach(func() {
+				runner = &fakeRunner{
+					handler: func(cmd string, args ...string) (string, error) {
+						if cmd != "vgs" {
+							return "", nil
+						}
+						if len(args) == 1 {
+							// discovery, all groups exist
+							return "", nil
+						}
+						return "  ndbus0region0fsdax 17179869184 8589934592 4194304 fsdax\n" +
+							"  ndbus0region0sector 17179869184 2147483648 4194304 sector\n" +
+							"  ndbus0region1fsdax 34359738368 17179869184 4194304 fsdax\n" +
+							"  ndbus0region1sector 17179869184 1073741824 4194304 sector\n", nil
+					},
+				}
+				lvm = newFakeLvm(runner)
+				lvm.regions = fakeRegions{
+					&fakeRegion{name: "region0", numaNode: 0},
+					&fakeRegion{name: "region1", numaNode: 1},
+				}
+				Expect(lvm.init(context.Background())).To(Succeed())
+			})
+
+			It("volume group", func() {
+				free, err := lvm.GetCapacityForVolumeGroup(context.Background(), "ndbus0region1fsdax")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(free).To(Equal(uint64(16 << 30)))
+				free, err = lvm.GetCapacityForVolumeGroup(context.Background(), "ndbus0region0sector")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(free).To(Equal(uint64(2 << 30)))
+			})
+
+			It("unknown volume group", func() {
+				_, err := lvm.GetCapacityForVolumeGroup(context.Background(), "ndbus0region2fsdax")
+				Expect(err).To(HaveOccurred())
+			})
+
+			It("region", func() {
+				capacity, err := lvm.GetCapacityForRegion(context.Background(), "region0")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(capacity).To(Equal(map[string]uint64{"fsdax": 8 << 30, "sector": 2 << 30}))
+				capacity, err = lvm.GetCapacityForRegion(context.Background(), "region1")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(capacity).To(Equal(map[string]uint64{"fsdax": 16 << 30, "sector": 1 << 30}))
+			})
+
+			It("unknown region", func() {
+				_, err := lvm.GetCapacityForRegion(context.Background(), "region2")
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
+		It("free space watermark", func() {
+			free := map[string]int{"ndbus0region0fsdax": 8, "ndbus0region1fsdax": 8}
+			runner := &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					return fmt.Sprintf("  ndbus0region0fsdax 17179869184 %d 4194304 fsdax\n", free["ndbus0region0fsdax"]<<30) +
+						fmt.Sprintf("  ndbus0region1fsdax 17179869184 %d 4194304 fsdax\n", free["ndbus0region1fsdax"]<<30), nil
+				},
+			}
+			lvm := newFakeLvm(runner, "ndbus0region0fsdax", "ndbus0region1fsdax")
+			lvm.vgCache = newVGCache(-1)
+			crossed := []VolumeGroupInfo{}
+			lvm.SetCapacityWatermark(0.25, func(vg VolumeGroupInfo) {
+				crossed = append(crossed, vg)
+			})
+			capacity := func() {
+				_, err := lvm.GetCapacity(context.Background())
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			capacity()
+			Expect(crossed).To(BeEmpty())
+
+			// crossing fires once, also when checked again
+			free["ndbus0region0fsdax"] = 2
+			capacity()
+			capacity()
+			Expect(crossed).To(Equal([]VolumeGroupInfo{
+				{Name: "ndbus0region0fsdax", Size: 16 << 30, Free: 2 << 30, ExtentSize: 4 << 20, Mode: "fsdax"},
+			}))
+
+			// exactly at the watermark is not below it
+			free["ndbus0region1fsdax"] = 4
+			capacity()
+			Expect(crossed).To(HaveLen(1))
+
+			// rising above and dropping again is another crossing
+			free["ndbus0region0fsdax"] = 8
+			capacity()
+			free["ndbus0region0fsdax"] = 1
+			capacity()
+			Expect(crossed).To(HaveLen(2))
+			Expect(crossed[1].Name).To(Equal("ndbus0region0fsdax"))
+			Expect(crossed[1].Free).To(Equal(uint64(1 << 30)))
+
+			lvm.SetCapacityWatermark(0, nil)
+			free["ndbus0region1fsdax"] = 0
+			capacity()
+			Expect(crossed).To(HaveLen(2))
+		})
+	})
+
+	Context("Resize", func() {
+		var lvm *pmemLvm
+
+		BeforeEach(func() {
+			var err error
+			lvm, err = newPmemLvm(LVMConfig{})
+			Expect(err).NotTo(HaveOccurred())
+			lvm.devices["vol1"] = PmemDeviceInfo{Name: "vol1", Path: "/dev/ndbus0region0fsdax/vol1", Size: 8 << 30}
+		})
+
+		It("shrinking disabled", func() {
+			err := lvm.ResizeDevice(context.Background(), "vol1", 4<<30)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("shrinking is disabled"))
+		})
+
+		It("same size", func() {
+			err := lvm.ResizeDevice(context.Background(), "vol1", 8<<30)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("unknown device", func() {
+			err := lvm.ResizeDevice(context.Background(), "vol2", 8<<30)
+			Expect(errors.Is(err, ErrDeviceNotFound)).To(BeTrue())
+		})
+
+		It("size conversion", func() {
+			Expect(lvSize(8 << 30)).To(Equal("8192"))
+			Expect(deviceVolumeGroup(lvm.devices["vol1"])).To(Equal("ndbus0region0fsdax"))
+			Expect(deviceVolumeGroup(PmemDeviceInfo{Path: "/dev/null", VolumeGroup: "vg1"})).To(Equal("vg1"))
+		})
+	})
+
+	Context("Create", func() {
+		It("duplicate name", func() {
+			lvm, err := newPmemLvm(LVMConfig{})
+			Expect(err).NotTo(HaveOccurred())
+			lvm.devices["vol1"] = PmemDeviceInfo{Name: "vol1", Path: "/dev/ndbus0region0fsdax/vol1", Size: 8 << 30}
+
+			exists, err := lvm.DeviceExists(context.Background(), "vol1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exists).To(BeTrue())
+
+			err = lvm.CreateDevice(context.Background(), "vol1", 8<<30, "fsdax")
+			Expect(err).To(HaveOccurred())
+			Expect(errors.Is(err, ErrDeviceExists)).To(BeTrue())
+		})
+
+		type modeCase struct {
+			nsmode, expected string
+		}
+		for _, c := range []modeCase{
+			{"", "fsdax"},
+			{"fsdax", "fsdax"},
+			{"memory", "fsdax"},
+			{"sector", "sector"},
+			{"dax", ""},
+			{"raw", ""},
+			{"foo", ""},
+		} {
+			c := c
+			It(fmt.Sprintf("mode %q", c.nsmode), func() {
+				nsmode, err := lvmNamespaceMode(c.nsmode)
+				if c.expected == "" {
+					Expect(err).To(HaveOccurred())
+				} else {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(nsmode).To(Equal(c.expected))
+				}
+			})
+		}
+
+		It("extra lvcreate arguments", func() {
+			lvs := ""
+			runner := &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					switch cmd {
+					case "vgs":
+						return "  ndbus0region0fsdax 17179869184 8589934592 4194304 fsdax\n", nil
+					case "lvs":
+						return lvs, nil
+					case "lvcreate":
+						lvs = "  vol1|/dev/null|4194304|uuid-vol1|ndbus0region0fsdax||||\n"
+					}
+					return "", nil
+				},
+			}
+			lvm, err := newPmemLvm(LVMConfig{LVCreateExtraArgs: []string{"--type", "linear", "--alloc", "normal"}})
+			Expect(err).NotTo(HaveOccurred())
+			lvm.runner = runner
+			lvm.volumeGroups = []string{"ndbus0region0fsdax"}
+			err = lvm.CreateDevice(context.Background(), "vol1", 4<<20, "fsdax")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner.commands("lvcreate")).To(Equal([]string{
+				"lvcreate -Zn -L 4 -Wy --yes --type linear --alloc normal -n vol1 ndbus0region0fsdax",
+			}))
+		})
+
+		type extentCase struct {
+			size, extentSize uint64
+			expected         string
+		}
+		for _, c := range []extentCase{
+			{4 << 20, 4 << 20, "1"},
+			{5 << 20, 4 << 20, "2"},
+			{1, 4 << 20, "1"},
+			{3 << 19, 512 << 10, "3"},
+			{1 << 30, 32 << 20, "32"},
+			{1<<30 + 1, 32 << 20, "33"},
+			{0, 4 << 20, ""},
+			{4 << 20, 0, ""},
+			{math.MaxUint64, 4 << 20, ""},
+		} {
+			c := c
+			It(fmt.Sprintf("extents for size %d and extent size %d", c.size, c.extentSize), func() {
+				extents, err := lvExtents(c.size, c.extentSize)
+				if c.expected == "" {
+					Expect(err).To(HaveOccurred())
+				} else {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(extents).To(Equal(c.expected))
+				}
+			})
+		}
+
+		It("allocate by extents", func() {
+			lvs := ""
+			runner := &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					switch cmd {
+					case "vgs":
+						return "  ndbus0region0fsdax 17179869184 8589934592 524288 fsdax\n", nil
+					case "lvs":
+						return lvs, nil
+					case "lvcreate":
+						lvs = "  vol1|/dev/null|1572864|uuid-vol1|ndbus0region0fsdax||||\n"
+					}
+					return "", nil
+				},
+			}
+			lvm, err := newPmemLvm(LVMConfig{AllocateByExtents: true})
+			Expect(err).NotTo(HaveOccurred())
+			lvm.runner = runner
+			lvm.volumeGroups = []string{"ndbus0region0fsdax"}
+			dev, err := lvm.CreateDeviceInfo(context.Background(), "vol1", 1<<20+1, "fsdax")
+			Expect(err).NotTo(HaveOccurred())
+			// -L would have asked for 2 MBytes
+			Expect(runner.commands("lvcreate")).To(Equal([]string{"lvcreate -Zn -l 3 -Wy --yes -n vol1 ndbus0region0fsdax"}))
+			Expect(dev.Size).To(Equal(uint64(3 << 19)))
+		})
+
+		for _, args := range [][]string{
+			{"-n", "other"},
+			{"-nother"},
+			{"--name=other"},
+			{"--zero", "n", "-L", "1G"},
+			{"--size", "1G"},
+			{"-l", "100%FREE"},
+			{"--thinpool", "pool"},
+			{"-i", "2"},
+		} {
+			args := args
+			It(fmt.Sprintf("conflicting lvcreate arguments %q", args), func() {
+				_, err := newPmemLvm(LVMConfig{LVCreateExtraArgs: args})
+				Expect(err).To(HaveOccurred())
+			})
+		}
+	})
+
+	Context("Names", func() {
+		type cases struct {
+			name  string
+			valid bool
+		}
+		for _, c := range []cases{
+			{"vol1", true},
+			{"pmem-csi-8c2d7ef6-1c7a-11e9-9b84-deadbeef0001", true},
+			{"a.b+c_d-e", true},
+			{"-", false},
+			{"-vol1", false},
+			{"--help", false},
+			{strings.Repeat("x", 127), true},
+			{strings.Repeat("x", 128), false},
+			{"", false},
+			{".", false},
+			{"..", false},
+			{"vol 1", false},
+			{"vol/1", false},
+			{"snapshot1", false},
+			{"vol_tdata", false},
+		} {
+			c := c
+			It(fmt.Sprintf("%q", c.name), func() {
+				err := validateLVName(c.name)
+				if c.valid {
+					Expect(err).NotTo(HaveOccurred())
+				} else {
+					Expect(errors.Is(err, ErrInvalidName)).To(BeTrue())
+				}
+			})
+		}
+
+		It("rejected before lvcreate", func() {
+			runner := &fakeRunner{}
+			lvm := newFakeLvm(runner, "ndbus0region0fsdax")
+			err := lvm.CreateDevice(context.Background(), "-vol1", 4<<20, "fsdax")
+			Expect(errors.Is(err, ErrInvalidName)).To(BeTrue())
+			Expect(runner.calls).To(BeEmpty())
+		})
+	})
+
+	Context("Commands", func() {
+		var runner *fakeRunner
+		var lvm *pmemLvm
+		var lvs string
+
+		BeforeEach(func() {
+			lvs = ""
+			runner = &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					switch cmd {
+					case "vgs":
+						return "  ndbus0region0fsdax 17179869184 8589934592 4194304 fsdax\n", nil
+					case "lvs":
+						return lvs, nil
+					case "lvcreate":
+						// /dev/null passes the device checks before clearing a new device
+						lvs = "  vol1|/dev/null|4194304|Gx1cNh-B7kJ-0y2q-Lm3s-pT4r-Vw5x-Yz6aBc|ndbus0region0fsdax||||\n"
+					}
+					return "", nil
+				},
+			}
+			lvm = newFakeLvm(runner, "ndbus0region0fsdax")
+		})
+
+		It("create", func() {
+			err := lvm.CreateDevice(context.Background(), "vol1", 4<<20, "fsdax")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner.commands("vgs")).To(Equal([]string{
+				"vgs --noheadings --nosuffix -o vg_name,vg_size,vg_free,vg_extent_size,vg_tags --units B ndbus0region0fsdax",
+			}))
+			Expect(runner.commands("lvcreate")).To(Equal([]string{
+				"lvcreate -Zn -L 4 -Wy --yes -n vol1 ndbus0region0fsdax",
+			}))
+			Expect(runner.commands("dd")).To(Equal([]string{
+				"dd if=/dev/zero of=/dev/null bs=1024 count=4",
+			}))
+			dev, err := lvm.GetDevice(context.Background(), "vol1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dev.Path).To(Equal("/dev/null"))
+		})
+
+		It("create retries on lock contention", func() {
+			lvm.lockRetryDelay = time.Millisecond
+			locked := 2
+			handler := runner.handler
+			runner.handler = func(cmd string, args ...string) (string, error) {
+				if cmd == "lvcreate" && locked > 0 {
+					locked--
+					return "  Can't get lock for ndbus0region0fsdax.\n", fmt.Errorf("exit status 5")
+				}
+				return handler(cmd, args...)
+			}
+			Expect(lvm.CreateDevice(context.Background(), "vol1", 4<<20, "fsdax")).To(Succeed())
+			Expect(runner.commands("lvcreate")).To(HaveLen(3))
+
+			lvm.lockRetries = 0
+			locked = 1
+			Expect(lvm.CreateDevice(context.Background(), "vol2", 4<<20, "fsdax")).NotTo(Succeed())
+		})
+
+		It("create zeroes device", func() {
+			Expect(lvm.CreateDevice(context.Background(), "vol1", 4<<20, "fsdax")).To(Succeed())
+			Expect(runner.commands("blkdiscard")).To(BeEmpty())
+
+			lvm.zeroOnCreate = true
+			Expect(lvm.DeleteDevice(context.Background(), "vol1", false)).To(Succeed())
+			lvs = ""
+			Expect(lvm.CreateDevice(context.Background(), "vol1", 4<<20, "fsdax")).To(Succeed())
+			Expect(runner.commands("blkdiscard")).To(Equal([]string{"blkdiscard -z /dev/null"}))
+			// only the first create and the delete cleared the start
+			Expect(runner.commands("dd")).To(HaveLen(2))
+		})
+
+		It("create zeroing cancelled", func() {
+			lvm.zeroOnCreate = true
+			ctx, cancel := context.WithCancel(context.Background())
+			handler := runner.handler
+			runner.ctxHandler = func(ctx context.Context, cmd string, args ...string) (string, error) {
+				if cmd == "blkdiscard" {
+					cancel()
+					<-ctx.Done()
+					return "", ctx.Err()
+				}
+				return handler(cmd, args...)
+			}
+			err := lvm.CreateDevice(ctx, "vol1", 4<<20, "fsdax")
+			Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+		})
+
+		It("create returns remaining space", func() {
+			// 8 GiB free, 5 MiB get rounded up to two 4 MiB extents
+			remaining, err := lvm.CreateDeviceRemaining(context.Background(), "vol1", 5<<20, "fsdax")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(remaining).To(Equal(uint64(8<<30 - 8<<20)))
+			Expect(runner.commands("lvcreate")).To(Equal([]string{"lvcreate -Zn -L 8 -Wy --yes -n vol1 ndbus0region0fsdax"}))
+		})
+
+		It("create with tags", func() {
+			runner.handler = func(cmd string, args ...string) (string, error) {
+				switch cmd {
+				case "vgs":
+					return "  ndbus0region0fsdax 17179869184 8589934592 4194304 fsdax\n", nil
+				case "lvs":
+					return lvs, nil
+				case "lvcreate":
+					tags := []string{}
+					for i, arg := range args {
+						if arg == "--addtag" {
+							tags = append(tags, args[i+1])
+						}
+					}
+					lvs = "  vol1|/dev/null|4194304|uuid-vol1|ndbus0region0fsdax|" + strings.Join(tags, ",") + "|||\n"
+				}
+				return "", nil
+			}
+			tags := map[string]string{"pvc": "claim-1", "namespace": "default", "pool": ""}
+			err := lvm.CreateDeviceWithTags(context.Background(), "vol1", 4<<20, "fsdax", tags)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner.commands("lvcreate")).To(Equal([]string{
+				"lvcreate -Zn -L 4 --addtag namespace=default --addtag pool= --addtag pvc=claim-1 -Wy --yes -n vol1 ndbus0region0fsdax",
+			}))
+			dev, err := lvm.GetDevice(context.Background(), "vol1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dev.Tags).To(Equal(tags))
+		})
+
+		It("invalid tags", func() {
+			for _, tags := range []map[string]string{
+				{"": "value"},
+				{"-key": "value"},
+				{"pvc name": "claim"},
+				{"a=b": "c"},
+				{"pvc": "claim,1"},
+				{"pvc": strings.Repeat("x", 1024)},
+			} {
+				err := lvm.CreateDeviceWithTags(context.Background(), "vol1", 4<<20, "fsdax", tags)
+				Expect(err).To(HaveOccurred(), "%v", tags)
+			}
+			Expect(runner.calls).To(BeEmpty())
+		})
+
+		It("ephemeral devices", func() {
+			runner.handler = func(cmd string, args ...string) (string, error) {
+				switch cmd {
+				case "vgs":
+					return "  ndbus0region0fsdax 17179869184 8589934592 4194304 fsdax\n", nil
+				case "lvs":
+					return lvs, nil
+				case "lvcreate":
+					lvs = "  vol1|/dev/null|4194304|uuid-vol1|ndbus0region0fsdax|" + EphemeralTag + "=true|||\n"
+				}
+				return "", nil
+			}
+			err := lvm.CreateDeviceWithTags(context.Background(), "vol1", 4<<20, "fsdax", map[string]string{EphemeralTag: "true"})
+			Expect(err).NotTo(HaveOccurred())
+			runner.calls = nil
+			Expect(lvm.DeleteDevice(context.Background(), "vol1", true)).To(Succeed())
+			Expect(runner.commands("shred")).To(BeEmpty())
+			Expect(runner.commands("dd")).To(BeEmpty())
+			Expect(runner.commands("lvremove")).To(Equal([]string{"lvremove -fy /dev/null"}))
+
+			// other values get erased
+			lvm.devices["vol2"] = PmemDeviceInfo{Name: "vol2", Path: "/dev/null", Size: 4 << 20, Tags: map[string]string{EphemeralTag: "false"}}
+			Expect(lvm.DeleteDevice(context.Background(), "vol2", true)).To(Succeed())
+			Expect(runner.commands("shred")).To(Equal([]string{"shred -v -n 1 /dev/null"}))
+		})
+
+		It("parses tags", func() {
+			Expect(parseLVTags("")).To(BeNil())
+			Expect(parseLVTags("foreign,pvc=claim-1,=x,url=a=b")).To(Equal(map[string]string{"pvc": "claim-1", "url": "a=b"}))
+		})
+
+		It("fragmented free space", func() {
+			runner.handler = func(cmd string, args ...string) (string, error) {
+				if cmd == "vgs" {
+					return "  ndbus0region0fsdax 8589934592 2147483648 4194304 fsdax\n" +
+						"  ndbus0region1fsdax 8589934592 2147483648 4194304 fsdax\n" +
+						"  ndbus0region2fsdax 8589934592 2147483648 4194304 fsdax\n", nil
+				}
+				return "", nil
+			}
+			lvm.volumeGroups = []string{"ndbus0region0fsdax", "ndbus0region1fsdax", "ndbus0region2fsdax"}
+			err := lvm.CreateDevice(context.Background(), "vol1", 4<<30, "fsdax")
+			Expect(errors.Is(err, ErrFragmented)).To(BeTrue())
+			Expect(errors.Is(err, ErrNotEnoughSpace)).To(BeTrue())
+			Expect(runner.commands("lvcreate")).To(BeEmpty())
+
+			err = lvm.CreateDevice(context.Background(), "vol1", 8<<30, "fsdax")
+			Expect(errors.Is(err, ErrNotEnoughSpace)).To(BeTrue())
+			Expect(errors.Is(err, ErrFragmented)).To(BeFalse())
+		})
+
+		It("looks up single device", func() {
+			err := lvm.CreateDevice(context.Background(), "vol1", 4<<20, "fsdax")
+			Expect(err).NotTo(HaveOccurred())
+			// existence check before, device info after lvcreate
+			Expect(runner.commands("lvs")).To(Equal([]string{
+				"lvs --noheadings --nosuffix --separator | -o lv_name,lv_path,lv_size,lv_uuid,vg_name,lv_tags,lv_dm_path,origin,lv_attr --units B -S lv_name=vol1 ndbus0region0fsdax",
+				"lvs --noheadings --nosuffix --separator | -o lv_name,lv_path,lv_size,lv_uuid,vg_name,lv_tags,lv_dm_path,origin,lv_attr --units B -S lv_name=vol1 ndbus0region0fsdax",
+			}))
+		})
+
+		It("get device created elsewhere", func() {
+			lvs = "  vol1|/dev/null|4194304|uuid-vol1|ndbus0region0fsdax||||\n"
+			dev, err := lvm.GetDevice(context.Background(), "vol1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dev.UUID).To(Equal("uuid-vol1"))
+			Expect(runner.commands("lvs")).To(Equal([]string{
+				"lvs --noheadings --nosuffix --separator | -o lv_name,lv_path,lv_size,lv_uuid,vg_name,lv_tags,lv_dm_path,origin,lv_attr --units B -S lv_name=vol1 ndbus0region0fsdax",
+			}))
+
+			// cached now
+			_, err = lvm.GetDevice(context.Background(), "vol1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner.commands("lvs")).To(HaveLen(1))
+
+			_, err = lvm.GetDevice(context.Background(), "vol 2")
+			Expect(errors.Is(err, ErrDeviceNotFound)).To(BeTrue())
+			Expect(runner.commands("lvs")).To(HaveLen(1))
+		})
+
+		It("create with info", func() {
+			runner.handler = func(cmd string, args ...string) (string, error) {
+				switch cmd {
+				case "vgs":
+					return "  ndbus0region0fsdax 17179869184 8589934592 4194304 fsdax\n", nil
+				case "lvs":
+					return lvs, nil
+				case "lvcreate":
+					// LVM rounds up to full extents
+					lvs = "  vol1|/dev/null|8388608|uuid-vol1|ndbus0region0fsdax||||\n"
+				}
+				return "", nil
+			}
+			dev, err := lvm.CreateDeviceInfo(context.Background(), "vol1", 5<<20, "fsdax")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dev).To(Equal(PmemDeviceInfo{Name: "vol1", Path: "/dev/null", Size: 8 << 20, UUID: "uuid-vol1", VolumeGroup: "ndbus0region0fsdax"}))
+		})
+
+		It("reports rounded up size", func() {
+			runner.handler = func(cmd string, args ...string) (string, error) {
+				switch cmd {
+				case "vgs":
+					return "  ndbus0region0fsdax 17179869184 8589934592 4194304 fsdax\n", nil
+				case "lvs":
+					return lvs, nil
+				case "lvcreate":
+					lvs = "  vol1|/dev/null|8388608|uuid-vol1|ndbus0region0fsdax||||\n"
+				}
+				return "", nil
+			}
+			var logged []string
+			ctx := WithLogger(context.Background(), recordingLogger{messages: &logged})
+			dev, err := lvm.CreateDeviceInfo(ctx, "vol1", 5<<20, "fsdax")
+			Expect(err).NotTo(HaveOccurred())
+			// lvcreate got the size rounded up to full extents
+			Expect(dev.Size).To(Equal(uint64(8 << 20)))
+			Expect(logged).To(ContainElement(fmt.Sprintf("Allocated size differs from requested size delta=%d", 3<<20)))
+		})
+
+		It("lvcreate failure", func() {
+			runner.handler = func(cmd string, args ...string) (string, error) {
+				switch cmd {
+				case "vgs":
+					return "  ndbus0region0fsdax 17179869184 8589934592 4194304 fsdax\n", nil
+				case "lvcreate":
+					return "Insufficient free space", fmt.Errorf("exit status 5")
+				}
+				return "", nil
+			}
+			err := lvm.CreateDevice(context.Background(), "vol1", 4<<20, "fsdax")
+			Expect(errors.Is(err, ErrNotEnoughSpace)).To(BeTrue())
+			Expect(lvm.devices).NotTo(HaveKey("vol1"))
+		})
+
+		It("lvcreate failure for other reason", func() {
+			runner.handler = func(cmd string, args ...string) (string, error) {
+				switch cmd {
+				case "vgs":
+					return "  ndbus0region0fsdax 17179869184 8589934592 4194304 fsdax\n" +
+						"  ndbus0region1fsdax 17179869184 8589934592 4194304 fsdax\n", nil
+				case "lvcreate":
+					return "  /dev/mapper/control: open failed: Permission denied\n", fmt.Errorf("exit status 5")
+				}
+				return "", nil
+			}
+			lvm.volumeGroups = []string{"ndbus0region0fsdax", "ndbus0region1fsdax"}
+			err := lvm.CreateDevice(context.Background(), "vol1", 4<<20, "fsdax")
+			Expect(err).To(HaveOccurred())
+			Expect(errors.Is(err, ErrNotEnoughSpace)).To(BeFalse())
+			Expect(err.Error()).To(ContainSubstring("Permission denied"))
+			Expect(err.Error()).To(ContainSubstring("exit status 5"))
+			Expect(runner.commands("lvcreate")).To(HaveLen(2))
+		})
+
+		It("vgs sizes with unit suffix", func() {
+			runner.handler = func(cmd string, args ...string) (string, error) {
+				return "  ndbus0region0fsdax 17179869184B 8589934592B 4194304B fsdax\n", nil
+			}
+			vgs, err := lvm.ListVolumeGroups(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(vgs).To(Equal([]VolumeGroupInfo{{Name: "ndbus0region0fsdax", Size: 16 << 30, Free: 8 << 30, ExtentSize: 4 << 20, Mode: "fsdax"}}))
+		})
+
+		It("vgs non-numeric sizes", func() {
+			for _, line := range []string{
+				"  ndbus0region0fsdax 16GiB 8589934592 4194304 fsdax\n",
+				"  ndbus0region0fsdax 17179869184 - 4194304 fsdax\n",
+				"  ndbus0region0fsdax 17179869184 8589934592 4m fsdax\n",
+			} {
+				line := line
+				runner.handler = func(cmd string, args ...string) (string, error) {
+					return line, nil
+				}
+				lvm.invalidateCache()
+				_, err := lvm.GetCapacity(context.Background())
+				Expect(err).To(HaveOccurred(), line)
+				Expect(err.Error()).To(ContainSubstring(strings.TrimSpace(line)))
+			}
+		})
+
+		It("vgs parse failure", func() {
+			runner.handler = func(cmd string, args ...string) (string, error) {
+				return "garbage", nil
+			}
+			_, err := lvm.GetCapacity(context.Background())
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("delete", func() {
+			lvm.devices["vol1"] = PmemDeviceInfo{Name: "vol1", Path: "/dev/null", Size: 4 << 20}
+			err := lvm.DeleteDevice(context.Background(), "vol1", true)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner.commands("shred")).To(Equal([]string{"shred -v -n 1 /dev/null"}))
+			Expect(runner.commands("lvremove")).To(Equal([]string{"lvremove -fy /dev/null"}))
+		})
+
+		It("cancelled erase", func() {
+			lvm.devices["vol1"] = PmemDeviceInfo{Name: "vol1", Path: "/dev/null", Size: 4 << 20}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			progress := make(chan string, 10)
+			runner.ctxHandler = func(ctx context.Context, cmd string, args ...string) (string, error) {
+				if cmd != "shred" {
+					return "", nil
+				}
+				// a long running shred, until it gets killed
+				lineFn := outputLinesFrom(ctx)
+				Expect(lineFn).NotTo(BeNil())
+				lineFn("shred: /dev/null: pass 1/1 (random)...1.0MiB/4.0MiB 25%")
+				progress <- "reported"
+				<-ctx.Done()
+				return "", fmt.Errorf("shred aborted: %w", ctx.Err())
+			}
+			var logged []string
+			ctx = WithLogger(ctx, recordingLogger{messages: &logged})
+			go func() {
+				<-progress
+				cancel()
+			}()
+			err := lvm.DeleteDevice(ctx, "vol1", true)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("erase of device vol1 cancelled"))
+			Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+			Expect(runner.commands("lvremove")).To(BeEmpty())
+			Expect(lvm.devices).To(HaveKey("vol1"))
+			Expect(logged).To(ContainElement("Wiping progress progress=shred: /dev/null: pass 1/1 (random)...1.0MiB/4.0MiB 25%"))
+		})
+
+		It("not enough space", func() {
+			err := lvm.CreateDevice(context.Background(), "vol1", 16<<30, "fsdax")
+			Expect(errors.Is(err, ErrNotEnoughSpace)).To(BeTrue())
+			Expect(runner.commands("lvcreate")).To(BeEmpty())
+		})
+
+		It("caches vgs", func() {
+			_, err := lvm.GetCapacity(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			_, err = lvm.GetCapacity(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner.commands("vgs")).To(HaveLen(1))
+		})
+
+		It("create invalidates vgs cache", func() {
+			_, err := lvm.GetCapacity(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			err = lvm.CreateDevice(context.Background(), "vol1", 4<<20, "fsdax")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = lvm.GetCapacity(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			// one for the first GetCapacity, served from cache for CreateDevice, one after lvcreate
+			Expect(runner.commands("vgs")).To(HaveLen(2))
+		})
+
+		It("request snapshot", func() {
+			lvm.vgCache = newVGCache(-1)
+			ctx := WithVGSnapshot(context.Background())
+			_, err := lvm.GetCapacity(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = lvm.GetCapacity(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner.commands("vgs")).To(HaveLen(1))
+
+			// another request does not share the snapshot
+			_, err = lvm.GetCapacity(WithVGSnapshot(context.Background()))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner.commands("vgs")).To(HaveLen(2))
+
+			// creating a device within the request invalidates the snapshot
+			err = lvm.CreateDevice(ctx, "vol1", 4<<20, "fsdax")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner.commands("vgs")).To(HaveLen(2))
+			_, err = lvm.GetCapacity(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner.commands("vgs")).To(HaveLen(3))
+		})
+
+		It("vgs cache expires", func() {
+			lvm.vgCache = newVGCache(time.Millisecond)
+			_, err := lvm.GetCapacity(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			time.Sleep(2 * time.Millisecond)
+			_, err = lvm.GetCapacity(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner.commands("vgs")).To(HaveLen(2))
+		})
+
+		It("metrics", func() {
+			reg := prometheus.NewRegistry()
+			Expect(lvm.RegisterMetrics(reg)).To(Succeed())
+			Expect(lvm.CreateDevice(context.Background(), "vol1", 4<<20, "fsdax")).To(Succeed())
+			Expect(lvm.DeleteDevice(context.Background(), "vol1", true)).To(Succeed())
+			_, err := lvm.GetCapacity(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+
+			families, err := reg.Gather()
+			Expect(err).NotTo(HaveOccurred())
+			values := map[string]float64{}
+			for _, family := range families {
+				for _, metric := range family.GetMetric() {
+					name := family.GetName()
+					for _, label := range metric.GetLabel() {
+						name += "/" + label.GetValue()
+					}
+					switch {
+					case metric.GetCounter() != nil:
+						values[name] = metric.GetCounter().GetValue()
+					case metric.GetGauge() != nil:
+						values[name] = metric.GetGauge().GetValue()
+					case metric.GetHistogram() != nil:
+						values[name] = float64(metric.GetHistogram().GetSampleCount())
+					}
+				}
+			}
+			Expect(values).To(HaveKeyWithValue("pmem_csi_lvm_operations_total/create", 1.0))
+			Expect(values).To(HaveKeyWithValue("pmem_csi_lvm_operations_total/delete", 1.0))
+			Expect(values).NotTo(HaveKey("pmem_csi_lvm_operation_failures_total/create"))
+			Expect(values).To(HaveKeyWithValue("pmem_csi_lvm_command_duration_seconds/lvcreate", 1.0))
+			Expect(values).To(HaveKeyWithValue("pmem_csi_lvm_command_duration_seconds/lvremove", 1.0))
+			Expect(values).To(HaveKeyWithValue("pmem_csi_lvm_erase_duration_seconds", 1.0))
+			Expect(values).To(HaveKeyWithValue("pmem_csi_lvm_capacity_bytes/total", float64(16<<30)))
+			Expect(values).To(HaveKeyWithValue("pmem_csi_lvm_capacity_bytes/free", float64(8<<30)))
+		})
+
+		It("delete phase durations", func() {
+			delay := 20 * time.Millisecond
+			handler := runner.handler
+			runner.handler = func(cmd string, args ...string) (string, error) {
+				switch cmd {
+				case "shred", "blkdiscard", "lvremove":
+					time.Sleep(delay)
+				}
+				return handler(cmd, args...)
+			}
+			reg := prometheus.NewRegistry()
+			Expect(lvm.RegisterMetrics(reg)).To(Succeed())
+			lvm.devices["vol1"] = PmemDeviceInfo{Name: "vol1", Path: "/dev/null", Size: 4 << 20, VolumeGroup: "ndbus0region0fsdax"}
+			Expect(lvm.DeleteDevice(context.Background(), "vol1", true)).To(Succeed())
+
+			families, err := reg.Gather()
+			Expect(err).NotTo(HaveOccurred())
+			durations := map[string]float64{}
+			for _, family := range families {
+				if family.GetName() != "pmem_csi_lvm_delete_phase_duration_seconds" {
+					continue
+				}
+				for _, metric := range family.GetMetric() {
+					Expect(metric.GetHistogram().GetSampleCount()).To(Equal(uint64(1)))
+					durations[metric.GetLabel()[0].GetValue()] = metric.GetHistogram().GetSampleSum()
+				}
+			}
+			Expect(durations).To(HaveKey("flush"))
+			Expect(durations).To(HaveKey("lvremove"))
+			Expect(durations["flush"]).To(BeNumerically(">=", delay.Seconds()))
+			Expect(durations["lvremove"]).To(BeNumerically(">=", delay.Seconds()))
+		})
+
+		It("dry run", func() {
+			lvm.dryRun = true
+			Expect(lvm.CreateDevice(context.Background(), "vol1", 4<<20, "fsdax")).To(Succeed())
+			lvm.devices["vol2"] = PmemDeviceInfo{Name: "vol2", Path: "/dev/null", Size: 4 << 20, VolumeGroup: "ndbus0region0fsdax"}
+			Expect(lvm.ResizeDevice(context.Background(), "vol2", 8<<20)).To(Succeed())
+			Expect(lvm.FlushDeviceData(context.Background(), "vol2")).To(Succeed())
+			Expect(lvm.DeleteDevice(context.Background(), "vol2", true)).To(Succeed())
+			_, err := lvm.GetCapacity(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+
+			for _, cmd := range []string{"lvcreate", "lvextend", "lvremove", "shred", "dd"} {
+				Expect(runner.commands(cmd)).To(BeEmpty(), cmd)
+			}
+			Expect(runner.commands("vgs")).NotTo(BeEmpty())
+			Expect(lvm.devices).NotTo(HaveKey("vol1"))
+			Expect(lvm.devices).To(HaveKey("vol2"))
+		})
+
+		It("rename", func() {
+			lvm.devices["vol1"] = PmemDeviceInfo{Name: "vol1", Path: "/dev/ndbus0region0fsdax/vol1", Size: 4 << 20, VolumeGroup: "ndbus0region0fsdax"}
+			runner.handler = func(cmd string, args ...string) (string, error) {
+				switch cmd {
+				case "lvs":
+					return lvs, nil
+				case "lvrename":
+					lvs = "  vol2|/dev/ndbus0region0fsdax/vol2|4194304|uuid-vol1|ndbus0region0fsdax||||\n"
+				}
+				return "", nil
+			}
+			Expect(lvm.RenameDevice(context.Background(), "vol1", "vol2")).To(Succeed())
+			Expect(runner.commands("lvrename")).To(Equal([]string{"lvrename ndbus0region0fsdax vol1 vol2"}))
+			Expect(lvm.devices).NotTo(HaveKey("vol1"))
+			Expect(lvm.devices["vol2"].Path).To(Equal("/dev/ndbus0region0fsdax/vol2"))
+		})
+
+		It("rename to existing name", func() {
+			lvm.devices["vol1"] = PmemDeviceInfo{Name: "vol1", Path: "/dev/ndbus0region0fsdax/vol1", Size: 4 << 20}
+			lvm.devices["vol2"] = PmemDeviceInfo{Name: "vol2", Path: "/dev/ndbus0region0fsdax/vol2", Size: 4 << 20}
+			err := lvm.RenameDevice(context.Background(), "vol1", "vol2")
+			Expect(errors.Is(err, ErrDeviceExists)).To(BeTrue())
+			err = lvm.RenameDevice(context.Background(), "vol1", "-vol3")
+			Expect(errors.Is(err, ErrInvalidName)).To(BeTrue())
+			Expect(runner.commands("lvrename")).To(BeEmpty())
+		})
+
+		It("delete unknown device", func() {
+			// a retried delete succeeds without erasing or removing anything
+			Expect(lvm.DeleteDevice(context.Background(), "vol2", true)).To(Succeed())
+			Expect(lvm.ForceDeleteDevice(context.Background(), "vol2", true)).To(Succeed())
+			// lvs confirms that the device is gone
+			Expect(runner.commands("lvs")).To(HaveLen(2))
+			Expect(runner.commands("shred")).To(BeEmpty())
+			Expect(runner.commands("lvremove")).To(BeEmpty())
+			_, err := lvm.GetDevice(context.Background(), "vol2")
+			Expect(errors.Is(err, ErrDeviceNotFound)).To(BeTrue())
+		})
+
+		It("delete device created behind our back", func() {
+			lvs = "  vol2|/dev/null|4194304|uuid-vol2|ndbus0region0fsdax||||\n"
+			Expect(lvm.DeleteDevice(context.Background(), "vol2", false)).To(Succeed())
+			Expect(runner.commands("lvremove")).To(Equal([]string{"lvremove -fy /dev/null"}))
+			Expect(lvm.devices).NotTo(HaveKey("vol2"))
+
+			lvs = "  vol3|/dev/null|4194304|uuid-vol3|ndbus0region0fsdax||||\n"
+			Expect(lvm.ForceDeleteDevice(context.Background(), "vol3", false)).To(Succeed())
+			Expect(runner.commands("lvremove")).To(HaveLen(2))
+		})
+
+		It("lvremove failure", func() {
+			lvm.devices["vol1"] = PmemDeviceInfo{Name: "vol1", Path: "/dev/null", Size: 4 << 20}
+			runner.handler = func(cmd string, args ...string) (string, error) {
+				if cmd == "lvremove" {
+					return "", fmt.Errorf("exit status 5")
+				}
+				return "", nil
+			}
+			err := lvm.DeleteDevice(context.Background(), "vol1", false)
+			Expect(err).To(HaveOccurred())
+			// not repeated, the volume was not reported as in use
+			Expect(runner.commands("lvremove")).To(HaveLen(1))
+		})
+
+		It("lvremove retries while in use", func() {
+			lvm.removeBusyRetryDelay = time.Millisecond
+			lvm.devices["vol1"] = PmemDeviceInfo{Name: "vol1", Path: "/dev/null", Size: 4 << 20}
+			inUse := 2
+			runner.handler = func(cmd string, args ...string) (string, error) {
+				if cmd == "lvremove" && inUse > 0 {
+					inUse--
+					return "  Logical volume ndbus0region0fsdax/vol1 contains a filesystem in use.\n", fmt.Errorf("exit status 5")
+				}
+				return "", nil
+			}
+			Expect(lvm.DeleteDevice(context.Background(), "vol1", false)).To(Succeed())
+			Expect(runner.commands("lvremove")).To(HaveLen(3))
+			Expect(lvm.devices).NotTo(HaveKey("vol1"))
+
+			lvm.devices["vol2"] = PmemDeviceInfo{Name: "vol2", Path: "/dev/null", Size: 4 << 20}
+			lvm.removeBusyRetries = -1
+			inUse = 1
+			Expect(lvm.DeleteDevice(context.Background(), "vol2", false)).NotTo(Succeed())
+			Expect(lvm.devices).To(HaveKey("vol2"))
+		})
+	})
+
+	Context("Concurrency", func() {
+		It("never overcommits a volume group", func() {
+			const vgSize = 64 << 20
+			var mutex sync.Mutex
+			free := uint64(vgSize)
+			volumes := map[string]uint64{}
+			overcommitted := []string{}
+			runner := &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					mutex.Lock()
+					defer mutex.Unlock()
+					switch cmd {
+					case "vgs":
+						return fmt.Sprintf("  ndbus0region0fsdax %d %d 4194304 fsdax\n", uint64(vgSize), free), nil
+					case "lvs":
+						output := ""
+						for name, size := range volumes {
+							output += fmt.Sprintf("  %s|/dev/null|%d|uuid-%s|ndbus0region0fsdax||||\n", name, size, name)
+						}
+						return output, nil
+					case "lvcreate":
+						// lvcreate -Zn -L <MB> -Wy --yes -n <name> <vg>
+						size, _ := strconv.ParseUint(args[2], 10, 64)
+						size <<= 20
+						if size > free {
+							overcommitted = append(overcommitted, args[6])
+							return "Insufficient free space", fmt.Errorf("exit status 5")
+						}
+						free -= size
+						volumes[args[6]] = size
+					case "lvremove":
+						for name, size := range volumes {
+							// all volumes share /dev/null and size, remove any of them
+							delete(volumes, name)
+							free += size
+							break
+						}
+					}
+					return "", nil
+				},
+			}
+			lvm := newFakeLvm(runner, "ndbus0region0fsdax")
+
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					defer GinkgoRecover()
+					name := fmt.Sprintf("vol%d", i)
+					err := lvm.CreateDevice(context.Background(), name, 16<<20, "fsdax")
+					if err != nil {
+						Expect(errors.Is(err, ErrNotEnoughSpace)).To(BeTrue(), "unexpected error: %v", err)
+						return
+					}
+					Expect(lvm.DeleteDevice(context.Background(), name, false)).To(Succeed())
+				}(i)
+			}
+			wg.Wait()
+
+			Expect(overcommitted).To(BeEmpty())
+			Expect(lvm.devices).To(BeEmpty())
+		})
+	})
+
+	Context("Thin pool", func() {
+		var runner *fakeRunner
+		var lvm *pmemLvm
+		var pools, thinVolumes, lvs string
+
+		BeforeEach(func() {
+			pools = "  ndbus0region0fsdax|17179869184|25.00|5.00|thinpool\n"
+			// 24 GiB in a 16 GiB pool
+			thinVolumes = "  ndbus0region0fsdax|17179869184|thinpool\n  ndbus0region0fsdax|8589934592|thinpool\n"
+			lvs = ""
+			runner = &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					switch cmd {
+					case "vgs":
+						return "  ndbus0region0fsdax 17179869184 0 4194304 fsdax\n", nil
+					case "lvs":
+						if strings.Contains(strings.Join(args, " "), "lv_name="+thinPoolName) {
+							return pools, nil
+						}
+						if strings.Contains(strings.Join(args, " "), "pool_lv="+thinPoolName) {
+							return thinVolumes, nil
+						}
+						return lvs, nil
+					case "lvcreate":
+						lvs = "  vol1|/dev/null|4194304|Gx1cNh-B7kJ-0y2q-Lm3s-pT4r-Vw5x-Yz6aBc|ndbus0region0fsdax||||\n"
+					}
+					return "", nil
+				},
+			}
+			lvm = newFakeLvm(runner, "ndbus0region0fsdax")
+			lvm.thinPool = true
+		})
+
+		It("create", func() {
+			err := lvm.CreateDevice(context.Background(), "vol1", 32<<30, "fsdax")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner.commands("lvcreate")).To(Equal([]string{
+				"lvcreate -V 32768 --thinpool thinpool -Wy --yes -n vol1 ndbus0region0fsdax",
+			}))
+		})
+
+		It("pool full", func() {
+			pools = "  ndbus0region0fsdax|17179869184|100.00|5.00|thinpool\n"
+			err := lvm.CreateDevice(context.Background(), "vol1", 4<<20, "fsdax")
+			Expect(errors.Is(err, ErrThinPoolFull)).To(BeTrue())
+			Expect(runner.commands("lvcreate")).To(BeEmpty())
+		})
+
+		It("capacity", func() {
+			capacity, err := lvm.GetCapacity(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(capacity["fsdax"]).To(Equal(uint64(12 << 30)))
+		})
+
+		It("creates missing pools", func() {
+			pools = ""
+			err := lvm.ensureThinPools(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner.commands("lvcreate")).To(Equal([]string{
+				"lvcreate --type thin-pool -l 100%FREE -n thinpool ndbus0region0fsdax",
+			}))
+		})
+
+		It("pool not listed as device", func() {
+			runner.handler = func(cmd string, args ...string) (string, error) {
+				return "  thinpool|/dev/vg/thinpool|4194304|Hy2dOi-C8lK-1z3r-Mn4t-qU5s-Wx6y-Za7bCd|ndbus0region0fsdax||||\n  vol1|/dev/vg/vol1|4194304|Gx1cNh-B7kJ-0y2q-Lm3s-pT4r-Vw5x-Yz6aBc|ndbus0region0fsdax||||\n", nil
+			}
+			devices, err := lvm.listDevices(context.Background(), "ndbus0region0fsdax")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(devices).To(HaveLen(1))
+			Expect(devices).To(HaveKey("vol1"))
+		})
+
+		It("without selection", func() {
+			lvm.noSelection = true
+			lvm.maxOverprovision = 2
+			runner.handler = func(cmd string, args ...string) (string, error) {
+				switch cmd {
+				case "vgs":
+					return "  ndbus0region0fsdax 17179869184 0 4194304 fsdax\n", nil
+				case "lvs":
+					switch {
+					case strings.Contains(strings.Join(args, " "), "data_percent"):
+						return "  ndbus0region0fsdax|17179869184|25.00|5.00|thinpool\n  ndbus0region0fsdax|4194304|||vol0\n", nil
+					case strings.Contains(strings.Join(args, " "), "pool_lv"):
+						return "  ndbus0region0fsdax|17179869184|thinpool\n  ndbus0region0fsdax|8589934592|thinpool\n  ndbus0region0fsdax|17179869184|\n", nil
+					}
+					return lvs, nil
+				case "lvcreate":
+					lvs = "  vol1|/dev/null|4194304|Gx1cNh-B7kJ-0y2q-Lm3s-pT4r-Vw5x-Yz6aBc|ndbus0region0fsdax||||\n"
+				}
+				return "", nil
+			}
+			capacity, err := lvm.GetCapacity(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(capacity["fsdax"]).To(Equal(uint64(12 << 30)))
+
+			// 24 GiB of thin volumes, the thick volume does not count against the limit
+			Expect(lvm.CreateDevice(context.Background(), "vol1", 8<<30, "fsdax")).To(Succeed())
+			Expect(runner.commands("lvs")).To(ContainElement(
+				"lvs --noheadings --nosuffix --separator | -o vg_name,lv_size,data_percent,metadata_percent,lv_name --units B ndbus0region0fsdax"))
+			Expect(runner.commands("lvs")).To(ContainElement(
+				"lvs --noheadings --nosuffix --separator | -o vg_name,lv_size,pool_lv --units B ndbus0region0fsdax"))
+			for _, call := range runner.commands("lvs") {
+				Expect(call).NotTo(ContainSubstring("-S"))
+			}
+		})
+
+		It("selects pools and thin volumes", func() {
+			Expect(lvm.CreateDevice(context.Background(), "vol1", 4<<20, "fsdax")).To(Succeed())
+			Expect(runner.commands("lvs")).To(ContainElement(
+				"lvs --noheadings --nosuffix --separator | -o vg_name,lv_size,data_percent,metadata_percent,lv_name --units B -S lv_name=thinpool ndbus0region0fsdax"))
+		})
+
+		It("lvcreate failures", func() {
+			handler := runner.handler
+			output := ""
+			runner.handler = func(cmd string, args ...string) (string, error) {
+				if cmd == "lvcreate" {
+					return output, fmt.Errorf("exit status 5")
+				}
+				return handler(cmd, args...)
+			}
+			output = "  Cannot create new thin volume, free space in thin pool ndbus0region0fsdax/thinpool reached threshold.\n"
+			err := lvm.CreateDevice(context.Background(), "vol1", 4<<20, "fsdax")
+			Expect(errors.Is(err, ErrThinPoolFull)).To(BeTrue())
+
+			output = "  Logical volume name \"vol1\" is invalid.\n"
+			err = lvm.CreateDevice(context.Background(), "vol1", 4<<20, "fsdax")
+			Expect(err).To(HaveOccurred())
+			Expect(errors.Is(err, ErrThinPoolFull)).To(BeFalse())
+			Expect(err.Error()).To(ContainSubstring("is invalid"))
+		})
+
+		It("malformed pool output", func() {
+			_, err := parseThinPoolOutput("  ndbus0region0fsdax|big|25.00|5.00|thinpool\n")
+			Expect(err).To(HaveOccurred())
+			_, err = parseThinPoolOutput("  ndbus0region0fsdax|17179869184|25.00|5.00\n")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("create within over-provisioning limit", func() {
+			lvm.maxOverprovision = 2
+			Expect(lvm.CreateDevice(context.Background(), "vol1", 8<<30, "fsdax")).To(Succeed())
+			Expect(runner.commands("lvcreate")).To(Equal([]string{
+				"lvcreate -V 8192 --thinpool thinpool -Wy --yes -n vol1 ndbus0region0fsdax",
+			}))
+		})
+
+		It("create beyond over-provisioning limit", func() {
+			lvm.maxOverprovision = 2
+			err := lvm.CreateDevice(context.Background(), "vol1", 8<<30+4<<20, "fsdax")
+			Expect(errors.Is(err, ErrOverprovisionLimit)).To(BeTrue())
+			Expect(runner.commands("lvcreate")).To(BeEmpty())
+
+			// without limit, overcommitting is fine
+			lvm.maxOverprovision = 0
+			Expect(lvm.CreateDevice(context.Background(), "vol1", 8<<30+4<<20, "fsdax")).To(Succeed())
+		})
+
+		It("invalid over-provisioning ratio", func() {
+			_, err := newPmemLvm(LVMConfig{ThinPool: true, MaxOverprovisionRatio: -1})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("parses metadata usage", func() {
+			pools, err := parseThinPoolOutput("  ndbus0region0fsdax|17179869184|25.00|100.00|thinpool\n  ndbus0region1fsdax|17179869184|||thinpool\n")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pools["ndbus0region0fsdax"].metadataPercent).To(Equal(float64(100)))
+			Expect(pools["ndbus0region0fsdax"].metadataFull()).To(BeTrue())
+			Expect(pools["ndbus0region0fsdax"].free()).To(BeZero())
+			// inactive pool
+			Expect(pools["ndbus0region1fsdax"].metadataFull()).To(BeFalse())
+			_, err = parseThinPoolOutput("  ndbus0region0fsdax|17179869184|25.00|full|thinpool\n")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("metadata full", func() {
+			pools = "  ndbus0region0fsdax|17179869184|25.00|100.00|thinpool\n"
+			err := lvm.CreateDevice(context.Background(), "vol1", 4<<20, "fsdax")
+			Expect(errors.Is(err, ErrThinMetadataFull)).To(BeTrue())
+			Expect(errors.Is(err, ErrThinPoolFull)).To(BeTrue())
+			Expect(runner.commands("lvcreate")).To(BeEmpty())
+
+			capacity, err := lvm.GetCapacity(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(capacity["fsdax"]).To(BeZero())
+		})
+
+		It("data and metadata full", func() {
+			pools = "  ndbus0region0fsdax|17179869184|100.00|100.00|thinpool\n"
+			err := lvm.CreateDevice(context.Background(), "vol1", 4<<20, "fsdax")
+			Expect(errors.Is(err, ErrThinPoolFull)).To(BeTrue())
+			Expect(errors.Is(err, ErrThinMetadataFull)).To(BeFalse())
+		})
+
+		It("reports metadata health", func() {
+			pools = "  ndbus0region0fsdax|17179869184|25.00|100.00|thinpool\n"
+			handler := runner.handler
+			runner.handler = func(cmd string, args ...string) (string, error) {
+				if cmd == "vgs" {
+					return "  ndbus0region0fsdax wz--n- 0\n", nil
+				}
+				return handler(cmd, args...)
+			}
+			health, err := lvm.HealthCheck(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(health).To(Equal([]VolumeGroupHealth{
+				{Name: "ndbus0region0fsdax", State: VolumeGroupThinMetadataFull, ThinMetadataPercent: 100},
+			}))
+
+			pools = "  ndbus0region0fsdax|17179869184|25.00|85.50|thinpool\n"
+			health, err = lvm.HealthCheck(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(health).To(Equal([]VolumeGroupHealth{
+				{Name: "ndbus0region0fsdax", State: VolumeGroupHealthy, ThinMetadataPercent: 85.5},
+			}))
+		})
+
+		It("resizes metadata", func() {
+			Expect(lvm.ResizeThinMetadata(context.Background(), "ndbus0region0fsdax", 128<<20)).To(Succeed())
+			Expect(runner.commands("lvextend")).To(Equal([]string{
+				"lvextend --poolmetadatasize 128 ndbus0region0fsdax/thinpool",
+			}))
+
+			Expect(lvm.ResizeThinMetadata(context.Background(), "other", 128<<20)).NotTo(Succeed())
+			err := lvm.ResizeThinMetadata(context.Background(), "ndbus0region0fsdax", 0)
+			Expect(errors.Is(err, ErrInvalidSize)).To(BeTrue())
+			lvm.thinPool = false
+			Expect(lvm.ResizeThinMetadata(context.Background(), "ndbus0region0fsdax", 128<<20)).NotTo(Succeed())
+			Expect(runner.commands("lvextend")).To(HaveLen(1))
+		})
+
+		It("pool usage", func() {
+			usage, err := lvm.GetThinPoolUsage(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(usage).To(Equal([]ThinPoolUsage{{
+				VolumeGroup:     "ndbus0region0fsdax",
+				Size:            16 << 30,
+				DataPercent:     25,
+				MetadataPercent: 5,
+				VirtualSize:     24 << 30,
+			}}))
+
+			lvm.thinPool = false
+			usage, err = lvm.GetThinPoolUsage(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(usage).To(BeEmpty())
+		})
+	})
+
+	Context("Striping", func() {
+		var runner *fakeRunner
+		var lvm *pmemLvm
+		var pvs, lvs string
+
+		BeforeEach(func() {
+			pvs = "  ndbus0region0fsdax|/dev/pmem0|4294967296\n  ndbus0region0fsdax|/dev/pmem0.1|4294967296\n"
+			lvs = ""
+			runner = &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					switch cmd {
+					case "vgs":
+						return "  ndbus0region0fsdax 17179869184 8589934592 4194304 fsdax\n", nil
+					case "pvs":
+						// like pvs, which takes volume group names for physical volumes
+						if args[len(args)-2] != "-S" && !lvm.noSelection {
+							return "  Failed to find physical volume \"" + args[len(args)-1] + "\".", fmt.Errorf("exit status 5")
+						}
+						return pvs, nil
+					case "lvs":
+						return lvs, nil
+					case "lvcreate":
+						lvs = "  vol1|/dev/null|4194304|Gx1cNh-B7kJ-0y2q-Lm3s-pT4r-Vw5x-Yz6aBc|ndbus0region0fsdax||||\n"
+					}
+					return "", nil
+				},
+			}
+			lvm = newFakeLvm(runner, "ndbus0region0fsdax")
+		})
+
+		It("arguments", func() {
+			Expect(stripedArgs("vol1", []string{"-L", "4096"}, "vg", 2, nil)).To(Equal([]string{
+				"-Zn", "-i", "2", "-I", "64", "-L", "4096", "-n", "vol1", "vg",
+			}))
+		})
+
+		It("create", func() {
+			err := lvm.CreateStripedDevice(context.Background(), "vol1", 8<<30, "fsdax", 2)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner.commands("lvcreate")).To(Equal([]string{
+				"lvcreate -Zn -i 2 -I 64 -L 8192 -Wy --yes -n vol1 ndbus0region0fsdax",
+			}))
+			Expect(runner.commands("pvs")).To(Equal([]string{
+				"pvs --noheadings --nosuffix --separator | -o vg_name,pv_name,pv_free --units B -S vg_name=ndbus0region0fsdax",
+			}))
+		})
+
+		It("invalid size", func() {
+			err := lvm.CreateStripedDevice(context.Background(), "vol1", 0, "fsdax", 2)
+			Expect(errors.Is(err, ErrInvalidSize)).To(BeTrue())
+			err = lvm.CreateStripedDevice(context.Background(), "vol1", 32<<30, "fsdax", 2)
+			Expect(errors.Is(err, ErrInvalidSize)).To(BeTrue())
+			Expect(runner.commands("lvcreate")).To(BeEmpty())
+		})
+
+		It("counts operations", func() {
+			reg := prometheus.NewRegistry()
+			Expect(lvm.RegisterMetrics(reg)).To(Succeed())
+			Expect(lvm.CreateStripedDevice(context.Background(), "vol1", 8<<30, "fsdax", 2)).To(Succeed())
+			Expect(lvm.CreateStripedDevice(context.Background(), "vol2", 0, "fsdax", 2)).NotTo(Succeed())
+
+			families, err := reg.Gather()
+			Expect(err).NotTo(HaveOccurred())
+			counters := map[string]float64{}
+			for _, family := range families {
+				for _, metric := range family.GetMetric() {
+					if metric.GetCounter() != nil {
+						counters[family.GetName()+"/"+metric.GetLabel()[0].GetValue()] = metric.GetCounter().GetValue()
+					}
+				}
+			}
+			Expect(counters).To(HaveKeyWithValue("pmem_csi_lvm_operations_total/create", 2.0))
+			Expect(counters).To(HaveKeyWithValue("pmem_csi_lvm_operation_failures_total/create", 1.0))
+		})
+
+		It("selects physical volumes of several groups", func() {
+			lvm.volumeGroups = []string{"ndbus0region0fsdax", "ndbus0region1fsdax"}
+			_, err := lvm.getPhysicalVolumes(context.Background(), lvm.volumeGroups)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner.commands("pvs")).To(Equal([]string{
+				"pvs --noheadings --nosuffix --separator | -o vg_name,pv_name,pv_free --units B -S vg_name=ndbus0region0fsdax||vg_name=ndbus0region1fsdax",
+			}))
+		})
+
+		It("filters physical volumes without selection", func() {
+			lvm.noSelection = true
+			pvs += "  ndbus0region1fsdax|/dev/pmem1|4294967296\n  |/dev/sda1|1073741824\n"
+			found, err := lvm.getPhysicalVolumes(context.Background(), []string{"ndbus0region0fsdax"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(found).To(Equal([]pvInfo{
+				{vg: "ndbus0region0fsdax", name: "/dev/pmem0", free: 4 << 30},
+				{vg: "ndbus0region0fsdax", name: "/dev/pmem0.1", free: 4 << 30},
+			}))
+			Expect(runner.commands("pvs")).To(Equal([]string{
+				"pvs --noheadings --nosuffix --separator | -o vg_name,pv_name,pv_free --units B",
+			}))
+		})
+
+		It("falls back to linear device", func() {
+			pvs = "  ndbus0region0fsdax|/dev/pmem0|8589934592\n  ndbus0region0fsdax|/dev/pmem0.1|0\n"
+			err := lvm.CreateStripedDevice(context.Background(), "vol1", 8<<30, "fsdax", 2)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner.commands("lvcreate")).To(Equal([]string{
+				"lvcreate -Zn -L 8192 -Wy --yes -n vol1 ndbus0region0fsdax",
+			}))
+		})
+
+		It("too few physical volumes", func() {
+			vgs := []vgInfo{{name: "vg1", free: 8 << 30}, {name: "vg2", free: 8 << 30}}
+			pvs := []pvInfo{
+				{vg: "vg1", name: "/dev/pmem0", free: 4 << 30},
+				{vg: "vg2", name: "/dev/pmem1", free: 2 << 30},
+				{vg: "vg2", name: "/dev/pmem1.1", free: 2 << 30},
+				{vg: "vg2", name: "/dev/pmem1.2", free: 2 << 30},
+			}
+			Expect(vgNames(stripeCandidates(vgs, pvs, 6<<30, 3))).To(Equal([]string{"vg2"}))
+		})
+
+		It("invalid stripes", func() {
+			err := lvm.CreateStripedDevice(context.Background(), "vol1", 8<<30, "fsdax", 0)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("pinned to physical volume", func() {
+			err := lvm.CreateDeviceOnPVs(context.Background(), "vol1", 2<<30, "fsdax", []string{"/dev/pmem0.1"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner.commands("lvcreate")).To(Equal([]string{
+				"lvcreate -Zn -L 2048 -Wy --yes -n vol1 ndbus0region0fsdax /dev/pmem0.1",
+			}))
+			// the physical volumes of the group get selected, not listed by group name
+			Expect(runner.commands("pvs")).To(Equal([]string{
+				"pvs --noheadings --nosuffix --separator | -o vg_name,pv_name,pv_free --units B -S vg_name=ndbus0region0fsdax",
+			}))
+		})
+
+		It("pinned to several physical volumes", func() {
+			err := lvm.CreateDeviceOnPVs(context.Background(), "vol1", 6<<30, "fsdax", []string{"/dev/pmem0", "/dev/pmem0.1"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner.commands("lvcreate")).To(Equal([]string{
+				"lvcreate -Zn -L 6144 -Wy --yes -n vol1 ndbus0region0fsdax /dev/pmem0 /dev/pmem0.1",
+			}))
+		})
+
+		It("physical volume without space", func() {
+			err := lvm.CreateDeviceOnPVs(context.Background(), "vol1", 6<<30, "fsdax", []string{"/dev/pmem0.1"})
+			Expect(errors.Is(err, ErrNotEnoughSpace)).To(BeTrue())
+			Expect(runner.commands("lvcreate")).To(BeEmpty())
+		})
+
+		It("physical volume of other group", func() {
+			pvs += "  ndbus0region1fsdax|/dev/pmem1|4294967296\n"
+			lvm.noSelection = true
+			err := lvm.CreateDeviceOnPVs(context.Background(), "vol1", 2<<30, "fsdax", []string{"/dev/pmem1"})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("not in a managed volume group"))
+			_, _, err = placementGroup([]pvInfo{
+				{vg: "vg1", name: "/dev/pmem0", free: 4 << 30},
+				{vg: "vg2", name: "/dev/pmem1", free: 4 << 30},
+			}, []string{"/dev/pmem0", "/dev/pmem1"}, "fsdax")
+			Expect(err).To(HaveOccurred())
+			Expect(runner.commands("lvcreate")).To(BeEmpty())
+		})
+	})
+
+	Context("Encryption", func() {
+		var runner *fakeRunner
+		var lvm *pmemLvm
+		var lvs string
+		var keyFiles, keys []string
+
+		BeforeEach(func() {
+			lvs = ""
+			keyFiles, keys = nil, nil
+			runner = &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					switch cmd {
+					case "vgs":
+						return "  ndbus0region0fsdax 17179869184 8589934592 4194304 fsdax\n", nil
+					case "lvs":
+						return lvs, nil
+					case "lvcreate":
+						lvs = "  vol1|/dev/null|4194304|uuid-vol1|ndbus0region0fsdax||||\n"
+					case "lvremove":
+						lvs = ""
+					case "cryptsetup":
+						for i, arg := range args {
+							if arg == "--key-file" {
+								key, err := ioutil.ReadFile(args[i+1])
+								Expect(err).NotTo(HaveOccurred())
+								keyFiles = append(keyFiles, args[i+1])
+								keys = append(keys, string(key))
+							}
+						}
+					}
+					return "", nil
+				},
+			}
+			lvm = newFakeLvm(runner, "ndbus0region0fsdax")
+		})
+
+		It("create", func() {
+			err := lvm.CreateEncryptedDevice(context.Background(), "vol1", 4<<20, "fsdax", fakeKeys("secret"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(keyFiles).To(HaveLen(2))
+			Expect(runner.commands("cryptsetup")).To(Equal([]string{
+				"cryptsetup luksFormat --batch-mode --key-file " + keyFiles[0] + " /dev/null",
+				"cryptsetup luksOpen --key-file " + keyFiles[1] + " /dev/null vol1-crypt",
+			}))
+			Expect(keys).To(Equal([]string{"secret", "secret"}))
+			for _, keyFile := range keyFiles {
+				_, err := os.Stat(keyFile)
+				Expect(os.IsNotExist(err)).To(BeTrue(), "key file %s removed", keyFile)
+			}
+			dev, err := lvm.GetDevice(context.Background(), "vol1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dev.Path).To(Equal("/dev/mapper/vol1-crypt"))
+		})
+
+		It("delete closes first", func() {
+			err := lvm.CreateEncryptedDevice(context.Background(), "vol1", 4<<20, "fsdax", fakeKeys("secret"))
+			Expect(err).NotTo(HaveOccurred())
+			runner.calls = nil
+			err = lvm.DeleteDevice(context.Background(), "vol1", false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner.calls).To(Equal([]string{
+				"cryptsetup luksClose vol1-crypt",
+				"dd if=/dev/zero of=/dev/null bs=1024 count=4",
+				"lvremove -fy /dev/null",
+			}))
+			Expect(lvm.devices).NotTo(HaveKey("vol1"))
+			Expect(lvm.cryptDevices).NotTo(HaveKey("vol1"))
+		})
+
+		It("luksFormat failure removes device", func() {
+			handler := runner.handler
+			runner.handler = func(cmd string, args ...string) (string, error) {
+				if cmd == "cryptsetup" {
+					return "", fmt.Errorf("exit status 1")
+				}
+				return handler(cmd, args...)
+			}
+			err := lvm.CreateEncryptedDevice(context.Background(), "vol1", 4<<20, "fsdax", fakeKeys("secret"))
+			Expect(err).To(HaveOccurred())
+			Expect(runner.commands("lvremove")).To(Equal([]string{"lvremove -fy /dev/null"}))
+			Expect(lvm.devices).NotTo(HaveKey("vol1"))
+		})
+
+		It("no resize", func() {
+			err := lvm.CreateEncryptedDevice(context.Background(), "vol1", 4<<20, "fsdax", fakeKeys("secret"))
+			Expect(err).NotTo(HaveOccurred())
+			err = lvm.ResizeDevice(context.Background(), "vol1", 8<<20)
+			Expect(err).To(HaveOccurred())
+			Expect(runner.commands("lvextend")).To(BeEmpty())
+		})
+	})
+
+	Context("List with prefix", func() {
+		var runner *fakeRunner
+		var lvm *pmemLvm
+
+		BeforeEach(func() {
+			runner = &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					// pretend that lvs applies the selection
+					for i, arg := range args {
+						if arg == "-S" {
+							if args[i+1] == `lv_name=~^pmem-csi\.` {
+								return "  pmem-csi.vol1|/dev/null|4194304|uuid-vol1|ndbus0region0fsdax||||\n" +
+									"  pmem-csi.vol2|/dev/null|4194304|uuid-vol2|ndbus0region0fsdax||||\n", nil
+							}
+							return "", nil
+						}
+					}
+					return "  pmem-csi.vol1|/dev/null|4194304|uuid-vol1|ndbus0region0fsdax||||\n" +
+						"  pmem-csi.vol2|/dev/null|4194304|uuid-vol2|ndbus0region0fsdax||||\n" +
+						"  other|/dev/null|4194304|uuid-other|ndbus0region0fsdax||||\n", nil
+				},
+			}
+			lvm = newFakeLvm(runner, "ndbus0region0fsdax")
+		})
+
+		It("matches prefix", func() {
+			devices, err := lvm.ListDevicesWithPrefix(context.Background(), "pmem-csi.")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(deviceNames(devices)).To(ConsistOf("pmem-csi.vol1", "pmem-csi.vol2"))
+			Expect(runner.calls).To(Equal([]string{
+				`lvs --noheadings --nosuffix --separator | -o lv_name,lv_path,lv_size,lv_uuid,vg_name,lv_tags,lv_dm_path,origin,lv_attr --units B -S lv_name=~^pmem-csi\. ndbus0region0fsdax`,
+			}))
+		})
+
+		It("no match", func() {
+			devices, err := lvm.ListDevicesWithPrefix(context.Background(), "nosuch")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(devices).To(BeEmpty())
+		})
+
+		It("empty prefix", func() {
+			devices, err := lvm.ListDevicesWithPrefix(context.Background(), "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(deviceNames(devices)).To(ConsistOf("pmem-csi.vol1", "pmem-csi.vol2", "other"))
+		})
+
+		It("invalid prefix", func() {
+			_, err := lvm.ListDevicesWithPrefix(context.Background(), "a b")
+			Expect(errors.Is(err, ErrInvalidName)).To(BeTrue())
+			Expect(runner.calls).To(BeEmpty())
+		})
+	})
+
+	Context("Iteration", func() {
+		var runner *fakeRunner
+		var lvm *pmemLvm
+
+		BeforeEach(func() {
+			runner = &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					return "  vol1|/dev/null|4194304|uuid-vol1|ndbus0region0fsdax||||\n" +
+						"  vol2|/dev/null|4194304|uuid-vol2|ndbus0region0fsdax|pvc=claim-2|||\n" +
+						"  vol3|/dev/null|4194304|uuid-vol3|ndbus0region0fsdax||||\n", nil
+				},
+			}
+			lvm = newFakeLvm(runner, "ndbus0region0fsdax")
+		})
+
+		It("visits all devices", func() {
+			names := []string{}
+			err := lvm.ForEachDevice(context.Background(), func(dev PmemDeviceInfo) error {
+				names = append(names, dev.Name)
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(names).To(Equal([]string{"vol1", "vol2", "vol3"}))
+			Expect(runner.commands("lvs")).To(HaveLen(1))
+		})
+
+		It("stops early", func() {
+			names := []string{}
+			err := lvm.ForEachDevice(context.Background(), func(dev PmemDeviceInfo) error {
+				names = append(names, dev.Name)
+				if dev.Tags["pvc"] == "claim-2" {
+					return ErrStopIteration
+				}
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(names).To(Equal([]string{"vol1", "vol2"}))
+		})
+
+		It("returns callback error", func() {
+			failure := errors.New("callback failed")
+			err := lvm.ForEachDevice(context.Background(), func(dev PmemDeviceInfo) error {
+				return failure
+			})
+			Expect(err).To(Equal(failure))
+		})
+
+		It("stops at malformed line", func() {
+			runner.handler = func(cmd string, args ...string) (string, error) {
+				return "  vol1|/dev/null|4194304|uuid-vol1|ndbus0region0fsdax||||\n  garbage\n", nil
+			}
+			names := []string{}
+			err := lvm.ForEachDevice(context.Background(), func(dev PmemDeviceInfo) error {
+				names = append(names, dev.Name)
+				return nil
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(names).To(Equal([]string{"vol1"}))
+		})
+	})
+
+	Context("Device cache", func() {
+		var runner *fakeRunner
+		var lvm *pmemLvm
+		var lvs string
+
+		BeforeEach(func() {
+			lvs = ""
+			runner = &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					switch cmd {
+					case "vgs":
+						return "  ndbus0region0fsdax 17179869184 8589934592 4194304 fsdax\n", nil
+					case "lvs":
+						return lvs, nil
+					case "lvcreate":
+						lvs = "  vol1|/dev/null|4194304|uuid-vol1|ndbus0region0fsdax||||\n"
+					case "lvremove":
+						lvs = ""
+					}
+					return "", nil
+				},
+			}
+			lvm = newFakeLvm(runner, "ndbus0region0fsdax")
+		})
+
+		It("answers from known devices", func() {
+			Expect(lvm.CreateDevice(context.Background(), "vol1", 4<<20, "fsdax")).To(Succeed())
+			lookups := len(runner.commands("lvs"))
+			for i := 0; i < 3; i++ {
+				dev, err := lvm.GetDevice(context.Background(), "vol1")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(dev.Path).To(Equal("/dev/null"))
+			}
+			Expect(runner.commands("lvs")).To(HaveLen(lookups))
+
+			Expect(lvm.DeleteDevice(context.Background(), "vol1", false)).To(Succeed())
+			_, err := lvm.GetDevice(context.Background(), "vol1")
+			Expect(errors.Is(err, ErrDeviceNotFound)).To(BeTrue())
+			// a miss asks lvs for devices created behind our back
+			Expect(runner.commands("lvs")).To(HaveLen(lookups + 1))
+		})
+
+		It("bypasses known devices", func() {
+			Expect(lvm.CreateDevice(context.Background(), "vol1", 4<<20, "fsdax")).To(Succeed())
+			// resized behind our back
+			lvs = "  vol1|/dev/null|8388608|uuid-vol1|ndbus0region0fsdax||||\n"
+			lookups := len(runner.commands("lvs"))
+			dev, err := lvm.GetDeviceUncached(context.Background(), "vol1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dev.Size).To(Equal(uint64(8 << 20)))
+			Expect(runner.commands("lvs")).To(HaveLen(lookups + 1))
+			dev, err = lvm.GetDevice(context.Background(), "vol1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dev.Size).To(Equal(uint64(8 << 20)))
+
+			// removed behind our back
+			lvs = ""
+			_, err = lvm.GetDeviceUncached(context.Background(), "vol1")
+			Expect(errors.Is(err, ErrDeviceNotFound)).To(BeTrue())
+			Expect(lvm.devices).NotTo(HaveKey("vol1"))
+		})
+	})
+
+	Context("Reconcile", func() {
+		It("rebuilds devices", func() {
+			runner := &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					return "  vol1|/dev/ndbus0region0fsdax/vol1|4194304|uuid-vol1|ndbus0region0fsdax||||\n" +
+						"  vol2|/dev/ndbus0region0fsdax/vol2|8388608|uuid-vol2|ndbus0region0fsdax|pvc=claim-2|||\n" +
+						"  vol3|/dev/ndbus0region1fsdax/vol3|4194304|uuid-vol3|ndbus0region1fsdax||||\n", nil
+				},
+			}
+			lvm := newFakeLvm(runner, "ndbus0region0fsdax", "ndbus0region1fsdax")
+			// stale entry from before
+			lvm.devices["gone"] = PmemDeviceInfo{Name: "gone"}
+			devices, err := lvm.Reconcile(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner.commands("lvs")).To(HaveLen(1))
+			Expect(devices).To(Equal(map[string]PmemDeviceInfo{
+				"vol1": {Name: "vol1", Path: "/dev/ndbus0region0fsdax/vol1", Size: 4 << 20, UUID: "uuid-vol1", VolumeGroup: "ndbus0region0fsdax"},
+				"vol2": {Name: "vol2", Path: "/dev/ndbus0region0fsdax/vol2", Size: 8 << 20, UUID: "uuid-vol2", VolumeGroup: "ndbus0region0fsdax", Tags: map[string]string{"pvc": "claim-2"}},
+				"vol3": {Name: "vol3", Path: "/dev/ndbus0region1fsdax/vol3", Size: 4 << 20, UUID: "uuid-vol3", VolumeGroup: "ndbus0region1fsdax"},
+			}))
+			Expect(lvm.devices).To(Equal(devices))
+
+			// result is a copy
+			delete(devices, "vol1")
+			Expect(lvm.devices).To(HaveKey("vol1"))
+		})
+
+		It("lvs failure keeps devices", func() {
+			runner := &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					return "", fmt.Errorf("exit status 5")
+				},
+			}
+			lvm := newFakeLvm(runner, "ndbus0region0fsdax")
+			lvm.devices["vol1"] = PmemDeviceInfo{Name: "vol1"}
+			_, err := lvm.Reconcile(context.Background())
+			Expect(err).To(HaveOccurred())
+			Expect(lvm.devices).To(HaveKey("vol1"))
+		})
+	})
+
+	Context("Pools", func() {
+		var runner *fakeRunner
+		var lvm *pmemLvm
+
+		BeforeEach(func() {
+			free := map[string]uint64{"ndbus0region0fsdax": 8 << 30, "ndbus0region1fsdax": 8 << 30, "ndbus0region2fsdax": 4 << 30}
+			lvs := ""
+			runner = &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					switch cmd {
+					case "vgs":
+						output := ""
+						for _, vg := range []string{"ndbus0region0fsdax", "ndbus0region1fsdax", "ndbus0region2fsdax"} {
+							output += fmt.Sprintf("  %s 17179869184 %d 4194304 fsdax\n", vg, free[vg])
+						}
+						return output, nil
+					case "lvs":
+						return lvs, nil
+					case "lvcreate":
+						vg := args[len(args)-1]
+						free[vg] -= 4 << 20
+						lvs = fmt.Sprintf("  vol1|/dev/null|4194304|uuid-vol1|%s||||\n", vg)
+					}
+					return "", nil
+				},
+			}
+			var err error
+			lvm, err = newPmemLvm(LVMConfig{Pools: map[string][]string{
+				"fast": {"ndbus0region1fsdax"},
+				"bulk": {"ndbus0region0fsdax", "ndbus0region2fsdax", "ndbus1region0fsdax"},
+			}})
+			Expect(err).NotTo(HaveOccurred())
+			lvm.runner = runner
+			lvm.volumeGroups = []string{"ndbus0region0fsdax", "ndbus0region1fsdax", "ndbus0region2fsdax"}
+		})
+
+		It("creates in pool", func() {
+			err := lvm.CreateDeviceInPool(context.Background(), "fast", "vol1", 4<<20, "fsdax")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner.commands("lvcreate")).To(Equal([]string{"lvcreate -Zn -L 4 -Wy --yes -n vol1 ndbus0region1fsdax"}))
+
+			fast, err := lvm.GetPoolCapacity(context.Background(), "fast")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fast).To(Equal(map[string]uint64{"fsdax": 8<<30 - 4<<20}))
+			bulk, err := lvm.GetPoolCapacity(context.Background(), "bulk")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(bulk).To(Equal(map[string]uint64{"fsdax": 8 << 30}))
+		})
+
+		It("erases per pool", func() {
+			var err error
+			lvm, err = newPmemLvm(LVMConfig{
+				ErasePolicy: ErasePolicy{Method: EraseZero},
+				Pools: map[string][]string{
+					"secure":  {"ndbus0region0fsdax"},
+					"scratch": {"ndbus0region1fsdax"},
+				},
+				PoolErasePolicies: map[string]ErasePolicy{
+					"secure":  {Method: EraseShred, Iterations: 2},
+					"scratch": {Method: EraseNone},
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			lvm.runner = runner
+			lvm.deviceBusy = func(string) (bool, error) { return false, nil }
+			lvm.volumeGroups = []string{"ndbus0region0fsdax", "ndbus0region1fsdax", "ndbus0region2fsdax"}
+			for _, vg := range lvm.volumeGroups {
+				lvm.devices["vol-"+vg] = PmemDeviceInfo{Name: "vol-" + vg, Path: "/dev/null", Size: 4 << 20, VolumeGroup: vg}
+			}
+
+			Expect(lvm.DeleteDevice(context.Background(), "vol-ndbus0region0fsdax", true)).To(Succeed())
+			Expect(runner.commands("shred")).To(Equal([]string{"shred -v -n 2 /dev/null"}))
+
+			runner.calls = nil
+			Expect(lvm.DeleteDevice(context.Background(), "vol-ndbus0region1fsdax", true)).To(Succeed())
+			Expect(runner.commands("shred")).To(BeEmpty())
+			Expect(runner.commands("blkdiscard")).To(BeEmpty())
+			Expect(runner.commands("lvremove")).To(HaveLen(1))
+
+			// groups outside of the pools use the global policy
+			runner.calls = nil
+			Expect(lvm.FlushDeviceData(context.Background(), "vol-ndbus0region2fsdax")).To(Succeed())
+			Expect(runner.commands("shred")).To(BeEmpty())
+			Expect(runner.commands("blkdiscard")).To(HaveLen(1))
+		})
+
+		It("rejects erase policies of unknown pools", func() {
+			_, err := newPmemLvm(LVMConfig{PoolErasePolicies: map[string]ErasePolicy{"fast": {Method: EraseNone}}})
+			Expect(err).To(HaveOccurred())
+			_, err = newPmemLvm(LVMConfig{
+				Pools:             map[string][]string{"fast": {"ndbus0region1fsdax"}},
+				PoolErasePolicies: map[string]ErasePolicy{"fast": {Method: "bogus"}},
+			})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("pool without space", func() {
+			err := lvm.CreateDeviceInPool(context.Background(), "fast", "vol1", 12<<30, "fsdax")
+			Expect(errors.Is(err, ErrNotEnoughSpace)).To(BeTrue())
+			Expect(runner.commands("lvcreate")).To(BeEmpty())
+		})
+
+		It("unknown pool", func() {
+			err := lvm.CreateDeviceInPool(context.Background(), "slow", "vol1", 4<<20, "fsdax")
+			Expect(err).To(HaveOccurred())
+			_, err = lvm.GetPoolCapacity(context.Background(), "slow")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("overlapping pools", func() {
+			_, err := newPmemLvm(LVMConfig{Pools: map[string][]string{
+				"fast": {"ndbus0region1fsdax"},
+				"bulk": {"ndbus0region0fsdax", "ndbus0region1fsdax"},
+			}})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("Volume group backing", func() {
+		var runner *fakeRunner
+		var lvm *pmemLvm
+
+		BeforeEach(func() {
+			runner = &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					switch cmd {
+					case "vgs":
+						return "  ndbus0region0fsdax 17179869184 8589934592 4194304 fsdax\n" +
+							"  ndbus0region0sector 8589934592 8589934592 4194304 sector\n" +
+							"  ndbus0region1fsdax 17179869184 17179869184 4194304 fsdax\n", nil
+					case "pvs":
+						return "  ndbus0region0fsdax|/dev/pmem0|4294967296\n" +
+							"  ndbus0region0fsdax|/dev/pmem0.1|4294967296\n" +
+							"  ndbus0region0sector|/dev/pmem0.2s|8589934592\n" +
+							"  ndbus0region1fsdax|/dev/pmem1|8589934592\n" +
+							"  ndbus0region1fsdax|/dev/pmem1.1s|8589934592\n", nil
+					}
+					return "", nil
+				},
+			}
+			lvm = newFakeLvm(runner, "ndbus0region0fsdax", "ndbus0region0sector", "ndbus0region1fsdax")
+			lvm.regions = fakeRegions{
+				&fakeRegion{name: "region0", nsList: []initNamespace{
+					fakeNamespace{name: "pmem-csi", blockDevice: "pmem0", mode: ndctl.FsdaxMode},
+					fakeNamespace{name: "pmem-csi", blockDevice: "pmem0.1", mode: ndctl.FsdaxMode},
+					fakeNamespace{name: "pmem-csi", blockDevice: "pmem0.2s", mode: ndctl.SectorMode},
+				}},
+				// one of the namespaces was reconfigured after creating the group
+				&fakeRegion{name: "region1", nsList: []initNamespace{
+					fakeNamespace{name: "pmem-csi", blockDevice: "pmem1", mode: ndctl.FsdaxMode},
+					fakeNamespace{name: "pmem-csi", blockDevice: "pmem1.1s", mode: ndctl.SectorMode},
+				}},
+			}
+		})
+
+		It("reports namespace modes", func() {
+			backing, err := lvm.GetVolumeGroupBacking(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(backing).To(Equal([]VolumeGroupBacking{
+				{
+					VolumeGroupInfo: VolumeGroupInfo{Name: "ndbus0region0fsdax", Size: 16 << 30, Free: 8 << 30, ExtentSize: 4 << 20, Mode: "fsdax"},
+					Bus:             "ndbus0",
+					Region:          "region0",
+					Namespaces:      map[string]string{"/dev/pmem0": "fsdax", "/dev/pmem0.1": "fsdax"},
+					NamespaceMode:   "fsdax",
+					DAX:             true,
+				},
+				{
+					VolumeGroupInfo: VolumeGroupInfo{Name: "ndbus0region0sector", Size: 8 << 30, Free: 8 << 30, ExtentSize: 4 << 20, Mode: "sector"},
+					Bus:             "ndbus0",
+					Region:          "region0",
+					Namespaces:      map[string]string{"/dev/pmem0.2s": "sector"},
+					NamespaceMode:   "sector",
+				},
+				{
+					VolumeGroupInfo: VolumeGroupInfo{Name: "ndbus0region1fsdax", Size: 16 << 30, Free: 16 << 30, ExtentSize: 4 << 20, Mode: "fsdax"},
+					Bus:             "ndbus0",
+					Region:          "region1",
+					Namespaces:      map[string]string{"/dev/pmem1": "fsdax", "/dev/pmem1.1s": "sector"},
+				},
+			}))
+		})
+
+		It("region gone", func() {
+			lvm.regions = fakeRegions{}
+			backing, err := lvm.GetVolumeGroupBacking(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(backing).To(HaveLen(3))
+			for _, b := range backing {
+				Expect(b.Region).To(BeEmpty())
+				Expect(b.Namespaces).To(BeEmpty())
+				Expect(b.DAX).To(BeFalse())
+			}
+		})
+	})
+
+	Context("JSON reports", func() {
+		const vgsJSON = `  {
+      "report": [
+          {
+              "vg": [
+                  {"vg_name":"ndbus0region0fsdax", "vg_size":"17179869184", "vg_free":"8589934592", "vg_extent_size":"4194304", "vg_tags":"fsdax"}
+              ]
+          }
+      ]
+  }
+`
+		const lvsJSON = `  {
+      "report": [
+          {
+              "lv": [
+                  {"lv_name":"vol1", "lv_path":"/dev/ndbus0region0fsdax/vol1", "lv_size":"4194304", "lv_uuid":"uuid-vol1", "vg_name":"ndbus0region0fsdax", "lv_tags":"pmem-csi.owner=test", "lv_dm_path":"/dev/mapper/ndbus0region0fsdax-vol1", "origin":"", "lv_attr":"-wi-a-----"},
+                  {"lv_name":"snap1", "lv_path":"/dev/ndbus0region0fsdax/snap1", "lv_size":"8388608", "lv_uuid":"uuid-snap1", "vg_name":"ndbus0region0fsdax", "lv_tags":"", "lv_dm_path":"/dev/mapper/ndbus0region0fsdax-snap1", "origin":"vol1", "lv_attr":"swi-a-s---"}
+              ]
+          }
+      ]
+  }
+`
+		var runner *fakeRunner
+		var lvm *pmemLvm
+		var version string
+
+		BeforeEach(func() {
+			version = "  LVM version:     2.03.11(2) (2021-01-08)\n"
+			runner = &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					json := strings.Contains(strings.Join(args, " "), "--reportformat json")
+					switch cmd {
+					case "lvm":
+						return version, nil
+					case "vgs":
+						if json {
+							return vgsJSON, nil
+						}
+						return "  ndbus0region0fsdax 17179869184 8589934592 4194304 fsdax\n", nil
+					case "lvs":
+						if json {
+							return lvsJSON, nil
+						}
+						return "  vol1|/dev/ndbus0region0fsdax/vol1|4194304|uuid-vol1|ndbus0region0fsdax||||\n", nil
+					}
+					return "", nil
+				},
+			}
+			var err error
+			lvm, err = newPmemLvm(LVMConfig{JSONReports: true})
+			Expect(err).NotTo(HaveOccurred())
+			lvm.runner = runner
+			lvm.regions = fakeRegions{&fakeRegion{name: "region0"}}
+		})
+
+		It("parses lvs and vgs", func() {
+			Expect(lvm.init(context.Background())).To(Succeed())
+			Expect(lvm.devices).To(Equal(map[string]PmemDeviceInfo{
+				"vol1": {
+					Name:        "vol1",
+					Path:        "/dev/ndbus0region0fsdax/vol1",
+					DMPath:      "/dev/mapper/ndbus0region0fsdax-vol1",
+					Size:        4 << 20,
+					UUID:        "uuid-vol1",
+					VolumeGroup: "ndbus0region0fsdax",
+					Tags:        map[string]string{"pmem-csi.owner": "test"},
+				},
+				"snap1": {
+					Name:        "snap1",
+					Path:        "/dev/ndbus0region0fsdax/snap1",
+					DMPath:      "/dev/mapper/ndbus0region0fsdax-snap1",
+					Size:        8 << 20,
+					UUID:        "uuid-snap1",
+					VolumeGroup: "ndbus0region0fsdax",
+					Origin:      "vol1",
+				},
+			}))
+			vgs, err := lvm.ListVolumeGroups(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(vgs).To(Equal([]VolumeGroupInfo{
+				{Name: "ndbus0region0fsdax", Size: 16 << 30, Free: 8 << 30, ExtentSize: 4 << 20, Mode: "fsdax"},
+			}))
+			names := []string{}
+			Expect(lvm.ForEachDevice(context.Background(), func(dev PmemDeviceInfo) error {
+				names = append(names, dev.Name)
+				return nil
+			})).To(Succeed())
+			Expect(names).To(Equal([]string{"vol1", "snap1"}))
+			Expect(runner.commands("lvs")).To(ContainElement(
+				"lvs --reportformat json --nosuffix -o lv_name,lv_path,lv_size,lv_uuid,vg_name,lv_tags,lv_dm_path,origin,lv_attr --units B ndbus0region0fsdax ndbus0region0sector"))
+		})
+
+		It("old version reports text", func() {
+			version = "  LVM version:     2.02.98(2) (2012-10-15)\n"
+			Expect(lvm.init(context.Background())).To(Succeed())
+			Expect(lvm.jsonReports).To(BeFalse())
+			Expect(lvm.devices).To(HaveLen(1))
+			for _, call := range append(runner.commands("lvs"), runner.commands("vgs")...) {
+				Expect(call).NotTo(ContainSubstring("json"))
+			}
+		})
+
+		It("missing column", func() {
+			_, err := parseJSONReport(`{"report": [{"vg": [{"vg_name": "vg1"}]}]}`, "vg", vgsColumns)
+			Expect(err).To(HaveOccurred())
+			_, err = parseJSONReport("  vg1 1 1 1 fsdax\n", "vg", vgsColumns)
+			Expect(err).To(HaveOccurred())
+			rows, err := parseJSONReport(`{"report": [{"vg": []}]}`, "vg", vgsColumns)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rows).To(BeEmpty())
+		})
+	})
+
+	Context("Without volume groups", func() {
+		var runner *fakeRunner
+		var lvm *pmemLvm
+
+		BeforeEach(func() {
+			runner = &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					// unmanaged groups and volumes of the system
+					switch cmd {
+					case "vgs":
+						return "  system 17179869184 8589934592 4194304 fsdax\n", nil
+					case "lvs":
+						return "  root|/dev/system/root|4194304|uuid-root|system||||\n", nil
+					}
+					return "", nil
+				},
+			}
+			lvm = newFakeLvm(runner)
+		})
+
+		It("queries nothing", func() {
+			capacity, err := lvm.GetCapacity(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(capacity).To(BeEmpty())
+			devices, err := lvm.ListDevices(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(devices).To(BeEmpty())
+			_, err = lvm.GetDeviceUncached(context.Background(), "root")
+			Expect(errors.Is(err, ErrDeviceNotFound)).To(BeTrue())
+			Expect(lvm.listDevices(context.Background())).To(BeEmpty())
+			Expect(lvm.getVolumeGroups(context.Background(), nil, "")).To(BeEmpty())
+			Expect(runner.commands("vgs")).To(BeEmpty())
+			Expect(runner.commands("lvs")).To(BeEmpty())
+		})
+
+		It("create fails", func() {
+			err := lvm.CreateDevice(context.Background(), "vol1", 4<<20, "fsdax")
+			Expect(errors.Is(err, ErrNoVolumeGroups)).To(BeTrue())
+			Expect(runner.calls).To(BeEmpty())
+		})
+	})
+
+	Context("Missing volume group", func() {
+		It("never queries unnamed groups", func() {
+			lvs := ""
+			runner := &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					switch cmd {
+					case "vgs":
+						if strings.Contains(strings.Join(args, " "), "vg_attr") {
+							return "  Volume group \"ndbus0region0sector\" not found\n  ndbus0region0fsdax wz--n- 0\n", exitError(5)
+						}
+						return "  Volume group \"ndbus0region0sector\" not found\n" +
+							"  ndbus0region0fsdax 17179869184 8589934592 4194304 fsdax\n", exitError(5)
+					case "lvs":
+						return lvs, nil
+					case "lvcreate":
+						lvs = "  vol1|/dev/null|4194304|uuid-vol1|ndbus0region0fsdax||||\n"
+					}
+					return "", nil
+				},
+			}
+			lvm := newFakeLvm(runner, "ndbus0region0fsdax", "ndbus0region0sector")
+			ctx := context.Background()
+			_, err := lvm.ListVolumeGroups(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = lvm.GetCapacity(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(lvm.CreateDevice(ctx, "vol1", 4<<20, "fsdax")).To(Succeed())
+			_, err = lvm.GetDeviceUncached(ctx, "vol1")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = lvm.ListDevices(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = lvm.ListIncomplete(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			health, err := lvm.HealthCheck(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(health[1].State).To(Equal(VolumeGroupMissing))
+			Expect(lvm.DeleteDevice(ctx, "vol1", false)).To(Succeed())
+
+			for _, call := range runner.calls {
+				args := strings.Fields(call)
+				if args[0] != "vgs" && args[0] != "lvs" {
+					continue
+				}
+				named := false
+				for _, arg := range args[1:] {
+					if lvm.managesVolumeGroup(arg) {
+						named = true
+					}
+				}
+				Expect(named).To(BeTrue(), "no volume group in %q", call)
+			}
+		})
+	})
+
+	Context("Reservations", func() {
+		var lvm *pmemLvm
+		var now time.Time
+
+		BeforeEach(func() {
+			runner := &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					if cmd == "vgs" {
+						return "  ndbus0region0fsdax 17179869184 8589934592 4194304 fsdax\n" +
+							"  ndbus0region0sector 17179869184 4294967296 4194304 sector\n", nil
+					}
+					return "", nil
+				},
+			}
+			lvm = newFakeLvm(runner, "ndbus0region0fsdax", "ndbus0region0sector")
+			now = time.Now()
+			lvm.reservations.now = func() time.Time { return now }
+		})
+
+		It("deducts reserved capacity until released", func() {
+			token1, err := lvm.Reserve(context.Background(), 1<<30)
+			Expect(err).NotTo(HaveOccurred())
+			token2, err := lvm.Reserve(context.Background(), 2<<30)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(token2).NotTo(Equal(token1))
+			Expect(lvm.GetCapacity(context.Background())).To(Equal(map[string]uint64{"fsdax": 5 << 30, "sector": 1 << 30}))
+
+			lvm.Release(token1)
+			Expect(lvm.GetCapacity(context.Background())).To(Equal(map[string]uint64{"fsdax": 6 << 30, "sector": 2 << 30}))
+			// releasing twice does no harm
+			lvm.Release(token1)
+			lvm.Release(token2)
+			Expect(lvm.GetCapacity(context.Background())).To(Equal(map[string]uint64{"fsdax": 8 << 30, "sector": 4 << 30}))
+		})
+
+		It("refuses to over-commit", func() {
+			_, err := lvm.Reserve(context.Background(), 6<<30)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = lvm.Reserve(context.Background(), 3<<30)
+			Expect(errors.Is(err, ErrNotEnoughSpace)).To(BeTrue())
+			_, err = lvm.Reserve(context.Background(), 2<<30)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(lvm.GetCapacity(context.Background())).To(Equal(map[string]uint64{"fsdax": 0, "sector": 0}))
+		})
+
+		It("rejects zero size", func() {
+			_, err := lvm.Reserve(context.Background(), 0)
+			Expect(errors.Is(err, ErrInvalidSize)).To(BeTrue())
+		})
+
+		It("expires abandoned reservations", func() {
+			_, err := lvm.Reserve(context.Background(), 1<<30)
+			Expect(err).NotTo(HaveOccurred())
+			now = now.Add(defaultReservationTTL - time.Second)
+			Expect(lvm.GetCapacity(context.Background())).To(Equal(map[string]uint64{"fsdax": 7 << 30, "sector": 3 << 30}))
+			now = now.Add(time.Second)
+			Expect(lvm.GetCapacity(context.Background())).To(Equal(map[string]uint64{"fsdax": 8 << 30, "sector": 4 << 30}))
+			Expect(lvm.reservations.entries).To(BeEmpty())
+		})
+
+		It("configurable expiry", func() {
+			lvm, err := newPmemLvm(LVMConfig{ReservationTTL: time.Minute})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(lvm.reservations.ttl).To(Equal(time.Minute))
+			_, err = newPmemLvm(LVMConfig{ReservationTTL: -time.Minute})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("Deployable capacity", func() {
+		var runner *fakeRunner
+		var incomplete string
+
+		BeforeEach(func() {
+			incomplete = ""
+			runner = &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					switch cmd {
+					case "vgs":
+						return "  ndbus0region0fsdax 17179869184 8589934592 4194304 fsdax\n" +
+							"  ndbus0region0sector 17179869184 4294967296 4194304 sector\n", nil
+					case "lvs":
+						if strings.Contains(strings.Join(args, " "), "lv_tags={"+incompleteTag+"}") {
+							return incomplete, nil
+						}
+					}
+					return "", nil
+				},
+			}
+		})
+
+		newLvm := func(cfg LVMConfig) *pmemLvm {
+			lvm, err := newPmemLvm(cfg)
+			Expect(err).NotTo(HaveOccurred())
+			lvm.runner = runner
+			lvm.volumeGroups = []string{"ndbus0region0fsdax", "ndbus0region0sector"}
+			return lvm
+		}
+
+		It("deducts reservations and incomplete devices", func() {
+			lvm := newLvm(LVMConfig{MarkIncomplete: true})
+			Expect(lvm.GetDeployableCapacity(context.Background())).To(Equal(uint64(8 << 30)))
+
+			_, err := lvm.Reserve(context.Background(), 1<<30)
+			Expect(err).NotTo(HaveOccurred())
+			incomplete = "  vol1|/dev/null|1073741824|uuid-vol1|ndbus0region0fsdax|pmem-csi.incomplete|||\n" +
+				"  vol2|/dev/null|2147483648|uuid-vol2|ndbus0region0sector|pmem-csi.incomplete|||\n"
+			Expect(lvm.GetDeployableCapacity(context.Background())).To(Equal(uint64(4 << 30)))
+			// GetCapacity only knows about reservations
+			Expect(lvm.GetCapacity(context.Background())).To(Equal(map[string]uint64{"fsdax": 7 << 30, "sector": 3 << 30}))
+		})
+
+		It("never goes below zero", func() {
+			lvm := newLvm(LVMConfig{MarkIncomplete: true})
+			_, err := lvm.Reserve(context.Background(), 6<<30)
+			Expect(err).NotTo(HaveOccurred())
+			incomplete = "  vol1|/dev/null|4294967296|uuid-vol1|ndbus0region0fsdax|pmem-csi.incomplete|||\n"
+			Expect(lvm.GetDeployableCapacity(context.Background())).To(BeZero())
+		})
+
+		It("ignores incomplete devices without marking", func() {
+			lvm := newLvm(LVMConfig{})
+			incomplete = "  vol1|/dev/null|1073741824|uuid-vol1|ndbus0region0fsdax|pmem-csi.incomplete|||\n"
+			Expect(lvm.GetDeployableCapacity(context.Background())).To(Equal(uint64(8 << 30)))
+			Expect(runner.commands("lvs")).To(BeEmpty())
+		})
+	})
+
+	Context("DAX", func() {
+		var runner *fakeRunner
+		var lvm *pmemLvm
+		var dax map[string]bool
+
+		BeforeEach(func() {
+			runner = &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					if cmd == "lvs" {
+						return "  vol1|/dev/fsdax/vol1|4194304|uuid-vol1|ndbus0region0fsdax||||\n" +
+							"  vol2|/dev/fsdax/vol2|4194304|uuid-vol2|ndbus0region0fsdax||||\n" +
+							"  vol3|/dev/sector/vol3|4194304|uuid-vol3|ndbus0region0sector||||\n", nil
+					}
+					return "", nil
+				},
+			}
+			lvm = newFakeLvm(runner, "ndbus0region0fsdax", "ndbus0region0sector")
+			dax = map[string]bool{"/dev/fsdax/vol1": true, "/dev/sector/vol3": true}
+			lvm.daxSupported = func(path string) bool { return dax[path] }
+		})
+
+		It("lists capable devices", func() {
+			devices, err := lvm.listDevices(context.Background(), lvm.volumeGroups...)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(devices["vol1"].DAXCapable).To(BeTrue())
+			// the kernel does not support DAX for it
+			Expect(devices["vol2"].DAXCapable).To(BeFalse())
+			// sector namespaces never support DAX
+			Expect(devices["vol3"].DAXCapable).To(BeFalse())
+		})
+
+		It("gets uncached devices", func() {
+			dev, err := lvm.GetDeviceUncached(context.Background(), "vol1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dev.DAXCapable).To(BeTrue())
+			cached, err := lvm.GetDevice(context.Background(), "vol1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cached.DAXCapable).To(BeTrue())
+
+			dax["/dev/fsdax/vol1"] = false
+			dev, err = lvm.GetDeviceUncached(context.Background(), "vol1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dev.DAXCapable).To(BeFalse())
+		})
+
+		It("iterates over devices", func() {
+			capable := map[string]bool{}
+			err := lvm.ForEachDevice(context.Background(), func(dev PmemDeviceInfo) error {
+				capable[dev.Name] = dev.DAXCapable
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(capable).To(Equal(map[string]bool{"vol1": true, "vol2": false, "vol3": false}))
+		})
+
+		It("volume group modes", func() {
+			Expect(vgNamespaceMode("ndbus0region0fsdax")).To(Equal("fsdax"))
+			Expect(vgNamespaceMode("ndbus0region1sector")).To(Equal("sector"))
+			Expect(vgNamespaceMode("system")).To(BeEmpty())
+		})
+	})
+
+	Context("Size validation", func() {
+		var runner *fakeRunner
+		var lvm *pmemLvm
+
+		BeforeEach(func() {
+			runner = &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					if cmd == "vgs" {
+						return "  ndbus0region0fsdax 4294967296 4294967296 4194304 fsdax\n" +
+							"  ndbus0region1fsdax 8589934592 1073741824 4194304 fsdax\n", nil
+					}
+					return "", nil
+				},
+			}
+			lvm = newFakeLvm(runner, "ndbus0region0fsdax", "ndbus0region1fsdax")
+		})
+
+		It("zero size", func() {
+			err := lvm.CreateDevice(context.Background(), "vol1", 0, "fsdax")
+			Expect(errors.Is(err, ErrInvalidSize)).To(BeTrue())
+			Expect(runner.commands("lvcreate")).To(BeEmpty())
+		})
+
+		It("sub-extent size", func() {
+			err := lvm.CreateDevice(context.Background(), "vol1", 4<<20-1, "fsdax")
+			Expect(errors.Is(err, ErrInvalidSize)).To(BeTrue())
+			Expect(runner.commands("lvcreate")).To(BeEmpty())
+		})
+
+		It("oversized", func() {
+			err := lvm.CreateDevice(context.Background(), "vol1", 8<<30+1, "fsdax")
+			Expect(errors.Is(err, ErrInvalidSize)).To(BeTrue())
+			Expect(errors.Is(err, ErrNotEnoughSpace)).To(BeFalse())
+			Expect(runner.commands("lvcreate")).To(BeEmpty())
+		})
+
+		It("larger than the free space", func() {
+			// fits into the size of ndbus0region1fsdax, which does not have that much free
+			err := lvm.CreateDevice(context.Background(), "vol1", 6<<30, "fsdax")
+			Expect(errors.Is(err, ErrNotEnoughSpace)).To(BeTrue())
+			Expect(errors.Is(err, ErrInvalidSize)).To(BeFalse())
+		})
+
+		It("zero size thin volume", func() {
+			lvm.thinPool = true
+			err := lvm.CreateDevice(context.Background(), "vol1", 0, "fsdax")
+			Expect(errors.Is(err, ErrInvalidSize)).To(BeTrue())
+			Expect(runner.commands("lvcreate")).To(BeEmpty())
+		})
+
+		It("on physical volumes", func() {
+			runner.handler = func(cmd string, args ...string) (string, error) {
+				switch cmd {
+				case "vgs":
+					return "  ndbus0region0fsdax 4294967296 4294967296 4194304 fsdax\n", nil
+				case "pvs":
+					return "  ndbus0region0fsdax|/dev/pmem0|4294967296\n", nil
+				}
+				return "", nil
+			}
+			err := lvm.CreateDeviceOnPVs(context.Background(), "vol1", 0, "fsdax", []string{"/dev/pmem0"})
+			Expect(errors.Is(err, ErrInvalidSize)).To(BeTrue())
+			Expect(runner.commands("lvcreate")).To(BeEmpty())
+		})
+	})
+
+	Context("Capabilities", func() {
+		It("linear volumes", func() {
+			lvm, err := newPmemLvm(LVMConfig{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(lvm.Capabilities()).To(Equal(DeviceManagerCapabilities{
+				Snapshots:  true,
+				Resize:     true,
+				Striping:   true,
+				Encryption: true,
+			}))
+		})
+
+		It("thin volumes", func() {
+			lvm, err := newPmemLvm(LVMConfig{ThinPool: true, AllowShrink: true})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(lvm.Capabilities()).To(Equal(DeviceManagerCapabilities{
+				Snapshots:        true,
+				Resize:           true,
+				Shrink:           true,
+				ThinProvisioning: true,
+				Encryption:       true,
+			}))
+		})
+
+		It("snapshots of thin volumes", func() {
+			created := false
+			runner := &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					switch cmd {
+					case "vgs":
+						// all space is in the thin pool
+						return "  ndbus0region0fsdax 17179869184 0 4194304 fsdax\n", nil
+					case "lvs":
+						if strings.Contains(strings.Join(args, " "), "pool_lv /dev/ndbus0region0fsdax/vol1") {
+							return "  thinpool\n", nil
+						}
+						if strings.Contains(strings.Join(args, " "), "-S lv_name=snap1") && created {
+							return "  snap1|/dev/ndbus0region0fsdax/snap1|4194304|uuid-snap1|ndbus0region0fsdax|||vol1|\n", nil
+						}
+					case "lvcreate":
+						created = true
+					}
+					return "", nil
+				},
+			}
+			lvm := newFakeLvm(runner, "ndbus0region0fsdax")
+			lvm.thinPool = true
+			lvm.devices["vol1"] = PmemDeviceInfo{Name: "vol1", Path: "/dev/ndbus0region0fsdax/vol1", Size: 4 << 20, VolumeGroup: "ndbus0region0fsdax"}
+			Expect(lvm.Capabilities().Snapshots).To(BeTrue())
+			Expect(lvm.CreateSnapshot(context.Background(), "vol1", "snap1", 0)).To(Succeed())
+			Expect(runner.commands("lvcreate")).To(Equal([]string{"lvcreate -s -n snap1 ndbus0region0fsdax/vol1"}))
+		})
+
+		It("implements advertised operations", func() {
+			for _, cfg := range []LVMConfig{{}, {ThinPool: true}} {
+				lvm, err := newPmemLvm(cfg)
+				Expect(err).NotTo(HaveOccurred())
+				var dm PmemDeviceManager = lvm
+				caps := dm.Capabilities()
+				if caps.Snapshots {
+					_, ok := dm.(Snapshotter)
+					Expect(ok).To(BeTrue())
+				}
+				if caps.Resize {
+					_, ok := dm.(Resizer)
+					Expect(ok).To(BeTrue())
+				}
+				if caps.Striping {
+					_, ok := dm.(StripedCreator)
+					Expect(ok).To(BeTrue())
+				}
+				if caps.Encryption {
+					_, ok := dm.(EncryptedCreator)
+					Expect(ok).To(BeTrue())
+				}
+			}
+		})
+
+		It("namespaces", func() {
+			Expect((&pmemNdctl{}).Capabilities()).To(Equal(DeviceManagerCapabilities{}))
+		})
+	})
+
+	Context("Capacity ranges", func() {
+		var runner *fakeRunner
+		var lvm *pmemLvm
+
+		BeforeEach(func() {
+			free := map[string]uint64{"ndbus0region0fsdax": 2 << 30, "ndbus0region1fsdax": 8 << 30, "ndbus0region2fsdax": 4 << 30}
+			lvs := ""
+			runner = &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					switch cmd {
+					case "vgs":
+						output := ""
+						for _, vg := range []string{"ndbus0region0fsdax", "ndbus0region1fsdax", "ndbus0region2fsdax"} {
+							output += fmt.Sprintf("  %s 17179869184 %d 4194304 fsdax\n", vg, free[vg])
+						}
+						return output, nil
+					case "lvs":
+						return lvs, nil
+					case "lvcreate":
+						mb, err := strconv.ParseUint(args[2], 10, 64)
+						Expect(err).NotTo(HaveOccurred())
+						vg := args[len(args)-1]
+						free[vg] -= mb << 20
+						lvs = fmt.Sprintf("  vol1|/dev/null|%d|uuid-vol1|%s||||\n", mb<<20, vg)
+					}
+					return "", nil
+				},
+			}
+			lvm = newFakeLvm(runner, "ndbus0region0fsdax", "ndbus0region1fsdax", "ndbus0region2fsdax")
+		})
+
+		It("maximum fits", func() {
+			dev, err := lvm.CreateDeviceRange(context.Background(), "vol1", 1<<30, 3<<30, "fsdax")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dev.Size).To(Equal(uint64(3 << 30)))
+			Expect(runner.commands("lvcreate")).To(Equal([]string{"lvcreate -Zn -L 3072 -Wy --yes -n vol1 ndbus0region1fsdax"}))
+		})
+
+		It("grows to the largest free space", func() {
+			dev, err := lvm.CreateDeviceRange(context.Background(), "vol1", 1<<30, 16<<30, "fsdax")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dev.Size).To(Equal(uint64(8 << 30)))
+			Expect(dev.VolumeGroup).To(Equal("ndbus0region1fsdax"))
+		})
+
+		It("does not round up beyond the maximum", func() {
+			dev, err := lvm.CreateDeviceRange(context.Background(), "vol1", 1<<30, 3<<30+1<<20, "fsdax")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dev.Size).To(Equal(uint64(3 << 30)))
+		})
+
+		It("without maximum", func() {
+			dev, err := lvm.CreateDeviceRange(context.Background(), "vol1", 1<<30, 0, "fsdax")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dev.Size).To(Equal(uint64(1 << 30)))
+			Expect(runner.commands("lvcreate")).To(Equal([]string{"lvcreate -Zn -L 1024 -Wy --yes -n vol1 ndbus0region0fsdax"}))
+		})
+
+		It("minimum too large", func() {
+			_, err := lvm.CreateDeviceRange(context.Background(), "vol1", 12<<30, 14<<30, "fsdax")
+			Expect(errors.Is(err, ErrNotEnoughSpace)).To(BeTrue())
+			Expect(runner.commands("lvcreate")).To(BeEmpty())
+		})
+
+		It("maximum below minimum", func() {
+			_, err := lvm.CreateDeviceRange(context.Background(), "vol1", 2<<30, 1<<30, "fsdax")
+			Expect(err).To(HaveOccurred())
+			Expect(runner.calls).To(BeEmpty())
+		})
+	})
+
+	Context("Incomplete devices", func() {
+		var runner *fakeRunner
+		var lvm *pmemLvm
+		var created []string
+		var tagged map[string]bool
+		var failClear bool
+
+		BeforeEach(func() {
+			created = nil
+			tagged = map[string]bool{}
+			failClear = false
+			runner = &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					switch cmd {
+					case "vgs":
+						return "  ndbus0region0fsdax 17179869184 8589934592 4194304 fsdax\n", nil
+					case "lvs":
+						output := ""
+						selectTagged := strings.Contains(strings.Join(args, " "), "lv_tags=")
+						for _, name := range created {
+							tags := ""
+							if tagged[name] {
+								tags = incompleteTag
+							} else if selectTagged {
+								continue
+							}
+							output += fmt.Sprintf("  %s|/dev/null|4194304|uuid-%s|ndbus0region0fsdax|%s|||\n", name, name, tags)
+						}
+						return output, nil
+					case "lvcreate":
+						created = append(created, args[len(args)-2])
+						for i, arg := range args {
+							if arg == "--addtag" && args[i+1] == incompleteTag {
+								tagged[args[len(args)-2]] = true
+							}
+						}
+					case "lvchange":
+						for _, name := range created {
+							delete(tagged, name)
+						}
+					case "dd":
+						if failClear {
+							return "", fmt.Errorf("exit status 1")
+						}
+					}
+					return "", nil
+				},
+			}
+			var err error
+			lvm, err = newPmemLvm(LVMConfig{MarkIncomplete: true})
+			Expect(err).NotTo(HaveOccurred())
+			lvm.runner = runner
+			lvm.volumeGroups = []string{"ndbus0region0fsdax"}
+		})
+
+		It("clears tag on success", func() {
+			Expect(lvm.CreateDevice(context.Background(), "vol1", 4<<20, "fsdax")).To(Succeed())
+			Expect(runner.commands("lvcreate")).To(Equal([]string{"lvcreate -Zn -L 4 --addtag pmem-csi.incomplete -Wy --yes -n vol1 ndbus0region0fsdax"}))
+			Expect(runner.commands("lvchange")).To(Equal([]string{"lvchange --deltag pmem-csi.incomplete /dev/null"}))
+			Expect(tagged).To(BeEmpty())
+			Expect(lvm.devices["vol1"].Tags).To(BeNil())
+
+			devices, err := lvm.ListIncomplete(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(devices).To(BeEmpty())
+		})
+
+		It("lists failed create", func() {
+			failClear = true
+			Expect(lvm.CreateDevice(context.Background(), "vol2", 4<<20, "fsdax")).NotTo(Succeed())
+			Expect(runner.commands("lvchange")).To(BeEmpty())
+
+			devices, err := lvm.ListIncomplete(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(deviceNames(devices)).To(ConsistOf("vol2"))
+			Expect(runner.commands("lvs")).To(ContainElement(
+				"lvs --noheadings --nosuffix --separator | -o lv_name,lv_path,lv_size,lv_uuid,vg_name,lv_tags,lv_dm_path,origin,lv_attr --units B -S lv_tags={pmem-csi.incomplete} ndbus0region0fsdax"))
+
+			// garbage collection
+			failClear = false
+			Expect(lvm.DeleteDevice(context.Background(), "vol2", false)).To(Succeed())
+		})
+
+		It("disabled by default", func() {
+			lvm.markIncomplete = false
+			Expect(lvm.CreateDevice(context.Background(), "vol1", 4<<20, "fsdax")).To(Succeed())
+			Expect(runner.commands("lvcreate")).To(Equal([]string{"lvcreate -Zn -L 4 -Wy --yes -n vol1 ndbus0region0fsdax"}))
+			Expect(runner.commands("lvchange")).To(BeEmpty())
+		})
+	})
+
+	Context("Flush", func() {
+		var runner *fakeRunner
+		var lvm *pmemLvm
+		var checked []string
+
+		BeforeEach(func() {
+			runner = &fakeRunner{}
+			lvm = newFakeLvm(runner, "ndbus0region0fsdax")
+			lvm.devices["vol1"] = PmemDeviceInfo{Name: "vol1", Path: "/dev/null", Size: 4 << 20}
+			checked = nil
+		})
+
+		busy := func(busy bool) func(path string) (bool, error) {
+			return func(path string) (bool, error) {
+				checked = append(checked, path)
+				return busy, nil
+			}
+		}
+
+		It("free device", func() {
+			lvm.deviceBusy = busy(false)
+			Expect(lvm.CanFlush(context.Background(), "vol1")).To(Succeed())
+			Expect(runner.calls).To(BeEmpty())
+			Expect(lvm.FlushDeviceData(context.Background(), "vol1")).To(Succeed())
+			Expect(checked).To(Equal([]string{"/dev/null", "/dev/null"}))
+			Expect(runner.commands("shred")).To(Equal([]string{"shred -v -n 1 /dev/null"}))
+		})
+
+		It("busy device", func() {
+			lvm.deviceBusy = busy(true)
+			err := lvm.CanFlush(context.Background(), "vol1")
+			Expect(errors.Is(err, ErrDeviceBusy)).To(BeTrue())
+			err = lvm.FlushDeviceData(context.Background(), "vol1")
+			Expect(errors.Is(err, ErrDeviceBusy)).To(BeTrue())
+			Expect(runner.calls).To(BeEmpty())
+		})
+
+		It("unknown device", func() {
+			lvm.deviceBusy = busy(false)
+			err := lvm.CanFlush(context.Background(), "vol2")
+			Expect(errors.Is(err, ErrDeviceNotFound)).To(BeTrue())
+			Expect(checked).To(BeEmpty())
+		})
+
+		It("delete closed device", func() {
+			lvm.deviceBusy = busy(false)
+			Expect(lvm.DeleteDevice(context.Background(), "vol1", false)).To(Succeed())
+			Expect(checked).To(Equal([]string{"/dev/null"}))
+			Expect(runner.commands("lvremove")).To(Equal([]string{"lvremove -fy /dev/null"}))
+		})
+
+		It("delete open device", func() {
+			lvm.deviceBusy = busy(true)
+			err := lvm.DeleteDevice(context.Background(), "vol1", false)
+			Expect(errors.Is(err, ErrDeviceBusy)).To(BeTrue())
+			err = lvm.DeleteDeviceAsync(context.Background(), "vol1")
+			Expect(errors.Is(err, ErrDeviceBusy)).To(BeTrue())
+			Expect(runner.calls).To(BeEmpty())
+			Expect(lvm.devices).To(HaveKey("vol1"))
+		})
+
+		It("force delete open device", func() {
+			lvm.deviceBusy = busy(true)
+			Expect(lvm.ForceDeleteDevice(context.Background(), "vol1", false)).To(Succeed())
+			Expect(checked).To(BeEmpty())
+			Expect(runner.commands("lvremove")).To(Equal([]string{"lvremove -fy /dev/null"}))
+			Expect(lvm.devices).NotTo(HaveKey("vol1"))
+		})
+
+		It("delete missing device", func() {
+			lvm.devices["vol1"] = PmemDeviceInfo{Name: "vol1", Path: "/dev/ndbus0region0fsdax/vol1", Size: 4 << 20}
+			lvm.erasePolicy = ErasePolicy{Method: EraseNone}
+			Expect(lvm.DeleteDevice(context.Background(), "vol1", true)).To(Succeed())
+			Expect(runner.commands("lvremove")).To(Equal([]string{"lvremove -fy /dev/ndbus0region0fsdax/vol1"}))
+		})
+	})
+
+	Context("Orphans", func() {
+		var runner *fakeRunner
+		var lvm *pmemLvm
+
+		BeforeEach(func() {
+			runner = &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					if cmd == "lvs" {
+						return "  vol1|/dev/null|4194304|uuid-vol1|ndbus0region0fsdax||||\n" +
+							"  orphan2|/dev/null|4194304|uuid-orphan2|ndbus0region0fsdax||||\n" +
+							"  orphan1|/dev/null|4194304|uuid-orphan1|ndbus0region0fsdax||||\n", nil
+					}
+					return "", nil
+				},
+			}
+			lvm = newFakeLvm(runner, "ndbus0region0fsdax")
+		})
+
+		It("deletes unknown devices", func() {
+			deleted, err := lvm.DeleteOrphans(context.Background(), map[string]bool{"vol1": true}, true)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(deleted).To(Equal([]string{"orphan1", "orphan2"}))
+			Expect(runner.commands("shred")).To(HaveLen(2))
+			Expect(runner.commands("lvremove")).To(Equal([]string{"lvremove -fy /dev/null", "lvremove -fy /dev/null"}))
+		})
+
+		It("nothing to delete", func() {
+			deleted, err := lvm.DeleteOrphans(context.Background(), map[string]bool{"vol1": true, "orphan1": true, "orphan2": true}, false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(deleted).To(BeEmpty())
+			Expect(runner.commands("lvremove")).To(BeEmpty())
+		})
+
+		It("stops at failure", func() {
+			handler := runner.handler
+			runner.handler = func(cmd string, args ...string) (string, error) {
+				if cmd == "lvremove" {
+					return "", fmt.Errorf("exit status 5")
+				}
+				return handler(cmd, args...)
+			}
+			deleted, err := lvm.DeleteOrphans(context.Background(), map[string]bool{"vol1": true}, false)
+			Expect(err).To(HaveOccurred())
+			Expect(deleted).To(BeEmpty())
+			Expect(runner.commands("lvremove")).To(HaveLen(1))
+		})
+	})
+
+	Context("Background deletion", func() {
+		var runner *fakeRunner
+		var lvm *pmemLvm
+		var release chan struct{}
+		var shredErr error
+
+		BeforeEach(func() {
+			release = make(chan struct{})
+			shredErr = nil
+			runner = &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					if cmd == "shred" {
+						<-release
+						return "", shredErr
+					}
+					return "", nil
+				},
+			}
+			lvm = newFakeLvm(runner, "ndbus0region0fsdax")
+			lvm.devices["vol1"] = PmemDeviceInfo{Name: "vol1", Path: "/dev/null", Size: 4 << 20, VolumeGroup: "ndbus0region0fsdax"}
+		})
+
+		// hasDevice checks under devicemutex whether the device is still known
+		hasDevice := func(name string) bool {
+			devicemutex.Lock()
+			defer devicemutex.Unlock()
+			_, ok := lvm.devices[name]
+			return ok
+		}
+
+		It("runs to completion", func() {
+			Expect(lvm.DeleteDeviceAsync(context.Background(), "vol1")).To(Succeed())
+			state, err := lvm.EraseStatus(context.Background(), "vol1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(state).To(Equal(EraseRunning))
+			// already running
+			Expect(lvm.DeleteDeviceAsync(context.Background(), "vol1")).To(Succeed())
+			Expect(hasDevice("vol1")).To(BeTrue())
+
+			close(release)
+			Eventually(func() EraseState {
+				state, _ := lvm.EraseStatus(context.Background(), "vol1")
+				return state
+			}).Should(Equal(EraseDone))
+			Expect(runner.commands("shred")).To(HaveLen(1))
+			Expect(runner.commands("lvremove")).To(Equal([]string{"lvremove -fy /dev/null"}))
+			Expect(hasDevice("vol1")).To(BeFalse())
+
+			// reported once
+			_, err = lvm.EraseStatus(context.Background(), "vol1")
+			Expect(errors.Is(err, ErrDeviceNotFound)).To(BeTrue())
+		})
+
+		It("reports failure", func() {
+			shredErr = fmt.Errorf("exit status 1")
+			Expect(lvm.DeleteDeviceAsync(context.Background(), "vol1")).To(Succeed())
+			close(release)
+			var err error
+			Eventually(func() EraseState {
+				var state EraseState
+				state, err = lvm.EraseStatus(context.Background(), "vol1")
+				return state
+			}).Should(Equal(EraseFailed))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("exit status 1"))
+			Expect(runner.commands("lvremove")).To(BeEmpty())
+			Expect(hasDevice("vol1")).To(BeTrue())
+
+			// can be retried
+			shredErr = nil
+			Expect(lvm.DeleteDeviceAsync(context.Background(), "vol1")).To(Succeed())
+			Eventually(func() EraseState {
+				state, _ := lvm.EraseStatus(context.Background(), "vol1")
+				return state
+			}).Should(Equal(EraseDone))
+		})
+
+		It("rejects other operations while running", func() {
+			Expect(lvm.DeleteDeviceAsync(context.Background(), "vol1")).To(Succeed())
+			ctx := context.Background()
+			Expect(errors.Is(lvm.DeleteDevice(ctx, "vol1", true), ErrDeviceDeleting)).To(BeTrue())
+			Expect(errors.Is(lvm.ForceDeleteDevice(ctx, "vol1", true), ErrDeviceDeleting)).To(BeTrue())
+			Expect(errors.Is(lvm.FlushDeviceData(ctx, "vol1"), ErrDeviceDeleting)).To(BeTrue())
+			Expect(errors.Is(lvm.ResizeDevice(ctx, "vol1", 8<<20), ErrDeviceDeleting)).To(BeTrue())
+			Expect(errors.Is(lvm.CreateDevice(ctx, "vol1", 4<<20, "fsdax"), ErrDeviceDeleting)).To(BeTrue())
+			_, err := lvm.GetDevice(ctx, "vol1")
+			Expect(errors.Is(err, ErrDeviceDeleting)).To(BeTrue())
+			Expect(runner.commands("lvcreate")).To(BeEmpty())
+			Expect(runner.commands("lvextend")).To(BeEmpty())
+
+			close(release)
+			Eventually(func() EraseState {
+				state, _ := lvm.EraseStatus(context.Background(), "vol1")
+				return state
+			}).Should(Equal(EraseDone))
+			Expect(runner.commands("shred")).To(HaveLen(1))
+			Expect(runner.commands("lvremove")).To(HaveLen(1))
+		})
+
+		It("forgets unreported results", func() {
+			now := time.Now()
+			lvm.eraseJobs.mutex.Lock()
+			lvm.eraseJobs.now = func() time.Time { return now }
+			lvm.eraseJobs.mutex.Unlock()
+			close(release)
+			Expect(lvm.DeleteDeviceAsync(context.Background(), "vol1")).To(Succeed())
+			Eventually(func() bool {
+				devicemutex.Lock()
+				defer devicemutex.Unlock()
+				return lvm.eraseJobs.deleting("vol1")
+			}).Should(BeFalse())
+
+			lvm.eraseJobs.mutex.Lock()
+			now = now.Add(defaultEraseJobRetention)
+			lvm.eraseJobs.mutex.Unlock()
+			_, err := lvm.EraseStatus(context.Background(), "vol1")
+			Expect(errors.Is(err, ErrDeviceNotFound)).To(BeTrue())
+			Expect(lvm.eraseJobs.jobs).To(BeEmpty())
+		})
+
+		It("unknown device", func() {
+			err := lvm.DeleteDeviceAsync(context.Background(), "vol2")
+			Expect(errors.Is(err, ErrDeviceNotFound)).To(BeTrue())
+			_, err = lvm.EraseStatus(context.Background(), "vol2")
+			Expect(errors.Is(err, ErrDeviceNotFound)).To(BeTrue())
+		})
+	})
+
+	Context("Wipe volume group", func() {
+		var runner *fakeRunner
+		var lvm *pmemLvm
+		var existing map[string]string
+
+		BeforeEach(func() {
+			existing = map[string]string{
+				"vol1":  "ndbus0region0fsdax",
+				"vol2":  "ndbus0region0fsdax",
+				"vol3":  "ndbus0region0fsdax",
+				"other": "ndbus0region1fsdax",
+			}
+			runner = &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					switch cmd {
+					case "lvs":
+						vg := args[len(args)-1]
+						output := ""
+						for _, name := range []string{"vol1", "vol2", "vol3", "other"} {
+							if existing[name] == vg {
+								output += fmt.Sprintf("  %s|/dev/%s/%s|4194304|uuid-%s|%s||||\n", name, vg, name, name, vg)
+							}
+						}
+						return output, nil
+					case "lvremove":
+						path := args[len(args)-1]
+						delete(existing, path[strings.LastIndex(path, "/")+1:])
+					}
+					return "", nil
+				},
+			}
+			lvm = newFakeLvm(runner, "ndbus0region0fsdax", "ndbus0region1fsdax")
+			lvm.devices["vol1"] = PmemDeviceInfo{Name: "vol1", Path: "/dev/ndbus0region0fsdax/vol1", Size: 4 << 20, VolumeGroup: "ndbus0region0fsdax"}
+			lvm.erasePolicy = ErasePolicy{Method: EraseNone}
+		})
+
+		It("removes all devices", func() {
+			Expect(lvm.WipeVolumeGroup(context.Background(), "ndbus0region0fsdax", true)).To(Succeed())
+			Expect(runner.commands("lvremove")).To(Equal([]string{
+				"lvremove -fy /dev/ndbus0region0fsdax/vol1",
+				"lvremove -fy /dev/ndbus0region0fsdax/vol2",
+				"lvremove -fy /dev/ndbus0region0fsdax/vol3",
+			}))
+			Expect(existing).To(Equal(map[string]string{"other": "ndbus0region1fsdax"}))
+			Expect(lvm.devices).NotTo(HaveKey("vol1"))
+
+			// nothing left to do
+			Expect(lvm.WipeVolumeGroup(context.Background(), "ndbus0region0fsdax", true)).To(Succeed())
+			Expect(runner.commands("lvremove")).To(HaveLen(3))
+		})
+
+		It("continues after failure", func() {
+			handler := runner.handler
+			runner.handler = func(cmd string, args ...string) (string, error) {
+				if cmd == "lvremove" && strings.HasSuffix(args[len(args)-1], "/vol2") {
+					return "", fmt.Errorf("exit status 5")
+				}
+				return handler(cmd, args...)
+			}
+			err := lvm.WipeVolumeGroup(context.Background(), "ndbus0region0fsdax", true)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("1 of 3 devices"))
+			Expect(err.Error()).To(ContainSubstring("vol2: exit status 5"))
+			Expect(existing).To(Equal(map[string]string{"vol2": "ndbus0region0fsdax", "other": "ndbus0region1fsdax"}))
+
+			// a second run retries the remaining device
+			runner.handler = handler
+			Expect(lvm.WipeVolumeGroup(context.Background(), "ndbus0region0fsdax", true)).To(Succeed())
+			Expect(existing).To(Equal(map[string]string{"other": "ndbus0region1fsdax"}))
+		})
+
+		It("unmanaged volume group", func() {
+			Expect(lvm.WipeVolumeGroup(context.Background(), "ndbus1region0fsdax", true)).NotTo(Succeed())
+			Expect(runner.calls).To(BeEmpty())
+		})
+	})
+
+	Context("Migrate", func() {
+		var runner *fakeRunner
+		var lvm *pmemLvm
+		var tmpDir string
+		// existing devices, name to volume group
+		var existing map[string]string
+		var free string
+
+		devicePath := func(vg, name string) string {
+			return tmpDir + "/" + vg + "-" + name
+		}
+
+		BeforeEach(func() {
+			var err error
+			tmpDir, err = ioutil.TempDir("", "pmd-migrate-")
+			Expect(err).NotTo(HaveOccurred())
+			existing = map[string]string{"vol1": "ndbus0region0fsdax"}
+			Expect(ioutil.WriteFile(devicePath("ndbus0region0fsdax", "vol1"), nil, 0600)).To(Succeed())
+			free = "8388608"
+			runner = &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					switch cmd {
+					case "vgs":
+						return "  ndbus0region0fsdax 17179869184 0 4194304 fsdax\n" +
+							"  ndbus0region1fsdax 17179869184 " + free + " 4194304 fsdax\n" +
+							"  ndbus0region1sector 17179869184 17179869184 4194304 sector\n", nil
+					case "lvs":
+						name := ""
+						var vgs []string
+						for i, arg := range args {
+							if arg == "-S" {
+								name = strings.TrimPrefix(args[i+1], "lv_name=")
+							}
+							if strings.HasPrefix(arg, "ndbus") {
+								vgs = append(vgs, arg)
+							}
+						}
+						output := ""
+						for _, vg := range vgs {
+							if existing[name] == vg {
+								output += fmt.Sprintf("  %s|%s|4194304|uuid-%s|%s|pmem-csi.owner=test|||\n", name, devicePath(vg, name), name, vg)
+							}
+						}
+						return output, nil
+					case "lvcreate":
+						vg := args[len(args)-1]
+						name := args[len(args)-2]
+						existing[name] = vg
+						return "", ioutil.WriteFile(devicePath(vg, name), nil, 0600)
+					case "lvremove":
+						path := args[len(args)-1]
+						for name, vg := range existing {
+							if devicePath(vg, name) == path || vg+"/"+name == path {
+								delete(existing, name)
+							}
+						}
+					case "lvrename":
+						existing[args[2]] = existing[args[1]]
+						delete(existing, args[1])
+					}
+					return "", nil
+				},
+			}
+			lvm = newFakeLvm(runner, "ndbus0region0fsdax", "ndbus0region1fsdax", "ndbus0region1sector")
+			lvm.devices["vol1"] = PmemDeviceInfo{Name: "vol1", Path: devicePath("ndbus0region0fsdax", "vol1"), Size: 4 << 20,
+				VolumeGroup: "ndbus0region0fsdax", Tags: map[string]string{"pmem-csi.owner": "test"}}
+			lvm.erasePolicy = ErasePolicy{Method: EraseNone}
+			lvm.deviceBusy = func(path string) (bool, error) { return false, nil }
+			lvm.allowCopyMigration = true
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(tmpDir)
+		})
+
+		It("copies the device", func() {
+			Expect(lvm.MigrateDevice(context.Background(), "vol1", "ndbus0region1fsdax")).To(Succeed())
+			Expect(runner.commands("lvcreate")).To(Equal([]string{
+				"lvcreate -Zn -L 4 --addtag pmem-csi.owner=test -Wy --yes -n vol1-migrate ndbus0region1fsdax",
+			}))
+			Expect(runner.commands("dd")).To(Equal([]string{
+				"dd if=" + devicePath("ndbus0region0fsdax", "vol1") + " of=" + devicePath("ndbus0region1fsdax", "vol1-migrate") + " bs=1M conv=fsync",
+			}))
+			Expect(runner.commands("lvremove")).To(Equal([]string{
+				"lvremove -fy " + devicePath("ndbus0region0fsdax", "vol1"),
+			}))
+			Expect(runner.commands("lvrename")).To(Equal([]string{
+				"lvrename ndbus0region1fsdax vol1-migrate vol1",
+			}))
+			Expect(existing).To(Equal(map[string]string{"vol1": "ndbus0region1fsdax"}))
+			dev, err := lvm.GetDevice(context.Background(), "vol1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dev.VolumeGroup).To(Equal("ndbus0region1fsdax"))
+			Expect(dev.Tags).To(Equal(map[string]string{"pmem-csi.owner": "test"}))
+		})
+
+		It("same volume group", func() {
+			Expect(lvm.MigrateDevice(context.Background(), "vol1", "ndbus0region0fsdax")).To(Succeed())
+			Expect(runner.calls).To(BeEmpty())
+		})
+
+		It("copying disabled", func() {
+			lvm.allowCopyMigration = false
+			Expect(lvm.MigrateDevice(context.Background(), "vol1", "ndbus0region1fsdax")).NotTo(Succeed())
+			Expect(runner.commands("lvcreate")).To(BeEmpty())
+		})
+
+		It("unmanaged volume group", func() {
+			Expect(lvm.MigrateDevice(context.Background(), "vol1", "ndbus1region0fsdax")).NotTo(Succeed())
+			Expect(runner.commands("lvcreate")).To(BeEmpty())
+		})
+
+		It("other namespace mode", func() {
+			err := lvm.MigrateDevice(context.Background(), "vol1", "ndbus0region1sector")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("sector namespaces"))
+			Expect(runner.commands("lvcreate")).To(BeEmpty())
+		})
+
+		It("busy device", func() {
+			lvm.deviceBusy = func(path string) (bool, error) { return true, nil }
+			err := lvm.MigrateDevice(context.Background(), "vol1", "ndbus0region1fsdax")
+			Expect(errors.Is(err, ErrDeviceBusy)).To(BeTrue())
+			Expect(runner.commands("lvcreate")).To(BeEmpty())
+		})
+
+		It("not enough space", func() {
+			free = "0"
+			err := lvm.MigrateDevice(context.Background(), "vol1", "ndbus0region1fsdax")
+			Expect(errors.Is(err, ErrNotEnoughSpace)).To(BeTrue())
+			Expect(runner.commands("lvcreate")).To(BeEmpty())
+		})
+
+		It("copy failure removes the copy", func() {
+			handler := runner.handler
+			runner.handler = func(cmd string, args ...string) (string, error) {
+				if cmd == "dd" {
+					return "No space left on device", fmt.Errorf("exit status 1")
+				}
+				return handler(cmd, args...)
+			}
+			err := lvm.MigrateDevice(context.Background(), "vol1", "ndbus0region1fsdax")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("No space left on device"))
+			Expect(runner.commands("lvremove")).To(Equal([]string{
+				"lvremove -fy " + devicePath("ndbus0region1fsdax", "vol1-migrate"),
+			}))
+			Expect(existing).To(Equal(map[string]string{"vol1": "ndbus0region0fsdax"}))
+			dev, err := lvm.GetDevice(context.Background(), "vol1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dev.VolumeGroup).To(Equal("ndbus0region0fsdax"))
+		})
+	})
+
+	Context("Snapshots", func() {
+		var runner *fakeRunner
+		var lvm *pmemLvm
+		var free string
+
+		BeforeEach(func() {
+			free = "8388608"
+			runner = &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					switch cmd {
+					case "vgs":
+						return "  ndbus0region0fsdax 17179869184 " + free + " 4194304 fsdax\n", nil
+					case "lvs":
+						if strings.Contains(strings.Join(args, " "), "-S lv_name=snap1") && len(runner.commands("lvcreate")) > 0 {
+							return "  snap1|/dev/ndbus0region0fsdax/snap1|4194304|uuid-snap1|ndbus0region0fsdax|||vol1|\n", nil
+						}
+					}
+					return "", nil
+				},
+			}
+			lvm = newFakeLvm(runner, "ndbus0region0fsdax")
+			lvm.devices["vol1"] = PmemDeviceInfo{Name: "vol1", Path: "/dev/ndbus0region0fsdax/vol1", Size: 4 << 20, VolumeGroup: "ndbus0region0fsdax"}
+		})
+
+		It("creates snapshot", func() {
+			Expect(lvm.CreateSnapshot(context.Background(), "vol1", "snap1", 0)).To(Succeed())
+			Expect(runner.commands("lvcreate")).To(Equal([]string{"lvcreate -s -L 4 -n snap1 ndbus0region0fsdax/vol1"}))
+			dev, err := lvm.GetDevice(context.Background(), "snap1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dev.Origin).To(Equal("vol1"))
+			Expect(dev.IsSnapshot()).To(BeTrue())
+
+			// no snapshots of snapshots
+			Expect(lvm.CreateSnapshot(context.Background(), "snap1", "snap2", 0)).NotTo(Succeed())
+		})
+
+		It("creates snapshot with given size", func() {
+			lvm.allocateByExtents = true
+			Expect(lvm.CreateSnapshot(context.Background(), "vol1", "snap1", 1<<20)).To(Succeed())
+			Expect(runner.commands("lvcreate")).To(Equal([]string{"lvcreate -s -l 1 -n snap1 ndbus0region0fsdax/vol1"}))
+		})
+
+		It("missing origin", func() {
+			err := lvm.CreateSnapshot(context.Background(), "vol2", "snap1", 0)
+			Expect(errors.Is(err, ErrDeviceNotFound)).To(BeTrue())
+			Expect(runner.calls).To(BeEmpty())
+		})
+
+		It("not enough space", func() {
+			free = "0"
+			err := lvm.CreateSnapshot(context.Background(), "vol1", "snap1", 0)
+			Expect(errors.Is(err, ErrNotEnoughSpace)).To(BeTrue())
+			Expect(runner.commands("lvcreate")).To(BeEmpty())
+		})
+
+		It("deletes snapshot", func() {
+			Expect(lvm.CreateSnapshot(context.Background(), "vol1", "snap1", 0)).To(Succeed())
+			Expect(lvm.DeleteSnapshot(context.Background(), "snap1")).To(Succeed())
+			Expect(runner.commands("lvremove")).To(Equal([]string{"lvremove -fy /dev/ndbus0region0fsdax/snap1"}))
+			Expect(lvm.devices).NotTo(HaveKey("snap1"))
+		})
+
+		It("refuses to delete other devices", func() {
+			Expect(lvm.DeleteSnapshot(context.Background(), "vol1")).NotTo(Succeed())
+			Expect(runner.commands("lvremove")).To(BeEmpty())
+		})
+
+		It("refuses to delete snapshot in use", func() {
+			Expect(lvm.CreateSnapshot(context.Background(), "vol1", "snap1", 0)).To(Succeed())
+			lvm.deviceBusy = func(path string) (bool, error) { return true, nil }
+			err := lvm.DeleteSnapshot(context.Background(), "snap1")
+			Expect(errors.Is(err, ErrDeviceBusy)).To(BeTrue())
+			Expect(runner.commands("lvremove")).To(BeEmpty())
+			Expect(lvm.devices).To(HaveKey("snap1"))
+		})
+
+		It("retries lvremove of snapshot in use", func() {
+			Expect(lvm.CreateSnapshot(context.Background(), "vol1", "snap1", 0)).To(Succeed())
+			lvm.removeBusyRetryDelay = time.Millisecond
+			inUse := 1
+			handler := runner.handler
+			runner.handler = func(cmd string, args ...string) (string, error) {
+				if cmd == "lvremove" && inUse > 0 {
+					inUse--
+					return "  Logical volume ndbus0region0fsdax/snap1 in use.\n", fmt.Errorf("exit status 5")
+				}
+				return handler(cmd, args...)
+			}
+			Expect(lvm.DeleteSnapshot(context.Background(), "snap1")).To(Succeed())
+			Expect(runner.commands("lvremove")).To(HaveLen(2))
+			Expect(lvm.devices).NotTo(HaveKey("snap1"))
+		})
+
+		It("missing snapshot counts as deleted", func() {
+			Expect(lvm.DeleteSnapshot(context.Background(), "snap1")).To(Succeed())
+			Expect(runner.commands("lvremove")).To(BeEmpty())
+		})
+
+		It("creates thin snapshot", func() {
+			lvm.thinPool = true
+			free = "0"
+			handler := runner.handler
+			runner.handler = func(cmd string, args ...string) (string, error) {
+				if cmd == "lvs" && strings.Join(args, " ") == "--noheadings -o pool_lv /dev/ndbus0region0fsdax/vol1" {
+					return "  thinpool\n", nil
+				}
+				return handler(cmd, args...)
+			}
+			Expect(lvm.CreateSnapshot(context.Background(), "vol1", "snap1", 1<<20)).To(Succeed())
+			Expect(runner.commands("lvcreate")).To(Equal([]string{"lvcreate -s -n snap1 ndbus0region0fsdax/vol1"}))
+			Expect(runner.commands("vgs")).To(BeEmpty())
+			Expect(lvm.devices).To(HaveKey("snap1"))
+		})
+
+		It("thick snapshot in thin mode", func() {
+			lvm.thinPool = true
+			Expect(lvm.CreateSnapshot(context.Background(), "vol1", "snap1", 0)).To(Succeed())
+			Expect(runner.commands("lvcreate")).To(Equal([]string{"lvcreate -s -L 4 -n snap1 ndbus0region0fsdax/vol1"}))
+		})
+	})
+
+	Context("Bulk deletion", func() {
+		var runner *fakeRunner
+		var lvm *pmemLvm
+
+		BeforeEach(func() {
+			runner = &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					if cmd == "lvremove" && args[len(args)-1] == "/dev/ndbus0region0fsdax/vol2" {
+						return "", fmt.Errorf("exit status 5")
+					}
+					return "", nil
+				},
+			}
+			lvm = newFakeLvm(runner, "ndbus0region0fsdax")
+			for _, name := range []string{"vol1", "vol2", "vol3", "vol4"} {
+				lvm.devices[name] = PmemDeviceInfo{Name: name, Path: "/dev/ndbus0region0fsdax/" + name, Size: 4 << 20}
+			}
+			lvm.erasePolicy = ErasePolicy{Method: EraseNone}
+			lvm.deviceBusy = func(path string) (bool, error) {
+				return path == "/dev/ndbus0region0fsdax/vol3", nil
+			}
+		})
+
+		It("continues after failures", func() {
+			deleted, errs := lvm.DeleteDevices(context.Background(), []string{"vol4", "vol2", "vol3", "vol9", "vol1", "vol4"}, true)
+			// vol9 does not exist and counts as deleted
+			Expect(deleted).To(Equal([]string{"vol4", "vol9", "vol1"}))
+			Expect(errs).To(HaveLen(2))
+			Expect(errs["vol2"]).To(MatchError("exit status 5"))
+			Expect(errors.Is(errs["vol3"], ErrDeviceBusy)).To(BeTrue())
+			Expect(lvm.devices).To(HaveLen(2))
+			Expect(lvm.devices).To(HaveKey("vol2"))
+			Expect(lvm.devices).To(HaveKey("vol3"))
+		})
+
+		It("nothing to delete", func() {
+			deleted, errs := lvm.DeleteDevices(context.Background(), nil, true)
+			Expect(deleted).To(BeEmpty())
+			Expect(errs).To(BeEmpty())
+			Expect(runner.calls).To(BeEmpty())
+		})
+
+		It("cancelled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			deleted, errs := lvm.DeleteDevices(ctx, []string{"vol1", "vol4"}, true)
+			Expect(deleted).To(BeEmpty())
+			Expect(errors.Is(errs["vol1"], context.Canceled)).To(BeTrue())
+			Expect(errors.Is(errs["vol4"], context.Canceled)).To(BeTrue())
+			Expect(runner.calls).To(BeEmpty())
+		})
+
+		It("rejects other operations while erasing", func() {
+			erasing := make(chan struct{})
+			release := make(chan struct{})
+			runner.handler = func(cmd string, args ...string) (string, error) {
+				if cmd == "shred" {
+					close(erasing)
+					<-release
+				}
+				return "", nil
+			}
+			lvm.devices["null0"] = PmemDeviceInfo{Name: "null0", Path: "/dev/null", Size: 4 << 20}
+			lvm.erasePolicy = DefaultErasePolicy
+			lvm.deviceBusy = func(path string) (bool, error) { return false, nil }
+			done := make(chan []string)
+			go func() {
+				deleted, _ := lvm.DeleteDevices(context.Background(), []string{"null0"}, true)
+				done <- deleted
+			}()
+			<-erasing
+			err := lvm.FlushDeviceData(context.Background(), "null0")
+			Expect(errors.Is(err, ErrDeviceDeleting)).To(BeTrue())
+			err = lvm.DeleteDevice(context.Background(), "null0", true)
+			Expect(errors.Is(err, ErrDeviceDeleting)).To(BeTrue())
+			close(release)
+			Expect(<-done).To(Equal([]string{"null0"}))
+			Expect(runner.commands("shred")).To(HaveLen(1))
+			// the result was returned by DeleteDevices, it is no background deletion
+			_, err = lvm.EraseStatus(context.Background(), "null0")
+			Expect(errors.Is(err, ErrDeviceNotFound)).To(BeTrue())
+		})
+
+		It("limits concurrent erasing", func() {
+			var mutex sync.Mutex
+			running, maxRunning := 0, 0
+			runner.handler = func(cmd string, args ...string) (string, error) {
+				if cmd == "shred" {
+					mutex.Lock()
+					running++
+					if running > maxRunning {
+						maxRunning = running
+					}
+					mutex.Unlock()
+					time.Sleep(50 * time.Millisecond)
+					mutex.Lock()
+					running--
+					mutex.Unlock()
+				}
+				return "", nil
+			}
+			names := []string{}
+			for i := 0; i < 6; i++ {
+				name := fmt.Sprintf("null%d", i)
+				lvm.devices[name] = PmemDeviceInfo{Name: name, Path: "/dev/null", Size: 4 << 20}
+				names = append(names, name)
+			}
+			lvm.erasePolicy = DefaultErasePolicy
+			lvm.deviceBusy = func(path string) (bool, error) { return false, nil }
+			lvm.deleteConcurrency = 3
+			deleted, errs := lvm.DeleteDevices(context.Background(), names, true)
+			Expect(errs).To(BeEmpty())
+			Expect(deleted).To(Equal(names))
+			Expect(runner.commands("shred")).To(HaveLen(6))
+			Expect(runner.commands("lvremove")).To(HaveLen(6))
+			// volumeMutex may serialize some of them on machines with few CPUs
+			Expect(maxRunning).To(BeNumerically("<=", 3))
+		})
+	})
+
+	Context("Volume groups", func() {
+		It("lists managed groups", func() {
+			runner := &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					return "  ndbus0region0fsdax 17179869184 8589934592 4194304 fsdax\n" +
+						"  ndbus0region0sector 8589934592 1073741824 33554432 sector\n", nil
+				},
+			}
+			lvm := newFakeLvm(runner, "ndbus0region0fsdax", "ndbus0region0sector")
+			vgs, err := lvm.ListVolumeGroups(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(vgs).To(Equal([]VolumeGroupInfo{
+				{Name: "ndbus0region0fsdax", Size: 16 << 30, Free: 8 << 30, ExtentSize: 4 << 20, Mode: "fsdax"},
+				{Name: "ndbus0region0sector", Size: 8 << 30, Free: 1 << 30, ExtentSize: 32 << 20, Mode: "sector"},
+			}))
+		})
+
+		It("matches lines by name", func() {
+			runner := &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					// sorted differently than requested, with blank lines and a group which is not managed
+					return "\n  ndbus0region0sector 8589934592 1073741824 33554432 sector\n" +
+						"  other 8589934592 8589934592 4194304 fsdax\n\n" +
+						"  ndbus0region0fsdax 17179869184 8589934592 4194304 fsdax\n\n", nil
+				},
+			}
+			lvm := newFakeLvm(runner, "ndbus0region0fsdax", "ndbus0region0sector")
+			vgs, err := lvm.ListVolumeGroups(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(vgs).To(Equal([]VolumeGroupInfo{
+				{Name: "ndbus0region0fsdax", Size: 16 << 30, Free: 8 << 30, ExtentSize: 4 << 20, Mode: "fsdax"},
+				{Name: "ndbus0region0sector", Size: 8 << 30, Free: 1 << 30, ExtentSize: 32 << 20, Mode: "sector"},
+			}))
+		})
+
+		It("missing group", func() {
+			runner := &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					return "  ndbus0region0sector 8589934592 1073741824 33554432 sector\n", nil
+				},
+			}
+			lvm := newFakeLvm(runner, "ndbus0region0fsdax", "ndbus0region0sector", "ndbus0region1fsdax")
+			vgs, err := lvm.ListVolumeGroups(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(vgs).To(Equal([]VolumeGroupInfo{
+				{Name: "ndbus0region0sector", Size: 8 << 30, Free: 1 << 30, ExtentSize: 32 << 20, Mode: "sector"},
+			}))
+			total, _, _, err := lvm.GetCapacityDetails(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(total).To(Equal(uint64(8 << 30)))
+		})
+
+		It("partially initialized node", func() {
+			lvs := ""
+			runner := &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					switch cmd {
+					case "lvs":
+						return lvs, nil
+					case "lvcreate":
+						lvs = "  vol1|/dev/null|4194304|uuid-vol1|ndbus0region0fsdax||||\n"
+						return "", nil
+					case "vgs":
+						// like vgs, fail when a named group does not exist, but report the others
+						return "  Volume group \"ndbus0region0sector\" not found\n" +
+							"  ndbus0region0fsdax 17179869184 8589934592 4194304 fsdax\n", exitError(5)
+					}
+					return "", nil
+				},
+			}
+			var messages []string
+			lvm := newFakeLvm(runner, "ndbus0region0fsdax", "ndbus0region0sector")
+			lvm.log = recordingLogger{messages: &messages}
+			vgs, err := lvm.ListVolumeGroups(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(vgs).To(Equal([]VolumeGroupInfo{
+				{Name: "ndbus0region0fsdax", Size: 16 << 30, Free: 8 << 30, ExtentSize: 4 << 20, Mode: "fsdax"},
+			}))
+			Expect(runner.commands("vgs")).To(Equal([]string{
+				"vgs --noheadings --nosuffix -o vg_name,vg_size,vg_free,vg_extent_size,vg_tags --units B ndbus0region0fsdax ndbus0region0sector",
+			}))
+			Expect(messages).To(ContainElement("Volume group not found"))
+
+			err = lvm.CreateDevice(context.Background(), "vol1", 4<<20, "fsdax")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("ignores untagged foreign groups", func() {
+			runner := &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					return "  Volume group \"ndbus0region0sector\" not found\n" +
+						"  ndbus0region0fsdax 17179869184 8589934592 4194304 fsdax\n" +
+						"  other 8589934592 8589934592 4194304\n", exitError(5)
+				},
+			}
+			lvm := newFakeLvm(runner, "ndbus0region0fsdax", "ndbus0region0sector")
+			vgs, err := lvm.ListVolumeGroups(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(vgs).To(Equal([]VolumeGroupInfo{
+				{Name: "ndbus0region0fsdax", Size: 16 << 30, Free: 8 << 30, ExtentSize: 4 << 20, Mode: "fsdax"},
+			}))
+			Expect(runner.commands("vgs")).To(HaveLen(1))
+		})
+
+		It("reports existing groups in JSON", func() {
+			runner := &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					return `  Volume group "ndbus0region0sector" not found
+  {
+      "report": [
+          {
+              "vg": [
+                  {"vg_name":"ndbus0region0fsdax", "vg_size":"17179869184", "vg_free":"8589934592", "vg_extent_size":"4194304", "vg_tags":"fsdax"}
+              ]
+          }
+      ]
+  }
+`, exitError(5)
+				},
+			}
+			lvm := newFakeLvm(runner, "ndbus0region0fsdax", "ndbus0region0sector")
+			lvm.jsonReports = true
+			vgs, err := lvm.ListVolumeGroups(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(vgs).To(HaveLen(1))
+			Expect(vgs[0].Name).To(Equal("ndbus0region0fsdax"))
+		})
+
+		It("no group exists", func() {
+			runner := &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					if len(args) > len(vgsArgs) {
+						return "  Volume group \"ndbus0region0fsdax\" not found\n", exitError(5)
+					}
+					return "  other 8589934592 8589934592 4194304 fsdax\n", nil
+				},
+			}
+			lvm := newFakeLvm(runner, "ndbus0region0fsdax")
+			_, err := lvm.ListVolumeGroups(context.Background())
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("ndbus0region0fsdax"))
+		})
+
+		It("no groups", func() {
+			runner := &fakeRunner{}
+			lvm := newFakeLvm(runner)
+			vgs, err := lvm.ListVolumeGroups(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(vgs).To(BeEmpty())
+			Expect(runner.calls).To(BeEmpty())
+		})
+	})
+
+	Context("Health", func() {
+		It("parses vg_attr", func() {
+			health, err := parseVGHealth("  ndbus0region0fsdax  wz--n- 0\n" +
+				"  ndbus0region1fsdax  wz-pn- 1\n" +
+				"  ndbus0region2fsdax  wz--n- 2\n\n")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(health).To(Equal(map[string]VolumeGroupHealth{
+				"ndbus0region0fsdax": {Name: "ndbus0region0fsdax", State: VolumeGroupHealthy},
+				"ndbus0region1fsdax": {Name: "ndbus0region1fsdax", State: VolumeGroupPartial, MissingPVs: 1},
+				"ndbus0region2fsdax": {Name: "ndbus0region2fsdax", State: VolumeGroupPartial, MissingPVs: 2},
+			}))
+		})
+
+		It("bad output", func() {
+			_, err := parseVGHealth("  ndbus0region0fsdax wz- 0\n")
+			Expect(err).To(HaveOccurred())
+			_, err = parseVGHealth("  ndbus0region0fsdax wz--n- none\n")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("reports managed groups", func() {
+			runner := &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					return "  Volume group \"ndbus0region1fsdax\" not found\n  ndbus0region0fsdax wz-pn- 1\n", exitError(5)
+				},
+			}
+			lvm := newFakeLvm(runner, "ndbus0region0fsdax", "ndbus0region1fsdax")
+			health, err := lvm.HealthCheck(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner.calls).To(Equal([]string{"vgs --noheadings -o vg_name,vg_attr,vg_missing_pv_count ndbus0region0fsdax ndbus0region1fsdax"}))
+			Expect(health).To(Equal([]VolumeGroupHealth{
+				{Name: "ndbus0region0fsdax", State: VolumeGroupPartial, MissingPVs: 1},
+				{Name: "ndbus0region1fsdax", State: VolumeGroupMissing},
+			}))
+		})
+	})
+
+	Context("Contiguous space", func() {
+		It("finds largest free segment", func() {
+			runner := &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					// 2 GiB free in pmem0 in total, but split by vol1, and 1 GiB in pmem0.1
+					return "  ndbus0region0fsdax|/dev/pmem0|128|free|4194304|fsdax\n" +
+						"  ndbus0region0fsdax|/dev/pmem0|256|linear|4194304|fsdax\n" +
+						"  ndbus0region0fsdax|/dev/pmem0|384|free|4194304|fsdax\n" +
+						"  ndbus0region0fsdax|/dev/pmem0.1|256|free|4194304|fsdax\n" +
+						"  ndbus0region0sector|/dev/pmem1s|32|striped|33554432|sector\n" +
+						"  ndbus0region0sector|/dev/pmem1s|8|free|33554432|sector\n", nil
+				},
+			}
+			lvm := newFakeLvm(runner, "ndbus0region0fsdax", "ndbus0region0sector")
+			contiguous, err := lvm.GetMaxContiguous(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(contiguous).To(Equal(map[string]uint64{"fsdax": 384 * 4 << 20, "sector": 8 * 32 << 20}))
+			Expect(runner.commands("pvs")).To(Equal([]string{
+				"pvs --noheadings --nosuffix --separator | --segments -o vg_name,pv_name,pvseg_size,segtype,vg_extent_size,vg_tags --units B -S vg_name=ndbus0region0fsdax||vg_name=ndbus0region0sector",
+			}))
+		})
+
+		It("ignores other volume groups without selection", func() {
+			runner := &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					return "  ndbus0region0fsdax|/dev/pmem0|128|free|4194304|fsdax\n" +
+						"  other|/dev/sda1|1024|free|4194304|fsdax\n", nil
+				},
+			}
+			lvm := newFakeLvm(runner, "ndbus0region0fsdax")
+			lvm.noSelection = true
+			contiguous, err := lvm.GetMaxContiguous(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(contiguous).To(Equal(map[string]uint64{"fsdax": 128 * 4 << 20, "sector": 0}))
+			Expect(runner.commands("pvs")).To(Equal([]string{
+				"pvs --noheadings --nosuffix --separator | --segments -o vg_name,pv_name,pvseg_size,segtype,vg_extent_size,vg_tags --units B",
+			}))
+		})
+
+		It("full volume groups", func() {
+			runner := &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					return "  ndbus0region0fsdax|/dev/pmem0|512|linear|4194304|fsdax\n", nil
+				},
+			}
+			lvm := newFakeLvm(runner, "ndbus0region0fsdax")
+			contiguous, err := lvm.GetMaxContiguous(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(contiguous).To(Equal(map[string]uint64{"fsdax": 0, "sector": 0}))
+		})
+
+		It("invalid output", func() {
+			runner := &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					return "  ndbus0region0fsdax|/dev/pmem0|many|free|4194304|fsdax\n", nil
+				},
+			}
+			lvm := newFakeLvm(runner, "ndbus0region0fsdax")
+			_, err := lvm.GetMaxContiguous(context.Background())
+			Expect(err).To(HaveOccurred())
+			_, err = parseFreeSegments("  ndbus0region0fsdax|/dev/pmem0|128\n")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("Tool paths", func() {
+		var tmpDir string
+
+		BeforeEach(func() {
+			var err error
+			tmpDir, err = ioutil.TempDir("", "pmd-tools-")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.WriteFile(tmpDir+"/lvs", []byte("#!/bin/sh\n"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(tmpDir+"/data", nil, 0644)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(tmpDir)
+		})
+
+		It("runs overridden binaries", func() {
+			lvm, err := newPmemLvm(LVMConfig{ToolPaths: map[string]string{"lvs": tmpDir + "/lvs"}})
+			Expect(err).NotTo(HaveOccurred())
+			runner := &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					if cmd == "vgs" {
+						return "  ndbus0region0fsdax 17179869184 8589934592 4194304 fsdax\n", nil
+					}
+					return "", nil
+				},
+			}
+			lvm.runner = runner
+			lvm.volumeGroups = []string{"ndbus0region0fsdax"}
+			Expect(lvm.ForEachDevice(context.Background(), func(dev PmemDeviceInfo) error { return nil })).To(Succeed())
+			_, err = lvm.GetCapacity(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner.commands(tmpDir + "/lvs")).To(HaveLen(1))
+			Expect(runner.commands("lvs")).To(BeEmpty())
+			Expect(runner.commands("vgs")).NotTo(BeEmpty())
+		})
+
+		It("rejects invalid paths", func() {
+			for _, path := range []string{tmpDir + "/no-such-file", tmpDir, tmpDir + "/data"} {
+				_, err := newPmemLvm(LVMConfig{ToolPaths: map[string]string{"lvcreate": path}})
+				Expect(err).To(HaveOccurred(), path)
+				Expect(err.Error()).To(ContainSubstring("lvcreate"), path)
+			}
+		})
+	})
+
+	Context("LVM config overrides", func() {
+		const overrides = `global/locking_type=1 devices/filter=["a|/dev/pmem.*|", "r|.*|"]`
+
+		It("passes --config to LVM commands", func() {
+			lvm, err := newPmemLvm(LVMConfig{LVMConfigOverrides: overrides})
+			Expect(err).NotTo(HaveOccurred())
+			lvs := ""
+			runner := &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					if !lvmTools[cmd] {
+						return "", nil
+					}
+					Expect(args[0]).To(Equal("--config"), cmd)
+					Expect(args[1]).To(Equal(overrides), cmd)
+					switch cmd {
+					case "vgs":
+						return "  ndbus0region0fsdax 17179869184 8589934592 4194304 fsdax\n", nil
+					case "lvs":
+						return lvs, nil
+					case "lvcreate":
+						lvs = "  vol1|/dev/null|4194304|uuid-vol1|ndbus0region0fsdax||||\n"
+					case "lvremove":
+						lvs = ""
+					}
+					return "", nil
+				},
+			}
+			lvm.runner = runner
+			lvm.volumeGroups = []string{"ndbus0region0fsdax"}
+			Expect(lvm.CreateDevice(context.Background(), "vol1", 4<<20, "fsdax")).To(Succeed())
+			Expect(lvm.DeleteDevice(context.Background(), "vol1", false)).To(Succeed())
+			for _, cmd := range []string{"lvcreate", "lvremove", "lvs", "vgs"} {
+				Expect(runner.commands(cmd)).NotTo(BeEmpty(), cmd)
+			}
+		})
+
+		It("leaves other commands alone", func() {
+			lvm, err := newPmemLvm(LVMConfig{LVMConfigOverrides: overrides})
+			Expect(err).NotTo(HaveOccurred())
+			runner := &fakeRunner{}
+			lvm.runner = runner
+			_, err = lvm.runCommand(context.Background(), "blkid", "/dev/null")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner.calls).To(Equal([]string{"blkid /dev/null"}))
+		})
+
+		It("passes nothing by default", func() {
+			runner := &fakeRunner{}
+			lvm := newFakeLvm(runner)
+			_, err := lvm.runCommand(context.Background(), "lvs", "--noheadings")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner.calls).To(Equal([]string{"lvs --noheadings"}))
+		})
+
+		It("accepts valid settings", func() {
+			for _, config := range []string{"", "global/locking_type=1", overrides, "  activation/udev_sync=0\tdevices/obtain_device_list_from_udev=0 "} {
+				Expect(validateLVMConfigOverrides(config)).To(Succeed(), config)
+			}
+		})
+
+		It("rejects malformed settings", func() {
+			for _, config := range []string{"locking_type=1", "global/locking_type", "global/locking_type=", "=1",
+				"global/Locking_type=1", `devices/filter=["a|.*|"`, `devices/filter="a|.*|`, "devices/filter=]"} {
+				_, err := newPmemLvm(LVMConfig{LVMConfigOverrides: config})
+				Expect(err).To(HaveOccurred(), config)
+			}
+		})
+	})
+
+	Context("Waiting for devices", func() {
+		var runner *fakeRunner
+		var lvm *pmemLvm
+		var tmpDir string
+		var created time.Time
+
+		BeforeEach(func() {
+			var err error
+			tmpDir, err = ioutil.TempDir("", "pmd-wait-")
+			Expect(err).NotTo(HaveOccurred())
+			// lvs lists the device only some time after the test started
+			created = time.Now().Add(250 * time.Millisecond)
+			runner = &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					switch {
+					case cmd == "vgs":
+						return "  ndbus0region0fsdax 17179869184 8589934592 4194304 fsdax\n", nil
+					case cmd == "lvcreate":
+						created = time.Now()
+					case cmd == "lvs" && time.Now().After(created):
+						return "  vol1|" + tmpDir + "/vol1|4194304|uuid-vol1|ndbus0region0fsdax||||\n", nil
+					}
+					return "", nil
+				},
+			}
+			lvm = newFakeLvm(runner, "ndbus0region0fsdax")
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(tmpDir)
+		})
+
+		// createNode creates the device node after a delay, like udev
+		createNode := func(delay time.Duration) {
+			path := tmpDir + "/vol1"
+			go func() {
+				defer GinkgoRecover()
+				time.Sleep(delay)
+				Expect(os.Symlink("/dev/null", path)).To(Succeed())
+			}()
+		}
+
+		It("device appears", func() {
+			createNode(400 * time.Millisecond)
+			dev, err := lvm.WaitForDevice(context.Background(), "vol1", 5*time.Second)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dev.Path).To(Equal(tmpDir + "/vol1"))
+			Expect(len(runner.commands("lvs"))).To(BeNumerically(">", 1))
+		})
+
+		It("device does not appear", func() {
+			_, err := lvm.WaitForDevice(context.Background(), "vol1", 100*time.Millisecond)
+			Expect(errors.Is(err, ErrDeviceNotFound)).To(BeTrue())
+		})
+
+		It("device node does not appear", func() {
+			created = time.Now()
+			_, err := lvm.WaitForDevice(context.Background(), "vol1", 200*time.Millisecond)
+			Expect(errors.Is(err, os.ErrNotExist)).To(BeTrue())
+		})
+
+		It("waiting gets aborted", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err := lvm.WaitForDevice(ctx, "vol1", 5*time.Second)
+			Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+		})
+
+		It("creating waits for device node", func() {
+			// only lvcreate creates it
+			created = time.Now().Add(time.Hour)
+			lvm.deviceWaitTimeout = 5 * time.Second
+			createNode(1500 * time.Millisecond)
+			dev, err := lvm.CreateDeviceInfo(context.Background(), "vol1", 4<<20, "fsdax")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dev.Path).To(Equal(tmpDir + "/vol1"))
+		})
+	})
+
+	Context("Accounting", func() {
+		var runner *fakeRunner
+		var lvm *pmemLvm
+		var segments string
+
+		BeforeEach(func() {
+			runner = &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					switch cmd {
+					case "vgs":
+						// 16 GiB each, 8 GiB free
+						return "  ndbus0region0fsdax 17179869184 8589934592 4194304 fsdax\n" +
+							"  ndbus0region1fsdax 17179869184 8589934592 4194304 fsdax\n", nil
+					case "lvs":
+						return segments, nil
+					}
+					return "", nil
+				},
+			}
+			lvm = newFakeLvm(runner, "ndbus0region0fsdax", "ndbus0region1fsdax")
+		})
+
+		It("reconciles", func() {
+			segments = "  ndbus0region0fsdax|4294967296|linear\n" +
+				"  ndbus0region0fsdax|4294967296|striped\n" +
+				// hidden data, metadata and spare volumes of a thin pool, the pool and its thin volume take no space of their own
+				"  ndbus0region1fsdax|8573157376|linear\n" +
+				"  ndbus0region1fsdax|8388608|linear\n" +
+				"  ndbus0region1fsdax|8388608|linear\n" +
+				"  ndbus0region1fsdax|8573157376|thin-pool\n" +
+				"  ndbus0region1fsdax|1073741824|thin\n"
+			Expect(lvm.VerifyAccounting(context.Background())).To(Succeed())
+			Expect(runner.commands("lvs")).To(Equal([]string{
+				"lvs --noheadings --nosuffix --separator | -a -o vg_name,seg_size,segtype --units B ndbus0region0fsdax ndbus0region1fsdax",
+			}))
+		})
+
+		It("tolerates one extent", func() {
+			segments = "  ndbus0region0fsdax|8585740288|linear\n" +
+				"  ndbus0region1fsdax|8589934592|linear\n"
+			Expect(lvm.VerifyAccounting(context.Background())).To(Succeed())
+		})
+
+		It("reports discrepancy", func() {
+			// 1 GiB unaccounted in region1
+			segments = "  ndbus0region0fsdax|8589934592|linear\n" +
+				"  ndbus0region1fsdax|7516192768|linear\n"
+			err := lvm.VerifyAccounting(context.Background())
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("ndbus0region1fsdax: size 17179869184, free 8589934592, allocated 7516192768"))
+			Expect(err.Error()).NotTo(ContainSubstring("ndbus0region0fsdax"))
+		})
+
+		It("bad output", func() {
+			segments = "  ndbus0region0fsdax|lots|linear\n"
+			Expect(lvm.VerifyAccounting(context.Background())).NotTo(Succeed())
+		})
+	})
+
+	Context("Activation", func() {
+		var runner *fakeRunner
+		var lvm *pmemLvm
+		var lvs string
+
+		BeforeEach(func() {
+			lvs = ""
+			runner = &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					switch cmd {
+					case "vgs":
+						return "  ndbus0region0fsdax 17179869184 8589934592 4194304 fsdax\n", nil
+					case "lvs":
+						return lvs, nil
+					case "lvcreate":
+						lvs = "  vol1|/dev/null|4194304|uuid-vol1|ndbus0region0fsdax||||\n"
+					}
+					return "", nil
+				},
+			}
+			lvm = newFakeLvm(runner, "ndbus0region0fsdax")
+		})
+
+		It("creates inactive devices", func() {
+			Expect(lvm.CreateDeviceWithOptions(context.Background(), "vol1", 4<<20, "fsdax", CreateOptions{Inactive: true})).To(Succeed())
+			Expect(runner.commands("lvcreate")).To(Equal([]string{"lvcreate -Zn -L 4 -a n -Wy --yes -n vol1 ndbus0region0fsdax"}))
+			// there is no device node to clear
+			Expect(runner.commands("dd")).To(BeEmpty())
+			Expect(lvm.devices).To(HaveKey("vol1"))
+		})
+
+		It("creates read-only devices", func() {
+			Expect(lvm.CreateDeviceWithOptions(context.Background(), "vol1", 4<<20, "fsdax", CreateOptions{ReadOnly: true})).To(Succeed())
+			Expect(runner.commands("lvcreate")).To(Equal([]string{"lvcreate -Zn -L 4 --permission r -Wy --yes -n vol1 ndbus0region0fsdax"}))
+			Expect(runner.commands("dd")).To(BeEmpty())
+		})
+
+		It("creates inactive thin volumes", func() {
+			lvm.thinPool = true
+			runner.handler = func(cmd string, args ...string) (string, error) {
+				switch cmd {
+				case "vgs":
+					return "  ndbus0region0fsdax 17179869184 8589934592 4194304 fsdax\n", nil
+				case "lvs":
+					for _, arg := range args {
+						if arg == "lv_name="+thinPoolName {
+							return "  ndbus0region0fsdax|8589934592|10.00|1.00|thinpool\n", nil
+						}
+					}
+					return lvs, nil
+				case "lvcreate":
+					lvs = "  vol1|/dev/null|4194304|uuid-vol1|ndbus0region0fsdax||||\n"
+				}
+				return "", nil
+			}
+			Expect(lvm.CreateDeviceWithOptions(context.Background(), "vol1", 4<<20, "fsdax", CreateOptions{Inactive: true, ReadOnly: true})).To(Succeed())
+			Expect(runner.commands("lvcreate")).To(Equal([]string{"lvcreate -V 4 --thinpool thinpool -a n --permission r -Wy --yes -n vol1 ndbus0region0fsdax"}))
+		})
+
+		It("activates devices", func() {
+			Expect(lvm.CreateDeviceWithOptions(context.Background(), "vol1", 4<<20, "fsdax", CreateOptions{Inactive: true})).To(Succeed())
+			Expect(lvm.ActivateDevice(context.Background(), "vol1")).To(Succeed())
+			Expect(runner.commands("lvchange")).To(Equal([]string{"lvchange -ay /dev/null"}))
+		})
+
+		It("activation failure", func() {
+			Expect(lvm.CreateDeviceWithOptions(context.Background(), "vol1", 4<<20, "fsdax", CreateOptions{Inactive: true})).To(Succeed())
+			runner.handler = func(cmd string, args ...string) (string, error) {
+				return "activation failed", errors.New("exit status 5")
+			}
+			err := lvm.ActivateDevice(context.Background(), "vol1")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("activation failed"))
+		})
+
+		It("activates unknown devices", func() {
+			err := lvm.ActivateDevice(context.Background(), "vol1")
+			Expect(errors.Is(err, ErrDeviceNotFound)).To(BeTrue())
+			Expect(runner.commands("lvchange")).To(BeEmpty())
+		})
+
+		It("default options", func() {
+			Expect(CreateOptions{}.lvcreateArgs()).To(BeEmpty())
+			for _, arg := range []string{"-an", "--activate", "--permission=r"} {
+				_, err := newPmemLvm(LVMConfig{LVCreateExtraArgs: []string{arg}})
+				Expect(err).To(HaveOccurred(), arg)
+			}
+		})
+	})
+
+	Context("Self test", func() {
+		var runner *fakeRunner
+		var lvm *pmemLvm
+		var lvs string
+
+		BeforeEach(func() {
+			lvs = ""
+			runner = &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					switch cmd {
+					case "vgs":
+						return "  selftest 1073741824 1073741824 4194304 fsdax\n", nil
+					case "lvs":
+						return lvs, nil
+					case "lvcreate":
+						lvs = "  pmem-csi-selftest|/dev/null|4194304|uuid-selftest|selftest||||-wi-a-----\n"
+					case "lvremove":
+						lvs = ""
+					}
+					return "", nil
+				},
+			}
+			var err error
+			lvm, err = newPmemLvm(LVMConfig{EnableSelfTest: true, SelfTestVolumeGroup: "selftest"})
+			Expect(err).NotTo(HaveOccurred())
+			lvm.runner = runner
+			lvm.volumeGroups = []string{"ndbus0region0fsdax"}
+			lvm.deviceBusy = func(path string) (bool, error) { return false, nil }
+		})
+
+		commandNames := func() []string {
+			names := []string{}
+			for _, call := range runner.calls {
+				names = append(names, strings.Fields(call)[0])
+			}
+			return names
+		}
+
+		It("walks through the sequence", func() {
+			Expect(lvm.SelfTest(context.Background())).To(Succeed())
+			Expect(commandNames()).To(Equal([]string{
+				"lvs",      // no old device
+				"vgs",      // extent size
+				"lvcreate", // create
+				"lvs", "dd",
+				"lvs",   // listed
+				"shred", // flush
+				"lvs", "dd", "lvremove",
+				"lvs", // gone
+			}))
+			Expect(runner.commands("lvcreate")).To(Equal([]string{"lvcreate -Zn -L 4 -Wy --yes -n pmem-csi-selftest selftest"}))
+			Expect(lvm.devices).NotTo(HaveKey("pmem-csi-selftest"))
+		})
+
+		It("removes an old device first", func() {
+			lvs = "  pmem-csi-selftest|/dev/null|4194304|uuid-selftest|selftest||||-wi-a-----\n"
+			Expect(lvm.SelfTest(context.Background())).To(Succeed())
+			Expect(runner.commands("lvremove")).To(HaveLen(2))
+			Expect(commandNames()[:3]).To(Equal([]string{"lvs", "dd", "lvremove"}))
+		})
+
+		It("detects a wrong size and cleans up", func() {
+			handler := runner.handler
+			runner.handler = func(cmd string, args ...string) (string, error) {
+				output, err := handler(cmd, args...)
+				if cmd == "lvcreate" {
+					lvs = "  pmem-csi-selftest|/dev/null|8388608|uuid-selftest|selftest||||-wi-a-----\n"
+				}
+				return output, err
+			}
+			err := lvm.SelfTest(context.Background())
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("size 8388608 instead of 4194304"))
+			Expect(runner.commands("lvremove")).To(HaveLen(1))
+			Expect(runner.commands("shred")).To(BeEmpty())
+		})
+
+		It("fails without the volume group", func() {
+			runner.handler = func(cmd string, args ...string) (string, error) { return "", nil }
+			err := lvm.SelfTest(context.Background())
+			Expect(err).To(HaveOccurred())
+			Expect(runner.commands("lvcreate")).To(BeEmpty())
+		})
+
+		It("must be enabled", func() {
+			disabled := newFakeLvm(runner, "selftest")
+			Expect(disabled.SelfTest(context.Background())).NotTo(Succeed())
+			Expect(runner.calls).To(BeEmpty())
+			_, err := newPmemLvm(LVMConfig{EnableSelfTest: true})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("Hidden volumes", func() {
+		// lvs -a output of a volume group with a thin pool, a snapshot and a mirror
+		const internal = "  vol1|/dev/ndbus0region0fsdax/vol1|4194304|uuid-vol1|ndbus0region0fsdax||||-wi-a-----\n" +
+			"  snap1|/dev/ndbus0region0fsdax/snap1|4194304|uuid-snap1|ndbus0region0fsdax|||vol1|swi-a-s---\n" +
+			"  pool|/dev/ndbus0region0fsdax/pool|8388608|uuid-pool|ndbus0region0fsdax||||twi-aotz--\n" +
+			"  [pool_tdata]||8388608|uuid-tdata|ndbus0region0fsdax||||Twi-ao----\n" +
+			"  [pool_tmeta]||4194304|uuid-tmeta|ndbus0region0fsdax||||ewi-ao----\n" +
+			"  [lvol0_pmspare]||4194304|uuid-pmspare|ndbus0region0fsdax||||ewi-------\n" +
+			"  mirror|/dev/ndbus0region0fsdax/mirror|4194304|uuid-mirror|ndbus0region0fsdax||||rwi-a-r---\n" +
+			"  [mirror_rimage_0]||4194304|uuid-rimage|ndbus0region0fsdax||||iwi-aor---\n" +
+			"  [mirror_rmeta_0]||4194304|uuid-rmeta|ndbus0region0fsdax||||ewi-aor---\n"
+
+		var runner *fakeRunner
+
+		BeforeEach(func() {
+			runner = &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					if cmd == "lvs" {
+						return internal, nil
+					}
+					return "", nil
+				},
+			}
+		})
+
+		deviceNames := func(devices map[string]PmemDeviceInfo) []string {
+			names := []string{}
+			for name := range devices {
+				names = append(names, name)
+			}
+			return names
+		}
+
+		It("are excluded by default", func() {
+			lvm := newFakeLvm(runner, "ndbus0region0fsdax")
+			devices, err := lvm.listDevices(context.Background(), lvm.volumeGroups...)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(deviceNames(devices)).To(ConsistOf("mirror", "snap1", "vol1"))
+			Expect(runner.commands("lvs -a")).To(BeEmpty())
+		})
+
+		It("are included on request", func() {
+			lvm, err := newPmemLvm(LVMConfig{IncludeHiddenVolumes: true})
+			Expect(err).NotTo(HaveOccurred())
+			lvm.runner = runner
+			lvm.volumeGroups = []string{"ndbus0region0fsdax"}
+			devices, err := lvm.listDevices(context.Background(), lvm.volumeGroups...)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(devices).To(HaveLen(9))
+			Expect(devices).To(HaveKey("[pool_tmeta]"))
+			Expect(runner.commands("lvs -a")).To(HaveLen(1))
+		})
+
+		It("are excluded from JSON reports", func() {
+			runner.handler = func(cmd string, args ...string) (string, error) {
+				return `{"report": [{"lv": [
+                  {"lv_name":"vol1", "lv_path":"/dev/ndbus0region0fsdax/vol1", "lv_size":"4194304", "lv_uuid":"uuid-vol1", "vg_name":"ndbus0region0fsdax", "lv_tags":"", "lv_dm_path":"", "origin":"", "lv_attr":"-wi-a-----"},
+                  {"lv_name":"[pool_tmeta]", "lv_path":"", "lv_size":"4194304", "lv_uuid":"uuid-tmeta", "vg_name":"ndbus0region0fsdax", "lv_tags":"", "lv_dm_path":"", "origin":"", "lv_attr":"ewi-ao----"}
+                ]}]}`, nil
+			}
+			lvm := newFakeLvm(runner, "ndbus0region0fsdax")
+			lvm.jsonReports = true
+			devices, err := lvm.listDevices(context.Background(), lvm.volumeGroups...)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(deviceNames(devices)).To(ConsistOf("vol1"))
+		})
+
+		It("parses lvs output", func() {
+			devices, err := parseLVSOuput(DiscardLogger(), internal, false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(deviceNames(devices)).To(ConsistOf("mirror", "snap1", "vol1"))
+			devices, err = parseLVSOuput(DiscardLogger(), internal, true)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(devices).To(HaveLen(9))
+		})
+	})
+
+	Context("Signature wiping", func() {
+		var runner *fakeRunner
+
+		BeforeEach(func() {
+			lvs := ""
+			runner = &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					switch cmd {
+					case "vgs":
+						return "  ndbus0region0fsdax 17179869184 8589934592 4194304 fsdax\n", nil
+					case "lvs":
+						return lvs, nil
+					case "lvcreate":
+						lvs = "  vol1|/dev/null|4194304|uuid-vol1|ndbus0region0fsdax||||\n"
+					}
+					return "", nil
+				},
+			}
+		})
+
+		It("wipes signatures by default", func() {
+			lvm := newFakeLvm(runner, "ndbus0region0fsdax")
+			Expect(lvm.CreateDevice(context.Background(), "vol1", 4<<20, "fsdax")).To(Succeed())
+			Expect(runner.commands("lvcreate")).To(Equal([]string{"lvcreate -Zn -L 4 -Wy --yes -n vol1 ndbus0region0fsdax"}))
+		})
+
+		It("keeps signatures when disabled", func() {
+			lvm, err := newPmemLvm(LVMConfig{KeepSignatures: true})
+			Expect(err).NotTo(HaveOccurred())
+			lvm.runner = runner
+			lvm.volumeGroups = []string{"ndbus0region0fsdax"}
+			Expect(lvm.CreateDevice(context.Background(), "vol1", 4<<20, "fsdax")).To(Succeed())
+			Expect(runner.commands("lvcreate")).To(Equal([]string{"lvcreate -Zn -L 4 -n vol1 ndbus0region0fsdax"}))
+		})
+
+		It("rejects wiping options in extra arguments", func() {
+			for _, arg := range []string{"-Wn", "--wipesignatures", "--wipesignatures=n"} {
+				_, err := newPmemLvm(LVMConfig{LVCreateExtraArgs: []string{arg}})
+				Expect(err).To(HaveOccurred(), arg)
+			}
+		})
+	})
+
+	Context("lvs output", func() {
+		It("trailing whitespace", func() {
+			devices, err := parseLVSOuput(DiscardLogger(), "  vol1|/dev/vg/vol1|4194304|Gx1cNh-B7kJ-0y2q-Lm3s-pT4r-Vw5x-Yz6aBc|vg|  |||\n  vol2|/dev/vg/vol2|8388608|Hy2dOi-C8lK-1z3r-Mn4t-qU5s-Wx6y-Za7bCd|vg||||\n\n", false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(devices).To(Equal(map[string]PmemDeviceInfo{
+				"vol1": {Name: "vol1", Path: "/dev/vg/vol1", Size: 4194304, UUID: "Gx1cNh-B7kJ-0y2q-Lm3s-pT4r-Vw5x-Yz6aBc", VolumeGroup: "vg"},
+				"vol2": {Name: "vol2", Path: "/dev/vg/vol2", Size: 8388608, UUID: "Hy2dOi-C8lK-1z3r-Mn4t-qU5s-Wx6y-Za7bCd", VolumeGroup: "vg"},
+			}))
+		})
+
+		It("empty output", func() {
+			devices, err := parseLVSOuput(DiscardLogger(), "", false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(devices).To(BeEmpty())
+		})
+
+		It("path with spaces", func() {
+			devices, err := parseLVSOuput(DiscardLogger(), "  vol1|/dev/my vg/vol1|4194304|Gx1cNh-B7kJ-0y2q-Lm3s-pT4r-Vw5x-Yz6aBc|ndbus0region0fsdax||||\n", false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(devices["vol1"].Path).To(Equal("/dev/my vg/vol1"))
+			Expect(devices["vol1"].VolumeGroup).To(Equal("ndbus0region0fsdax"))
+		})
+
+		It("both paths", func() {
+			devices, err := parseLVSOuput(DiscardLogger(), "  vol1|/dev/ndbus0region0fsdax/vol1|4194304|Gx1cNh-B7kJ-0y2q-Lm3s-pT4r-Vw5x-Yz6aBc|ndbus0region0fsdax||/dev/mapper/ndbus0region0fsdax-vol1||\n"+
+				"  my-vol|/dev/ndbus0region0fsdax/my-vol|4194304|Hy2dOi-C8lK-1z3r-Mn4t-qU5s-Wx6y-Za7bCd|ndbus0region0fsdax||/dev/mapper/ndbus0region0fsdax-my--vol||\n", false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(devices["vol1"].Path).To(Equal("/dev/ndbus0region0fsdax/vol1"))
+			Expect(devices["vol1"].DMPath).To(Equal("/dev/mapper/ndbus0region0fsdax-vol1"))
+			// device mapper doubles hyphens in names
+			Expect(devices["my-vol"].Path).To(Equal("/dev/ndbus0region0fsdax/my-vol"))
+			Expect(devices["my-vol"].DMPath).To(Equal("/dev/mapper/ndbus0region0fsdax-my--vol"))
+		})
+
+		It("snapshot origin", func() {
+			devices, err := parseLVSOuput(DiscardLogger(), "  vol1|/dev/vg/vol1|4194304|Gx1cNh-B7kJ-0y2q-Lm3s-pT4r-Vw5x-Yz6aBc|vg||||\n"+
+				"  snap1|/dev/vg/snap1|4194304|Hy2dOi-C8lK-1z3r-Mn4t-qU5s-Wx6y-Za7bCd|vg|||vol1|\n", false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(devices["vol1"].IsSnapshot()).To(BeFalse())
+			Expect(devices["snap1"].Origin).To(Equal("vol1"))
+			Expect(devices["snap1"].IsSnapshot()).To(BeTrue())
+		})
+
+		It("extra fields", func() {
+			devices, err := parseLVSOuput(DiscardLogger(), "  vol1|/dev/vg/vol1|4194304|Gx1cNh-B7kJ-0y2q-Lm3s-pT4r-Vw5x-Yz6aBc|ndbus0region0fsdax|||||extra\n", false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(devices["vol1"].Size).To(Equal(uint64(4194304)))
+		})
+
+		It("malformed line", func() {
+			_, err := parseLVSOuput(DiscardLogger(), "  vol1|/dev/vg/vol1|4194304|Gx1cNh-B7kJ-0y2q-Lm3s-pT4r-Vw5x-Yz6aBc|ndbus0region0fsdax||||\n  vol2 /dev/vg/vol2 8388608|\n", false)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("vol2 /dev/vg/vol2"))
+		})
+
+		It("size with unit suffix", func() {
+			devices, err := parseLVSOuput(DiscardLogger(), "  vol1|/dev/vg/vol1|4194304B|Gx1cNh-B7kJ-0y2q-Lm3s-pT4r-Vw5x-Yz6aBc|vg||||\n", false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(devices["vol1"].Size).To(Equal(uint64(4194304)))
+
+			for field, expected := range map[string]uint64{"1073741824": 1 << 30, "1073741824B": 1 << 30, " 512B ": 512} {
+				size, err := parseBytes(field)
+				Expect(err).NotTo(HaveOccurred(), field)
+				Expect(size).To(Equal(expected), field)
+			}
+			for _, field := range []string{"", "B", "1GiB", "4.00m"} {
+				_, err := parseBytes(field)
+				Expect(err).To(HaveOccurred(), field)
+			}
+		})
+
+		It("non-numeric size", func() {
+			_, err := parseLVSOuput(DiscardLogger(), "  vol1|/dev/vg/vol1|Gx1cNh-B7kJ-0y2q-Lm3s-pT4r-Vw5x-Yz6aBc|ndbus0region0fsdax|4194304\n", false)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("lookup by uuid", func() {
+			runner := &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					return "  vol1|/dev/vg/vol1|4194304|Gx1cNh-B7kJ-0y2q-Lm3s-pT4r-Vw5x-Yz6aBc|ndbus0region0fsdax||||\n  vol2|/dev/vg/vol2|8388608|Hy2dOi-C8lK-1z3r-Mn4t-qU5s-Wx6y-Za7bCd|ndbus0region0fsdax||||\n", nil
+				},
+			}
+			lvm := newFakeLvm(runner, "ndbus0region0fsdax")
+			dev, err := lvm.GetDeviceByUUID(context.Background(), "Hy2dOi-C8lK-1z3r-Mn4t-qU5s-Wx6y-Za7bCd")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dev.Name).To(Equal("vol2"))
+			_, err = lvm.GetDeviceByUUID(context.Background(), "no-such-uuid")
+			Expect(errors.Is(err, ErrDeviceNotFound)).To(BeTrue())
+		})
+	})
+})
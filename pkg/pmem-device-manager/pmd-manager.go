@@ -1,33 +1,158 @@
 package pmdmanager
 
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrDeviceExists is returned by CreateDevice when a device with the requested name already exists.
+	// Callers may treat it as success of an idempotent create.
+	ErrDeviceExists = errors.New("device already exists")
+	// ErrDeviceNotFound is returned when no device with the requested name exists
+	ErrDeviceNotFound = errors.New("device not found")
+	// ErrNotEnoughSpace is returned when no region has enough free space for the requested size
+	ErrNotEnoughSpace = errors.New("not enough space")
+	// ErrFragmented is returned when the free space would be enough for the requested size,
+	// but no single region has enough of it. It wraps ErrNotEnoughSpace.
+	ErrFragmented = fmt.Errorf("free space fragmented over regions: %w", ErrNotEnoughSpace)
+	// ErrThinPoolFull is returned when all thin pools ran out of data space
+	ErrThinPoolFull = errors.New("thin pool full")
+	// ErrThinMetadataFull is returned when the metadata volume of all thin pools which still have
+	// data space is full, see ResizeThinMetadata. It wraps ErrThinPoolFull.
+	ErrThinMetadataFull = fmt.Errorf("thin pool metadata full: %w", ErrThinPoolFull)
+	// ErrOverprovisionLimit is returned when a new thin volume would exceed LVMConfig.MaxOverprovisionRatio in all pools
+	ErrOverprovisionLimit = errors.New("thin pool over-provisioning limit reached")
+	// ErrInvalidName is returned for device names which the backend cannot use
+	ErrInvalidName = errors.New("invalid device name")
+	// ErrFilesystemMismatch is returned by FormatDevice when the device has a filesystem of another type
+	ErrFilesystemMismatch = errors.New("different filesystem exists")
+	// ErrNoVolumeGroups is returned by the LVM device manager constructors when none of the
+	// managed regions has a volume group, usually because the node was not prepared, and
+	// when creating a device without any volume group to choose from
+	ErrNoVolumeGroups = errors.New("no volume groups found")
+	// ErrDeviceBusy is returned by CanFlush, FlushDeviceData and the LVM DeleteDevice for devices which are mounted or open
+	ErrDeviceBusy = errors.New("device busy")
+	// ErrNotErased is returned when ErasePolicy.Verify finds data on a device after erasing it
+	ErrNotErased = errors.New("device data not erased")
+	// ErrInvalidSize is returned when creating a device with size zero, smaller than the
+	// allocation unit or larger than what any volume group can hold
+	ErrInvalidSize = errors.New("invalid device size")
+	// ErrDeviceDeleting is returned for devices which DeleteDeviceAsync is deleting in the background
+	ErrDeviceDeleting = errors.New("device is getting deleted")
+	// ErrStopIteration can be returned by the callback of ForEachDevice to stop early without error
+	ErrStopIteration = errors.New("stop iteration")
+)
+
 //PmemDeviceInfo represents a block device
 type PmemDeviceInfo struct {
 	//Name name of the block device
 	Name string
 	//Path actual device path
 	Path string
+	//DMPath device mapper path of the logical volume, /dev/mapper/<vg>-<lv>, empty for namespace devices
+	DMPath string
 	//Size size allocated for block device
 	Size uint64
+	//UUID identifier assigned by the backend, it does not change when the device gets renamed
+	UUID string
+	//VolumeGroup LVM volume group holding the device, empty for namespace devices
+	VolumeGroup string
+	//Tags key/value pairs stored with the device, nil if there are none
+	Tags map[string]string
+	//Origin name of the device a snapshot was taken of, empty for other devices
+	Origin string
+	//DAXCapable is set when the device is on a fsdax namespace and supports direct access,
+	//so filesystems on it can be mounted with -o dax
+	DAXCapable bool
+}
+
+//IsSnapshot checks whether the device is a snapshot of another device
+func (dev PmemDeviceInfo) IsSnapshot() bool {
+	return dev.Origin != ""
 }
 
 //PmemDeviceManager interface to manage the PMEM block devices
+// All methods take a context: when it gets cancelled or times out,
+// the underlying commands get aborted and the method returns an error wrapping ctx.Err().
 type PmemDeviceManager interface {
 	//GetCapacity returns the available maximum capacity that can be assigned to a Device/Volume
-	GetCapacity() (map[string]uint64, error)
+	GetCapacity(ctx context.Context) (map[string]uint64, error)
 
 	//CreateDevice creates a new block device with give name, size and namespace mode
-	CreateDevice(name string, size uint64, nsmode string) error
+	CreateDevice(ctx context.Context, name string, size uint64, nsmode string) error
 
 	//GetDevice returns the block device information for given name
-	GetDevice(name string) (PmemDeviceInfo, error)
+	GetDevice(ctx context.Context, name string) (PmemDeviceInfo, error)
 
 	//DeleteDevice deletes an existing block device with give name.
-	// If 'flush' is 'true', then the device data is zerod beofore deleting the device
-	DeleteDevice(name string, flush bool) error
+	// If 'flush' is 'true', then the device data is zerod beofore deleting the device.
+	// A device which does not exist counts as deleted, so retried deletes succeed.
+	DeleteDevice(ctx context.Context, name string, flush bool) error
+
+	//FlushDeviceData zeros all blocks in the blocke device with given name.
+	// It refuses devices which are in use, see CanFlush.
+	FlushDeviceData(ctx context.Context, name string) error
 
-	//FlushDeviceData zeros all blocks in the blocke device with given name
-	FlushDeviceData(name string) error
+	//CanFlush checks without modifying anything whether FlushDeviceData may erase the device
+	// with given name: it must exist and must not be mounted or held open by another device
+	CanFlush(ctx context.Context, name string) error
+
+	//FormatDevice creates a filesystem of given type on the device with given name,
+	// unless it has one already. Extra mkfs options can be passed in opts.
+	FormatDevice(ctx context.Context, name string, fsType string, opts []string) error
 
 	//ListDevices returns all the block devices information that was created by this device manager
-	ListDevices() ([]PmemDeviceInfo, error)
+	ListDevices(ctx context.Context) ([]PmemDeviceInfo, error)
+
+	//Capabilities returns which optional features the backend supports in its configuration
+	Capabilities() DeviceManagerCapabilities
+}
+
+//DeviceManagerCapabilities lists the optional features of a PmemDeviceManager, so callers
+// only advertise and attempt operations which the backend supports. The operations are
+// methods of optional interfaces: a manager which reports a capability implements the
+// interface named with it, callers get there with a type assertion.
+type DeviceManagerCapabilities struct {
+	//Snapshots devices can be snapshotted with CreateSnapshot, see Snapshotter
+	Snapshots bool
+	//Resize devices can grow with ResizeDevice, see Resizer
+	Resize bool
+	//Shrink devices can also get smaller with ResizeDevice
+	Shrink bool
+	//Striping devices can be striped across volume groups with CreateStripedDevice, see StripedCreator
+	Striping bool
+	//ThinProvisioning devices only allocate what gets written, so capacity can be overcommitted
+	ThinProvisioning bool
+	//Encryption devices can be encrypted with CreateEncryptedDevice, see EncryptedCreator
+	Encryption bool
+}
+
+//Snapshotter is implemented by managers which report DeviceManagerCapabilities.Snapshots
+type Snapshotter interface {
+	//CreateSnapshot creates a snapshot snapName of the device sourceName, size is the
+	// space reserved for changes, 0 for the size of the origin
+	CreateSnapshot(ctx context.Context, sourceName, snapName string, size uint64) error
+
+	//DeleteSnapshot removes a snapshot created by CreateSnapshot
+	DeleteSnapshot(ctx context.Context, name string) error
+}
+
+//Resizer is implemented by managers which report DeviceManagerCapabilities.Resize
+type Resizer interface {
+	//ResizeDevice changes the size of the device with given name to newSize
+	ResizeDevice(ctx context.Context, name string, newSize uint64) error
+}
+
+//StripedCreator is implemented by managers which report DeviceManagerCapabilities.Striping
+type StripedCreator interface {
+	//CreateStripedDevice creates a device like CreateDevice, striped over stripes physical volumes
+	CreateStripedDevice(ctx context.Context, name string, size uint64, nsmode string, stripes int) error
+}
+
+//EncryptedCreator is implemented by managers which report DeviceManagerCapabilities.Encryption
+type EncryptedCreator interface {
+	//CreateEncryptedDevice creates a device like CreateDevice, encrypted with a key from keys
+	CreateEncryptedDevice(ctx context.Context, name string, size uint64, nsmode string, keys KeyProvider) error
 }
@@ -1,6 +1,8 @@
 package pmdmanager
 
 import (
+	"context"
+	"errors"
 	"fmt"
 
 	"github.com/intel/pmem-csi/pkg/ndctl"
@@ -8,13 +10,82 @@ import (
 	"k8s.io/kubernetes/pkg/util/mount"
 )
 
+// pmemNdctl is the direct device manager: each device is a pmem namespace of its own,
+// created and destroyed through libndctl instead of being carved out of a volume group
 type pmemNdctl struct {
-	ctx *ndctl.Context
+	ctx    namespaceContext
+	runner commandRunner
 }
 
 var _ PmemDeviceManager = &pmemNdctl{}
 
-//NewPmemDeviceManagerNdctl Instantiates a new ndctl based pmem device manager
+// namespaceContext the parts of the ndctl context needed by pmemNdctl, implemented by ndctlContext
+type namespaceContext interface {
+	// maxAvailableExtent returns the largest free extent of all active regions
+	maxAvailableExtent() uint64
+	createNamespace(opts ndctl.CreateNamespaceOpts) error
+	destroyNamespaceByName(name string) error
+	namespaceByName(name string) (initNamespace, error)
+	activeNamespaces() []initNamespace
+}
+
+// ndctlContext the namespaceContext of libndctl
+type ndctlContext struct {
+	*ndctl.Context
+}
+
+func (c ndctlContext) maxAvailableExtent() uint64 {
+	var capacity uint64
+	for _, bus := range c.GetBuses() {
+		for _, r := range bus.ActiveRegions() {
+			available := r.MaxAvailableExtent()
+			if available > capacity {
+				capacity = available
+			}
+		}
+	}
+	return capacity
+}
+
+func (c ndctlContext) createNamespace(opts ndctl.CreateNamespaceOpts) error {
+	ns, err := c.CreateNamespace(opts)
+	if err != nil {
+		return err
+	}
+	data, _ := ns.MarshalJSON() //nolint: gosec
+	glog.V(3).Infof("Namespace created: %s", data)
+	return nil
+}
+
+func (c ndctlContext) destroyNamespaceByName(name string) error {
+	return c.DestroyNamespaceByName(name)
+}
+
+func (c ndctlContext) namespaceByName(name string) (initNamespace, error) {
+	ns, err := c.GetNamespaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	return ns, nil
+}
+
+func (c ndctlContext) activeNamespaces() []initNamespace {
+	namespaces := []initNamespace{}
+	for _, ns := range c.GetActiveNamespaces() {
+		namespaces = append(namespaces, ns)
+	}
+	return namespaces
+}
+
+// NewPmemDeviceManagerNamespaces Instantiates the direct device manager, which creates one
+// pmem namespace per device instead of carving logical volumes out of volume groups.
+// It is the same as NewPmemDeviceManagerNdctl.
+func NewPmemDeviceManagerNamespaces() (PmemDeviceManager, error) {
+	return NewPmemDeviceManagerNdctl()
+}
+
+//NewPmemDeviceManagerNdctl Instantiates a new ndctl based pmem device manager,
+// which creates one namespace per device
 func NewPmemDeviceManagerNdctl() (PmemDeviceManager, error) {
 	ctx, err := ndctl.NewContext()
 	if err != nil {
@@ -39,22 +110,26 @@ func NewPmemDeviceManagerNdctl() (PmemDeviceManager, error) {
 	}
 
 	return &pmemNdctl{
-		ctx: ctx,
+		ctx:    ndctlContext{ctx},
+		runner: execRunner{},
 	}, nil
 }
 
-func (pmem *pmemNdctl) GetCapacity() (map[string]uint64, error) {
+func (pmem *pmemNdctl) flushConfig() flushConfig {
+	return flushConfig{policy: DefaultErasePolicy, runner: pmem.runner}
+}
+
+// Capabilities reports no optional features, namespaces can only be created and deleted
+func (pmem *pmemNdctl) Capabilities() DeviceManagerCapabilities {
+	return DeviceManagerCapabilities{}
+}
+
+// GetCapacity reports the largest free extent of all regions, not their sum:
+// a namespace cannot span regions or gaps inside a region
+func (pmem *pmemNdctl) GetCapacity(ctx context.Context) (map[string]uint64, error) {
 	Capacity := map[string]uint64{}
 	nsmodes := []ndctl.NamespaceMode{ndctl.FsdaxMode, ndctl.SectorMode}
-	var capacity uint64
-	for _, bus := range pmem.ctx.GetBuses() {
-		for _, r := range bus.ActiveRegions() {
-			available := r.MaxAvailableExtent()
-			if available > capacity {
-				capacity = available
-			}
-		}
-	}
+	capacity := pmem.ctx.maxAvailableExtent()
 	// we set same capacity for all namespace modes
 	// TODO: we should maintain all modes capacity when adding or subtracting
 	// from upper layer, not done right now!!
@@ -64,7 +139,7 @@ func (pmem *pmemNdctl) GetCapacity() (map[string]uint64, error) {
 	return Capacity, nil
 }
 
-func (pmem *pmemNdctl) CreateDevice(name string, size uint64, nsmode string) error {
+func (pmem *pmemNdctl) CreateDevice(ctx context.Context, name string, size uint64, nsmode string) error {
 	devicemutex.Lock()
 	defer devicemutex.Unlock()
 	// Check that such name does not exist. In certain error states, for example when
@@ -72,17 +147,17 @@ func (pmem *pmemNdctl) CreateDevice(name string, size uint64, nsmode string) err
 	// this function is asked to create new devices repeatedly, forcing running out of space.
 	// Avoid device filling with garbage entries by returning error.
 	// Overall, no point having more than one namespace with same name.
-	_, err := pmem.GetDevice(name)
+	_, err := pmem.GetDevice(ctx, name)
 	if err == nil {
 		glog.V(4).Infof("Device with name: %s already exists, refuse to create another", name)
-		return fmt.Errorf("CreateDevice: Failed: namespace with that name exists")
+		return fmt.Errorf("CreateDevice: Failed: namespace with that name: %w", ErrDeviceExists)
 	}
 	// align up by 1 GB, also compensate for libndctl giving us 1 GB less than we ask
 	var align uint64 = 1024 * 1024 * 1024
 	size /= align
 	size += 2
 	size *= align
-	ns, err := pmem.ctx.CreateNamespace(ndctl.CreateNamespaceOpts{
+	err = pmem.ctx.createNamespace(ndctl.CreateNamespaceOpts{
 		Name:  name,
 		Size:  size,
 		Align: align,
@@ -91,14 +166,12 @@ func (pmem *pmemNdctl) CreateDevice(name string, size uint64, nsmode string) err
 	if err != nil {
 		return err
 	}
-	data, _ := ns.MarshalJSON() //nolint: gosec
-	glog.V(3).Infof("Namespace created: %s", data)
 	// clear start of device to avoid old data being recognized as file system
-	device, err := pmem.GetDevice(name)
+	device, err := pmem.GetDevice(ctx, name)
 	if err != nil {
 		return err
 	}
-	err = ClearDevice(device, false)
+	err = clearDevice(ctx, device, false, pmem.flushConfig())
 	if err != nil {
 		return err
 	}
@@ -106,51 +179,83 @@ func (pmem *pmemNdctl) CreateDevice(name string, size uint64, nsmode string) err
 	return nil
 }
 
-func (pmem *pmemNdctl) DeleteDevice(name string, flush bool) error {
-	volumeMutex.LockKey(name)
-	defer volumeMutex.UnlockKey(name)
-	device, err := pmem.GetDevice(name)
+func (pmem *pmemNdctl) DeleteDevice(ctx context.Context, name string, flush bool) error {
+	// not volumeMutex, flushDevice takes that
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+	device, err := pmem.GetDevice(ctx, name)
+	if errors.Is(err, ErrDeviceNotFound) {
+		glog.V(3).Infof("DeleteDevice: namespace %s already deleted", name)
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	err = ClearDevice(device, flush)
+	err = clearDevice(ctx, device, flush, pmem.flushConfig())
+	if err != nil {
+		return err
+	}
+	return pmem.ctx.destroyNamespaceByName(name)
+}
+
+func (pmem *pmemNdctl) FlushDeviceData(ctx context.Context, name string) error {
+	// not volumeMutex, flushDevice takes that
+	devicemutex.Lock()
+	defer devicemutex.Unlock()
+	device, err := pmem.GetDevice(ctx, name)
+	if err != nil {
+		return err
+	}
+	cfg := pmem.flushConfig()
+	if err := canFlush(device, cfg); err != nil {
+		return err
+	}
+	return clearDevice(ctx, device, true, cfg)
+}
+
+func (pmem *pmemNdctl) CanFlush(ctx context.Context, name string) error {
+	volumeMutex.LockKey(name)
+	defer volumeMutex.UnlockKey(name)
+	device, err := pmem.GetDevice(ctx, name)
 	if err != nil {
 		return err
 	}
-	return pmem.ctx.DestroyNamespaceByName(name)
+	return canFlush(device, flushConfig{runner: pmem.runner})
 }
 
-func (pmem *pmemNdctl) FlushDeviceData(name string) error {
+func (pmem *pmemNdctl) FormatDevice(ctx context.Context, name string, fsType string, opts []string) error {
 	volumeMutex.LockKey(name)
 	defer volumeMutex.UnlockKey(name)
-	device, err := pmem.GetDevice(name)
+	device, err := pmem.GetDevice(ctx, name)
 	if err != nil {
 		return err
 	}
-	return ClearDevice(device, true)
+	return formatDevice(ctx, device, fsType, opts, flushConfig{runner: pmem.runner})
 }
 
-func (pmem *pmemNdctl) GetDevice(name string) (PmemDeviceInfo, error) {
-	ns, err := pmem.ctx.GetNamespaceByName(name)
+func (pmem *pmemNdctl) GetDevice(ctx context.Context, name string) (PmemDeviceInfo, error) {
+	ns, err := pmem.ctx.namespaceByName(name)
 	if err != nil {
-		return PmemDeviceInfo{}, err
+		return PmemDeviceInfo{}, fmt.Errorf("Namespace with name %s: %w", name, ErrDeviceNotFound)
 	}
 
 	return namespaceToPmemInfo(ns), nil
 }
 
-func (pmem *pmemNdctl) ListDevices() ([]PmemDeviceInfo, error) {
+func (pmem *pmemNdctl) ListDevices(ctx context.Context) ([]PmemDeviceInfo, error) {
 	devices := []PmemDeviceInfo{}
-	for _, ns := range pmem.ctx.GetActiveNamespaces() {
+	for _, ns := range pmem.ctx.activeNamespaces() {
 		devices = append(devices, namespaceToPmemInfo(ns))
 	}
 	return devices, nil
 }
 
-func namespaceToPmemInfo(ns *ndctl.Namespace) PmemDeviceInfo {
+func namespaceToPmemInfo(ns initNamespace) PmemDeviceInfo {
 	return PmemDeviceInfo{
 		Name: ns.Name(),
 		Path: "/dev/" + ns.BlockDeviceName(),
 		Size: ns.Size(),
+		// the block device of a fsdax namespace supports direct access
+		DAXCapable: ns.Mode() == ndctl.FsdaxMode,
 	}
 }
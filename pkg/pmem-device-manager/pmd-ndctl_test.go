@@ -0,0 +1,113 @@
+package pmdmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/intel/pmem-csi/pkg/ndctl"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// fakeNamespaces replaces the ndctl context of pmemNdctl, all namespaces share /dev/null
+type fakeNamespaces struct {
+	available  uint64
+	namespaces []fakeNamespace
+	created    []ndctl.CreateNamespaceOpts
+}
+
+func (f *fakeNamespaces) maxAvailableExtent() uint64 { return f.available }
+
+func (f *fakeNamespaces) createNamespace(opts ndctl.CreateNamespaceOpts) error {
+	if opts.Size > f.available {
+		return fmt.Errorf("Not enough space to create namespace with size %v", opts.Size)
+	}
+	f.created = append(f.created, opts)
+	f.namespaces = append(f.namespaces, fakeNamespace{name: opts.Name, mode: opts.Mode, size: opts.Size, blockDevice: "null"})
+	f.available -= opts.Size
+	return nil
+}
+
+func (f *fakeNamespaces) destroyNamespaceByName(name string) error {
+	for i, ns := range f.namespaces {
+		if ns.name == name {
+			f.namespaces = append(f.namespaces[:i], f.namespaces[i+1:]...)
+			f.available += ns.size
+			return nil
+		}
+	}
+	return fmt.Errorf("namespace %s not found", name)
+}
+
+func (f *fakeNamespaces) namespaceByName(name string) (initNamespace, error) {
+	for _, ns := range f.namespaces {
+		if ns.name == name {
+			return ns, nil
+		}
+	}
+	return nil, fmt.Errorf("namespace %s not found", name)
+}
+
+func (f *fakeNamespaces) activeNamespaces() []initNamespace {
+	namespaces := []initNamespace{}
+	for _, ns := range f.namespaces {
+		namespaces = append(namespaces, ns)
+	}
+	return namespaces
+}
+
+var _ = Describe("pmem-ndctl", func() {
+	var namespaces *fakeNamespaces
+	var runner *fakeRunner
+	var pmem *pmemNdctl
+
+	BeforeEach(func() {
+		namespaces = &fakeNamespaces{available: 16 << 30}
+		runner = &fakeRunner{}
+		pmem = &pmemNdctl{ctx: namespaces, runner: runner}
+	})
+
+	It("creates one namespace per device", func() {
+		Expect(pmem.CreateDevice(context.Background(), "vol1", 3<<30, "fsdax")).To(Succeed())
+		// aligned up with extra space for what libndctl takes
+		Expect(namespaces.created).To(Equal([]ndctl.CreateNamespaceOpts{
+			{Name: "vol1", Size: 5 << 30, Align: 1 << 30, Mode: ndctl.FsdaxMode},
+		}))
+		// the start gets cleared
+		Expect(runner.commands("dd")).To(HaveLen(1))
+
+		devices, err := pmem.ListDevices(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(devices).To(Equal([]PmemDeviceInfo{{Name: "vol1", Path: "/dev/null", Size: 5 << 30, DAXCapable: true}}))
+	})
+
+	It("refuses duplicate names", func() {
+		Expect(pmem.CreateDevice(context.Background(), "vol1", 1<<30, "sector")).To(Succeed())
+		err := pmem.CreateDevice(context.Background(), "vol1", 1<<30, "sector")
+		Expect(errors.Is(err, ErrDeviceExists)).To(BeTrue())
+		Expect(namespaces.created).To(HaveLen(1))
+	})
+
+	It("fails without space", func() {
+		Expect(pmem.CreateDevice(context.Background(), "vol1", 15<<30, "fsdax")).NotTo(Succeed())
+		Expect(namespaces.namespaces).To(BeEmpty())
+	})
+
+	It("destroys the namespace on delete", func() {
+		Expect(pmem.CreateDevice(context.Background(), "vol1", 1<<30, "fsdax")).To(Succeed())
+		Expect(pmem.DeleteDevice(context.Background(), "vol1", false)).To(Succeed())
+		Expect(namespaces.namespaces).To(BeEmpty())
+		Expect(namespaces.available).To(Equal(uint64(16 << 30)))
+		_, err := pmem.GetDevice(context.Background(), "vol1")
+		Expect(errors.Is(err, ErrDeviceNotFound)).To(BeTrue())
+		// already gone
+		Expect(pmem.DeleteDevice(context.Background(), "vol1", false)).To(Succeed())
+	})
+
+	It("reports the largest free extent as capacity", func() {
+		Expect(pmem.GetCapacity(context.Background())).To(Equal(map[string]uint64{"fsdax": 16 << 30, "sector": 16 << 30}))
+		Expect(pmem.CreateDevice(context.Background(), "vol1", 1<<30, "fsdax")).To(Succeed())
+		Expect(pmem.GetCapacity(context.Background())).To(Equal(map[string]uint64{"fsdax": 13 << 30, "sector": 13 << 30}))
+	})
+})
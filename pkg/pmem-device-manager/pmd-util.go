@@ -1,28 +1,417 @@
 package pmdmanager
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	pmemexec "github.com/intel/pmem-csi/pkg/pmem-exec"
-	"k8s.io/klog/glog"
 	"k8s.io/utils/keymutex"
 )
 
 const (
 	retryStatTimeout time.Duration = 100 * time.Millisecond
+	// defaultDeviceWaitTimeout how long new devices may take until their device node appears
+	defaultDeviceWaitTimeout time.Duration = 10 * retryStatTimeout
+	// defaultCommandTimeout limits the run time of LVM tools and other short running commands
+	defaultCommandTimeout time.Duration = 30 * time.Second
+	// defaultShredTimeout limits the run time of overwriting an entire device,
+	// which may take long on large volumes
+	defaultShredTimeout time.Duration = 30 * time.Minute
+	// defaultLockRetries how often LVM commands get repeated when another process holds the LVM lock
+	defaultLockRetries = 3
+	// defaultLockRetryDelay wait time before the first repetition, it doubles for each further one
+	defaultLockRetryDelay time.Duration = 100 * time.Millisecond
+	// defaultRemoveBusyRetries how often lvremove gets repeated while the volume is still in use
+	defaultRemoveBusyRetries = 3
+	// defaultRemoveBusyRetryDelay wait time before the first repetition, it doubles for each further one
+	defaultRemoveBusyRetryDelay time.Duration = 200 * time.Millisecond
 )
 
+// EraseMethod defines how the data of an entire device gets erased
+type EraseMethod string
+
+const (
+	// EraseShred overwrites the device with random data using shred
+	EraseShred EraseMethod = "shred"
+	// EraseZero zeroes the device using blkdiscard
+	EraseZero EraseMethod = "zero"
+	// EraseNone leaves device data as is
+	EraseNone EraseMethod = "none"
+	// EraseAuto zeroes devices which support discard with blkdiscard, which is much
+	// faster than shred, and uses shred for all other devices
+	EraseAuto EraseMethod = "auto"
+	// EraseSignatures only zeroes the start and the end of the device with dd, where
+	// filesystems, LUKS and partition tables keep their signatures, see ErasePolicy.SignatureMB.
+	// Other data remains readable, but the device no longer looks like it held a filesystem.
+	EraseSignatures EraseMethod = "signatures"
+)
+
+// defaultSignatureMB covers the 16 MBytes of a LUKS2 header and the superblocks of common filesystems
+const defaultSignatureMB = 16
+
+// ErasePolicy defines how device data gets erased by DeleteDevice and FlushDeviceData
+type ErasePolicy struct {
+	// Method erase method, defaults to EraseShred
+	Method EraseMethod
+	// Iterations number of shred passes, defaults to 1
+	Iterations uint
+	// Verify reads samples of the device after zeroing it and fails with ErrNotErased
+	// when they contain data. This costs extra time and only applies to blkdiscard,
+	// which EraseZero and EraseAuto use, because shred leaves random data behind.
+	Verify bool
+	// SignatureMB MBytes zeroed at the start and at the end of the device by EraseSignatures,
+	// defaults to 16
+	SignatureMB uint
+}
+
+// DefaultErasePolicy uses one iteration of shred instead of shred's default=3 for speed.
+// EraseAuto is faster on devices with discard support, but has to be chosen explicitly.
+var DefaultErasePolicy = ErasePolicy{Method: EraseShred, Iterations: 1}
+
+// withDefaults fills in unset fields and validates the policy
+func (p ErasePolicy) withDefaults() (ErasePolicy, error) {
+	if p.Method == "" {
+		p.Method = DefaultErasePolicy.Method
+	}
+	if p.Iterations == 0 {
+		p.Iterations = DefaultErasePolicy.Iterations
+	}
+	if p.SignatureMB == 0 {
+		p.SignatureMB = defaultSignatureMB
+	}
+	switch p.Method {
+	case EraseShred, EraseZero, EraseNone, EraseAuto, EraseSignatures:
+	default:
+		return p, fmt.Errorf("Unknown erase method(%v)", p.Method)
+	}
+	return p, nil
+}
+
+// eraseCommand returns the command erasing all data of the device, empty for EraseNone.
+// EraseSignatures runs the commands of signatureCommands instead.
+// discard tells whether the device supports discard, which matters for EraseAuto.
+func (p ErasePolicy) eraseCommand(dev PmemDeviceInfo, discard bool) (string, []string) {
+	switch p.Method {
+	case EraseZero:
+		return "blkdiscard", []string{"-z", dev.Path}
+	case EraseAuto:
+		if discard {
+			return "blkdiscard", []string{"-z", dev.Path}
+		}
+	case EraseNone:
+		return "", nil
+	}
+	// -v reports progress, see flushDevice
+	return "shred", []string{"-v", "-n", strconv.FormatUint(uint64(p.Iterations), 10), dev.Path}
+}
+
+// signatureCommands returns the dd arguments for EraseSignatures: one command for the start
+// and one for the end of the device, or one for all of it when it is not larger than both
+func (p ErasePolicy) signatureCommands(dev PmemDeviceInfo) [][]string {
+	const mb = 1024 * 1024
+	of := "of=" + dev.Path
+	n := uint64(p.SignatureMB)
+	if n == 0 {
+		n = defaultSignatureMB
+	}
+	if dev.Size <= 2*n*mb {
+		// count counts bytes, so dd stops exactly at the end of the device
+		return [][]string{{"if=/dev/zero", of, "bs=1M", "count=" + strconv.FormatUint(dev.Size, 10), "iflag=count_bytes", "conv=fsync"}}
+	}
+	count := "count=" + strconv.FormatUint(n, 10)
+	// seek counts bytes, so the end gets zeroed also when the size is no multiple of 1M
+	seek := "seek=" + strconv.FormatUint(dev.Size-n*mb, 10)
+	return [][]string{
+		{"if=/dev/zero", of, "bs=1M", count, "conv=fsync"},
+		{"if=/dev/zero", of, "bs=1M", count, seek, "oflag=seek_bytes", "conv=fsync"},
+	}
+}
+
+// flushConfig controls how flushDevice erases data
+type flushConfig struct {
+	policy   ErasePolicy
+	timeouts commandTimeouts
+	runner   commandRunner
+	// log is used unless the context carries a logger, nil means glog
+	log Logger
+	// discardSupported checks whether the device supports discard, nil means sysfsDiscardSupported
+	discardSupported func(path string) bool
+	// deviceBusy checks whether the device is in use, nil means sysfsDeviceBusy
+	deviceBusy func(path string) (bool, error)
+	// openDevice opens the device for verifying an erase, nil means os.Open
+	openDevice func(path string) (deviceReader, error)
+	// dryRun is set when the runner does not modify devices, nothing gets verified then
+	dryRun bool
+}
+
+// deviceReader reads the data of a device
+type deviceReader interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// open opens the device for reading
+func (cfg flushConfig) open(path string) (deviceReader, error) {
+	if cfg.openDevice != nil {
+		return cfg.openDevice(path)
+	}
+	return os.Open(path)
+}
+
+// supportsDiscard checks whether the device supports discard
+func (cfg flushConfig) supportsDiscard(path string) bool {
+	if cfg.discardSupported != nil {
+		return cfg.discardSupported(path)
+	}
+	return sysfsDiscardSupported(path)
+}
+
+// sysfsDiscardSupported reads the discard limit of the device from sysfs,
+// devices without discard support have a limit of zero
+func sysfsDiscardSupported(path string) bool {
+	// logical volume paths are links to the device mapper device
+	devPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false
+	}
+	data, err := ioutil.ReadFile(filepath.Join("/sys/class/block", filepath.Base(devPath), "queue/discard_max_bytes"))
+	if err != nil {
+		return false
+	}
+	maxBytes, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	return err == nil && maxBytes > 0
+}
+
+// sysfsDAXSupported reads from sysfs whether the device supports direct access,
+// devices which cannot be found do not
+func sysfsDAXSupported(path string) bool {
+	devPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false
+	}
+	data, err := ioutil.ReadFile(filepath.Join("/sys/class/block", filepath.Base(devPath), "queue/dax"))
+	if err != nil {
+		return false
+	}
+	return strings.TrimSpace(string(data)) == "1"
+}
+
+// busy checks whether the device is in use
+func (cfg flushConfig) busy(path string) (bool, error) {
+	if cfg.deviceBusy != nil {
+		return cfg.deviceBusy(path)
+	}
+	return sysfsDeviceBusy(path)
+}
+
+// sysfsDeviceBusy reports devices which are mounted or held by another block device,
+// like an opened encrypted device on top of a logical volume
+func sysfsDeviceBusy(path string) (bool, error) {
+	devPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false, fmt.Errorf("device %s: %w", path, err)
+	}
+	if holders, err := ioutil.ReadDir(filepath.Join("/sys/class/block", filepath.Base(devPath), "holders")); err == nil && len(holders) > 0 {
+		return true, nil
+	}
+	mounts, err := ioutil.ReadFile("/proc/self/mounts")
+	if err != nil {
+		return false, fmt.Errorf("reading mounts failed: %w", err)
+	}
+	for _, line := range strings.Split(string(mounts), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || !strings.HasPrefix(fields[0], "/dev/") {
+			continue
+		}
+		// mounts may list another link to the same device
+		if source, err := filepath.EvalSymlinks(fields[0]); err == nil && source == devPath {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// canFlush refuses to erase devices which are in use
+func canFlush(device PmemDeviceInfo, cfg flushConfig) error {
+	busy, err := cfg.busy(device.Path)
+	if err != nil {
+		return err
+	}
+	if busy {
+		return fmt.Errorf("device %s (%s) is mounted or open: %w", device.Name, device.Path, ErrDeviceBusy)
+	}
+	return nil
+}
+
+// logger returns the logger for messages about flushing
+func (cfg flushConfig) logger(ctx context.Context) Logger {
+	fallback := cfg.log
+	if fallback == nil {
+		fallback = GlogLogger()
+	}
+	return loggerFrom(ctx, fallback)
+}
+
+// commandRunner executes external commands, replaced by a fake in tests
+type commandRunner interface {
+	// Run runs the command and returns its combined output
+	Run(ctx context.Context, cmd string, args ...string) (string, error)
+}
+
+// execRunner runs commands on the host via os/exec
+type execRunner struct{}
+
+func (execRunner) Run(ctx context.Context, cmd string, args ...string) (string, error) {
+	if lineFn := outputLinesFrom(ctx); lineFn != nil {
+		return pmemexec.RunCommandLines(ctx, lineFn, cmd, args...)
+	}
+	return pmemexec.RunCommandContext(ctx, cmd, args...)
+}
+
+// toolPathRunner runs commands which have an entry in paths from that path
+// instead of looking them up in PATH
+type toolPathRunner struct {
+	runner commandRunner
+	paths  map[string]string
+}
+
+func (r toolPathRunner) Run(ctx context.Context, cmd string, args ...string) (string, error) {
+	if path, ok := r.paths[cmd]; ok {
+		cmd = path
+	}
+	return r.runner.Run(ctx, cmd, args...)
+}
+
+// checkToolPaths verifies that the binaries configured as LVMConfig.ToolPaths exist
+func checkToolPaths(paths map[string]string) error {
+	for cmd, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("path of %s: %w", cmd, err)
+		}
+		if info.IsDir() || info.Mode()&0111 == 0 {
+			return fmt.Errorf("path of %s: %s is no executable file", cmd, path)
+		}
+	}
+	return nil
+}
+
+type outputLinesKey struct{}
+
+// withOutputLines asks runners to call lineFn for each line of output while commands run
+func withOutputLines(ctx context.Context, lineFn func(line string)) context.Context {
+	return context.WithValue(ctx, outputLinesKey{}, lineFn)
+}
+
+// outputLinesFrom returns the function set by withOutputLines, nil if there is none
+func outputLinesFrom(ctx context.Context) func(line string) {
+	lineFn, _ := ctx.Value(outputLinesKey{}).(func(line string))
+	return lineFn
+}
+
+// dryRunRunner only logs commands which modify volumes or data, others are passed on
+type dryRunRunner struct {
+	runner commandRunner
+	log    Logger
+}
+
+func (r dryRunRunner) Run(ctx context.Context, cmd string, args ...string) (string, error) {
+	switch cmd {
+	case "lvcreate", "lvremove", "lvextend", "lvreduce", "lvrename", "lvchange", "shred", "blkdiscard", "dd", "mkfs.ext4", "mkfs.xfs", "cryptsetup":
+		loggerFrom(ctx, r.log).Info("Dry run, not executing", "command", cmd, "args", strings.Join(args, " "))
+		return "", nil
+	}
+	return r.runner.Run(ctx, cmd, args...)
+}
+
+// lvmLockErrors are parts of the lowercased output of LVM tools which failed
+// because another process holds the global or a volume group lock
+var lvmLockErrors = []string{"can't get lock", "couldn't get lock", "global lock failed"}
+
+// isLVMLockError checks whether output of an LVM tool reports lock contention
+func isLVMLockError(output string) bool {
+	output = strings.ToLower(output)
+	for _, msg := range lvmLockErrors {
+		if strings.Contains(output, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// lvInUseErrors are parts of the lowercased output of lvremove for volumes which are still
+// open, as in "Logical volume vg/lv in use." or "Can't remove open logical volume", which
+// happens when holders of a just unmounted filesystem have not let go of it yet
+var lvInUseErrors = []string{"in use", "open logical volume"}
+
+// isLVInUseError checks whether output of lvremove reports that the volume is in use
+func isLVInUseError(output string) bool {
+	output = strings.ToLower(output)
+	for _, msg := range lvInUseErrors {
+		if strings.Contains(output, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// lockRetryRunner repeats LVM commands which modify volumes when they fail because of
+// lock contention, waiting delay before the first repetition and twice as long before each
+// further one. All attempts together are limited by the timeout of the command.
+type lockRetryRunner struct {
+	runner  commandRunner
+	retries int
+	delay   time.Duration
+	log     Logger
+}
+
+func (r lockRetryRunner) Run(ctx context.Context, cmd string, args ...string) (string, error) {
+	switch cmd {
+	case "lvcreate", "lvremove", "lvextend", "lvreduce", "lvrename", "lvchange":
+	default:
+		return r.runner.Run(ctx, cmd, args...)
+	}
+	delay := r.delay
+	for attempt := 0; ; attempt++ {
+		output, err := r.runner.Run(ctx, cmd, args...)
+		if err == nil || attempt >= r.retries || ctx.Err() != nil || !isLVMLockError(output) {
+			return output, err
+		}
+		loggerFrom(ctx, r.log).V(3).Info("LVM lock held by another process, retrying",
+			"command", cmd, "attempt", attempt+1, "delay", delay, "output", output)
+		select {
+		case <-ctx.Done():
+			return output, err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// commandTimeouts limits how long external commands may run, zero means no limit
+type commandTimeouts struct {
+	// command limit for LVM tools and dd
+	command time.Duration
+	// shred limit for erasing an entire device
+	shred time.Duration
+}
+
 // Two mutexes protecting device and volumes concurrent access.
 // Create, Delete, Flush may operate on same phys.device from parallel threads.
 // The mutexes defined here are used by different device managers.
 // Ndctl manager would crash without Creation mutex protection
 // in 2-volume creation scenario on same Node.
-// For LVM manager, situation is likely not that risky,
-// but we use similar protection in LVM Manager for clarity and unified style,
+// For LVM manager, it makes checking the free space of a volume group
+// and creating, resizing or removing a volume in it one atomic step,
 // as LVM state is also single instance for a Node.
 
 // All-device mutex i.e. global in driver context:
@@ -31,64 +420,225 @@ var devicemutex = &sync.Mutex{}
 // Finer-grain mutexes used by name:
 var volumeMutex = keymutex.NewHashed(-1)
 
-func ClearDevice(device PmemDeviceInfo, flush bool) error {
-	glog.V(4).Infof("ClearDevice: path: %v flush:%v", device.Path, flush)
+func ClearDevice(ctx context.Context, device PmemDeviceInfo, flush bool) error {
+	return clearDevice(ctx, device, flush, flushConfig{policy: DefaultErasePolicy, runner: execRunner{}})
+}
+
+func clearDevice(ctx context.Context, device PmemDeviceInfo, flush bool, cfg flushConfig) error {
+	cfg.logger(ctx).V(4).Info("Clearing device", "device", device.Name, "path", device.Path, "flush", flush)
 	// by default, clear 4 kbytes to avoid recognizing file system by next volume seeing data area
 	var blocks uint64 = 4
 	if flush {
 		// clear all data if "erase all" asked specifically
 		blocks = 0
 	}
-	return FlushDevice(device, blocks)
+	return flushDevice(ctx, device, blocks, cfg)
 }
 
-func FlushDevice(dev PmemDeviceInfo, blocks uint64) error {
-	volumeMutex.LockKey(dev.Name)
-	defer volumeMutex.UnlockKey(dev.Name)
+func FlushDevice(ctx context.Context, dev PmemDeviceInfo, blocks uint64) error {
+	return flushDevice(ctx, dev, blocks, flushConfig{policy: DefaultErasePolicy, runner: execRunner{}})
+}
+
+func flushDevice(ctx context.Context, dev PmemDeviceInfo, blocks uint64, cfg flushConfig) error {
 	// erase data on block device.
-	// zero number of blocks causes overwriting whole device with random data.
+	// zero number of blocks causes erasing whole device according to erase policy.
 	// nonzero number of blocks clears blocks*1024 bytes.
+	log := cfg.logger(ctx)
+	if blocks == 0 && cfg.policy.Method == EraseNone {
+		log.V(5).Info("Erase policy is none, leaving data", "device", dev.Name, "path", dev.Path)
+		return nil
+	}
+	volumeMutex.LockKey(dev.Name)
+	defer volumeMutex.UnlockKey(dev.Name)
 	// Before action, check that dev.Path exists and is device
 	fileinfo, err := os.Stat(dev.Path)
 	if err != nil {
-		glog.Errorf("FlushDevice: %s does not exist", dev.Path)
+		log.Error(err, "Device does not exist", "device", dev.Name, "path", dev.Path)
 		return err
 	}
 	if (fileinfo.Mode() & os.ModeDevice) == 0 {
-		glog.Errorf("FlushDevice: %s is not device", dev.Path)
-		return fmt.Errorf("%s is not device", dev.Path)
+		err := fmt.Errorf("%s is not device", dev.Path)
+		log.Error(err, "Not a device", "device", dev.Name, "path", dev.Path)
+		return err
 	}
-	if blocks == 0 {
-		glog.V(5).Infof("Wiping entire device: %s", dev.Path)
-		// use one iteration instead of shred's default=3 for speed
-		if _, err := pmemexec.RunCommand("shred", "-n", "1", dev.Path); err != nil {
-			return fmt.Errorf("device shred failure: %v", err.Error())
+	if blocks == 0 && cfg.policy.Method == EraseSignatures {
+		log.V(5).Info("Zeroing signatures", "device", dev.Name, "path", dev.Path, "size", dev.Size, "mb", cfg.policy.SignatureMB)
+		for _, args := range cfg.policy.signatureCommands(dev) {
+			if _, err := runCommand(ctx, cfg.runner, cfg.timeouts.command, "dd", args...); err != nil {
+				return fmt.Errorf("device signature zeroing failure: %w", err)
+			}
+		}
+	} else if blocks == 0 {
+		discard := false
+		if cfg.policy.Method == EraseAuto {
+			discard = cfg.supportsDiscard(dev.Path)
+			log.V(4).Info("Chose erase method", "device", dev.Name, "path", dev.Path, "discard", discard)
+		}
+		cmd, args := cfg.policy.eraseCommand(dev, discard)
+		log.V(5).Info("Wiping data", "device", dev.Name, "path", dev.Path, "size", dev.Size, "command", cmd)
+		progressCtx := withOutputLines(ctx, func(line string) {
+			log.V(3).Info("Wiping progress", "device", dev.Name, "command", cmd, "progress", line)
+		})
+		if _, err := runCommand(progressCtx, cfg.runner, cfg.timeouts.shred, cmd, args...); err != nil {
+			if ctx.Err() != nil {
+				// the command got killed, callers must not assume that the data is gone
+				return fmt.Errorf("erase of device %s cancelled: %w", dev.Name, err)
+			}
+			return fmt.Errorf("device %s failure: %w", cmd, err)
+		}
+		if cfg.policy.Verify && cmd == "blkdiscard" && !cfg.dryRun {
+			if err := verifyZeroed(dev, cfg); err != nil {
+				return err
+			}
+			log.V(5).Info("Verified erase", "device", dev.Name, "path", dev.Path)
 		}
 	} else {
-		glog.V(5).Infof("Zeroing %d 1k blocks at start of device: %s Size %v", blocks, dev.Path, dev.Size)
+		log.V(5).Info("Zeroing start of device", "device", dev.Name, "path", dev.Path, "size", dev.Size, "blocks", blocks)
 		of := "of=" + dev.Path
 		// guard against writing more than volume size
 		if blocks*1024 > dev.Size {
 			blocks = dev.Size / 1024
 		}
 		count := "count=" + strconv.FormatUint(blocks, 10)
-		if _, err := pmemexec.RunCommand("dd", "if=/dev/zero", of, "bs=1024", count); err != nil {
-			return fmt.Errorf("device zeroing failure: %v", err.Error())
+		if _, err := runCommand(ctx, cfg.runner, cfg.timeouts.command, "dd", "if=/dev/zero", of, "bs=1024", count); err != nil {
+			return fmt.Errorf("device zeroing failure: %w", err)
+		}
+	}
+	return nil
+}
+
+// verifySampleSize number of bytes checked at each sampled offset of an erased device
+const verifySampleSize = 4096
+
+// verifyZeroed reads samples at the start, middle and end of the device
+// and fails when any of them is not zero
+func verifyZeroed(dev PmemDeviceInfo, cfg flushConfig) error {
+	file, err := cfg.open(dev.Path)
+	if err != nil {
+		return fmt.Errorf("verifying erase of device %s: %w", dev.Name, err)
+	}
+	defer file.Close()
+	buf := make([]byte, verifySampleSize)
+	for _, offset := range verifyOffsets(dev.Size) {
+		n, err := file.ReadAt(buf, int64(offset))
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("verifying erase of device %s at offset %d: %w", dev.Name, offset, err)
+		}
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return fmt.Errorf("device %s has data at offset %d after erase: %w", dev.Name, offset, ErrNotErased)
+			}
 		}
 	}
 	return nil
 }
 
-func WaitDeviceAppears(dev PmemDeviceInfo) error {
-	for i := 0; i < 10; i++ {
+// verifyOffsets returns the offsets of the samples read by verifyZeroed
+func verifyOffsets(size uint64) []uint64 {
+	if size <= verifySampleSize {
+		return []uint64{0}
+	}
+	middle := size / 2 / verifySampleSize * verifySampleSize
+	offsets := []uint64{0}
+	if middle > 0 {
+		offsets = append(offsets, middle)
+	}
+	if end := size - verifySampleSize; end > middle {
+		offsets = append(offsets, end)
+	}
+	return offsets
+}
+
+func WaitDeviceAppears(ctx context.Context, dev PmemDeviceInfo) error {
+	return waitDevicePath(ctx, dev, defaultDeviceWaitTimeout)
+}
+
+// waitDevicePath polls until the device node of dev exists, at most for timeout
+func waitDevicePath(ctx context.Context, dev PmemDeviceInfo, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for i := 0; ; i++ {
 		_, err := os.Stat(dev.Path)
 		if err == nil {
 			return nil
-		} else {
-			glog.Warningf("WaitDeviceAppears[%d]: %s does not exist, sleep %v and retry",
-				i, dev.Path, retryStatTimeout)
-			time.Sleep(retryStatTimeout)
+		}
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("device %s did not appear within %v: %w", dev.Path, timeout, err)
+		}
+		loggerFrom(ctx, GlogLogger()).Info("Device does not exist yet, retrying",
+			"device", dev.Name, "path", dev.Path, "attempt", i, "delay", retryStatTimeout)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for device %s aborted: %w", dev.Path, ctx.Err())
+		case <-time.After(retryStatTimeout):
 		}
 	}
-	return fmt.Errorf("device %s did not appear after multiple retries", dev.Path)
+}
+
+// blkidNotFound is the exit code of blkid when the device has no known signature
+const blkidNotFound = 2
+
+// formatDevice creates a filesystem of type fsType (ext4 if empty) on the device, unless
+// it has one already. opts are passed to mkfs in addition to the pmem specific options:
+// 4k blocks are needed for mounting with dax, and xfs does not support dax with reflink.
+func formatDevice(ctx context.Context, dev PmemDeviceInfo, fsType string, opts []string, cfg flushConfig) error {
+	var args []string
+	switch fsType {
+	case "", "ext4":
+		fsType = "ext4"
+		args = []string{"-b", "4096", "-F"}
+	case "xfs":
+		args = []string{"-b", "size=4096", "-m", "reflink=0", "-f"}
+	default:
+		return fmt.Errorf("Unsupported filesystem type %q, xfs and ext4 are supported", fsType)
+	}
+	log := cfg.logger(ctx)
+	existing, err := filesystemType(ctx, dev.Path, cfg)
+	if err != nil {
+		return err
+	}
+	if existing == fsType {
+		log.V(4).Info("Filesystem exists already, skipping mkfs", "device", dev.Name, "path", dev.Path, "fstype", fsType)
+		return nil
+	}
+	if existing != "" {
+		return fmt.Errorf("device %s has %s filesystem, not %s: %w", dev.Name, existing, fsType, ErrFilesystemMismatch)
+	}
+	cmd := "mkfs." + fsType
+	args = append(append(args, opts...), dev.Path)
+	log.V(4).Info("Creating filesystem", "device", dev.Name, "path", dev.Path, "command", cmd, "args", strings.Join(args, " "))
+	if output, err := runCommand(ctx, cfg.runner, cfg.timeouts.command, cmd, args...); err != nil {
+		return fmt.Errorf("%s failed: %w(output: %s)", cmd, err, output)
+	}
+	return nil
+}
+
+// filesystemType returns the type of the filesystem on the device, empty if there is none
+func filesystemType(ctx context.Context, path string, cfg flushConfig) (string, error) {
+	// -p probes the device itself, the blkid cache and udev may not know about recent changes
+	output, err := runCommand(ctx, cfg.runner, cfg.timeouts.command, "blkid", "-p", "-c", "/dev/null", "-o", "value", "-s", "TYPE", path)
+	if err != nil {
+		var exitErr interface{ ExitCode() int }
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == blkidNotFound {
+			return "", nil
+		}
+		return "", fmt.Errorf("blkid %s failed: %w(output: %s)", path, err, output)
+	}
+	return strings.TrimSpace(output), nil
+}
+
+// runCommand runs the command, killing it when the timeout expires (zero means no timeout).
+// An expired timeout results in an error naming the command and the timeout.
+func runCommand(ctx context.Context, runner commandRunner, timeout time.Duration, cmd string, args ...string) (string, error) {
+	cmdCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		cmdCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	output, err := runner.Run(cmdCtx, cmd, args...)
+	if err != nil && ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+		return output, fmt.Errorf("%s timed out after %v: %w", cmd, timeout, err)
+	}
+
+	return output, err
 }
@@ -0,0 +1,363 @@
+package pmdmanager
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("pmem-util", func() {
+	Context("Cancellation", func() {
+		It("waiting for device gets aborted", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			err := WaitDeviceAppears(ctx, PmemDeviceInfo{Name: "nodev", Path: "/dev/no/such/device"})
+			Expect(err).To(HaveOccurred())
+			Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+		})
+	})
+
+	Context("Timeouts", func() {
+		var tmpDir string
+
+		BeforeEach(func() {
+			var err error
+			tmpDir, err = ioutil.TempDir("", "pmd-util-")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(tmpDir)
+		})
+
+		It("hung command gets killed", func() {
+			fake := filepath.Join(tmpDir, "fake-lvcreate")
+			err := ioutil.WriteFile(fake, []byte("#!/bin/sh\nexec sleep 10\n"), 0755)
+			Expect(err).NotTo(HaveOccurred())
+
+			start := time.Now()
+			_, err = runCommand(context.Background(), execRunner{}, 100*time.Millisecond, fake)
+			Expect(err).To(HaveOccurred())
+			Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+			Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+			Expect(err.Error()).To(ContainSubstring("fake-lvcreate timed out after 100ms"))
+		})
+
+		It("no timeout", func() {
+			_, err := runCommand(context.Background(), execRunner{}, 0, "true")
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Context("Lock retries", func() {
+		lockError := "  Can't get lock for ndbus0region0fsdax.\n"
+		var failures int
+		var runner *fakeRunner
+		var retry lockRetryRunner
+
+		BeforeEach(func() {
+			failures = 2
+			runner = &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					if failures > 0 {
+						failures--
+						return lockError, fmt.Errorf("exit status 5")
+					}
+					return "", nil
+				},
+			}
+			retry = lockRetryRunner{runner: runner, retries: 3, delay: time.Millisecond, log: DiscardLogger()}
+		})
+
+		It("succeeds after lock contention", func() {
+			_, err := retry.Run(context.Background(), "lvcreate", "-n", "vol1", "ndbus0region0fsdax")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner.commands("lvcreate")).To(HaveLen(3))
+		})
+
+		It("gives up after retries", func() {
+			failures = 10
+			output, err := retry.Run(context.Background(), "lvremove", "-fy", "/dev/null")
+			Expect(err).To(HaveOccurred())
+			Expect(output).To(Equal(lockError))
+			Expect(runner.commands("lvremove")).To(HaveLen(4))
+		})
+
+		It("other failures", func() {
+			runner.handler = func(cmd string, args ...string) (string, error) {
+				return "  Volume group \"ndbus0region0fsdax\" has insufficient free space\n", fmt.Errorf("exit status 5")
+			}
+			_, err := retry.Run(context.Background(), "lvcreate", "-n", "vol1", "ndbus0region0fsdax")
+			Expect(err).To(HaveOccurred())
+			Expect(runner.calls).To(HaveLen(1))
+		})
+
+		It("only for modifying commands", func() {
+			_, err := retry.Run(context.Background(), "vgs", "ndbus0region0fsdax")
+			Expect(err).To(HaveOccurred())
+			Expect(runner.calls).To(HaveLen(1))
+		})
+
+		It("stops when cancelled", func() {
+			retry.delay = time.Hour
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(10*time.Millisecond, cancel)
+			_, err := retry.Run(ctx, "lvcreate", "-n", "vol1", "ndbus0region0fsdax")
+			Expect(err).To(HaveOccurred())
+			Expect(runner.calls).To(HaveLen(1))
+		})
+
+		It("detects lock messages", func() {
+			Expect(isLVMLockError("  Global lock failed: check that lvmlockd is running.")).To(BeTrue())
+			Expect(isLVMLockError("  /run/lock/lvm/V_vg:aux: open failed: Couldn't get lock")).To(BeTrue())
+			Expect(isLVMLockError("  Logical volume vol1 already exists in Volume group vg.")).To(BeFalse())
+		})
+	})
+
+	Context("Logging", func() {
+		It("adds values", func() {
+			log := glogLogger{}.WithValues("volume", "vol1").(glogLogger)
+			Expect(log.format("Wiping data", []interface{}{"size", 4096, "odd"})).To(Equal(`Wiping data volume="vol1" size="4096" odd=<missing>`))
+		})
+
+		It("logger from context", func() {
+			ctx := WithLogger(context.Background(), DiscardLogger())
+			Expect(loggerFrom(ctx, GlogLogger())).To(Equal(DiscardLogger()))
+			Expect(loggerFrom(context.Background(), GlogLogger())).To(Equal(GlogLogger()))
+		})
+	})
+
+	Context("Erase policy", func() {
+		dev := PmemDeviceInfo{Name: "vol1", Path: "/dev/vg/vol1", Size: 1 << 30}
+
+		type cases struct {
+			name    string
+			policy  ErasePolicy
+			discard bool
+			cmd     string
+			args    []string
+		}
+		for _, c := range []cases{
+			{"default", ErasePolicy{}, false, "shred", []string{"-v", "-n", "1", dev.Path}},
+			{"default with discard", ErasePolicy{}, true, "shred", []string{"-v", "-n", "1", dev.Path}},
+			{"auto", ErasePolicy{Method: EraseAuto}, false, "shred", []string{"-v", "-n", "1", dev.Path}},
+			{"auto with discard", ErasePolicy{Method: EraseAuto}, true, "blkdiscard", []string{"-z", dev.Path}},
+			{"shred", ErasePolicy{Method: EraseShred, Iterations: 3}, true, "shred", []string{"-v", "-n", "3", dev.Path}},
+			{"zero", ErasePolicy{Method: EraseZero}, false, "blkdiscard", []string{"-z", dev.Path}},
+			{"none", ErasePolicy{Method: EraseNone}, true, "", nil},
+		} {
+			c := c
+			It(c.name, func() {
+				policy, err := c.policy.withDefaults()
+				Expect(err).NotTo(HaveOccurred())
+				cmd, args := policy.eraseCommand(dev, c.discard)
+				Expect(cmd).To(Equal(c.cmd))
+				Expect(args).To(Equal(c.args))
+			})
+		}
+
+		It("signatures", func() {
+			policy, err := ErasePolicy{Method: EraseSignatures, SignatureMB: 2}.withDefaults()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(policy.signatureCommands(dev)).To(Equal([][]string{
+				{"if=/dev/zero", "of=/dev/vg/vol1", "bs=1M", "count=2", "conv=fsync"},
+				{"if=/dev/zero", "of=/dev/vg/vol1", "bs=1M", "count=2", "seek=1071644672", "oflag=seek_bytes", "conv=fsync"},
+			}))
+			// start and end overlap
+			small := PmemDeviceInfo{Name: "vol1", Path: "/dev/vg/vol1", Size: 4 << 20}
+			Expect(policy.signatureCommands(small)).To(Equal([][]string{
+				{"if=/dev/zero", "of=/dev/vg/vol1", "bs=1M", "count=4194304", "iflag=count_bytes", "conv=fsync"},
+			}))
+
+			policy, err = ErasePolicy{Method: EraseSignatures}.withDefaults()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(policy.SignatureMB).To(Equal(uint(16)))
+			runner := &fakeRunner{}
+			null := PmemDeviceInfo{Name: "vol1", Path: "/dev/null", Size: 1 << 30}
+			Expect(flushDevice(context.Background(), null, 0, flushConfig{policy: policy, runner: runner})).To(Succeed())
+			Expect(runner.calls).To(Equal([]string{
+				"dd if=/dev/zero of=/dev/null bs=1M count=16 conv=fsync",
+				"dd if=/dev/zero of=/dev/null bs=1M count=16 seek=1056964608 oflag=seek_bytes conv=fsync",
+			}))
+		})
+
+		It("auto checks for discard", func() {
+			null := PmemDeviceInfo{Name: "vol1", Path: "/dev/null", Size: 1 << 30}
+			for _, discard := range []bool{true, false} {
+				runner := &fakeRunner{}
+				checked := []string{}
+				cfg := flushConfig{
+					policy: ErasePolicy{Method: EraseAuto, Iterations: 1},
+					runner: runner,
+					discardSupported: func(path string) bool {
+						checked = append(checked, path)
+						return discard
+					},
+				}
+				err := flushDevice(context.Background(), null, 0, cfg)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(checked).To(Equal([]string{"/dev/null"}))
+				if discard {
+					Expect(runner.calls).To(Equal([]string{"blkdiscard -z /dev/null"}))
+				} else {
+					Expect(runner.calls).To(Equal([]string{"shred -v -n 1 /dev/null"}))
+				}
+			}
+		})
+
+		Context("verify", func() {
+			null := PmemDeviceInfo{Name: "vol1", Path: "/dev/null", Size: 1 << 20}
+			verifyConfig := func(method EraseMethod, data []byte) (flushConfig, *[]string) {
+				opened := []string{}
+				return flushConfig{
+					policy: ErasePolicy{Method: method, Iterations: 1, Verify: true},
+					runner: &fakeRunner{},
+					openDevice: func(path string) (deviceReader, error) {
+						opened = append(opened, path)
+						return fakeDevice{bytes.NewReader(data)}, nil
+					},
+				}, &opened
+			}
+
+			It("zeroed device", func() {
+				cfg, opened := verifyConfig(EraseZero, make([]byte, null.Size))
+				Expect(flushDevice(context.Background(), null, 0, cfg)).To(Succeed())
+				Expect(*opened).To(Equal([]string{"/dev/null"}))
+			})
+
+			It("data remains", func() {
+				data := make([]byte, null.Size)
+				data[len(data)-1] = 0xff
+				cfg, _ := verifyConfig(EraseZero, data)
+				err := flushDevice(context.Background(), null, 0, cfg)
+				Expect(errors.Is(err, ErrNotErased)).To(BeTrue())
+				Expect(err.Error()).To(ContainSubstring(fmt.Sprintf("offset %d", null.Size-verifySampleSize)))
+			})
+
+			It("not for shred", func() {
+				cfg, opened := verifyConfig(EraseShred, []byte{1, 2, 3})
+				Expect(flushDevice(context.Background(), null, 0, cfg)).To(Succeed())
+				Expect(*opened).To(BeEmpty())
+			})
+
+			It("not in dry run", func() {
+				cfg, opened := verifyConfig(EraseZero, []byte{1, 2, 3})
+				cfg.dryRun = true
+				Expect(flushDevice(context.Background(), null, 0, cfg)).To(Succeed())
+				Expect(*opened).To(BeEmpty())
+			})
+
+			It("sample offsets", func() {
+				Expect(verifyOffsets(0)).To(Equal([]uint64{0}))
+				Expect(verifyOffsets(4096)).To(Equal([]uint64{0}))
+				Expect(verifyOffsets(6000)).To(Equal([]uint64{0, 1904}))
+				Expect(verifyOffsets(8192)).To(Equal([]uint64{0, 4096}))
+				Expect(verifyOffsets(1 << 20)).To(Equal([]uint64{0, 512 << 10, 1<<20 - 4096}))
+			})
+		})
+
+		It("no discard without sysfs entry", func() {
+			Expect(sysfsDiscardSupported("/dev/no/such/device")).To(BeFalse())
+		})
+
+		It("unused device is not busy", func() {
+			busy, err := sysfsDeviceBusy("/dev/null")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(busy).To(BeFalse())
+		})
+
+		It("missing device", func() {
+			_, err := sysfsDeviceBusy("/dev/no/such/device")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("none skips flushing", func() {
+			runner := &fakeRunner{}
+			err := flushDevice(context.Background(), dev, 0, flushConfig{policy: ErasePolicy{Method: EraseNone}, runner: runner})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner.calls).To(BeEmpty())
+		})
+
+		It("unknown method", func() {
+			_, err := ErasePolicy{Method: "burn"}.withDefaults()
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("Format", func() {
+		dev := PmemDeviceInfo{Name: "vol1", Path: "/dev/ndbus0region0fsdax/vol1"}
+		fsRunner := func(blkid string, blkidErr error) *fakeRunner {
+			return &fakeRunner{
+				handler: func(cmd string, args ...string) (string, error) {
+					if cmd == "blkid" {
+						return blkid, blkidErr
+					}
+					return "", nil
+				},
+			}
+		}
+
+		It("creates ext4", func() {
+			runner := fsRunner("", exitError(blkidNotFound))
+			err := formatDevice(context.Background(), dev, "", []string{"-E", "nodiscard"}, flushConfig{runner: runner})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner.commands("mkfs.ext4")).To(Equal([]string{"mkfs.ext4 -b 4096 -F -E nodiscard /dev/ndbus0region0fsdax/vol1"}))
+		})
+
+		It("creates xfs", func() {
+			runner := fsRunner("", exitError(blkidNotFound))
+			err := formatDevice(context.Background(), dev, "xfs", nil, flushConfig{runner: runner})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner.commands("mkfs.xfs")).To(Equal([]string{"mkfs.xfs -b size=4096 -m reflink=0 -f /dev/ndbus0region0fsdax/vol1"}))
+		})
+
+		It("skips existing filesystem", func() {
+			runner := fsRunner("xfs\n", nil)
+			err := formatDevice(context.Background(), dev, "xfs", nil, flushConfig{runner: runner})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner.commands("mkfs.xfs")).To(BeEmpty())
+		})
+
+		It("refuses other filesystem", func() {
+			runner := fsRunner("ext4\n", nil)
+			err := formatDevice(context.Background(), dev, "xfs", nil, flushConfig{runner: runner})
+			Expect(errors.Is(err, ErrFilesystemMismatch)).To(BeTrue())
+			Expect(runner.commands("mkfs.xfs")).To(BeEmpty())
+		})
+
+		It("blkid failure", func() {
+			runner := fsRunner("", exitError(4))
+			err := formatDevice(context.Background(), dev, "ext4", nil, flushConfig{runner: runner})
+			Expect(err).To(HaveOccurred())
+			Expect(runner.commands("mkfs.ext4")).To(BeEmpty())
+		})
+
+		It("unsupported type", func() {
+			runner := fsRunner("", exitError(blkidNotFound))
+			err := formatDevice(context.Background(), dev, "btrfs", nil, flushConfig{runner: runner})
+			Expect(err).To(HaveOccurred())
+			Expect(runner.calls).To(BeEmpty())
+		})
+	})
+})
+
+// fakeDevice is the content of a device read by verifyZeroed
+type fakeDevice struct {
+	*bytes.Reader
+}
+
+func (fakeDevice) Close() error { return nil }
+
+// exitError mimics exec.ExitError of a command which returned code
+type exitError int
+
+func (e exitError) Error() string { return fmt.Sprintf("exit status %d", int(e)) }
+func (e exitError) ExitCode() int { return int(e) }
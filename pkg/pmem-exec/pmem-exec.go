@@ -1,6 +1,11 @@
 package pmemexec
 
 import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os/exec"
 	"strings"
 
@@ -9,10 +14,58 @@ import (
 
 // RunCommand wrapper around exec.Command()
 func RunCommand(cmd string, args ...string) (string, error) {
+	return RunCommandContext(context.Background(), cmd, args...)
+}
+
+// RunCommandContext wrapper around exec.CommandContext()
+// The command gets killed when ctx is done before the command completes.
+// In that case the returned error wraps ctx.Err(), so callers can tell
+// an aborted command from a failing one with errors.Is().
+func RunCommandContext(ctx context.Context, cmd string, args ...string) (string, error) {
 	glog.V(5).Infof("Executing: %s %s", cmd, strings.Join(args, " "))
-	output, err := exec.Command(cmd, args...).CombinedOutput()
+	output, err := exec.CommandContext(ctx, cmd, args...).CombinedOutput()
 	strOutput := string(output)
 	glog.V(5).Infof("Output: %s", output)
+	if err != nil && ctx.Err() != nil {
+		return strOutput, fmt.Errorf("%s aborted: %w", cmd, ctx.Err())
+	}
+
+	return strOutput, err
+}
+
+// RunCommandLines works like RunCommandContext and additionally calls lineFn
+// for each line of output while the command is running. Long running commands
+// can report progress that way.
+func RunCommandLines(ctx context.Context, lineFn func(line string), cmd string, args ...string) (string, error) {
+	glog.V(5).Infof("Executing: %s %s", cmd, strings.Join(args, " "))
+	command := exec.CommandContext(ctx, cmd, args...)
+	reader, writer := io.Pipe()
+	command.Stdout = writer
+	command.Stderr = writer
+	if err := command.Start(); err != nil {
+		return "", err
+	}
+	var output strings.Builder
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			line := scanner.Text()
+			output.WriteString(line + "\n")
+			lineFn(line)
+		}
+		// keep the command from blocking on a full pipe
+		io.Copy(ioutil.Discard, reader)
+	}()
+	err := command.Wait()
+	writer.Close()
+	<-done
+	strOutput := output.String()
+	glog.V(5).Infof("Output: %s", strOutput)
+	if err != nil && ctx.Err() != nil {
+		return strOutput, fmt.Errorf("%s aborted: %w", cmd, ctx.Err())
+	}
 
 	return strOutput, err
 }